@@ -0,0 +1,407 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"cum/types"
+)
+
+// groupRequest is the body accepted when creating or updating a group
+type groupRequest struct {
+	ID          string         `json:"id"`
+	Name        string         `json:"name"`
+	Description string         `json:"description"`
+	Owner       *memberRequest `json:"owner"`
+}
+
+// groupResponse is the representation of a group returned by the API
+type groupResponse struct {
+	ID          string            `json:"id"`
+	Name        string            `json:"name"`
+	Description string            `json:"description"`
+	Owner       *memberResponse   `json:"owner"`
+	Members     []*memberResponse `json:"members"`
+}
+
+// groupSummaryResponse is the representation of a listed group, without
+// its members
+type groupSummaryResponse struct {
+	ID          string          `json:"id"`
+	Name        string          `json:"name"`
+	Description string          `json:"description"`
+	Owner       *memberResponse `json:"owner"`
+}
+
+// groupListResponse is a page of groups returned by the API
+type groupListResponse struct {
+	Groups     []*groupSummaryResponse `json:"groups"`
+	NextCursor string                  `json:"next_cursor,omitempty"`
+}
+
+// memberRequest is the body accepted when adding a member to a group, and
+// the reference to the owner of a group
+type memberRequest struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+}
+
+// memberResponse is the representation of a group member returned by the API
+type memberResponse struct {
+	Type string `json:"type"`
+	ID   string `json:"id"`
+	Name string `json:"name,omitempty"`
+}
+
+// newGroupResponse converts a group to its API representation
+func newGroupResponse(group *types.Group) *groupResponse {
+	resp := &groupResponse{
+		ID:          group.ID,
+		Name:        group.Name,
+		Description: group.Description,
+		Members:     []*memberResponse{},
+	}
+	if group.OwnerID != nil && *group.OwnerID != nil {
+		resp.Owner = newMemberResponse(*group.OwnerID)
+	}
+	for _, member := range group.Members {
+		if member == nil || *member == nil {
+			continue
+		}
+		resp.Members = append(resp.Members, newMemberResponse(*member))
+	}
+	return resp
+}
+
+// newGroupSummaryResponse converts a listed group to its API representation
+func newGroupSummaryResponse(group *types.Group) *groupSummaryResponse {
+	resp := &groupSummaryResponse{
+		ID:          group.ID,
+		Name:        group.Name,
+		Description: group.Description,
+	}
+	if group.OwnerID != nil && *group.OwnerID != nil {
+		resp.Owner = newMemberResponse(*group.OwnerID)
+	}
+	return resp
+}
+
+// newMemberResponse converts a group member to its API representation
+func newMemberResponse(member types.Member) *memberResponse {
+	resp := &memberResponse{
+		Type: member.GetType(),
+		ID:   member.GetID(),
+	}
+	switch m := member.(type) {
+	case *types.User:
+		resp.Name = m.Username
+	case *types.Group:
+		resp.Name = m.Name
+	}
+	return resp
+}
+
+// handleGroups routes the /groups endpoints
+//
+//	GET    /groups
+//	POST   /groups
+//	GET    /groups/by-name/{name}
+//	GET    /groups/owned-by/{type}/{id}
+//	GET    /groups/{id}
+//	GET    /groups/{id}/effective-members
+//	PUT    /groups/{id}
+//	DELETE /groups/{id}
+//	POST   /groups/{id}/members
+//	DELETE /groups/{id}/members/{type}/{memberID}
+func (s *Server) handleGroups(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r.URL.Path, "/groups")
+
+	switch {
+	case len(segments) == 0:
+		switch r.Method {
+		case http.MethodGet:
+			s.listGroups(w, r)
+		case http.MethodPost:
+			s.createGroup(w, r)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case len(segments) == 1:
+		switch r.Method {
+		case http.MethodGet:
+			s.getGroup(w, r, segments[0])
+		case http.MethodPut:
+			s.updateGroup(w, r, segments[0])
+		case http.MethodDelete:
+			s.deleteGroup(w, r, segments[0])
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+		}
+	case len(segments) == 2 && segments[0] == "by-name":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.getGroupByName(w, r, segments[1])
+	case len(segments) == 3 && segments[0] == "owned-by":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.getGroupsByOwner(w, r, segments[1], segments[2])
+	case len(segments) == 2 && segments[1] == "effective-members":
+		if r.Method != http.MethodGet {
+			methodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.getEffectiveMembers(w, r, segments[0])
+	case len(segments) == 2 && segments[1] == "members":
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		s.addMember(w, r, segments[0])
+	case len(segments) == 4 && segments[1] == "members":
+		if r.Method != http.MethodDelete {
+			methodNotAllowed(w, http.MethodDelete)
+			return
+		}
+		s.removeMember(w, r, segments[0], segments[2], segments[3])
+	default:
+		notFound(w)
+	}
+}
+
+// createGroup creates a new group
+func (s *Server) createGroup(w http.ResponseWriter, r *http.Request) {
+	var req groupRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Name == "" {
+		writeError(w, http.StatusBadRequest, errors.New("name is required"))
+		return
+	}
+
+	if req.ID == "" {
+		id, err := types.NewID()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		req.ID = id
+	}
+
+	owner, err := s.lookupOwner(r.Context(), req.Owner)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	group := &types.Group{
+		ID:          req.ID,
+		Name:        req.Name,
+		Description: req.Description,
+		OwnerID:     owner,
+	}
+	if err := s.storage.CreateGroup(r.Context(), group); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newGroupResponse(group))
+}
+
+// listGroups returns a page of groups without their members, filtered by
+// the name_prefix and name_contains query parameters
+func (s *Server) listGroups(w http.ResponseWriter, r *http.Request) {
+	list, err := parseListQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query := r.URL.Query()
+	page, err := s.storage.ListGroups(r.Context(), &types.GroupListOptions{
+		NamePrefix:   query.Get("name_prefix"),
+		NameContains: query.Get("name_contains"),
+		SortBy:       list.sortBy,
+		Descending:   list.descending,
+		Limit:        list.limit,
+		Cursor:       list.cursor,
+	})
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	resp := &groupListResponse{
+		Groups:     make([]*groupSummaryResponse, 0, len(page.Groups)),
+		NextCursor: page.NextCursor,
+	}
+	for _, group := range page.Groups {
+		resp.Groups = append(resp.Groups, newGroupSummaryResponse(group))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// getGroup returns a group by its ID
+func (s *Server) getGroup(w http.ResponseWriter, r *http.Request, id string) {
+	group, err := s.storage.GetGroupByID(r.Context(), id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newGroupResponse(group))
+}
+
+// getGroupByName returns a group by its name
+func (s *Server) getGroupByName(w http.ResponseWriter, r *http.Request, name string) {
+	group, err := s.storage.GetGroupByName(r.Context(), name)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newGroupResponse(group))
+}
+
+// getGroupsByOwner returns the groups owned by a user or group
+func (s *Server) getGroupsByOwner(w http.ResponseWriter, r *http.Request, ownerType, ownerID string) {
+	owner, err := types.NewMemberReference(ownerType, ownerID)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	groups, err := s.storage.GetGroupsByOwner(r.Context(), owner)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	resp := make([]*groupResponse, 0, len(groups))
+	for _, group := range groups {
+		resp = append(resp, newGroupResponse(group))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// updateGroup updates the name, description or owner of a group. The
+// description and owner are replaced, so omitting them clears them. Members
+// are managed through the members endpoints and are left unchanged.
+func (s *Server) updateGroup(w http.ResponseWriter, r *http.Request, id string) {
+	var req groupRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.ID != "" && req.ID != id {
+		writeError(w, http.StatusBadRequest, errors.New("group ID cannot be changed"))
+		return
+	}
+
+	current, err := s.storage.GetGroupByID(r.Context(), id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	owner, err := s.lookupOwner(r.Context(), req.Owner)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	group := *current
+	if req.Name != "" {
+		group.Name = req.Name
+	}
+	group.Description = req.Description
+	group.OwnerID = owner
+
+	if err := s.storage.UpdateGroup(r.Context(), &group); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newGroupResponse(&group))
+}
+
+// deleteGroup deletes a group
+func (s *Server) deleteGroup(w http.ResponseWriter, r *http.Request, id string) {
+	group, err := s.storage.GetGroupByID(r.Context(), id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if err := s.storage.DeleteGroup(r.Context(), group); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// addMember adds a user or a group to a group
+func (s *Server) addMember(w http.ResponseWriter, r *http.Request, groupID string) {
+	var req memberRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	member, err := s.lookupMember(r.Context(), req.Type, req.ID)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	if err := s.storage.AddMemberToGroup(r.Context(), member, groupID); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newMemberResponse(member))
+}
+
+// removeMember removes a user or a group from a group
+func (s *Server) removeMember(w http.ResponseWriter, r *http.Request, groupID, memberType, memberID string) {
+	member, err := types.NewMemberReference(memberType, memberID)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	if err := s.storage.RemoveMemberFromGroup(r.Context(), &member, groupID); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// lookupMember loads the user or group referenced by a member request
+func (s *Server) lookupMember(ctx context.Context, memberType, id string) (types.Member, error) {
+	switch memberType {
+	case "user":
+		return s.storage.GetUserByID(ctx, id)
+	case "group":
+		return s.storage.GetGroupByID(ctx, id)
+	default:
+		return nil, fmt.Errorf("%w: unknown member type %q", types.ErrInvalidMember, memberType)
+	}
+}
+
+// lookupOwner checks that the user or group referenced as the owner of a
+// group exists and returns a reference to it, or nil if there is no owner
+func (s *Server) lookupOwner(ctx context.Context, req *memberRequest) (*types.Member, error) {
+	if req == nil {
+		return nil, nil
+	}
+	if _, err := s.lookupMember(ctx, req.Type, req.ID); err != nil {
+		return nil, err
+	}
+	owner, err := types.NewMemberReference(req.Type, req.ID)
+	if err != nil {
+		return nil, err
+	}
+	return &owner, nil
+}
@@ -0,0 +1,44 @@
+package api
+
+import (
+	"fmt"
+	"net/http"
+	"strconv"
+)
+
+// listQuery is the sort order, limit and cursor of a listing request
+type listQuery struct {
+	sortBy     string
+	descending bool
+	limit      int
+	cursor     string
+}
+
+// parseListQuery parses the sort, order, limit and cursor query parameters
+// of a listing request. The sort field and the cursor are validated by the
+// storage.
+func parseListQuery(r *http.Request) (*listQuery, error) {
+	query := r.URL.Query()
+	list := &listQuery{
+		sortBy: query.Get("sort"),
+		cursor: query.Get("cursor"),
+	}
+
+	switch order := query.Get("order"); order {
+	case "", "asc":
+	case "desc":
+		list.descending = true
+	default:
+		return nil, fmt.Errorf("invalid order %q, expected asc or desc", order)
+	}
+
+	if limit := query.Get("limit"); limit != "" {
+		n, err := strconv.Atoi(limit)
+		if err != nil || n <= 0 {
+			return nil, fmt.Errorf("invalid limit %q, expected a positive number", limit)
+		}
+		list.limit = n
+	}
+
+	return list, nil
+}
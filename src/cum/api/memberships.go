@@ -0,0 +1,51 @@
+package api
+
+import (
+	"net/http"
+
+	"cum/types"
+)
+
+// effectiveMembershipResponse is the representation of an effective
+// membership returned by the API
+type effectiveMembershipResponse struct {
+	UserID  string   `json:"user_id"`
+	GroupID string   `json:"group_id"`
+	Path    []string `json:"path"`
+}
+
+// newEffectiveMembershipsResponse converts effective memberships to their
+// API representation
+func newEffectiveMembershipsResponse(memberships []*types.EffectiveMembership) []*effectiveMembershipResponse {
+	resp := make([]*effectiveMembershipResponse, 0, len(memberships))
+	for _, membership := range memberships {
+		resp = append(resp, &effectiveMembershipResponse{
+			UserID:  membership.UserID,
+			GroupID: membership.GroupID,
+			Path:    membership.Path,
+		})
+	}
+	return resp
+}
+
+// getEffectiveMembers returns the users that are members of a group,
+// directly or through nested groups
+func (s *Server) getEffectiveMembers(w http.ResponseWriter, r *http.Request, groupID string) {
+	memberships, err := s.storage.GetEffectiveMembers(r.Context(), groupID)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newEffectiveMembershipsResponse(memberships))
+}
+
+// getEffectiveGroups returns the groups a user is a member of, directly or
+// through nested groups
+func (s *Server) getEffectiveGroups(w http.ResponseWriter, r *http.Request, userID string) {
+	memberships, err := s.storage.GetEffectiveGroups(r.Context(), userID)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newEffectiveMembershipsResponse(memberships))
+}
@@ -0,0 +1,180 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"cum/password"
+	"cum/types"
+)
+
+// errInvalidResetToken is returned when a password reset token is unknown,
+// expired or already redeemed
+var errInvalidResetToken = errors.New("invalid or expired password reset token")
+
+// passwordResetRequest is the body accepted when resetting the password of
+// a user
+type passwordResetRequest struct {
+	// OneTimePassword replaces the password with a one-time password,
+	// instead of issuing a reset token
+	OneTimePassword bool `json:"one_time_password"`
+}
+
+// passwordResetResponse is the reset token or the one-time password of a
+// password reset. They are only ever returned once.
+type passwordResetResponse struct {
+	UserID    string `json:"user_id"`
+	Token     string `json:"token,omitempty"`
+	ExpiresAt int64  `json:"expires_at,omitempty"`
+	Password  string `json:"password,omitempty"`
+}
+
+// redeemRequest is the body accepted when redeeming a password reset token
+type redeemRequest struct {
+	Token    string `json:"token"`
+	Password string `json:"password"`
+}
+
+// handlePasswordResets routes the /password-resets endpoint
+//
+//	POST   /password-resets
+func (s *Server) handlePasswordResets(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		methodNotAllowed(w, http.MethodPost)
+		return
+	}
+	s.redeemPasswordReset(w, r)
+}
+
+// resetPassword resets the password of a user. It issues a single-use
+// reset token expiring after the password reset TTL, or replaces the
+// password with a one-time password the user must change at the next
+// login.
+func (s *Server) resetPassword(w http.ResponseWriter, r *http.Request, id string) {
+	var req passwordResetRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	user, err := s.storage.GetUserByID(r.Context(), id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	if req.OneTimePassword {
+		oneTime, err := password.GenerateOneTime()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		if err := s.setPassword(r.Context(), user, oneTime, true); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		writeJSON(w, http.StatusCreated, &passwordResetResponse{UserID: user.ID, Password: oneTime})
+		return
+	}
+
+	token, err := password.NewResetToken()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+	reset := &types.PasswordReset{
+		ID:        password.ResetTokenID(token),
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(s.passwordResetTTL).Unix(),
+	}
+	if err := s.storage.CreatePasswordReset(r.Context(), reset); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, &passwordResetResponse{UserID: user.ID, Token: token, ExpiresAt: reset.ExpiresAt})
+}
+
+// redeemPasswordReset sets the password of a user with a reset token,
+// which cannot be redeemed again. The token is consumed first, so that
+// concurrent requests cannot both redeem it, and restored when the
+// password cannot be set. Once the password is set, the other reset
+// tokens and the sessions of the user are revoked.
+func (s *Server) redeemPasswordReset(w http.ResponseWriter, r *http.Request) {
+	var req redeemRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Token == "" || req.Password == "" {
+		writeError(w, http.StatusBadRequest, errors.New("token and password are required"))
+		return
+	}
+
+	reset, err := s.storage.ConsumePasswordReset(r.Context(), password.ResetTokenID(req.Token))
+	if errors.Is(err, types.ErrNotFound) {
+		writeError(w, http.StatusBadRequest, errInvalidResetToken)
+		return
+	}
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	user, err := s.storage.GetUserByID(r.Context(), reset.UserID)
+	if errors.Is(err, types.ErrNotFound) {
+		writeError(w, http.StatusBadRequest, errInvalidResetToken)
+		return
+	}
+	if err == nil {
+		err = s.setPassword(r.Context(), user, req.Password, false)
+	}
+	if err != nil {
+		s.restorePasswordReset(reset)
+		writeStorageError(w, err)
+		return
+	}
+
+	if err := s.storage.DeleteUserPasswordResets(r.Context(), user.ID); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if err := s.storage.DeleteUserSessions(r.Context(), user.ID); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// restorePasswordReset stores again a password reset consumed by a
+// redemption that failed, so that the token can be redeemed again. It is
+// restored even when the request was cancelled.
+func (s *Server) restorePasswordReset(reset *types.PasswordReset) {
+	if err := s.storage.CreatePasswordReset(context.Background(), reset); err != nil {
+		log.Printf("Failed to restore the password reset of user %s: %v", reset.UserID, err)
+	}
+}
+
+// setPassword replaces the password of a user, marked as one to change at
+// the next login when reset. The password is hashed first, so that one
+// the hasher refuses never reaches the directory, and the directory is
+// given the password before it is stored, so that a password it refuses,
+// for example by its password policy, is not stored either.
+func (s *Server) setPassword(ctx context.Context, user *types.User, newPassword string, reset bool) error {
+	hash, err := s.hasher.Hash(newPassword)
+	if err != nil {
+		return err
+	}
+	if s.directory != nil {
+		if err := s.directory.SetPassword(ctx, user, newPassword, reset); err != nil {
+			return err
+		}
+	}
+
+	updated := *user
+	updated.Password = hash
+	updated.MustChangePassword = reset
+	return s.storage.UpdateUser(ctx, &updated)
+}
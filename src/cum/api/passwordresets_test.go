@@ -0,0 +1,167 @@
+package api
+
+import (
+	"context"
+	"net/http"
+	"testing"
+
+	"cum/types"
+)
+
+// login creates a session for a user, checking the status code of the
+// response, and returns the ID of the session if one was created
+func login(t *testing.T, s *Server, req *loginRequest, status int) string {
+	t.Helper()
+	w := do(t, s, http.MethodPost, "/sessions", req)
+	checkStatus(t, w, status)
+	if status != http.StatusCreated {
+		return ""
+	}
+	var session sessionResponse
+	decode(t, w, &session)
+	return session.ID
+}
+
+// mustIssueReset resets the password of a user and returns the response
+func mustIssueReset(t *testing.T, s *Server, userID string, req *passwordResetRequest) *passwordResetResponse {
+	t.Helper()
+	w := do(t, s, http.MethodPost, "/users/"+userID+"/password-reset", req)
+	checkStatus(t, w, http.StatusCreated)
+	var resp passwordResetResponse
+	decode(t, w, &resp)
+	if resp.UserID != userID {
+		t.Errorf("got a reset of user %q, want %q", resp.UserID, userID)
+	}
+	return &resp
+}
+
+// getUserResponse returns a user through the API
+func getUserResponse(t *testing.T, s *Server, id string) *userResponse {
+	t.Helper()
+	w := do(t, s, http.MethodGet, "/users/"+id, nil)
+	checkStatus(t, w, http.StatusOK)
+	var user userResponse
+	decode(t, w, &user)
+	return &user
+}
+
+func TestRedeemPasswordReset(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	mustCreateUser(t, s, &userRequest{ID: "u1", Username: "alice", Password: "old-password"})
+	session := login(t, s, &loginRequest{Username: "alice", Password: "old-password"}, http.StatusCreated)
+
+	reset := mustIssueReset(t, s, "u1", &passwordResetRequest{})
+	if reset.Token == "" || reset.ExpiresAt == 0 || reset.Password != "" {
+		t.Fatalf("got reset %+v, want a token only", reset)
+	}
+	other := mustIssueReset(t, s, "u1", &passwordResetRequest{})
+
+	w := do(t, s, http.MethodPost, "/password-resets", &redeemRequest{Token: reset.Token, Password: "new-password"})
+	checkStatus(t, w, http.StatusNoContent)
+
+	login(t, s, &loginRequest{Username: "alice", Password: "old-password"}, http.StatusUnauthorized)
+	login(t, s, &loginRequest{Username: "alice", Password: "new-password"}, http.StatusCreated)
+
+	// The token is single-use, and the other tokens and the sessions of
+	// the user are revoked
+	w = do(t, s, http.MethodPost, "/password-resets", &redeemRequest{Token: reset.Token, Password: "other-password"})
+	checkError(t, w, http.StatusBadRequest, errInvalidResetToken.Error())
+	w = do(t, s, http.MethodPost, "/password-resets", &redeemRequest{Token: other.Token, Password: "other-password"})
+	checkError(t, w, http.StatusBadRequest, errInvalidResetToken.Error())
+	checkStatus(t, do(t, s, http.MethodGet, "/sessions/"+session, nil), http.StatusNotFound)
+}
+
+func TestRedeemPasswordResetInvalidRequests(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+
+	tests := []struct {
+		name    string
+		body    interface{}
+		message string
+	}{
+		{"missing token", &redeemRequest{Password: "new-password"}, "token and password are required"},
+		{"missing password", &redeemRequest{Token: "token"}, "token and password are required"},
+		{"unknown token", &redeemRequest{Token: "token", Password: "new-password"}, errInvalidResetToken.Error()},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			w := do(t, s, http.MethodPost, "/password-resets", tt.body)
+			checkError(t, w, http.StatusBadRequest, tt.message)
+		})
+	}
+
+	w := do(t, s, http.MethodPost, "/password-resets", map[string]string{"token": "token", "password": "p", "user_id": "u1"})
+	checkStatus(t, w, http.StatusBadRequest)
+}
+
+func TestResetPasswordUnknownUser(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	w := do(t, s, http.MethodPost, "/users/u1/password-reset", &passwordResetRequest{})
+	checkStatus(t, w, http.StatusNotFound)
+}
+
+func TestOneTimePassword(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	mustCreateUser(t, s, &userRequest{ID: "u1", Username: "alice", Password: "old-password"})
+
+	reset := mustIssueReset(t, s, "u1", &passwordResetRequest{OneTimePassword: true})
+	if reset.Password == "" || reset.Token != "" {
+		t.Fatalf("got reset %+v, want a one-time password only", reset)
+	}
+	if !getUserResponse(t, s, "u1").MustChangePassword {
+		t.Error("a one-time password is not marked as one to change")
+	}
+
+	// The one-time password must be changed to log in
+	login(t, s, &loginRequest{Username: "alice", Password: reset.Password}, http.StatusForbidden)
+	login(t, s, &loginRequest{Username: "alice", Password: reset.Password, NewPassword: "new-password"}, http.StatusCreated)
+	if getUserResponse(t, s, "u1").MustChangePassword {
+		t.Error("the changed password is still marked as one to change")
+	}
+	login(t, s, &loginRequest{Username: "alice", Password: "new-password"}, http.StatusCreated)
+}
+
+func TestRedeemPasswordResetClearsOneTimePassword(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	mustCreateUser(t, s, &userRequest{ID: "u1", Username: "alice", Password: "old-password"})
+	mustIssueReset(t, s, "u1", &passwordResetRequest{OneTimePassword: true})
+	reset := mustIssueReset(t, s, "u1", &passwordResetRequest{})
+
+	w := do(t, s, http.MethodPost, "/password-resets", &redeemRequest{Token: reset.Token, Password: "new-password"})
+	checkStatus(t, w, http.StatusNoContent)
+	if getUserResponse(t, s, "u1").MustChangePassword {
+		t.Error("the redeemed password is still marked as one to change")
+	}
+	login(t, s, &loginRequest{Username: "alice", Password: "new-password"}, http.StatusCreated)
+}
+
+func TestRedeemPasswordResetRestoresToken(t *testing.T) {
+	directory := &fakeDirectory{}
+	s, _ := newTestServer(t, directory)
+	mustCreateUser(t, s, &userRequest{ID: "u1", Username: "alice", Password: "old-password"})
+	reset := mustIssueReset(t, s, "u1", &passwordResetRequest{})
+
+	// A password the directory refuses is not stored, and the token can
+	// be redeemed again
+	directory.err = types.ErrInvalidArgument
+	w := do(t, s, http.MethodPost, "/password-resets", &redeemRequest{Token: reset.Token, Password: "weak"})
+	checkStatus(t, w, http.StatusBadRequest)
+	login(t, s, &loginRequest{Username: "alice", Password: "old-password"}, http.StatusCreated)
+
+	directory.err = nil
+	w = do(t, s, http.MethodPost, "/password-resets", &redeemRequest{Token: reset.Token, Password: "new-password"})
+	checkStatus(t, w, http.StatusNoContent)
+	if got := directory.passwords["alice"]; got != "new-password" {
+		t.Errorf("the directory was given password %q, want new-password", got)
+	}
+	login(t, s, &loginRequest{Username: "alice", Password: "new-password"}, http.StatusCreated)
+
+	// Cancelled redemptions restore the token too
+	reset = mustIssueReset(t, s, "u1", &passwordResetRequest{})
+	directory.err = context.Canceled
+	w = do(t, s, http.MethodPost, "/password-resets", &redeemRequest{Token: reset.Token, Password: "other-password"})
+	checkError(t, w, http.StatusServiceUnavailable, "service unavailable")
+	directory.err = nil
+	w = do(t, s, http.MethodPost, "/password-resets", &redeemRequest{Token: reset.Token, Password: "other-password"})
+	checkStatus(t, w, http.StatusNoContent)
+}
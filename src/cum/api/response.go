@@ -0,0 +1,87 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+
+	"cum/types"
+)
+
+// errorResponse is the body returned for every failed request
+type errorResponse struct {
+	Error string `json:"error"`
+}
+
+// writeJSON writes v as a JSON response with the given status code
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	if v == nil {
+		return
+	}
+	if err := json.NewEncoder(w).Encode(v); err != nil {
+		log.Printf("Failed to encode response: %v", err)
+	}
+}
+
+// writeError writes an error response with the given status code. Server
+// errors are logged and answered with the status text only, so that the
+// messages of the backends do not reach clients.
+func writeError(w http.ResponseWriter, status int, err error) {
+	if status >= http.StatusInternalServerError {
+		log.Printf("Server error: %v", err)
+		err = errors.New(strings.ToLower(http.StatusText(status)))
+	}
+	writeJSON(w, status, errorResponse{Error: err.Error()})
+}
+
+// writeStorageError writes an error response for an error returned by
+// the storage, deriving the status code from the error
+func writeStorageError(w http.ResponseWriter, err error) {
+	writeError(w, statusFromError(err), err)
+}
+
+// statusFromError maps a storage error to an HTTP status code
+func statusFromError(err error) int {
+	switch {
+	case errors.Is(err, types.ErrNotFound):
+		return http.StatusNotFound
+	case errors.Is(err, types.ErrAlreadyExists), errors.Is(err, types.ErrConflict),
+		errors.Is(err, types.ErrMembershipCycle), errors.Is(err, types.ErrMaxDepthExceeded):
+		return http.StatusConflict
+	case errors.Is(err, types.ErrInvalidMember), errors.Is(err, types.ErrInvalidArgument):
+		return http.StatusBadRequest
+	case errors.Is(err, types.ErrBackendUnavailable), errors.Is(err, context.Canceled):
+		return http.StatusServiceUnavailable
+	case errors.Is(err, context.DeadlineExceeded):
+		return http.StatusGatewayTimeout
+	default:
+		return http.StatusInternalServerError
+	}
+}
+
+// methodNotAllowed writes a 405 response listing the allowed methods
+func methodNotAllowed(w http.ResponseWriter, allowed ...string) {
+	w.Header().Set("Allow", strings.Join(allowed, ", "))
+	writeError(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
+
+// notFound writes a 404 response for an unknown route
+func notFound(w http.ResponseWriter) {
+	writeError(w, http.StatusNotFound, errors.New("route not found"))
+}
+
+// decodeJSON decodes the request body into v, rejecting unknown fields
+func decodeJSON(r *http.Request, v interface{}) error {
+	decoder := json.NewDecoder(r.Body)
+	decoder.DisallowUnknownFields()
+	if err := decoder.Decode(v); err != nil {
+		return fmt.Errorf("invalid request body: %v", err)
+	}
+	return nil
+}
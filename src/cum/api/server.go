@@ -0,0 +1,136 @@
+// Package api exposes the central user management storage over a JSON
+// REST API. Every handler talks to a types.Storage, so the API works the
+// same regardless of the configured backend.
+package api
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"cum/password"
+	"cum/types"
+)
+
+// ServerConfig is the configuration for a Server
+type ServerConfig struct {
+	// Storage is the storage for users, groups and sessions
+	Storage types.Storage
+	// Hasher hashes and verifies user passwords
+	Hasher *password.Hasher
+	// SessionTTL is how long a session created on login is valid
+	SessionTTL time.Duration
+	// PasswordResetTTL is how long a password reset token can be redeemed.
+	// It defaults to an hour.
+	PasswordResetTTL time.Duration
+	// Directory, if set, is given the passwords set through the API in
+	// cleartext, for directories that cannot be given password hashes,
+	// such as Active Directory
+	Directory Directory
+	// RequestTimeout is how long a request may run before its storage
+	// operations are aborted. Zero means no timeout.
+	RequestTimeout time.Duration
+	// Metrics are reported by GET /metrics as a JSON object, each function
+	// returning the current value of its key
+	Metrics map[string]func() interface{}
+}
+
+// Directory is a directory given the passwords set through the API in
+// cleartext
+type Directory interface {
+	// AddUser adds a created user with its password, once the user is
+	// stored
+	AddUser(ctx context.Context, user *types.User, password string) error
+	// SetPassword sets the password of a user before its hash is stored,
+	// as a one-time password to change at the next login when reset
+	SetPassword(ctx context.Context, user *types.User, password string, reset bool) error
+}
+
+// Server is the HTTP server of the REST API
+type Server struct {
+	storage          types.Storage
+	hasher           *password.Hasher
+	sessionTTL       time.Duration
+	passwordResetTTL time.Duration
+	directory        Directory
+	timeout          time.Duration
+	metrics          map[string]func() interface{}
+	mux              *http.ServeMux
+}
+
+// NewServer creates a new Server from the given configuration
+func NewServer(config *ServerConfig) *Server {
+	s := &Server{
+		storage:          config.Storage,
+		hasher:           config.Hasher,
+		sessionTTL:       config.SessionTTL,
+		passwordResetTTL: config.PasswordResetTTL,
+		directory:        config.Directory,
+		timeout:          config.RequestTimeout,
+		metrics:          config.Metrics,
+		mux:              http.NewServeMux(),
+	}
+	if s.passwordResetTTL <= 0 {
+		s.passwordResetTTL = time.Hour
+	}
+
+	s.mux.HandleFunc("/healthz", s.handleHealth)
+	s.mux.HandleFunc("/metrics", s.handleMetrics)
+	s.mux.HandleFunc("/users", s.handleUsers)
+	s.mux.HandleFunc("/users/", s.handleUsers)
+	s.mux.HandleFunc("/groups", s.handleGroups)
+	s.mux.HandleFunc("/groups/", s.handleGroups)
+	s.mux.HandleFunc("/sessions", s.handleSessions)
+	s.mux.HandleFunc("/sessions/", s.handleSessions)
+	s.mux.HandleFunc("/password-resets", s.handlePasswordResets)
+
+	return s
+}
+
+// ServeHTTP implements the http.Handler interface. The request context,
+// which is cancelled when the client goes away, is given the configured
+// timeout and passed down to the storage.
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if s.timeout > 0 {
+		ctx, cancel := context.WithTimeout(r.Context(), s.timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	s.mux.ServeHTTP(w, r)
+}
+
+// handleHealth reports that the server is up
+func (s *Server) handleHealth(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	writeJSON(w, http.StatusOK, map[string]string{"status": "ok"})
+}
+
+// handleMetrics reports the current value of the configured metrics
+func (s *Server) handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w, http.MethodGet)
+		return
+	}
+	metrics := make(map[string]interface{}, len(s.metrics))
+	for name, value := range s.metrics {
+		metrics[name] = value()
+	}
+	writeJSON(w, http.StatusOK, metrics)
+}
+
+// pathSegments splits the request path after the given prefix into its
+// non-empty segments
+func pathSegments(path, prefix string) []string {
+	path = strings.TrimPrefix(path, prefix)
+	var segments []string
+	for _, segment := range strings.Split(path, "/") {
+		if segment != "" {
+			segments = append(segments, segment)
+		}
+	}
+	return segments
+}
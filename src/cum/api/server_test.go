@@ -0,0 +1,239 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"cum/password"
+	"cum/storage"
+	"cum/types"
+)
+
+// newTestServer returns a server backed by an in-memory storage, with the
+// given directory if not nil, and the storage
+func newTestServer(t *testing.T, directory Directory) (*Server, *storage.InMemoryStorage) {
+	t.Helper()
+	backend := storage.NewInMemoryStorage(&storage.InMemoryStorageConfig{})
+	t.Cleanup(func() { backend.Close() })
+	// The lowest costs, for fast tests
+	hasher, err := password.NewHasher(&password.Config{
+		Algorithm:             "argon2id",
+		BcryptCost:            4,
+		Argon2Memory:          64,
+		Argon2Iterations:      1,
+		Argon2Parallelism:     1,
+		ScryptCost:            4,
+		ScryptBlockSize:       8,
+		ScryptParallelization: 1,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return NewServer(&ServerConfig{
+		Storage:    backend,
+		Hasher:     hasher,
+		SessionTTL: time.Hour,
+		Directory:  directory,
+	}), backend
+}
+
+// do sends a request to a server, with body encoded as JSON if not nil,
+// and returns the response
+func do(t *testing.T, s *Server, method string, path string, body interface{}) *httptest.ResponseRecorder {
+	t.Helper()
+	var buf bytes.Buffer
+	if body != nil {
+		if err := json.NewEncoder(&buf).Encode(body); err != nil {
+			t.Fatal(err)
+		}
+	}
+	w := httptest.NewRecorder()
+	s.ServeHTTP(w, httptest.NewRequest(method, path, &buf))
+	return w
+}
+
+// decode decodes the JSON body of a response into v
+func decode(t *testing.T, w *httptest.ResponseRecorder, v interface{}) {
+	t.Helper()
+	if err := json.NewDecoder(w.Body).Decode(v); err != nil {
+		t.Fatalf("invalid response body: %v", err)
+	}
+}
+
+// checkStatus checks the status code of a response
+func checkStatus(t *testing.T, w *httptest.ResponseRecorder, want int) {
+	t.Helper()
+	if w.Code != want {
+		t.Fatalf("got status %d, want %d: %s", w.Code, want, w.Body.String())
+	}
+}
+
+// checkError checks the status code and error message of a response
+func checkError(t *testing.T, w *httptest.ResponseRecorder, status int, message string) {
+	t.Helper()
+	checkStatus(t, w, status)
+	var resp errorResponse
+	decode(t, w, &resp)
+	if resp.Error != message {
+		t.Errorf("got error %q, want %q", resp.Error, message)
+	}
+}
+
+// mustCreateUser creates a user through the API
+func mustCreateUser(t *testing.T, s *Server, req *userRequest) *userResponse {
+	t.Helper()
+	w := do(t, s, http.MethodPost, "/users", req)
+	checkStatus(t, w, http.StatusCreated)
+	var user userResponse
+	decode(t, w, &user)
+	return &user
+}
+
+// fakeDirectory is a directory recording the passwords it is given, and
+// refusing them with err if set
+type fakeDirectory struct {
+	err       error
+	passwords map[string]string
+}
+
+// AddUser records the password of a user, or returns d.err
+func (d *fakeDirectory) AddUser(ctx context.Context, user *types.User, password string) error {
+	return d.SetPassword(ctx, user, password, false)
+}
+
+// SetPassword records the password of a user, or returns d.err
+func (d *fakeDirectory) SetPassword(ctx context.Context, user *types.User, password string, reset bool) error {
+	if d.err != nil {
+		return d.err
+	}
+	if d.passwords == nil {
+		d.passwords = make(map[string]string)
+	}
+	d.passwords[user.Username] = password
+	return nil
+}
+
+func TestRouting(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+	mustCreateUser(t, s, &userRequest{ID: "u1", Username: "alice", Email: "alice@example.org"})
+	// Users whose IDs are route names are still reached by their ID
+	mustCreateUser(t, s, &userRequest{ID: "by-username", Username: "bob", Email: "bob@example.org"})
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		userID string
+	}{
+		{http.MethodGet, "/users/u1", http.StatusOK, "u1"},
+		{http.MethodGet, "/users/u1/", http.StatusOK, "u1"},
+		{http.MethodGet, "/users/by-username", http.StatusOK, "by-username"},
+		{http.MethodGet, "/users/by-username/alice", http.StatusOK, "u1"},
+		{http.MethodGet, "/users/by-username/bob", http.StatusOK, "by-username"},
+		{http.MethodGet, "/users/by-email/alice@example.org", http.StatusOK, "u1"},
+		{http.MethodGet, "/users/by-username/carol", http.StatusNotFound, ""},
+		{http.MethodGet, "/users/u2", http.StatusNotFound, ""},
+		{http.MethodGet, "/users/u1/effective-groups", http.StatusOK, ""},
+		{http.MethodGet, "/healthz", http.StatusOK, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := do(t, s, tt.method, tt.path, nil)
+			checkStatus(t, w, tt.status)
+			if tt.userID == "" {
+				return
+			}
+			var user userResponse
+			decode(t, w, &user)
+			if user.ID != tt.userID {
+				t.Errorf("got user %q, want %q", user.ID, tt.userID)
+			}
+		})
+	}
+}
+
+func TestRoutingErrors(t *testing.T) {
+	s, _ := newTestServer(t, nil)
+
+	tests := []struct {
+		method string
+		path   string
+		status int
+		allow  string
+	}{
+		{http.MethodPatch, "/users", http.StatusMethodNotAllowed, "GET, POST"},
+		{http.MethodPost, "/users/u1", http.StatusMethodNotAllowed, "GET, PUT, DELETE"},
+		{http.MethodPost, "/users/by-username/alice", http.StatusMethodNotAllowed, "GET"},
+		{http.MethodGet, "/users/u1/password-reset", http.StatusMethodNotAllowed, "POST"},
+		{http.MethodPost, "/users/u1/effective-groups", http.StatusMethodNotAllowed, "GET"},
+		{http.MethodGet, "/sessions", http.StatusMethodNotAllowed, "POST"},
+		{http.MethodGet, "/password-resets", http.StatusMethodNotAllowed, "POST"},
+		{http.MethodPost, "/healthz", http.StatusMethodNotAllowed, "GET"},
+		{http.MethodGet, "/users/u1/unknown", http.StatusNotFound, ""},
+		{http.MethodGet, "/users/u1/password-reset/x", http.StatusNotFound, ""},
+		{http.MethodGet, "/sessions/s1/x", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.method+" "+tt.path, func(t *testing.T) {
+			w := do(t, s, tt.method, tt.path, nil)
+			if tt.status == http.StatusNotFound {
+				checkError(t, w, tt.status, "route not found")
+			} else {
+				checkError(t, w, tt.status, "method not allowed")
+			}
+			if got := w.Header().Get("Allow"); got != tt.allow {
+				t.Errorf("got Allow %q, want %q", got, tt.allow)
+			}
+		})
+	}
+}
+
+func TestStatusFromError(t *testing.T) {
+	tests := []struct {
+		err    error
+		status int
+	}{
+		{types.ErrNotFound, http.StatusNotFound},
+		{types.ErrAlreadyExists, http.StatusConflict},
+		{types.ErrConflict, http.StatusConflict},
+		{types.ErrMembershipCycle, http.StatusConflict},
+		{types.ErrMaxDepthExceeded, http.StatusConflict},
+		{types.ErrInvalidMember, http.StatusBadRequest},
+		{types.ErrInvalidArgument, http.StatusBadRequest},
+		{types.ErrBackendUnavailable, http.StatusServiceUnavailable},
+		{context.Canceled, http.StatusServiceUnavailable},
+		{context.DeadlineExceeded, http.StatusGatewayTimeout},
+		{fmt.Errorf("user u1: %w", types.ErrNotFound), http.StatusNotFound},
+		{fmt.Errorf("%w: username alice is already taken", types.ErrConflict), http.StatusConflict},
+		{errors.New("connection reset"), http.StatusInternalServerError},
+	}
+	for _, tt := range tests {
+		if got := statusFromError(tt.err); got != tt.status {
+			t.Errorf("statusFromError(%v) = %d, want %d", tt.err, got, tt.status)
+		}
+	}
+}
+
+func TestWriteStorageErrorHidesServerErrors(t *testing.T) {
+	tests := []struct {
+		err     error
+		status  int
+		message string
+	}{
+		{fmt.Errorf("user u1: %w", types.ErrNotFound), http.StatusNotFound, "user u1: not found"},
+		{fmt.Errorf("dial tcp: %w", types.ErrBackendUnavailable), http.StatusServiceUnavailable, "service unavailable"},
+		{errors.New("pq: relation users does not exist"), http.StatusInternalServerError, "internal server error"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		writeStorageError(w, tt.err)
+		checkError(t, w, tt.status, tt.message)
+	}
+}
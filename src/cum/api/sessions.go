@@ -0,0 +1,177 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"time"
+
+	"cum/types"
+)
+
+// errInvalidCredentials is returned when a login fails
+var errInvalidCredentials = errors.New("invalid username or password")
+
+// errPasswordChangeRequired is returned when a user logs in with a one-time
+// password without changing it
+var errPasswordChangeRequired = errors.New("password change required, log in again with a new_password")
+
+// loginRequest is the body accepted when creating a session
+type loginRequest struct {
+	Username string `json:"username"`
+	Password string `json:"password"`
+	// NewPassword, if set, replaces the password once it is verified. It
+	// is required to log in with a one-time password.
+	NewPassword string `json:"new_password"`
+}
+
+// sessionResponse is the representation of a session returned by the API
+type sessionResponse struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// newSessionResponse converts a session to its API representation
+func newSessionResponse(session *types.Session) *sessionResponse {
+	return &sessionResponse{
+		ID:        session.ID,
+		UserID:    session.UserID,
+		ExpiresAt: session.ExpiresAt,
+	}
+}
+
+// handleSessions routes the /sessions endpoints
+//
+//	POST   /sessions
+//	GET    /sessions/{id}
+//	DELETE /sessions/{id}
+func (s *Server) handleSessions(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r.URL.Path, "/sessions")
+
+	switch len(segments) {
+	case 0:
+		if r.Method != http.MethodPost {
+			methodNotAllowed(w, http.MethodPost)
+			return
+		}
+		s.createSession(w, r)
+	case 1:
+		switch r.Method {
+		case http.MethodGet:
+			s.getSession(w, r, segments[0])
+		case http.MethodDelete:
+			s.deleteSession(w, r, segments[0])
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodDelete)
+		}
+	default:
+		notFound(w)
+	}
+}
+
+// createSession logs a user in with its username and password and
+// creates a new session for it. Password hashes made with an outdated
+// algorithm or cost are upgraded on the way. Users logging in with a
+// one-time password must change it in the same request.
+func (s *Server) createSession(w http.ResponseWriter, r *http.Request) {
+	var req loginRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Username == "" || req.Password == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username and password are required"))
+		return
+	}
+
+	user, err := s.storage.GetUserByUsername(r.Context(), req.Username)
+	if err != nil {
+		if errors.Is(err, types.ErrNotFound) {
+			writeError(w, http.StatusUnauthorized, errInvalidCredentials)
+			return
+		}
+		writeStorageError(w, err)
+		return
+	}
+
+	ok, rehash, err := s.hasher.Verify(req.Password, user.Password)
+	if err != nil {
+		log.Printf("Failed to verify the password of user %s: %v", user.ID, err)
+	}
+	if !ok {
+		writeError(w, http.StatusUnauthorized, errInvalidCredentials)
+		return
+	}
+
+	switch {
+	case req.NewPassword != "":
+		if req.NewPassword == req.Password {
+			writeError(w, http.StatusBadRequest, errors.New("the new password must differ from the current one"))
+			return
+		}
+		if err := s.setPassword(r.Context(), user, req.NewPassword, false); err != nil {
+			writeStorageError(w, err)
+			return
+		}
+	case user.MustChangePassword:
+		writeError(w, http.StatusForbidden, errPasswordChangeRequired)
+		return
+	case rehash:
+		s.rehashPassword(r.Context(), user, req.Password)
+	}
+
+	id, err := types.NewID()
+	if err != nil {
+		writeError(w, http.StatusInternalServerError, err)
+		return
+	}
+
+	session := &types.Session{
+		ID:        id,
+		UserID:    user.ID,
+		ExpiresAt: time.Now().Add(s.sessionTTL).Unix(),
+	}
+	if err := s.storage.CreateSession(r.Context(), session); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusCreated, newSessionResponse(session))
+}
+
+// rehashPassword replaces the stored password hash of a user with a hash
+// made with the preferred algorithm and cost. Failures are logged only, as
+// the login itself succeeded.
+func (s *Server) rehashPassword(ctx context.Context, user *types.User, password string) {
+	hash, err := s.hasher.Hash(password)
+	if err != nil {
+		log.Printf("Failed to rehash the password of user %s: %v", user.ID, err)
+		return
+	}
+
+	updated := *user
+	updated.Password = hash
+	if err := s.storage.UpdateUser(ctx, &updated); err != nil {
+		log.Printf("Failed to store the rehashed password of user %s: %v", user.ID, err)
+	}
+}
+
+// getSession returns a session by its ID
+func (s *Server) getSession(w http.ResponseWriter, r *http.Request, id string) {
+	session, err := s.storage.GetSessionByID(r.Context(), id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newSessionResponse(session))
+}
+
+// deleteSession deletes a session
+func (s *Server) deleteSession(w http.ResponseWriter, r *http.Request, id string) {
+	if err := s.storage.DeleteSession(r.Context(), id); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,331 @@
+package api
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+
+	"cum/types"
+)
+
+// userRequest is the body accepted when creating or updating a user
+type userRequest struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+}
+
+// userResponse is the representation of a user returned by the API
+type userResponse struct {
+	ID                 string `json:"id"`
+	Username           string `json:"username"`
+	Email              string `json:"email"`
+	MustChangePassword bool   `json:"must_change_password"`
+}
+
+// userListResponse is a page of users returned by the API
+type userListResponse struct {
+	Users      []*userResponse `json:"users"`
+	NextCursor string          `json:"next_cursor,omitempty"`
+}
+
+// newUserResponse converts a user to its API representation
+func newUserResponse(user *types.User) *userResponse {
+	return &userResponse{
+		ID:                 user.ID,
+		Username:           user.Username,
+		Email:              user.Email,
+		MustChangePassword: user.MustChangePassword,
+	}
+}
+
+// handleUsers routes the /users endpoints
+//
+//	GET    /users
+//	POST   /users
+//	GET    /users/by-username/{username}
+//	GET    /users/by-email/{email}
+//	GET    /users/{id}
+//	GET    /users/{id}/effective-groups
+//	POST   /users/{id}/password-reset
+//	PUT    /users/{id}
+//	DELETE /users/{id}
+func (s *Server) handleUsers(w http.ResponseWriter, r *http.Request) {
+	segments := pathSegments(r.URL.Path, "/users")
+
+	switch len(segments) {
+	case 0:
+		switch r.Method {
+		case http.MethodGet:
+			s.listUsers(w, r)
+		case http.MethodPost:
+			s.createUser(w, r)
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPost)
+		}
+	case 1:
+		switch r.Method {
+		case http.MethodGet:
+			s.getUser(w, r, segments[0])
+		case http.MethodPut:
+			s.updateUser(w, r, segments[0])
+		case http.MethodDelete:
+			s.deleteUser(w, r, segments[0])
+		default:
+			methodNotAllowed(w, http.MethodGet, http.MethodPut, http.MethodDelete)
+		}
+	case 2:
+		switch {
+		case segments[0] == "by-username" || segments[0] == "by-email":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+				return
+			}
+			if segments[0] == "by-username" {
+				s.getUserByUsername(w, r, segments[1])
+			} else {
+				s.getUserByEmail(w, r, segments[1])
+			}
+		case segments[1] == "password-reset":
+			if r.Method != http.MethodPost {
+				methodNotAllowed(w, http.MethodPost)
+				return
+			}
+			s.resetPassword(w, r, segments[0])
+		case segments[1] == "effective-groups":
+			if r.Method != http.MethodGet {
+				methodNotAllowed(w, http.MethodGet)
+				return
+			}
+			s.getEffectiveGroups(w, r, segments[0])
+		default:
+			notFound(w)
+		}
+	default:
+		notFound(w)
+	}
+}
+
+// createUser creates a new user
+func (s *Server) createUser(w http.ResponseWriter, r *http.Request) {
+	var req userRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.Username == "" {
+		writeError(w, http.StatusBadRequest, errors.New("username is required"))
+		return
+	}
+
+	if req.ID == "" {
+		id, err := types.NewID()
+		if err != nil {
+			writeError(w, http.StatusInternalServerError, err)
+			return
+		}
+		req.ID = id
+	}
+
+	user := &types.User{
+		ID:       req.ID,
+		Username: req.Username,
+		Email:    req.Email,
+	}
+	if req.Password != "" {
+		hash, err := s.hasher.Hash(req.Password)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		user.Password = hash
+	}
+	if err := s.storage.CreateUser(r.Context(), user); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	// The directory is given the password once the user is stored, and a
+	// password it refuses, for example by its password policy, undoes the
+	// creation
+	if s.directory != nil && req.Password != "" {
+		if err := s.directory.AddUser(r.Context(), user, req.Password); err != nil {
+			s.deleteCreatedUser(user)
+			writeStorageError(w, err)
+			return
+		}
+	}
+	writeJSON(w, http.StatusCreated, newUserResponse(user))
+}
+
+// deleteCreatedUser deletes a user whose creation failed after it was
+// stored. It is deleted even when the request was cancelled.
+func (s *Server) deleteCreatedUser(user *types.User) {
+	if err := s.storage.DeleteUser(context.Background(), user.ID); err != nil {
+		log.Printf("Failed to delete user %s after its creation failed: %v", user.ID, err)
+	}
+}
+
+// listUsers returns a page of users, filtered by the username_prefix,
+// username_contains, email_prefix and email_contains query parameters
+func (s *Server) listUsers(w http.ResponseWriter, r *http.Request) {
+	list, err := parseListQuery(r)
+	if err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+
+	query := r.URL.Query()
+	page, err := s.storage.ListUsers(r.Context(), &types.UserListOptions{
+		UsernamePrefix:   query.Get("username_prefix"),
+		UsernameContains: query.Get("username_contains"),
+		EmailPrefix:      query.Get("email_prefix"),
+		EmailContains:    query.Get("email_contains"),
+		SortBy:           list.sortBy,
+		Descending:       list.descending,
+		Limit:            list.limit,
+		Cursor:           list.cursor,
+	})
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	resp := &userListResponse{
+		Users:      make([]*userResponse, 0, len(page.Users)),
+		NextCursor: page.NextCursor,
+	}
+	for _, user := range page.Users {
+		resp.Users = append(resp.Users, newUserResponse(user))
+	}
+	writeJSON(w, http.StatusOK, resp)
+}
+
+// getUser returns a user by its ID
+func (s *Server) getUser(w http.ResponseWriter, r *http.Request, id string) {
+	user, err := s.storage.GetUserByID(r.Context(), id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUserResponse(user))
+}
+
+// getUserByUsername returns a user by its username
+func (s *Server) getUserByUsername(w http.ResponseWriter, r *http.Request, username string) {
+	user, err := s.storage.GetUserByUsername(r.Context(), username)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUserResponse(user))
+}
+
+// getUserByEmail returns a user by its email
+func (s *Server) getUserByEmail(w http.ResponseWriter, r *http.Request, email string) {
+	user, err := s.storage.GetUserByEmail(r.Context(), email)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUserResponse(user))
+}
+
+// updateUser updates the username, email or password of a user. Empty
+// fields are left unchanged. A password set by an administrator is not one
+// to change at the next login. The directory is given a new password
+// before it is stored, once the update is checked, since it cannot be
+// taken back if the storage then refuses the update.
+func (s *Server) updateUser(w http.ResponseWriter, r *http.Request, id string) {
+	var req userRequest
+	if err := decodeJSON(r, &req); err != nil {
+		writeError(w, http.StatusBadRequest, err)
+		return
+	}
+	if req.ID != "" && req.ID != id {
+		writeError(w, http.StatusBadRequest, errors.New("user ID cannot be changed"))
+		return
+	}
+
+	current, err := s.storage.GetUserByID(r.Context(), id)
+	if err != nil {
+		writeStorageError(w, err)
+		return
+	}
+
+	user := *current
+	if req.Username != "" {
+		user.Username = req.Username
+	}
+	if req.Email != "" {
+		user.Email = req.Email
+	}
+	if req.Password != "" {
+		hash, err := s.hasher.Hash(req.Password)
+		if err != nil {
+			writeStorageError(w, err)
+			return
+		}
+		user.Password = hash
+		user.MustChangePassword = false
+
+		if s.directory != nil {
+			if err := s.checkUserUnique(r.Context(), &user); err != nil {
+				writeStorageError(w, err)
+				return
+			}
+			// The directory still knows the user by its current username
+			if err := s.directory.SetPassword(r.Context(), current, req.Password, false); err != nil {
+				writeStorageError(w, err)
+				return
+			}
+		}
+	}
+
+	if err := s.storage.UpdateUser(r.Context(), &user); err != nil {
+		if s.directory != nil && req.Password != "" {
+			log.Printf("User %s has a new password in the directory, but storing it failed: %v", id, err)
+		}
+		writeStorageError(w, err)
+		return
+	}
+	writeJSON(w, http.StatusOK, newUserResponse(&user))
+}
+
+// checkUserUnique returns the conflict the storage would refuse an updated
+// user with, if its username or email is taken by another user
+func (s *Server) checkUserUnique(ctx context.Context, user *types.User) error {
+	other, err := s.storage.GetUserByUsername(ctx, user.Username)
+	if err == nil && other.ID != user.ID {
+		return fmt.Errorf("%w: username %s is already taken", types.ErrConflict, user.Username)
+	}
+	if err != nil && !errors.Is(err, types.ErrNotFound) {
+		return err
+	}
+	if user.Email == "" {
+		return nil
+	}
+	other, err = s.storage.GetUserByEmail(ctx, user.Email)
+	if err == nil && other.ID != user.ID {
+		return fmt.Errorf("%w: email %s is already taken", types.ErrConflict, user.Email)
+	}
+	if err != nil && !errors.Is(err, types.ErrNotFound) {
+		return err
+	}
+	return nil
+}
+
+// deleteUser deletes a user
+func (s *Server) deleteUser(w http.ResponseWriter, r *http.Request, id string) {
+	if _, err := s.storage.GetUserByID(r.Context(), id); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	if err := s.storage.DeleteUser(r.Context(), id); err != nil {
+		writeStorageError(w, err)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
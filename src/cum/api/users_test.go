@@ -0,0 +1,52 @@
+package api
+
+import (
+	"net/http"
+	"testing"
+
+	"cum/types"
+)
+
+func TestCreateUserRefusedByDirectory(t *testing.T) {
+	directory := &fakeDirectory{err: types.ErrInvalidArgument}
+	s, _ := newTestServer(t, directory)
+
+	// A password the directory refuses undoes the creation
+	w := do(t, s, http.MethodPost, "/users", &userRequest{ID: "u1", Username: "alice", Password: "weak"})
+	checkStatus(t, w, http.StatusBadRequest)
+	checkStatus(t, do(t, s, http.MethodGet, "/users/u1", nil), http.StatusNotFound)
+
+	directory.err = nil
+	mustCreateUser(t, s, &userRequest{ID: "u1", Username: "alice", Password: "sécret"})
+	if got := directory.passwords["alice"]; got != "sécret" {
+		t.Errorf("the directory was given password %q, want sécret", got)
+	}
+	login(t, s, &loginRequest{Username: "alice", Password: "sécret"}, http.StatusCreated)
+}
+
+func TestUpdateUserConflictSkipsDirectory(t *testing.T) {
+	directory := &fakeDirectory{}
+	s, _ := newTestServer(t, directory)
+	mustCreateUser(t, s, &userRequest{ID: "u1", Username: "alice", Email: "alice@example.org"})
+	mustCreateUser(t, s, &userRequest{ID: "u2", Username: "bob", Email: "bob@example.org"})
+
+	// The directory is not given the password of an update the storage
+	// would refuse
+	for _, req := range []*userRequest{
+		{Username: "alice", Password: "sécret"},
+		{Email: "alice@example.org", Password: "sécret"},
+	} {
+		w := do(t, s, http.MethodPut, "/users/u2", req)
+		checkStatus(t, w, http.StatusConflict)
+	}
+	if len(directory.passwords) != 0 {
+		t.Errorf("the directory was given passwords %v", directory.passwords)
+	}
+
+	w := do(t, s, http.MethodPut, "/users/u2", &userRequest{Username: "bobby", Password: "sécret"})
+	checkStatus(t, w, http.StatusOK)
+	if got := directory.passwords["bob"]; got != "sécret" {
+		t.Errorf("the directory was given password %q for bob, want sécret", got)
+	}
+	login(t, s, &loginRequest{Username: "bobby", Password: "sécret"}, http.StatusCreated)
+}
@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"strings"
+
+	"cum/provision"
+)
+
+// importLDAP runs the import ldap subcommand, which imports the users,
+// groups and memberships of the LDAP server set by the flags into the
+// storage
+//
+//	cum import ldap            creates the missing users and groups and adds their members
+//	cum import ldap -dry-run   only prints the changes
+func importLDAP(args []string) {
+	if len(args) == 0 || args[0] != "ldap" {
+		log.Fatal("Usage: cum -ldap-host HOST [flags] import ldap [-dry-run] [-user-attributes MAP] [-group-attributes MAP]")
+	}
+
+	flags := flag.NewFlagSet("import ldap", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only print the changes")
+	userAttributes := flags.String("user-attributes", "", "Comma separated field=attribute pairs mapping the username, email and password fields to LDAP attributes (default username=<naming attribute>,email=mail,password=userPassword)")
+	groupAttributes := flags.String("group-attributes", "", "Comma separated field=attribute pairs mapping the name and description fields to LDAP attributes (default name=<naming attribute>,description=description)")
+	flags.Parse(args[1:])
+
+	if *LDAPHost == "" {
+		log.Fatal("Usage: cum -ldap-host HOST [flags] import ldap [-dry-run] [-user-attributes MAP] [-group-attributes MAP]")
+	}
+	userMap, err := parseAttributeMap(*userAttributes)
+	if err != nil {
+		log.Fatalf("Invalid -user-attributes: %v", err)
+	}
+	groupMap, err := parseAttributeMap(*groupAttributes)
+	if err != nil {
+		log.Fatalf("Invalid -group-attributes: %v", err)
+	}
+
+	ldapClient = newLDAPClient()
+	defer ldapClient.Close()
+
+	myStorage, backend := openStorage()
+	defer myStorage.Close()
+
+	report, err := provision.Import(context.Background(), &provision.ImportConfig{
+		Storage:         myStorage,
+		LDAP:            ldapClient,
+		DryRun:          *dryRun,
+		UserAttributes:  userMap,
+		GroupAttributes: groupMap,
+		PosixIDs:        backend,
+	})
+	if report != nil {
+		prefix := ""
+		if *dryRun {
+			prefix = "Would "
+		}
+		for _, change := range report.Changes {
+			fmt.Printf("%s%s\n", prefix, change)
+		}
+		for _, skip := range report.Skipped {
+			fmt.Printf("Skipped %s\n", skip)
+		}
+		for _, conflict := range report.PosixConflicts {
+			fmt.Printf("Conflicting POSIX number of %s\n", conflict)
+		}
+	}
+	if err != nil {
+		log.Fatalf("Failed to import: %v", err)
+	}
+	if len(report.Changes) == 0 {
+		fmt.Println("Nothing to import")
+	}
+}
+
+// parseAttributeMap parses comma separated field=attribute pairs. An empty
+// attribute leaves the field out of the import.
+func parseAttributeMap(value string) (map[string]string, error) {
+	mapping := map[string]string{}
+	for _, item := range splitList(value) {
+		field, attribute, ok := strings.Cut(item, "=")
+		if !ok || strings.TrimSpace(field) == "" {
+			return nil, fmt.Errorf("%q is not a field=attribute pair", item)
+		}
+		mapping[strings.TrimSpace(field)] = strings.TrimSpace(attribute)
+	}
+	return mapping, nil
+}
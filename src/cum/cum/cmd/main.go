@@ -1,10 +1,21 @@
 package main
 
 import (
+	"context"
 	"flag"
 	"fmt"
 	"log"
-
+	"net/http"
+	"os"
+	"os/signal"
+	"strings"
+	"syscall"
+	"time"
+
+	"cum/api"
+	"cum/ldapctl"
+	"cum/password"
+	"cum/provision"
 	"cum/storage"
 	"cum/types"
 )
@@ -61,6 +72,216 @@ var (
 	// PostgresMaxOpenConnections is a flag to set the PostgreSQL max open connections
 	PostgresMaxOpenConnections = flag.Int("postgres-max-open-connections", 10, "PostgreSQL max open connections")
 
+	// PostgresSkipMigrations is a flag to not apply pending PostgreSQL schema migrations on startup
+	PostgresSkipMigrations = flag.Bool("postgres-skip-migrations", false, "Do not apply pending PostgreSQL schema migrations on startup")
+
+	// Redis is a flag to use the Redis storage
+	Redis = flag.Bool("redis", false, "Use the Redis storage")
+
+	// RedisHost is a flag to set the Redis host
+	RedisHost = flag.String("redis-host", "localhost", "Redis host")
+
+	// RedisPort is a flag to set the Redis port
+	RedisPort = flag.Int("redis-port", 6379, "Redis port")
+
+	// RedisPassword is a flag to set the Redis password
+	RedisPassword = flag.String("redis-password", "", "Redis password")
+
+	// RedisDB is a flag to set the Redis database
+	RedisDB = flag.Int("redis-db", 0, "Redis database")
+
+	// LDAPHost is a flag to set the LDAP host
+	LDAPHost = flag.String("ldap-host", "", "LDAP host, leave empty to disable LDAP")
+
+	// LDAPPort is a flag to set the LDAP port
+	LDAPPort = flag.Int("ldap-port", 0, "LDAP port (defaults to 636 with ldaps, 389 otherwise)")
+
+	// LDAPTLSMode is a flag to set how LDAP connections are secured
+	LDAPTLSMode = flag.String("ldap-tls", "none", "How LDAP connections are secured (none, ldaps or starttls)")
+
+	// LDAPCACert is a flag to set the CA bundle verifying the LDAP server certificate
+	LDAPCACert = flag.String("ldap-ca-cert", "", "PEM bundle of the CAs verifying the LDAP server certificate (defaults to the system CAs)")
+
+	// LDAPClientCert is a flag to set the client certificate presented to the LDAP server
+	LDAPClientCert = flag.String("ldap-client-cert", "", "PEM client certificate presented to the LDAP server")
+
+	// LDAPClientKey is a flag to set the key of the client certificate
+	LDAPClientKey = flag.String("ldap-client-key", "", "PEM key of the LDAP client certificate")
+
+	// LDAPServerName is a flag to set the name the LDAP server certificate is verified against
+	LDAPServerName = flag.String("ldap-server-name", "", "Name the LDAP server certificate is verified against (defaults to the LDAP host)")
+
+	// LDAPInsecureSkipVerify is a flag to disable the verification of the LDAP server certificate
+	LDAPInsecureSkipVerify = flag.Bool("ldap-insecure-skip-verify", false, "Do not verify the LDAP server certificate")
+
+	// LDAPRefuseInsecure is a flag to refuse cleartext LDAP connections and unverified certificates
+	LDAPRefuseInsecure = flag.Bool("ldap-refuse-insecure", false, "Refuse cleartext LDAP connections and unverified LDAP server certificates")
+
+	// LDAPBindDN is a flag to set the LDAP bind DN
+	LDAPBindDN = flag.String("ldap-bind-dn", "", "LDAP bind DN")
+
+	// LDAPBindPassword is a flag to set the LDAP bind password
+	LDAPBindPassword = flag.String("ldap-bind-password", "", "LDAP bind password")
+
+	// LDAPBaseDN is a flag to set the LDAP base DN
+	LDAPBaseDN = flag.String("ldap-base-dn", "", "LDAP base DN")
+
+	// LDAPUserSearchBaseDN is a flag to set the LDAP user search base DN
+	LDAPUserSearchBaseDN = flag.String("ldap-user-search-base-dn", "", "LDAP user search base DN (defaults to the base DN)")
+
+	// LDAPUserSearchFilter is a flag to set the LDAP user search filter
+	LDAPUserSearchFilter = flag.String("ldap-user-search-filter", "", "LDAP user search filter, %s being the user name (defaults to the filter of the schema)")
+
+	// LDAPUserSearchScope is a flag to set the LDAP user search scope
+	LDAPUserSearchScope = flag.String("ldap-user-search-scope", "sub", "LDAP user search scope (base, one or sub)")
+
+	// LDAPUserSearchAttributes is a flag to set the LDAP user search attributes
+	LDAPUserSearchAttributes = flag.String("ldap-user-search-attributes", "", "Comma separated attributes returned by LDAP user searches (defaults to the naming attribute, cn, sn and mail)")
+
+	// LDAPGroupSearchBaseDN is a flag to set the LDAP group search base DN
+	LDAPGroupSearchBaseDN = flag.String("ldap-group-search-base-dn", "", "LDAP group search base DN (defaults to the base DN)")
+
+	// LDAPGroupSearchFilter is a flag to set the LDAP group search filter
+	LDAPGroupSearchFilter = flag.String("ldap-group-search-filter", "", "LDAP group search filter, %s being the group name (defaults to the filter of the schema)")
+
+	// LDAPGroupMemberFilter is a flag to set the LDAP filter matching the groups of a user
+	LDAPGroupMemberFilter = flag.String("ldap-group-member-filter", "", "LDAP filter matching the groups of a user, %s being the member value of the user (defaults to the filter of the schema)")
+
+	// LDAPGroupSearchScope is a flag to set the LDAP group search scope
+	LDAPGroupSearchScope = flag.String("ldap-group-search-scope", "sub", "LDAP group search scope (base, one or sub)")
+
+	// LDAPGroupSearchAttributes is a flag to set the LDAP group search attributes
+	LDAPGroupSearchAttributes = flag.String("ldap-group-search-attributes", "", "Comma separated attributes returned by LDAP group searches (defaults to the naming attribute, gidNumber and the member attribute)")
+
+	// LDAPSchema is a flag to set the LDAP schema profile
+	LDAPSchema = flag.String("ldap-schema", "rfc2307", "LDAP schema profile (rfc2307, rfc2307bis, groupofnames, groupofuniquenames or activedirectory)")
+
+	// LDAPUserObjectClasses is a flag to set the object classes of LDAP users
+	LDAPUserObjectClasses = flag.String("ldap-user-object-classes", "", "Comma separated object classes of added LDAP users (defaults to top,person,organizationalPerson,inetOrgPerson)")
+
+	// LDAPUserNamingAttribute is a flag to set the attribute naming LDAP users
+	LDAPUserNamingAttribute = flag.String("ldap-user-naming-attribute", "", "Attribute holding the name of LDAP users, cn or uid (defaults to cn)")
+
+	// LDAPGroupObjectClasses is a flag to set the object classes of LDAP groups
+	LDAPGroupObjectClasses = flag.String("ldap-group-object-classes", "", "Comma separated object classes of added LDAP groups (defaults to the ones of the schema)")
+
+	// LDAPGroupNamingAttribute is a flag to set the attribute naming LDAP groups
+	LDAPGroupNamingAttribute = flag.String("ldap-group-naming-attribute", "", "Attribute holding the name of LDAP groups (defaults to cn)")
+
+	// LDAPMemberAttribute is a flag to set the attribute listing the members of LDAP groups
+	LDAPMemberAttribute = flag.String("ldap-member-attribute", "", "Attribute listing the members of LDAP groups (defaults to the one of the schema)")
+
+	// LDAPMemberFormat is a flag to set the format of the members of LDAP groups
+	LDAPMemberFormat = flag.String("ldap-member-format", "", "Format of the members of LDAP groups, uid or dn (defaults to the one of the schema)")
+
+	// LDAPEmptyMember is a flag to set the placeholder member of LDAP groups
+	LDAPEmptyMember = flag.String("ldap-empty-member", "", "DN kept as a member of every LDAP group, for object classes requiring a member")
+
+	// LDAPNestedGroups is a flag to list nested groups as members of LDAP groups
+	LDAPNestedGroups = flag.Bool("ldap-nested-groups", false, "List nested groups as members of LDAP groups by DN, rather than flattening their users (requires the dn member format)")
+
+	// LDAPUserPrincipalNameSuffix is a flag to set the domain of the userPrincipalName of Active Directory users
+	LDAPUserPrincipalNameSuffix = flag.String("ldap-upn-suffix", "", "Domain of the userPrincipalName of added Active Directory users (defaults to the domain of the base DN)")
+
+	// LDAPPageSize is a flag to set the page size of LDAP searches
+	LDAPPageSize = flag.Int("ldap-page-size", 0, "Number of entries per page of LDAP searches listing users and groups, -1 to disable paging (defaults to 1000)")
+
+	// LDAPMaxOpenConnections is a flag to set the maximum number of LDAP connections
+	LDAPMaxOpenConnections = flag.Int("ldap-max-open-connections", 10, "Maximum number of LDAP connections")
+
+	// LDAPMaxIdleConnections is a flag to set the maximum number of idle LDAP connections
+	LDAPMaxIdleConnections = flag.Int("ldap-max-idle-connections", 10, "Maximum number of idle LDAP connections kept for reuse")
+
+	// LDAPIdleTimeout is a flag to set how long an LDAP connection may stay idle
+	LDAPIdleTimeout = flag.Duration("ldap-idle-timeout", 5*time.Minute, "How long an LDAP connection may stay idle before it is closed (0 to disable)")
+
+	// LDAPHealthCheckInterval is a flag to set how long an LDAP connection may stay idle before it is checked
+	LDAPHealthCheckInterval = flag.Duration("ldap-health-check-interval", 30*time.Second, "How long an LDAP connection may stay idle before it is checked before its reuse (0 to disable)")
+
+	// LDAPPasswordResetAttribute is a flag to set the attribute marking reset LDAP passwords
+	LDAPPasswordResetAttribute = flag.String("ldap-password-reset-attribute", "shadowLastChange", "Attribute marking the one-time passwords users must change at their next login: shadowLastChange, pwdReset or none (activedirectory always uses pwdLastSet)")
+
+	// LDAPProvision is a flag to provision the changes of users and groups to LDAP
+	LDAPProvision = flag.Bool("ldap-provision", false, "Provision the changes of users and groups to LDAP")
+
+	// LDAPProvisionInterval is a flag to set how often the outbox is checked for changes to provision
+	LDAPProvisionInterval = flag.Duration("ldap-provision-interval", 5*time.Second, "How often the outbox is checked for changes to provision to LDAP")
+
+	// LDAPProvisionMaxBackoff is a flag to set the maximum delay before a failed change is provisioned again
+	LDAPProvisionMaxBackoff = flag.Duration("ldap-provision-max-backoff", time.Hour, "Maximum delay before a failed change is provisioned to LDAP again")
+
+	// LDAPUIDMin is a flag to set the lowest uidNumber allocated to users
+	LDAPUIDMin = flag.Int64("ldap-uid-min", 10000, "Lowest uidNumber allocated to provisioned users")
+
+	// LDAPUIDMax is a flag to set the highest uidNumber allocated to users
+	LDAPUIDMax = flag.Int64("ldap-uid-max", 60000, "Highest uidNumber allocated to provisioned users")
+
+	// LDAPGIDMin is a flag to set the lowest gidNumber allocated to groups
+	LDAPGIDMin = flag.Int64("ldap-gid-min", 10000, "Lowest gidNumber allocated to provisioned groups")
+
+	// LDAPGIDMax is a flag to set the highest gidNumber allocated to groups
+	LDAPGIDMax = flag.Int64("ldap-gid-max", 60000, "Highest gidNumber allocated to provisioned groups")
+
+	// LDAPUserGID is a flag to set the gidNumber of the primary group of users
+	LDAPUserGID = flag.Int64("ldap-user-gid", 100, "gidNumber of the primary group of provisioned users")
+
+	// LDAPHomeDirectory is a flag to set the home directory of users
+	LDAPHomeDirectory = flag.String("ldap-home-directory", "/home/%s", "Home directory of provisioned users, %s being the username")
+
+	// LDAPLoginShell is a flag to set the login shell of users
+	LDAPLoginShell = flag.String("ldap-login-shell", "/bin/bash", "Login shell of provisioned users")
+
+	// DeletePolicy is a flag to set what happens to the memberships and ownerships of deleted users and groups
+	DeletePolicy = flag.String("delete-policy", "cascade", "What happens to the memberships and ownerships of deleted users and groups (cascade or restrict)")
+
+	// MaxNestingDepth is a flag to set the maximum number of levels of nested groups
+	MaxNestingDepth = flag.Int("max-nesting-depth", storage.DefaultMaxNestingDepth, "Maximum number of levels of nested groups")
+
+	// ListenAddress is a flag to set the address the REST API listens on
+	ListenAddress = flag.String("listen", ":8080", "Address the REST API listens on")
+
+	// ShutdownTimeout is a flag to set how long to wait for in-flight requests on shutdown
+	ShutdownTimeout = flag.Duration("shutdown-timeout", 10*time.Second, "How long to wait for in-flight requests on shutdown")
+
+	// RequestTimeout is a flag to set how long a request may run before its storage operations are aborted
+	RequestTimeout = flag.Duration("request-timeout", 30*time.Second, "How long a request may run before its storage operations are aborted (0 to disable)")
+
+	// SessionTTL is a flag to set how long a session created on login is valid
+	SessionTTL = flag.Duration("session-ttl", 24*time.Hour, "How long a session created on login is valid")
+
+	// PasswordResetTTL is a flag to set how long a password reset token can be redeemed
+	PasswordResetTTL = flag.Duration("password-reset-ttl", time.Hour, "How long a password reset token can be redeemed")
+
+	// SessionCleanupInterval is a flag to set how often expired sessions are deleted
+	SessionCleanupInterval = flag.Duration("session-cleanup-interval", time.Minute, "How often expired sessions and password resets are deleted by the in-memory and PostgreSQL storages")
+
+	// PasswordAlgorithm is a flag to set the algorithm used to hash new passwords
+	PasswordAlgorithm = flag.String("password-algorithm", "argon2id", "Algorithm used to hash new passwords (argon2id, bcrypt or scrypt)")
+
+	// PasswordLegacyPlaintext is a flag to accept the legacy plain text passwords
+	PasswordLegacyPlaintext = flag.Bool("password-legacy-plaintext", false, "Verify stored passwords that are not hashes as legacy plain text passwords, which are hashed on the next login")
+
+	// BcryptCost is a flag to set the bcrypt cost
+	BcryptCost = flag.Int("bcrypt-cost", 12, "bcrypt cost")
+
+	// Argon2Memory is a flag to set the argon2id memory in KiB
+	Argon2Memory = flag.Uint("argon2-memory", 64*1024, "argon2id memory in KiB")
+
+	// Argon2Iterations is a flag to set the argon2id number of iterations
+	Argon2Iterations = flag.Uint("argon2-iterations", 3, "argon2id number of iterations")
+
+	// Argon2Parallelism is a flag to set the argon2id degree of parallelism
+	Argon2Parallelism = flag.Uint("argon2-parallelism", 2, "argon2id degree of parallelism")
+
+	// ScryptCost is a flag to set the base 2 logarithm of the scrypt cost
+	ScryptCost = flag.Int("scrypt-cost", 15, "Base 2 logarithm of the scrypt CPU/memory cost")
+
+	// ScryptBlockSize is a flag to set the scrypt block size
+	ScryptBlockSize = flag.Int("scrypt-block-size", 8, "scrypt block size")
+
+	// ScryptParallelization is a flag to set the scrypt parallelization
+	ScryptParallelization = flag.Int("scrypt-parallelization", 1, "scrypt parallelization")
+
 	// VersionFlag is a flag to print the version of the application
 	VersionFlag = flag.Bool("version", false, "Print the version of the application")
 
@@ -69,6 +290,12 @@ var (
 
 	// postgresStorage is the PostgreSQL storage
 	postgresStorage *storage.PostgresStorage
+
+	// redisStorage is the Redis storage
+	redisStorage *storage.RedisStorage
+
+	// ldapClient is the LDAP client, nil when no LDAP host is set
+	ldapClient *ldapctl.Client
 )
 
 func version() {
@@ -76,43 +303,145 @@ func version() {
 }
 
 func help() {
+	fmt.Println("Usage: cum [flags]")
+	fmt.Println("       cum [flags] migrate up|down [N]|status")
+	fmt.Println("       cum [flags] reconcile [-dry-run] [-prune]")
+	fmt.Println("       cum [flags] import ldap [-dry-run] [-user-attributes MAP] [-group-attributes MAP]")
+	fmt.Println()
 	flag.PrintDefaults()
 }
 
-func main() {
-	flag.Parse()
+// postgresConfig returns the PostgreSQL storage configuration set by the flags
+func postgresConfig() *storage.PostgresStorageConfig {
+	return &storage.PostgresStorageConfig{
+		Host:                *PostgresHost,
+		Port:                *PostgresPort,
+		User:                *PostgresUser,
+		Password:            *PostgresPassword,
+		Database:            *PostgresDatabase,
+		SSLMode:             *PostgresSSLMode,
+		MaxIdleConnections:  *PostgresMaxIdleConnections,
+		MaxOpenConnections:  *PostgresMaxOpenConnections,
+		SessionReapInterval: *SessionCleanupInterval,
+		SkipMigrations:      *PostgresSkipMigrations,
+	}
+}
 
-	if *VersionFlag {
-		version()
-		return
+// ldapConfig returns the LDAP configuration set by the flags
+func ldapConfig() *types.LDAPConfig {
+	return &types.LDAPConfig{
+		Host:                   *LDAPHost,
+		Port:                   *LDAPPort,
+		TLSMode:                *LDAPTLSMode,
+		CACertFile:             *LDAPCACert,
+		ClientCertFile:         *LDAPClientCert,
+		ClientKeyFile:          *LDAPClientKey,
+		TLSServerName:          *LDAPServerName,
+		InsecureSkipVerify:     *LDAPInsecureSkipVerify,
+		RefuseInsecure:         *LDAPRefuseInsecure,
+		BindDN:                 *LDAPBindDN,
+		BindPassword:           *LDAPBindPassword,
+		BaseDN:                 *LDAPBaseDN,
+		UserSearchBaseDN:       *LDAPUserSearchBaseDN,
+		UserSearchFilter:       *LDAPUserSearchFilter,
+		UserSearchScope:        *LDAPUserSearchScope,
+		UserSearchAttributes:   splitList(*LDAPUserSearchAttributes),
+		GroupSearchBaseDN:      *LDAPGroupSearchBaseDN,
+		GroupSearchFilter:      *LDAPGroupSearchFilter,
+		GroupMemberFilter:      *LDAPGroupMemberFilter,
+		GroupSearchScope:       *LDAPGroupSearchScope,
+		GroupSearchAttributes:  splitList(*LDAPGroupSearchAttributes),
+		PageSize:               *LDAPPageSize,
+		PasswordResetAttribute: *LDAPPasswordResetAttribute,
+		Schema: types.LDAPSchema{
+			Profile:                 *LDAPSchema,
+			UserObjectClasses:       splitList(*LDAPUserObjectClasses),
+			UserNamingAttribute:     *LDAPUserNamingAttribute,
+			GroupObjectClasses:      splitList(*LDAPGroupObjectClasses),
+			GroupNamingAttribute:    *LDAPGroupNamingAttribute,
+			MemberAttribute:         *LDAPMemberAttribute,
+			MemberFormat:            *LDAPMemberFormat,
+			EmptyMember:             *LDAPEmptyMember,
+			NestedGroups:            *LDAPNestedGroups,
+			UserPrincipalNameSuffix: *LDAPUserPrincipalNameSuffix,
+		},
+		MaxOpenConnections:    *LDAPMaxOpenConnections,
+		MaxIdleConnections:    *LDAPMaxIdleConnections,
+		ConnectionIdleTimeout: *LDAPIdleTimeout,
+		HealthCheckInterval:   *LDAPHealthCheckInterval,
 	}
+}
 
-	if *HelpFlag {
-		help()
-		return
+// splitList splits a comma separated flag value, dropping empty items
+func splitList(value string) []string {
+	items := []string{}
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
+	}
+	return items
+}
+
+// newLDAPClient creates the LDAP client set by the flags
+func newLDAPClient() *ldapctl.Client {
+	client, err := ldapctl.NewClient(ldapConfig())
+	if err != nil {
+		log.Fatalf("Failed to initialize the LDAP client: %v", err)
+	}
+	return client
+}
+
+// provisioningStorage is the part of a storage backend used to provision
+// LDAP
+type provisioningStorage interface {
+	types.OutboxStorage
+	types.PosixIDStorage
+}
+
+// posixConfig returns the configuration of the POSIX attributes set by the
+// flags, whose numbers are stored in ids
+func posixConfig(ids types.PosixIDStorage) *provision.PosixConfig {
+	return &provision.PosixConfig{
+		IDs:           ids,
+		UIDMin:        *LDAPUIDMin,
+		UIDMax:        *LDAPUIDMax,
+		GIDMin:        *LDAPGIDMin,
+		GIDMax:        *LDAPGIDMax,
+		UserGIDNumber: *LDAPUserGID,
+		HomeDirectory: *LDAPHomeDirectory,
+		LoginShell:    *LDAPLoginShell,
+	}
+}
+
+// openStorage opens the storage selected by the flags, and returns it
+// together with its backend, which stores the outbox and the POSIX numbers.
+// The storage is closed when the returned storage is.
+func openStorage() (types.Storage, provisioningStorage) {
+	deletePolicy, err := storage.ParseDeletePolicy(*DeletePolicy)
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	// Initialize the storage
 	var myStorage types.Storage
-	var err error
+	var backend provisioningStorage
 
 	if *InMemory {
-		inMemoryStorage := storage.NewInMemoryStorage()
+		inMemoryStorage := storage.NewInMemoryStorage(&storage.InMemoryStorageConfig{
+			JanitorInterval: *SessionCleanupInterval,
+			DeletePolicy:    deletePolicy,
+			MaxNestingDepth: *MaxNestingDepth,
+		})
 		myStorage, err = types.NewStorage(inMemoryStorage)
 		if err != nil {
 			log.Fatalf("Failed to initialize the in-memory storage: %v", err)
 		}
+		backend = inMemoryStorage
 	} else if *Postgres {
-		postgresStorage, err = storage.NewPostgresStorage(&storage.PostgresStorageConfig{
-			Host:               *PostgresHost,
-			Port:               *PostgresPort,
-			User:               *PostgresUser,
-			Password:           *PostgresPassword,
-			Database:           *PostgresDatabase,
-			SSLMode:            *PostgresSSLMode,
-			MaxIdleConnections: *PostgresMaxIdleConnections,
-			MaxOpenConnections: *PostgresMaxOpenConnections,
-		})
+		config := postgresConfig()
+		config.DeletePolicy = deletePolicy
+		config.MaxNestingDepth = *MaxNestingDepth
+		postgresStorage, err = storage.NewPostgresStorage(config)
 		if err != nil {
 			log.Fatalf("Failed to initialize the PostgreSQL storage: %v", err)
 		}
@@ -120,149 +449,154 @@ func main() {
 		if err != nil {
 			log.Fatalf("Failed to initialize the PostgreSQL storage: %v", err)
 		}
+		backend = postgresStorage
+	} else if *Redis {
+		redisStorage, err = storage.NewRedisStorage(&storage.RedisStorageConfig{
+			Host:            *RedisHost,
+			Port:            *RedisPort,
+			Password:        *RedisPassword,
+			DB:              *RedisDB,
+			DeletePolicy:    deletePolicy,
+			MaxNestingDepth: *MaxNestingDepth,
+		})
+		if err != nil {
+			log.Fatalf("Failed to initialize the Redis storage: %v", err)
+		}
+		myStorage, err = types.NewStorage(redisStorage)
+		if err != nil {
+			log.Fatalf("Failed to initialize the Redis storage: %v", err)
+		}
+		backend = redisStorage
 	} else {
 		log.Fatal("No storage specified")
 	}
 
-	// Create a new user
-	user := &types.User{
-		ID:       "user1",
-		Username: "johndoe",
-		Email:    "john@example.com",
-		Password: "password",
-	}
-	err = myStorage.CreateUser(user)
-	if err != nil {
-		log.Printf("Failed to create user: %v", err)
-	}
-
-	// Create a new user
-	user2 := &types.User{
-		ID:       "user2",
-		Username: "johndoe2",
-		Email:    "johndoe@example.com",
-	}
-
-	err = myStorage.CreateUser(user2)
-	if err != nil {
-		log.Printf("Failed to create user: %v", err)
-	}
+	return myStorage, backend
+}
 
-	// Get a user by ID
-	u, err := myStorage.GetUserByID("user1")
-	if err != nil {
-		log.Fatalf("Failed to get user by ID: %v", err)
-	}
-	fmt.Println(u)
+func main() {
+	flag.Parse()
 
-	// Get a user by username
-	u, err = myStorage.GetUserByUsername("johndoe")
-	if err != nil {
-		log.Fatalf("Failed to get user by username: %v", err)
+	if *VersionFlag {
+		version()
+		return
 	}
-	fmt.Println(u)
 
-	// Get a user by email
-	u, err = myStorage.GetUserByEmail("john@example.com")
-	if err != nil {
-		log.Fatalf("Failed to get user by email: %v", err)
+	if *HelpFlag {
+		help()
+		return
 	}
-	fmt.Println(u)
 
-	// Update a user
-	user.Email = "john.doe@example.com"
-	err = myStorage.UpdateUser(user)
-	if err != nil {
-		log.Fatalf("Failed to update user: %v", err)
+	if flag.Arg(0) == "migrate" {
+		migrate(flag.Args()[1:])
+		return
 	}
 
-	// Get a user by ID after updating
-	u, err = myStorage.GetUserByID("user1")
-	if err != nil {
-		log.Fatalf("Failed to get user by ID after updating: %v", err)
+	if flag.Arg(0) == "reconcile" {
+		reconcile(flag.Args()[1:])
+		return
 	}
-	fmt.Println(u)
 
-	// Create a new group
-	group := &types.Group{
-		ID:          "group1",
-		Name:        "my-group",
-		Description: "My group description",
-	}
-	err = myStorage.CreateGroup(group)
-	if err != nil {
-		log.Fatalf("Failed to create group: %v", err)
+	if flag.Arg(0) == "import" {
+		importLDAP(flag.Args()[1:])
+		return
 	}
 
-	// Create a new group
-	group2 := &types.Group{
-		ID:   "group2",
-		Name: "Developers",
-	}
-	err = myStorage.CreateGroup(group2)
-	if err != nil {
-		log.Fatalf("Failed to create group: %v", err)
+	metrics := map[string]func() interface{}{}
+	if *LDAPHost != "" {
+		ldapClient = newLDAPClient()
+		defer ldapClient.Close()
+		metrics["ldap_pool"] = func() interface{} { return ldapClient.Stats() }
 	}
 
-	// Get a group by ID
-	g, err := myStorage.GetGroupByID("group1")
-	if err != nil {
-		log.Fatalf("Failed to get group by ID: %v", err)
-	}
-	fmt.Println(g)
+	myStorage, backend := openStorage()
+	defer func() {
+		if err := myStorage.Close(); err != nil {
+			log.Printf("Failed to close the storage: %v", err)
+		}
+	}()
 
-	// Get a group by name
-	g, err = myStorage.GetGroupByName("my-group")
-	if err != nil {
-		log.Fatalf("Failed to get group by name: %v", err)
+	var directory api.Directory
+	if *LDAPProvision {
+		if ldapClient == nil {
+			log.Fatal("LDAP provisioning requires an LDAP host")
+		}
+		worker := provision.NewWorker(&provision.WorkerConfig{
+			Storage:    myStorage,
+			Outbox:     backend,
+			LDAP:       ldapClient,
+			Posix:      posixConfig(backend),
+			Interval:   *LDAPProvisionInterval,
+			MaxBackoff: *LDAPProvisionMaxBackoff,
+		})
+		defer worker.Close()
+		myStorage = provision.NewStorage(&provision.StorageConfig{
+			Storage: myStorage,
+			Notify:  worker.Notify,
+		})
+		metrics["provisioning"] = func() interface{} { return worker.Stats() }
+
+		// Directories that cannot be given the stored hashes are given the
+		// passwords set through the API in cleartext
+		if !ldapClient.AcceptsPasswordHashes() {
+			directory = provision.NewDirectory(&provision.DirectoryConfig{
+				LDAP:  ldapClient,
+				Posix: posixConfig(backend),
+			})
+		}
 	}
-	fmt.Println(g)
 
-	// Update a group
-	group.Description = "My updated group description"
-	err = myStorage.UpdateGroup(group)
-	if err != nil {
-		log.Fatalf("Failed to update group: %v", err)
+	if *Argon2Parallelism > 255 {
+		log.Fatal("The argon2id degree of parallelism must not exceed 255")
 	}
-
-	// Get a group by ID after updating
-	g, err = myStorage.GetGroupByID("group1")
+	hasher, err := password.NewHasher(&password.Config{
+		Algorithm:             *PasswordAlgorithm,
+		BcryptCost:            *BcryptCost,
+		Argon2Memory:          uint32(*Argon2Memory),
+		Argon2Iterations:      uint32(*Argon2Iterations),
+		Argon2Parallelism:     uint8(*Argon2Parallelism),
+		ScryptCost:            *ScryptCost,
+		ScryptBlockSize:       *ScryptBlockSize,
+		ScryptParallelization: *ScryptParallelization,
+		LegacyPlaintext:       *PasswordLegacyPlaintext,
+	})
 	if err != nil {
-		log.Fatalf("Failed to get group by ID after updating: %v", err)
+		log.Fatalf("Failed to initialize the password hasher: %v", err)
 	}
-	fmt.Printf("Updated group: %v\n", g)
 
-	// Assign user1 to group1
-	err = myStorage.AddMemberToGroup(user, group.ID)
-	if err != nil {
-		log.Fatalf("Failed to add %s to %s: %v", user.ID, group.ID, err)
+	server := &http.Server{
+		Addr: *ListenAddress,
+		Handler: api.NewServer(&api.ServerConfig{
+			Storage:          myStorage,
+			Hasher:           hasher,
+			SessionTTL:       *SessionTTL,
+			PasswordResetTTL: *PasswordResetTTL,
+			Directory:        directory,
+			RequestTimeout:   *RequestTimeout,
+			Metrics:          metrics,
+		}),
 	}
 
-	// Assign user2 to group2
-	err = myStorage.AddMemberToGroup(user2, group2.ID)
-	if err != nil {
-		log.Fatalf("Failed to add %s to %s: %v", user2.ID, group2.ID, err)
-	}
+	// Shut down gracefully on SIGINT and SIGTERM
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
 
-	// Assign user2 to group2
-	err = myStorage.AddMemberToGroup(group2, group.ID)
-	if err != nil {
-		log.Fatalf("Failed to add %s to %s: %v", group2.ID, group.ID, err)
-	}
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+		<-signals
 
-	fmt.Println(myStorage)
-	// Delete a user
-	err = myStorage.DeleteUser("user1")
-	if err != nil {
-		log.Fatalf("Failed to delete user: %v", err)
-	}
+		log.Println("Shutting down the server...")
+		ctx, cancel := context.WithTimeout(context.Background(), *ShutdownTimeout)
+		defer cancel()
+		if err := server.Shutdown(ctx); err != nil {
+			log.Printf("Failed to shut down the server gracefully: %v", err)
+		}
+	}()
 
-	// Delete a group
-	err = myStorage.DeleteGroup(group)
-	if err != nil {
-		log.Fatalf("Failed to delete group: %v", err)
+	log.Printf("Listening on %s", *ListenAddress)
+	if err := server.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+		log.Fatalf("Failed to start the server: %v", err)
 	}
-	fmt.Println("Deleted group")
-
-	fmt.Println(myStorage)
+	<-done
 }
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strconv"
+
+	"cum/storage"
+)
+
+// migrate runs the migrate subcommand against the PostgreSQL database set
+// by the -postgres-* flags
+//
+//	cum migrate up         applies all pending migrations
+//	cum migrate down [N]   reverts the last N applied migrations (default 1)
+//	cum migrate status     lists all migrations and whether they are applied
+func migrate(args []string) {
+	if len(args) == 0 {
+		log.Fatal("Usage: cum migrate up|down [N]|status")
+	}
+
+	db, err := storage.OpenPostgres(postgresConfig())
+	if err != nil {
+		log.Fatalf("Failed to open the PostgreSQL database: %v", err)
+	}
+	defer db.Close()
+
+	migrator, err := storage.NewPostgresMigrator(db)
+	if err != nil {
+		log.Fatalf("Failed to load the migrations: %v", err)
+	}
+
+	switch args[0] {
+	case "up":
+		applied, err := migrator.Up(context.Background())
+		for _, migration := range applied {
+			fmt.Printf("Applied %d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatalf("Failed to apply the migrations: %v", err)
+		}
+		if len(applied) == 0 {
+			fmt.Println("No pending migrations")
+		}
+	case "down":
+		steps := 1
+		if len(args) > 1 {
+			steps, err = strconv.Atoi(args[1])
+			if err != nil || steps < 1 {
+				log.Fatalf("Invalid number of migrations to revert: %s", args[1])
+			}
+		}
+		reverted, err := migrator.Down(context.Background(), steps)
+		for _, migration := range reverted {
+			fmt.Printf("Reverted %d_%s\n", migration.Version, migration.Name)
+		}
+		if err != nil {
+			log.Fatalf("Failed to revert the migrations: %v", err)
+		}
+		if len(reverted) == 0 {
+			fmt.Println("No applied migrations")
+		}
+	case "status":
+		statuses, err := migrator.Status(context.Background())
+		if err != nil {
+			log.Fatalf("Failed to get the migration status: %v", err)
+		}
+		for _, status := range statuses {
+			if status.Applied {
+				fmt.Printf("%04d_%s\tapplied at %s\n", status.Version, status.Name, status.AppliedAt.Format("2006-01-02 15:04:05 MST"))
+			} else {
+				fmt.Printf("%04d_%s\tpending\n", status.Version, status.Name)
+			}
+		}
+	default:
+		log.Fatalf("Unknown migrate command %s", args[0])
+	}
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+
+	"cum/provision"
+)
+
+// reconcile runs the reconcile subcommand, which repairs the differences
+// between the storage and the LDAP server set by the flags
+//
+//	cum reconcile            adds the missing LDAP users and groups and sets group members
+//	cum reconcile -dry-run   only prints the changes
+//	cum reconcile -prune     also deletes the LDAP users and groups missing from the storage
+func reconcile(args []string) {
+	flags := flag.NewFlagSet("reconcile", flag.ExitOnError)
+	dryRun := flags.Bool("dry-run", false, "Only print the changes")
+	prune := flags.Bool("prune", false, "Delete the LDAP users and groups missing from the storage")
+	flags.Parse(args)
+
+	if *LDAPHost == "" {
+		log.Fatal("Usage: cum -ldap-host HOST [flags] reconcile [-dry-run] [-prune]")
+	}
+	ldapClient = newLDAPClient()
+	defer ldapClient.Close()
+
+	myStorage, backend := openStorage()
+	defer myStorage.Close()
+
+	report, err := provision.Reconcile(context.Background(), &provision.ReconcileConfig{
+		Storage: myStorage,
+		LDAP:    ldapClient,
+		Posix:   posixConfig(backend),
+		DryRun:  *dryRun,
+		Prune:   *prune,
+	})
+	prefix := ""
+	if *dryRun {
+		prefix = "Would "
+	}
+	for _, change := range report.Changes {
+		fmt.Printf("%s%s\n", prefix, change)
+	}
+	for _, conflict := range report.PosixConflicts {
+		fmt.Printf("Conflicting POSIX number of %s\n", conflict)
+	}
+	for _, change := range report.Unmanaged {
+		fmt.Printf("Skipped %s, use -prune to delete it\n", change)
+	}
+	if err != nil {
+		log.Fatalf("Failed to reconcile: %v", err)
+	}
+	if len(report.Changes) == 0 {
+		fmt.Println("Nothing to change")
+	}
+}
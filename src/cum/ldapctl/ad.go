@@ -0,0 +1,184 @@
+package ldapctl
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf16"
+
+	"cum/types"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ProfileActiveDirectory is the schema profile of Active Directory
+const ProfileActiveDirectory = "activedirectory"
+
+// Flags of the userAccountControl attribute of Active Directory users
+const (
+	uacAccountDisable = 0x2
+	uacNormalAccount  = 0x200
+)
+
+// activeDirectory reports whether the directory is Active Directory
+func (c *Client) activeDirectory() bool {
+	return strings.EqualFold(c.config.Schema.Profile, ProfileActiveDirectory)
+}
+
+// userRDNAttribute returns the attribute naming the entries of added
+// users. Active Directory users are named by their cn, whatever their
+// naming attribute.
+func (c *Client) userRDNAttribute() string {
+	if c.activeDirectory() {
+		return "cn"
+	}
+	return c.config.Schema.UserNamingAttribute
+}
+
+// AcceptsPasswordHashes reports whether the directory verifies passwords
+// against hashes stored in userPassword. Active Directory only accepts
+// cleartext passwords, which it hashes itself.
+func (c *Client) AcceptsPasswordHashes() bool {
+	return !c.activeDirectory()
+}
+
+// passwordAttribute returns the attribute setting the given password: a
+// userPassword, or the unicodePwd of Active Directory, which is only
+// accepted over TLS
+func (c *Client) passwordAttribute(password string) (ldap.Attribute, error) {
+	if !c.activeDirectory() {
+		return ldap.Attribute{Type: "userPassword", Vals: []string{password}}, nil
+	}
+	if c.config.TLSMode == TLSModeNone {
+		return ldap.Attribute{}, fmt.Errorf("%w: Active Directory passwords can only be set over ldaps or starttls", ErrTLSRequired)
+	}
+	return ldap.Attribute{Type: "unicodePwd", Vals: []string{adPassword(password)}}, nil
+}
+
+// adPassword encodes a password as a unicodePwd value: quoted, in UTF-16LE
+func adPassword(password string) string {
+	encoded := utf16.Encode([]rune(`"` + password + `"`))
+	b := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return string(b)
+}
+
+// userPrincipalName returns the userPrincipalName of an Active Directory
+// user, in the configured domain or else the domain of the base DN
+func (c *Client) userPrincipalName(user string) string {
+	suffix := c.config.Schema.UserPrincipalNameSuffix
+	if suffix == "" {
+		suffix = dnDomain(c.config.BaseDN)
+	}
+	return user + "@" + suffix
+}
+
+// dnDomain returns the DNS domain of the dc components of a DN, such as
+// example.com for dc=example,dc=com
+func dnDomain(baseDN string) string {
+	dn, err := ldap.ParseDN(baseDN)
+	if err != nil {
+		return ""
+	}
+	var labels []string
+	for _, rdn := range dn.RDNs {
+		for _, attribute := range rdn.Attributes {
+			if strings.EqualFold(attribute.Type, "dc") {
+				labels = append(labels, attribute.Value)
+			}
+		}
+	}
+	return strings.Join(labels, ".")
+}
+
+// posixObjectClasses returns the object classes of POSIX accounts. Active
+// Directory users hold the POSIX attributes without extra object classes.
+func (c *Client) posixObjectClasses() []string {
+	if c.activeDirectory() {
+		return nil
+	}
+	return posixAccountObjectClasses
+}
+
+// posixAttributes returns the LDAP attributes of a POSIX account. Active
+// Directory names the home directory unixHomeDirectory.
+func (c *Client) posixAttributes(account *PosixAccount) []ldap.Attribute {
+	attributes := account.attributes()
+	if c.activeDirectory() {
+		for i := range attributes {
+			if attributes[i].Type == "homeDirectory" {
+				attributes[i].Type = "unixHomeDirectory"
+			}
+		}
+	}
+	return attributes
+}
+
+// parsePosixAttributes returns the POSIX attributes of a user entry, or
+// nil if it has no uidNumber
+func (c *Client) parsePosixAttributes(entry *ldap.Entry) (*PosixAccount, error) {
+	account, err := parsePosixAccount(entry)
+	if account != nil && c.activeDirectory() {
+		account.HomeDirectory = entry.GetAttributeValue("unixHomeDirectory")
+	}
+	return account, err
+}
+
+// newUserAccountControl returns the userAccountControl of a new Active
+// Directory user: a normal account, disabled until it has a password
+func newUserAccountControl(password string) string {
+	if password == "" {
+		return strconv.Itoa(uacNormalAccount | uacAccountDisable)
+	}
+	return strconv.Itoa(uacNormalAccount)
+}
+
+// UserEnabled reports whether the given Active Directory user is enabled
+func (c *Client) UserEnabled(ctx context.Context, user string) (bool, error) {
+	_, uac, err := c.userAccountControl(ctx, user)
+	if err != nil {
+		return false, err
+	}
+	return uac&uacAccountDisable == 0, nil
+}
+
+// UserSetEnabled enables or disables the given Active Directory user.
+// Active Directory refuses to enable a user without a password when its
+// password policy requires one.
+func (c *Client) UserSetEnabled(ctx context.Context, user string, enabled bool) error {
+	entry, uac, err := c.userAccountControl(ctx, user)
+	if err != nil {
+		return err
+	}
+	if enabled {
+		uac &^= uacAccountDisable
+	} else {
+		uac |= uacAccountDisable
+	}
+
+	modifyRequest := ldap.NewModifyRequest(entry.DN, nil)
+	modifyRequest.Replace("userAccountControl", []string{strconv.FormatInt(uac, 10)})
+
+	return c.modify(ctx, modifyRequest)
+}
+
+// userAccountControl returns the entry and the userAccountControl of an
+// Active Directory user
+func (c *Client) userAccountControl(ctx context.Context, user string) (*ldap.Entry, int64, error) {
+	if !c.activeDirectory() {
+		return nil, 0, fmt.Errorf("%w: enabling and disabling users requires the %s schema profile", types.ErrInvalidArgument, ProfileActiveDirectory)
+	}
+	entry, err := c.lookupEntry(ctx, c.config.UserSearchBaseDN, c.userScope, filterFor(c.config.UserSearchFilter, user), []string{"userAccountControl"})
+	if err != nil {
+		return nil, 0, err
+	}
+	uac, err := strconv.ParseInt(entry.GetAttributeValue("userAccountControl"), 10, 64)
+	if err != nil {
+		return nil, 0, fmt.Errorf("%w: invalid userAccountControl of %s: %v", types.ErrInvalidArgument, entry.DN, err)
+	}
+	return entry, uac, nil
+}
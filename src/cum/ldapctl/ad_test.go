@@ -0,0 +1,212 @@
+package ldapctl
+
+import (
+	"context"
+	"errors"
+	"testing"
+
+	"cum/ldapctl/ldaptest"
+	"cum/types"
+)
+
+// newTestClient returns a client of an LDAP stand-in with the given
+// configuration, and the stand-in
+func newTestClient(t *testing.T, config *types.LDAPConfig) (*Client, *ldaptest.Server) {
+	t.Helper()
+	server := ldaptest.NewServer()
+	if config.BaseDN == "" {
+		config.BaseDN = "dc=example,dc=org"
+	}
+	if config.UserSearchBaseDN == "" {
+		config.UserSearchBaseDN = "ou=people,dc=example,dc=org"
+	}
+	if config.GroupSearchBaseDN == "" {
+		config.GroupSearchBaseDN = "ou=groups,dc=example,dc=org"
+	}
+	c, err := NewClientWithDial(config, server.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { c.Close() })
+	return c, server
+}
+
+// newTestADClient returns a client of an Active Directory stand-in, over
+// TLS so that passwords can be set
+func newTestADClient(t *testing.T) (*Client, *ldaptest.Server) {
+	t.Helper()
+	return newTestClient(t, &types.LDAPConfig{
+		TLSMode: TLSModeLDAPS,
+		Schema:  types.LDAPSchema{Profile: ProfileActiveDirectory},
+	})
+}
+
+func TestADPassword(t *testing.T) {
+	tests := []struct {
+		password string
+		want     []byte
+	}{
+		{"", []byte{'"', 0, '"', 0}},
+		{"ab1", []byte{'"', 0, 'a', 0, 'b', 0, '1', 0, '"', 0}},
+		{"é€", []byte{'"', 0, 0xe9, 0x00, 0xac, 0x20, '"', 0}},
+		// Characters outside the BMP are surrogate pairs
+		{"𝄞", []byte{'"', 0, 0x34, 0xd8, 0x1e, 0xdd, '"', 0}},
+		{`a"b`, []byte{'"', 0, 'a', 0, '"', 0, 'b', 0, '"', 0}},
+	}
+	for _, tt := range tests {
+		if got := adPassword(tt.password); got != string(tt.want) {
+			t.Errorf("adPassword(%q) = % x, want % x", tt.password, got, tt.want)
+		}
+	}
+}
+
+func TestNewUserAccountControl(t *testing.T) {
+	if got := newUserAccountControl(""); got != "514" {
+		t.Errorf("without a password: got %s, want 514, a disabled normal account", got)
+	}
+	if got := newUserAccountControl("secret"); got != "512" {
+		t.Errorf("with a password: got %s, want 512, a normal account", got)
+	}
+}
+
+func TestADUserAdd(t *testing.T) {
+	ctx := context.Background()
+	c, server := newTestADClient(t)
+
+	if err := c.UserAdd(ctx, "alice", "sécret", nil); err != nil {
+		t.Fatal(err)
+	}
+	entry := server.Entry("cn=alice,ou=people,dc=example,dc=org")
+	if entry == nil {
+		t.Fatal("the user was not added under its cn")
+	}
+	if got := entry.GetAttributeValue("sAMAccountName"); got != "alice" {
+		t.Errorf("got sAMAccountName %q, want alice", got)
+	}
+	if got := entry.GetAttributeValue("userPrincipalName"); got != "alice@example.org" {
+		t.Errorf("got userPrincipalName %q, want alice@example.org", got)
+	}
+	if got := entry.GetAttributeValue("unicodePwd"); got != adPassword("sécret") {
+		t.Errorf("got unicodePwd % x, want % x", got, adPassword("sécret"))
+	}
+	if got := entry.GetAttributeValue("userPassword"); got != "" {
+		t.Errorf("got userPassword %q, want none", got)
+	}
+	if got := entry.GetAttributeValue("userAccountControl"); got != "512" {
+		t.Errorf("got userAccountControl %s, want 512", got)
+	}
+	if enabled, err := c.UserEnabled(ctx, "alice"); err != nil || !enabled {
+		t.Errorf("a user added with a password is not enabled: %v", err)
+	}
+
+	if err := c.UserAdd(ctx, "bob", "", nil); err != nil {
+		t.Fatal(err)
+	}
+	entry = server.Entry("cn=bob,ou=people,dc=example,dc=org")
+	if got := entry.GetAttributeValue("userAccountControl"); got != "514" {
+		t.Errorf("got userAccountControl %s without a password, want 514", got)
+	}
+	if got := entry.GetAttributeValue("unicodePwd"); got != "" {
+		t.Errorf("got a unicodePwd without a password")
+	}
+	if enabled, err := c.UserEnabled(ctx, "bob"); err != nil || enabled {
+		t.Errorf("a user added without a password is enabled: %v", err)
+	}
+}
+
+func TestADUserSetEnabled(t *testing.T) {
+	ctx := context.Background()
+	c, server := newTestADClient(t)
+	dn := "cn=alice,ou=people,dc=example,dc=org"
+
+	// A normal account whose password never expires
+	err := server.AddEntry(dn, map[string][]string{
+		"objectClass":        {"top", "person", "organizationalPerson", "user"},
+		"cn":                 {"alice"},
+		"sAMAccountName":     {"alice"},
+		"userAccountControl": {"66048"},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Other flags are kept, and setting the current state changes nothing
+	for _, tt := range []struct {
+		enabled bool
+		want    string
+	}{
+		{false, "66050"},
+		{false, "66050"},
+		{true, "66048"},
+		{true, "66048"},
+	} {
+		if err := c.UserSetEnabled(ctx, "alice", tt.enabled); err != nil {
+			t.Fatal(err)
+		}
+		if got := server.Entry(dn).GetAttributeValue("userAccountControl"); got != tt.want {
+			t.Errorf("enabled %v: got userAccountControl %s, want %s", tt.enabled, got, tt.want)
+		}
+		if enabled, err := c.UserEnabled(ctx, "alice"); err != nil || enabled != tt.enabled {
+			t.Errorf("UserEnabled = %v, %v, want %v", enabled, err, tt.enabled)
+		}
+	}
+
+	if err := c.UserSetEnabled(ctx, "nobody", true); !errors.Is(err, types.ErrNotFound) {
+		t.Errorf("enabling a missing user returned %v, want ErrNotFound", err)
+	}
+
+	if err := server.AddEntry("cn=bob,ou=people,dc=example,dc=org", map[string][]string{
+		"objectClass":        {"user"},
+		"sAMAccountName":     {"bob"},
+		"userAccountControl": {"not a number"},
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := c.UserEnabled(ctx, "bob"); !errors.Is(err, types.ErrInvalidArgument) {
+		t.Errorf("an invalid userAccountControl returned %v, want ErrInvalidArgument", err)
+	}
+}
+
+func TestADPasswords(t *testing.T) {
+	ctx := context.Background()
+	c, server := newTestADClient(t)
+	if err := c.UserAdd(ctx, "alice", "first", nil); err != nil {
+		t.Fatal(err)
+	}
+	dn := "cn=alice,ou=people,dc=example,dc=org"
+
+	if err := c.UserPasswordReset(ctx, "alice", "one-time"); err != nil {
+		t.Fatal(err)
+	}
+	entry := server.Entry(dn)
+	if entry.GetAttributeValue("unicodePwd") != adPassword("one-time") || entry.GetAttributeValue("pwdLastSet") != "0" {
+		t.Errorf("a reset set unicodePwd % x and pwdLastSet %q, want the new password and 0", entry.GetAttributeValue("unicodePwd"), entry.GetAttributeValue("pwdLastSet"))
+	}
+
+	if err := c.UserPasswordChange(ctx, "alice", "changed"); err != nil {
+		t.Fatal(err)
+	}
+	entry = server.Entry(dn)
+	if entry.GetAttributeValue("unicodePwd") != adPassword("changed") || entry.GetAttributeValue("pwdLastSet") != "-1" {
+		t.Errorf("a change set unicodePwd % x and pwdLastSet %q, want the new password and -1", entry.GetAttributeValue("unicodePwd"), entry.GetAttributeValue("pwdLastSet"))
+	}
+
+	// Active Directory only accepts passwords over TLS
+	plain, _ := newTestClient(t, &types.LDAPConfig{Schema: types.LDAPSchema{Profile: ProfileActiveDirectory}})
+	if err := plain.UserAdd(ctx, "bob", "secret", nil); !errors.Is(err, ErrTLSRequired) {
+		t.Errorf("adding a user with a password without TLS returned %v, want ErrTLSRequired", err)
+	}
+	if c.AcceptsPasswordHashes() {
+		t.Error("Active Directory accepts password hashes")
+	}
+}
+
+func TestUserEnabledRequiresActiveDirectory(t *testing.T) {
+	c, _ := newTestClient(t, &types.LDAPConfig{})
+	if _, err := c.UserEnabled(context.Background(), "alice"); !errors.Is(err, types.ErrInvalidArgument) {
+		t.Errorf("got %v, want ErrInvalidArgument", err)
+	}
+	if err := c.UserSetEnabled(context.Background(), "alice", true); !errors.Is(err, types.ErrInvalidArgument) {
+		t.Errorf("got %v, want ErrInvalidArgument", err)
+	}
+}
@@ -0,0 +1,38 @@
+package ldapctl
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// entryDN returns the DN of the entry named by the given attribute value
+// under baseDN, escaping the value as described in RFC 4514
+func entryDN(attribute string, value string, baseDN string) string {
+	return attribute + "=" + ldap.EscapeDN(value) + "," + baseDN
+}
+
+// filterFor replaces every %s of a configured filter with value, escaped
+// as described in RFC 4515
+func filterFor(format string, value string) string {
+	return strings.ReplaceAll(format, "%s", ldap.EscapeFilter(value))
+}
+
+// filterForAny replaces every %s of a configured filter with a wildcard,
+// matching every entry the filter is meant for
+func filterForAny(format string) string {
+	return strings.ReplaceAll(format, "%s", "*")
+}
+
+// checkFilter returns an error if a configured filter does not take a
+// value, or is not a valid filter once it is filled
+func checkFilter(name string, format string) error {
+	if !strings.Contains(format, "%s") {
+		return fmt.Errorf("LDAP %s %q has no %%s for the searched value", name, format)
+	}
+	if _, err := ldap.CompileFilter(filterFor(format, "value")); err != nil {
+		return fmt.Errorf("invalid LDAP %s %q: %v", name, format, err)
+	}
+	return nil
+}
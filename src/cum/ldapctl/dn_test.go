@@ -0,0 +1,163 @@
+package ldapctl
+
+import (
+	"reflect"
+	"testing"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// injections are values trying to change the meaning of a DN or filter
+var injections = []string{
+	"*",
+	"a*",
+	")(",
+	"alice)(uid=*",
+	"alice)(|(objectClass=*)",
+	"\x00",
+	"alice\x00",
+	`\00`,
+	`\2a`,
+	",",
+	"alice,ou=admins",
+	"+",
+	"alice+uid=root",
+	"#",
+	"#616c696365",
+	" alice ",
+	`"alice"`,
+	"<alice>;",
+	"\\",
+	"élise",
+}
+
+func TestEntryDN(t *testing.T) {
+	tests := []struct {
+		value string
+		want  string
+	}{
+		{"alice", "cn=alice,ou=people,dc=example,dc=org"},
+		{"*", "cn=*,ou=people,dc=example,dc=org"},
+		{"\x00", `cn=\00,ou=people,dc=example,dc=org`},
+		{"alice,ou=admins", `cn=alice\,ou=admins,ou=people,dc=example,dc=org`},
+		{"alice+uid=root", `cn=alice\+uid=root,ou=people,dc=example,dc=org`},
+		{"#616c696365", `cn=\#616c696365,ou=people,dc=example,dc=org`},
+		{"a#b", "cn=a#b,ou=people,dc=example,dc=org"},
+		{" alice ", `cn=\ alice\ ,ou=people,dc=example,dc=org`},
+		{`a\b`, `cn=a\\b,ou=people,dc=example,dc=org`},
+	}
+	for _, tt := range tests {
+		if got := entryDN("cn", tt.value, "ou=people,dc=example,dc=org"); got != tt.want {
+			t.Errorf("entryDN(%q) = %q, want %q", tt.value, got, tt.want)
+		}
+	}
+}
+
+// TestEntryDNInjections checks that every value stays a single attribute
+// value of the first RDN, under the base DN
+func TestEntryDNInjections(t *testing.T) {
+	base, err := ldap.ParseDN("ou=people,dc=example,dc=org")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, value := range injections {
+		dn, err := ldap.ParseDN(entryDN("cn", value, "ou=people,dc=example,dc=org"))
+		if err != nil {
+			t.Errorf("%q: %v", value, err)
+			continue
+		}
+		if len(dn.RDNs) != len(base.RDNs)+1 {
+			t.Errorf("%q: got %d RDNs, want %d", value, len(dn.RDNs), len(base.RDNs)+1)
+			continue
+		}
+		attributes := dn.RDNs[0].Attributes
+		if len(attributes) != 1 || attributes[0].Type != "cn" || attributes[0].Value != value {
+			t.Errorf("%q: got first RDN %v, want cn=%q alone", value, attributes, value)
+		}
+		if !(&ldap.DN{RDNs: dn.RDNs[1:]}).Equal(base) {
+			t.Errorf("%q: the DN is not under the base DN", value)
+		}
+	}
+}
+
+// equalityMatches returns the attribute and value of every equality match
+// of a compiled filter made of AND, OR and equality matches only
+func equalityMatches(t *testing.T, packet *ber.Packet) [][2]string {
+	t.Helper()
+	switch packet.Tag {
+	case ldap.FilterAnd, ldap.FilterOr:
+		var matches [][2]string
+		for _, child := range packet.Children {
+			matches = append(matches, equalityMatches(t, child)...)
+		}
+		return matches
+	case ldap.FilterEqualityMatch:
+		return [][2]string{{packet.Children[0].Value.(string), packet.Children[1].Value.(string)}}
+	}
+	t.Fatalf("got a %s filter, want only equality matches", ldap.FilterMap[uint64(packet.Tag)])
+	return nil
+}
+
+func TestFilterForInjections(t *testing.T) {
+	for _, value := range injections {
+		filter := filterFor("(&(objectClass=person)(uid=%s))", value)
+		packet, err := ldap.CompileFilter(filter)
+		if err != nil {
+			t.Errorf("%q: %v", value, err)
+			continue
+		}
+		got := equalityMatches(t, packet)
+		want := [][2]string{{"objectClass", "person"}, {"uid", value}}
+		if !reflect.DeepEqual(got, want) {
+			t.Errorf("%q: filter %s matches %v, want %v", value, filter, got, want)
+		}
+	}
+}
+
+func TestFilterFor(t *testing.T) {
+	tests := []struct {
+		format string
+		value  string
+		want   string
+	}{
+		{"(uid=%s)", "alice", "(uid=alice)"},
+		{"(uid=%s)", "*", `(uid=\2a)`},
+		{"(uid=%s)", ")(", `(uid=\29\28)`},
+		{"(uid=%s)", "\x00", `(uid=\00)`},
+		{"(uid=%s)", `\00`, `(uid=\5c00)`},
+		{"(uid=%s)", "a,b+c", "(uid=a,b+c)"},
+		{"(uid=%s)", "#a", "(uid=#a)"},
+		{"(|(uid=%s)(mail=%s))", "x)(", `(|(uid=x\29\28)(mail=x\29\28))`},
+		{"(&(cn=%s)(description=100%))", "a", "(&(cn=a)(description=100%))"},
+	}
+	for _, tt := range tests {
+		if got := filterFor(tt.format, tt.value); got != tt.want {
+			t.Errorf("filterFor(%q, %q) = %q, want %q", tt.format, tt.value, got, tt.want)
+		}
+	}
+
+	if got, want := filterForAny("(|(uid=%s)(mail=%s))"), "(|(uid=*)(mail=*))"; got != want {
+		t.Errorf("filterForAny = %q, want %q", got, want)
+	}
+}
+
+func TestCheckFilter(t *testing.T) {
+	tests := []struct {
+		format string
+		valid  bool
+	}{
+		{"(uid=%s)", true},
+		{"(|(uid=%s)(mail=%s))", true},
+		{"(uid=alice)", false},
+		{"(uid=%s", false},
+		{"uid=%s", false},
+		{"(uid=%d)", false},
+	}
+	for _, tt := range tests {
+		if err := checkFilter("user search filter", tt.format); (err == nil) != tt.valid {
+			t.Errorf("checkFilter(%q) = %v, want valid %v", tt.format, err, tt.valid)
+		}
+	}
+}
@@ -0,0 +1,127 @@
+package ldapctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"cum/types"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+var (
+	// ErrInvalidCredentials is returned when a bind is refused because of
+	// a wrong DN or password
+	ErrInvalidCredentials = errors.New("invalid credentials")
+
+	// ErrPermissionDenied is returned when the bound DN is not allowed to
+	// perform an operation
+	ErrPermissionDenied = errors.New("permission denied")
+
+	// ErrTLSRequired is returned when an operation sending a cleartext
+	// password, such as setting an Active Directory password, is made on
+	// a connection without TLS
+	ErrTLSRequired = errors.New("TLS required")
+)
+
+// Error is an error returned by an LDAP operation. It matches the error of
+// the types package or of this package corresponding to its result code
+// with errors.Is, and the underlying *ldap.Error with errors.As.
+type Error struct {
+	// Op is the failed operation: dial, bind, search, add, modify or delete
+	Op string
+	// DN is the DN the operation was made on, if any
+	DN string
+	// Code is the LDAP result code, or 0 if the error is not an LDAP result
+	Code uint16
+	// Kind is the error matching Code, or nil if there is none
+	Kind error
+	// Err is the underlying error
+	Err error
+}
+
+// Error returns the error message
+func (e *Error) Error() string {
+	msg := "ldap " + e.Op
+	if e.DN != "" {
+		msg += " " + e.DN
+	}
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	return fmt.Sprintf("%s: %v", msg, e.Err)
+}
+
+// Unwrap returns the underlying error
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether the kind of the error is target
+func (e *Error) Is(target error) bool {
+	return e.Kind != nil && e.Kind == target
+}
+
+// newError wraps an error returned by an LDAP operation. Errors caused by
+// the cancellation of ctx are reported as such, as the operation then
+// fails with a closed connection.
+func newError(ctx context.Context, op string, dn string, err error) error {
+	e := &Error{Op: op, DN: dn, Err: err}
+
+	var ldapErr *ldap.Error
+	if errors.As(err, &ldapErr) {
+		e.Code = ldapErr.ResultCode
+		e.Kind = resultKind(ldapErr.ResultCode)
+	}
+	if ctxErr := ctx.Err(); ctxErr != nil {
+		e.Kind = ctxErr
+	}
+
+	return e
+}
+
+// notFoundError returns the error of a search from baseDN expected to find
+// an entry matching filter and finding none
+func notFoundError(baseDN string, filter string) error {
+	return &Error{Op: "search", DN: baseDN, Kind: types.ErrNotFound, Err: fmt.Errorf("no entry matches %s", filter)}
+}
+
+// ambiguousError returns the error of a search from baseDN expected to
+// find a single entry matching filter and finding several
+func ambiguousError(baseDN string, filter string) error {
+	return &Error{Op: "search", DN: baseDN, Kind: types.ErrConflict, Err: fmt.Errorf("several entries match %s", filter)}
+}
+
+// resultKind returns the error matching an LDAP result code, or nil if
+// there is none
+func resultKind(code uint16) error {
+	switch code {
+	case ldap.LDAPResultNoSuchObject, ldap.LDAPResultNoSuchAttribute:
+		return types.ErrNotFound
+	case ldap.LDAPResultEntryAlreadyExists:
+		return types.ErrAlreadyExists
+	case ldap.LDAPResultAttributeOrValueExists, ldap.LDAPResultConstraintViolation,
+		ldap.LDAPResultNotAllowedOnNonLeaf:
+		return types.ErrConflict
+	case ldap.LDAPResultInvalidCredentials, ldap.LDAPResultInappropriateAuthentication,
+		ldap.ErrorEmptyPassword:
+		return ErrInvalidCredentials
+	case ldap.LDAPResultInsufficientAccessRights, ldap.LDAPResultAuthorizationDenied,
+		ldap.LDAPResultStrongAuthRequired, ldap.LDAPResultConfidentialityRequired,
+		ldap.LDAPResultUnwillingToPerform:
+		return ErrPermissionDenied
+	case ldap.LDAPResultInvalidDNSyntax, ldap.LDAPResultInvalidAttributeSyntax,
+		ldap.LDAPResultUndefinedAttributeType, ldap.LDAPResultObjectClassViolation,
+		ldap.LDAPResultNamingViolation, ldap.LDAPResultNotAllowedOnRDN,
+		ldap.LDAPResultObjectClassModsProhibited, ldap.LDAPResultFilterError,
+		ldap.ErrorFilterCompile:
+		return types.ErrInvalidArgument
+	case ldap.LDAPResultBusy, ldap.LDAPResultUnavailable, ldap.LDAPResultServerDown,
+		ldap.LDAPResultConnectError, ldap.LDAPResultTimeout, ldap.ErrorNetwork:
+		return types.ErrBackendUnavailable
+	case ldap.LDAPResultTimeLimitExceeded:
+		return context.DeadlineExceeded
+	}
+	return nil
+}
@@ -6,555 +6,768 @@ package ldapctl
 // It is also used to add and remove users from groups
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"net"
+	"strconv"
+
+	"cum/types"
 
 	"github.com/go-ldap/ldap/v3"
 )
 
-// LDAP server connection
-var l *ldap.Conn
+// Client manages the users and groups of an LDAP server. Operations take
+// a bound connection from a pool, so a Client is safe for concurrent use.
+type Client struct {
+	config     types.LDAPConfig
+	userScope  int
+	groupScope int
+	tlsConfig  *tls.Config
+	pool       *pool
+}
 
-// LDAP server connection error
-var err error
+// DialFunc opens a new bound connection to an LDAP server, giving up at
+// the deadline of ctx
+type DialFunc func(ctx context.Context) (ldap.Client, error)
 
-// LDAP server address
-var ldapServer string
+// NewClient creates a new Client from the given configuration. Missing
+// settings are set to their defaults.
+func NewClient(config *types.LDAPConfig) (*Client, error) {
+	if config.Host == "" {
+		return nil, errors.New("LDAP host is required")
+	}
+	return newClient(config, nil)
+}
 
-// LDAP server port
-var ldapPort string
+// NewClientWithDial creates a new Client opening its connections with dial
+// rather than to the configured host, such as to a stand-in of the server
+// in tests. The TLS and bind settings only apply to UserCheck, which binds
+// again as the client after checking a password.
+func NewClientWithDial(config *types.LDAPConfig, dial DialFunc) (*Client, error) {
+	return newClient(config, dial)
+}
 
-// LDAP server base DN
-var ldapBaseDN string
+// newClient creates a new Client opening its connections with dial, or to
+// the configured host if dial is nil
+func newClient(config *types.LDAPConfig, dial DialFunc) (*Client, error) {
+	c := &Client{config: *config}
+	if c.config.TLSMode == "" {
+		c.config.TLSMode = TLSModeNone
+	}
+	if c.config.Port == 0 {
+		c.config.Port = 389
+		if c.config.TLSMode == TLSModeLDAPS {
+			c.config.Port = 636
+		}
+	}
+	if c.config.UserSearchBaseDN == "" {
+		c.config.UserSearchBaseDN = c.config.BaseDN
+	}
+	if c.config.GroupSearchBaseDN == "" {
+		c.config.GroupSearchBaseDN = c.config.BaseDN
+	}
 
-// LDAP server bind DN
-var ldapBindDN string
+	var err error
+	if c.config.Schema, err = resolveSchema(c.config.Schema); err != nil {
+		return nil, err
+	}
+	schema := c.config.Schema
+	userClass := schema.UserObjectClasses[len(schema.UserObjectClasses)-1]
+	groupClass := schema.GroupObjectClasses[len(schema.GroupObjectClasses)-1]
+	if c.config.UserSearchFilter == "" {
+		c.config.UserSearchFilter = fmt.Sprintf("(&(objectClass=%s)(%s=%%s))", userClass, schema.UserNamingAttribute)
+	}
+	if c.config.GroupSearchFilter == "" {
+		c.config.GroupSearchFilter = fmt.Sprintf("(&(objectClass=%s)(%s=%%s))", groupClass, schema.GroupNamingAttribute)
+	}
+	if c.config.GroupMemberFilter == "" {
+		c.config.GroupMemberFilter = fmt.Sprintf("(&(objectClass=%s)(%s=%%s))", groupClass, schema.MemberAttribute)
+	}
+	for _, filter := range []struct{ name, format string }{
+		{"user search filter", c.config.UserSearchFilter},
+		{"group search filter", c.config.GroupSearchFilter},
+		{"group member filter", c.config.GroupMemberFilter},
+	} {
+		if err := checkFilter(filter.name, filter.format); err != nil {
+			return nil, err
+		}
+	}
+	if len(c.config.UserSearchAttributes) == 0 {
+		c.config.UserSearchAttributes = appendMissing([]string{schema.UserNamingAttribute}, "cn", "sn", "mail")
+	}
+	if len(c.config.GroupSearchAttributes) == 0 {
+		c.config.GroupSearchAttributes = []string{schema.GroupNamingAttribute}
+		if c.posixGroups() {
+			c.config.GroupSearchAttributes = append(c.config.GroupSearchAttributes, "gidNumber")
+		}
+		c.config.GroupSearchAttributes = appendMissing(c.config.GroupSearchAttributes, schema.MemberAttribute)
+	}
+	if c.config.PageSize == 0 {
+		c.config.PageSize = defaultPageSize
+	}
+	if c.config.MaxOpenConnections <= 0 {
+		c.config.MaxOpenConnections = 10
+	}
+	if c.config.MaxIdleConnections <= 0 || c.config.MaxIdleConnections > c.config.MaxOpenConnections {
+		c.config.MaxIdleConnections = c.config.MaxOpenConnections
+	}
 
-// LDAP server bind password
-var ldapBindPassword string
+	if c.config.PasswordResetAttribute, err = checkPasswordResetAttribute(c.config.PasswordResetAttribute); err != nil {
+		return nil, err
+	}
+	if c.tlsConfig, err = tlsConfig(&c.config); err != nil {
+		return nil, err
+	}
+	if c.userScope, err = parseScope(c.config.UserSearchScope); err != nil {
+		return nil, err
+	}
+	if c.groupScope, err = parseScope(c.config.GroupSearchScope); err != nil {
+		return nil, err
+	}
 
-// LDAP server user search filter
-var ldapUserSearchFilter string
+	if dial == nil {
+		dial = c.dial
+	}
+	c.pool = newPool(
+		dial,
+		c.config.MaxOpenConnections,
+		c.config.MaxIdleConnections,
+		c.config.ConnectionIdleTimeout,
+		c.config.HealthCheckInterval,
+	)
 
-// LDAP server group search filter
-var ldapGroupSearchFilter string
+	return c, nil
+}
 
-// LDAP server user search base DN
-var ldapUserSearchBaseDN string
+// Stats returns the usage statistics of the connection pool
+func (c *Client) Stats() PoolStats {
+	return c.pool.Stats()
+}
 
-// LDAP server group search base DN
-var ldapGroupSearchBaseDN string
+// Schema returns the schema of the directory, with the settings taken
+// from its profile
+func (c *Client) Schema() types.LDAPSchema {
+	return c.config.Schema
+}
 
-// LDAP server user search scope
-var ldapUserSearchScope string
+// Close closes the connections of the client
+func (c *Client) Close() error {
+	c.pool.Close()
+	return nil
+}
 
-// LDAP server group search scope
-var ldapGroupSearchScope string
+// parseScope converts a search scope name to its LDAP value
+func parseScope(scope string) (int, error) {
+	switch scope {
+	case "base":
+		return ldap.ScopeBaseObject, nil
+	case "one":
+		return ldap.ScopeSingleLevel, nil
+	case "", "sub":
+		return ldap.ScopeWholeSubtree, nil
+	default:
+		return 0, fmt.Errorf("unknown LDAP search scope %q, expected base, one or sub", scope)
+	}
+}
 
-// LDAP server user search attributes
-var ldapUserSearchAttributes string
+// dial opens a new connection to the LDAP server, secures it as set by
+// the TLS mode and binds it. Dialing gives up at the deadline of ctx.
+func (c *Client) dial(ctx context.Context) (ldap.Client, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, newError(ctx, "dial", "", err)
+	}
 
-// LDAP server group search attributes
-var ldapGroupSearchAttributes string
+	// Connect to LDAP server
+	dialer := &net.Dialer{}
+	if deadline, ok := ctx.Deadline(); ok {
+		dialer.Deadline = deadline
+	}
+	addr := net.JoinHostPort(c.config.Host, strconv.Itoa(c.config.Port))
+	var l *ldap.Conn
+	var err error
+	if c.config.TLSMode == TLSModeLDAPS {
+		l, err = ldap.DialURL("ldaps://"+addr, ldap.DialWithDialer(dialer), ldap.DialWithTLSConfig(c.tlsConfig))
+	} else {
+		l, err = ldap.DialURL("ldap://"+addr, ldap.DialWithDialer(dialer))
+	}
+	if err != nil {
+		return nil, newError(ctx, "dial", "", err)
+	}
 
-// LDAP server user search attributes
-var ldapUserSearchAttributesArray []string
+	release := guard(ctx, l)
+	defer release()
 
-// LDAP server group search attributes
-var ldapGroupSearchAttributesArray []string
+	// Upgrade the connection before sending any credentials
+	if c.config.TLSMode == TLSModeStartTLS {
+		if err := l.StartTLS(c.tlsConfig.Clone()); err != nil {
+			l.Close()
+			return nil, newError(ctx, "starttls", "", err)
+		}
+	}
 
-// LDAP server user search scope
-var ldapUserSearchScopeInt int
+	// Bind to LDAP server
+	if err := c.bind(l); err != nil {
+		l.Close()
+		return nil, newError(ctx, "bind", c.config.BindDN, err)
+	}
 
-// LDAP server group search scope
-var ldapGroupSearchScopeInt int
+	return l, nil
+}
 
-const (
-	ldapUserDefaultPassword = "Cumulus"
-)
+// bind binds a connection with the credentials of the client. Without a
+// bind DN, it binds with the client certificate (SASL EXTERNAL) when there
+// is one, and anonymously otherwise.
+func (c *Client) bind(l ldap.Client) error {
+	switch {
+	case c.config.BindDN != "":
+		return l.Bind(c.config.BindDN, c.config.BindPassword)
+	case c.tlsConfig != nil && len(c.tlsConfig.Certificates) > 0:
+		return l.ExternalBind()
+	default:
+		return l.UnauthenticatedBind("")
+	}
+}
 
-// LDAP server connection
-func ldapConnect() {
-	// Connect to LDAP server
-	l, err = ldap.Dial("tcp", ldapServer+":"+ldapPort)
+// do runs fn on a connection of the pool. Requests made by fn give up at
+// the deadline of ctx. When a reused connection turns out to be broken,
+// as after a server restart, fn is run again on another connection.
+func (c *Client) do(ctx context.Context, op string, dn string, fn func(l ldap.Client) error) error {
+	for {
+		pc, err := c.pool.get(ctx)
+		if err != nil {
+			var ldapErr *Error
+			if errors.As(err, &ldapErr) {
+				return err
+			}
+			return newError(ctx, op, dn, err)
+		}
+
+		release := guard(ctx, pc.conn)
+		err = fn(pc.conn)
+		release()
+
+		broken := err != nil && isConnectionError(err)
+		if broken && pc.reused && ctx.Err() == nil {
+			c.pool.put(pc, false)
+			continue
+		}
+		c.pool.put(pc, !broken)
+
+		if err != nil {
+			return newError(ctx, op, dn, err)
+		}
+		return nil
+	}
+}
+
+// lookup returns the DN of the only entry matching filter, searched from
+// baseDN with the given scope
+func (c *Client) lookup(ctx context.Context, baseDN string, scope int, filter string) (string, error) {
+	entry, err := c.lookupEntry(ctx, baseDN, scope, filter, []string{"1.1"})
 	if err != nil {
-		log.Fatal(err)
+		return "", err
 	}
+	return entry.DN, nil
+}
 
-	// Bind to LDAP server
-	err = l.Bind(ldapBindDN, ldapBindPassword)
+// lookupEntry returns the only entry matching filter with the given
+// attributes, searched from baseDN with the given scope
+func (c *Client) lookupEntry(ctx context.Context, baseDN string, scope int, filter string, attributes []string) (*ldap.Entry, error) {
+	sr, err := c.search(ctx, ldap.NewSearchRequest(
+		baseDN,
+		scope,
+		ldap.NeverDerefAliases,
+		2,
+		0,
+		false,
+		filter,
+		attributes,
+		nil,
+	))
+	var ldapErr *Error
+	if errors.As(err, &ldapErr) && ldapErr.Code == ldap.LDAPResultSizeLimitExceeded {
+		return nil, ambiguousError(baseDN, filter)
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
+	}
+
+	switch len(sr.Entries) {
+	case 0:
+		return nil, notFoundError(baseDN, filter)
+	case 1:
+		return sr.Entries[0], nil
+	default:
+		return nil, ambiguousError(baseDN, filter)
 	}
 }
 
-// LDAP server disconnection
-func ldapDisconnect() {
-	l.Close()
+// userDN returns the DN of the given user, as found by the user filter
+func (c *Client) userDN(ctx context.Context, user string) (string, error) {
+	return c.lookup(ctx, c.config.UserSearchBaseDN, c.userScope, filterFor(c.config.UserSearchFilter, user))
 }
 
-// LDAP server user search
-func ldapUserSearch(user string) *ldap.SearchResult {
-	// Connect to LDAP server
-	ldapConnect()
+// groupDN returns the DN of the given group, as found by the group filter
+func (c *Client) groupDN(ctx context.Context, group string) (string, error) {
+	return c.lookup(ctx, c.config.GroupSearchBaseDN, c.groupScope, filterFor(c.config.GroupSearchFilter, group))
+}
+
+// search runs a search request and returns its result. Searches without
+// a size limit are paged when a page size is set.
+func (c *Client) search(ctx context.Context, request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	entries, err := c.stream(ctx, request, "").collect()
+	if err != nil {
+		return nil, err
+	}
+	return &ldap.SearchResult{Entries: entries}, nil
+}
 
-	// Search for the given user
-	searchRequest := ldap.NewSearchRequest(
-		ldapUserSearchBaseDN,
-		ldapUserSearchScopeInt,
+// userSearchRequest returns the request searching the users matching the
+// filter, returning the given attributes
+func (c *Client) userSearchRequest(filter string, attributes []string) *ldap.SearchRequest {
+	return ldap.NewSearchRequest(
+		c.config.UserSearchBaseDN,
+		c.userScope,
 		ldap.NeverDerefAliases,
 		0,
 		0,
 		false,
-		fmt.Sprintf(ldapUserSearchFilter, user),
-		ldapUserSearchAttributesArray,
+		filter,
+		attributes,
 		nil,
 	)
-
-	sr, err := l.Search(searchRequest)
-	if err != nil {
-		log.Fatal(err)
-	}
-
-	// Disconnect from LDAP server
-	ldapDisconnect()
-
-	return sr
 }
 
-// LDAP server group search
-func ldapGroupSearch(group string) *ldap.SearchResult {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// Search for the given group
-	searchRequest := ldap.NewSearchRequest(
-		ldapGroupSearchBaseDN,
-		ldapGroupSearchScopeInt,
+// groupSearchRequest returns the request searching the groups matching
+// the filter under the given base DN, returning the given attributes
+func (c *Client) groupSearchRequest(baseDN string, filter string, attributes []string) *ldap.SearchRequest {
+	return ldap.NewSearchRequest(
+		baseDN,
+		c.groupScope,
 		ldap.NeverDerefAliases,
 		0,
 		0,
 		false,
-		fmt.Sprintf(ldapGroupSearchFilter, group),
-		ldapGroupSearchAttributesArray,
+		filter,
+		attributes,
 		nil,
 	)
+}
 
-	sr, err := l.Search(searchRequest)
-	if err != nil {
-		log.Fatal(err)
-	}
+// searchUsers searches the users matching the filter, returning the given
+// attributes
+func (c *Client) searchUsers(ctx context.Context, filter string, attributes []string) (*ldap.SearchResult, error) {
+	return c.search(ctx, c.userSearchRequest(filter, attributes))
+}
 
-	// Disconnect from LDAP server
-	ldapDisconnect()
+// searchGroups searches the groups matching the filter under the given base
+// DN, returning the given attributes
+func (c *Client) searchGroups(ctx context.Context, baseDN string, filter string, attributes []string) (*ldap.SearchResult, error) {
+	return c.search(ctx, c.groupSearchRequest(baseDN, filter, attributes))
+}
 
-	return sr
+// modify runs a modify request
+func (c *Client) modify(ctx context.Context, request *ldap.ModifyRequest) error {
+	return c.do(ctx, "modify", request.DN, func(l ldap.Client) error {
+		return l.Modify(request)
+	})
 }
 
-// LDAP server user add
-func ldapUserAdd(user string, password string) {
-	// Connect to LDAP server
-	ldapConnect()
+// add runs an add request
+func (c *Client) add(ctx context.Context, request *ldap.AddRequest) error {
+	return c.do(ctx, "add", request.DN, func(l ldap.Client) error {
+		return l.Add(request)
+	})
+}
 
-	// Add the given user
-	addRequest := ldap.NewAddRequest(fmt.Sprintf("cn=%s,%s", user, ldapUserSearchBaseDN), nil)
-	addRequest.Attribute("objectClass", []string{"top", "person", "organizationalPerson", "inetOrgPerson"})
-	addRequest.Attribute("cn", []string{user})
-	addRequest.Attribute("sn", []string{user})
-	addRequest.Attribute("userPassword", []string{password})
+// del deletes the entry with the given DN
+func (c *Client) del(ctx context.Context, dn string) error {
+	return c.do(ctx, "delete", dn, func(l ldap.Client) error {
+		return l.Del(ldap.NewDelRequest(dn, nil))
+	})
+}
 
-	err = l.Add(addRequest)
-	if err != nil {
-		log.Fatal(err)
+// attributeValues returns the values of an attribute of all entries of a
+// search result
+func attributeValues(sr *ldap.SearchResult, attribute string) []string {
+	var values []string
+	for _, entry := range sr.Entries {
+		values = append(values, entry.GetAttributeValues(attribute)...)
 	}
-
-	// Disconnect from LDAP server
-	ldapDisconnect()
+	return values
 }
 
-// LDAP server user delete
-func ldapUserDelete(user string) {
-	// Connect to LDAP server
-	ldapConnect()
+// appendMissing appends the values missing from values, compared
+// case-insensitively like attribute names
+func appendMissing(values []string, more ...string) []string {
+	result := append([]string{}, values...)
+	return append(result, missingValues(result, more)...)
+}
 
-	// Delete the given user
-	delRequest := ldap.NewDelRequest(fmt.Sprintf("cn=%s,%s", user, ldapUserSearchBaseDN), nil)
+// names returns the names of the entries of an iterator, leaving out the
+// entries without one
+func names(it *EntryIterator) ([]string, error) {
+	defer it.Close()
 
-	err = l.Del(delRequest)
-	if err != nil {
-		log.Fatal(err)
+	var names []string
+	for it.Next() {
+		if name := it.Name(); name != "" {
+			names = append(names, name)
+		}
 	}
-
-	// Disconnect from LDAP server
-	ldapDisconnect()
+	return names, it.Err()
 }
 
-// LDAP server user modify
-func ldapUserModify(user string, password string) {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// Modify the given user
-	modifyRequest := ldap.NewModifyRequest(fmt.Sprintf("cn=%s,%s", user, ldapUserSearchBaseDN), nil)
-	modifyRequest.Replace("userPassword", []string{password})
+// entriesByName returns the entries of an iterator keyed by their name.
+// Entries without one are left out.
+func entriesByName(it *EntryIterator) (map[string]*ldap.Entry, error) {
+	defer it.Close()
 
-	err = l.Modify(modifyRequest)
-	if err != nil {
-		log.Fatal(err)
+	entries := make(map[string]*ldap.Entry)
+	for it.Next() {
+		if name := it.Name(); name != "" {
+			entries[name] = it.Entry()
+		}
 	}
+	return entries, it.Err()
+}
 
-	// Disconnect from LDAP server
-	ldapDisconnect()
+// UserSearch searches for the given user
+func (c *Client) UserSearch(ctx context.Context, user string) (*ldap.SearchResult, error) {
+	return c.searchUsers(ctx, filterFor(c.config.UserSearchFilter, user), c.config.UserSearchAttributes)
 }
 
-// LDAP server group add
-func ldapGroupAdd(group string) {
-	// Connect to LDAP server
-	ldapConnect()
+// GroupSearch searches for the given group
+func (c *Client) GroupSearch(ctx context.Context, group string) (*ldap.SearchResult, error) {
+	return c.searchGroups(ctx, c.config.GroupSearchBaseDN, filterFor(c.config.GroupSearchFilter, group), c.config.GroupSearchAttributes)
+}
 
-	// Add the given group
-	addRequest := ldap.NewAddRequest(fmt.Sprintf("cn=%s,%s", group, ldapGroupSearchBaseDN), nil)
-	addRequest.Attribute("objectClass", []string{"top", "posixGroup"})
-	addRequest.Attribute("cn", []string{group})
-	addRequest.Attribute("gidNumber", []string{"1000"})
+// UserAdd adds the given user with the given password. The user has no
+// password if it is empty, and is a POSIX account if account is not nil.
+// Active Directory users get a userPrincipalName, and are disabled when
+// they have no password.
+func (c *Client) UserAdd(ctx context.Context, user string, password string, account *PosixAccount) error {
+	schema := c.config.Schema
+	objectClasses := schema.UserObjectClasses
+	nameAttributes := appendMissing([]string{schema.UserNamingAttribute}, "cn", "sn")
+	if account != nil {
+		objectClasses = appendMissing(objectClasses, c.posixObjectClasses()...)
+		if !c.activeDirectory() {
+			nameAttributes = appendMissing(nameAttributes, "uid")
+		}
+	}
 
-	err = l.Add(addRequest)
-	if err != nil {
-		log.Fatal(err)
+	addRequest := ldap.NewAddRequest(entryDN(c.userRDNAttribute(), user, c.config.UserSearchBaseDN), nil)
+	addRequest.Attribute("objectClass", objectClasses)
+	for _, attribute := range nameAttributes {
+		addRequest.Attribute(attribute, []string{user})
+	}
+	if c.activeDirectory() {
+		addRequest.Attribute("userPrincipalName", []string{c.userPrincipalName(user)})
+		addRequest.Attribute("userAccountControl", []string{newUserAccountControl(password)})
+	}
+	if password != "" {
+		attribute, err := c.passwordAttribute(password)
+		if err != nil {
+			return err
+		}
+		addRequest.Attribute(attribute.Type, attribute.Vals)
+	}
+	if account != nil {
+		for _, attribute := range c.posixAttributes(account) {
+			addRequest.Attribute(attribute.Type, attribute.Vals)
+		}
 	}
 
-	// Disconnect from LDAP server
-	ldapDisconnect()
+	return c.add(ctx, addRequest)
 }
 
-// LDAP server group delete
-func ldapGroupDelete(group string) {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// Delete the given group
-	delRequest := ldap.NewDelRequest(fmt.Sprintf("cn=%s,%s", group, ldapGroupSearchBaseDN), nil)
-
-	err = l.Del(delRequest)
+// UserPosixAccount returns the POSIX attributes of the given user, or nil
+// if the user is not a POSIX account
+func (c *Client) UserPosixAccount(ctx context.Context, user string) (*PosixAccount, error) {
+	attributes := posixAccountAttributes
+	if c.activeDirectory() {
+		attributes = appendMissing(attributes, "unixHomeDirectory")
+	}
+	entry, err := c.lookupEntry(ctx, c.config.UserSearchBaseDN, c.userScope, filterFor(c.config.UserSearchFilter, user), attributes)
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	// Disconnect from LDAP server
-	ldapDisconnect()
+	return c.parsePosixAttributes(entry)
 }
 
-// LDAP server user add to group
-func ldapUserAddToGroup(user string, group string) {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// Add the given user to the given group
-	modifyRequest := ldap.NewModifyRequest(fmt.Sprintf("cn=%s,%s", group, ldapGroupSearchBaseDN), nil)
-	modifyRequest.Add("memberUid", []string{user})
-
-	err = l.Modify(modifyRequest)
+// UserSetPosixAccount makes the given user a POSIX account with the given
+// attributes, replacing the current ones
+func (c *Client) UserSetPosixAccount(ctx context.Context, user string, account *PosixAccount) error {
+	entry, err := c.lookupEntry(ctx, c.config.UserSearchBaseDN, c.userScope, filterFor(c.config.UserSearchFilter, user), []string{"objectClass", "uid"})
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
 
-	// Disconnect from LDAP server
-	ldapDisconnect()
-}
-
-// LDAP server user delete from group
-func ldapUserDeleteFromGroup(user string, group string) {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// Delete the given user from the given group
-	modifyRequest := ldap.NewModifyRequest(fmt.Sprintf("cn=%s,%s", group, ldapGroupSearchBaseDN), nil)
-	modifyRequest.Delete("memberUid", []string{user})
-
-	err = l.Modify(modifyRequest)
-	if err != nil {
-		log.Fatal(err)
+	modifyRequest := ldap.NewModifyRequest(entry.DN, nil)
+	if missing := missingValues(entry.GetAttributeValues("objectClass"), c.posixObjectClasses()); len(missing) > 0 {
+		modifyRequest.Add("objectClass", missing)
+	}
+	if len(entry.GetAttributeValues("uid")) == 0 && !c.activeDirectory() {
+		modifyRequest.Add("uid", []string{user})
+	}
+	for _, attribute := range c.posixAttributes(account) {
+		modifyRequest.Replace(attribute.Type, attribute.Vals)
 	}
 
-	// Disconnect from LDAP server
-	ldapDisconnect()
+	return c.modify(ctx, modifyRequest)
 }
 
-// LDAP server user check
-func ldapUserCheck(user string, password string) bool {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// Check the given user
-	err = l.Bind(fmt.Sprintf("cn=%s,%s", user, ldapUserSearchBaseDN), password)
+// UserDelete deletes the given user
+func (c *Client) UserDelete(ctx context.Context, user string) error {
+	dn, err := c.userDN(ctx, user)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return c.del(ctx, dn)
+}
 
-	// Disconnect from LDAP server
-	ldapDisconnect()
-
-	return true
+// UserModify replaces the password of the given user
+func (c *Client) UserModify(ctx context.Context, user string, password string) error {
+	return c.UserPasswordChange(ctx, user, password)
 }
 
-// LDAP server group check
-func ldapGroupCheck(user string, group string) bool {
-	// Connect to LDAP server
-	ldapConnect()
+// GroupAdd adds the given group. Its gidNumber is only set when groups are
+// posixGroup.
+func (c *Client) GroupAdd(ctx context.Context, group string, gidNumber int64) error {
+	schema := c.config.Schema
+	addRequest := ldap.NewAddRequest(entryDN(schema.GroupNamingAttribute, group, c.config.GroupSearchBaseDN), nil)
+	addRequest.Attribute("objectClass", schema.GroupObjectClasses)
+	nameAttributes := appendMissing([]string{schema.GroupNamingAttribute}, "cn")
+	if c.activeDirectory() {
+		nameAttributes = appendMissing(nameAttributes, "sAMAccountName")
+	}
+	for _, attribute := range nameAttributes {
+		addRequest.Attribute(attribute, []string{group})
+	}
+	if c.posixGroups() {
+		addRequest.Attribute("gidNumber", []string{strconv.FormatInt(gidNumber, 10)})
+	}
+	if schema.EmptyMember != "" {
+		addRequest.Attribute(schema.MemberAttribute, []string{schema.EmptyMember})
+	}
 
-	// Check the given group
-	searchRequest := ldap.NewSearchRequest(
-		fmt.Sprintf("cn=%s,%s", group, ldapGroupSearchBaseDN),
-		ldapGroupSearchScopeInt,
-		ldap.NeverDerefAliases,
-		0,
-		0,
-		false,
-		fmt.Sprintf(ldapGroupSearchFilter, user),
-		ldapGroupSearchAttributesArray,
-		nil,
-	)
+	return c.add(ctx, addRequest)
+}
 
-	sr, err := l.Search(searchRequest)
+// GroupDelete deletes the given group
+func (c *Client) GroupDelete(ctx context.Context, group string) error {
+	dn, err := c.groupDN(ctx, group)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
+	return c.del(ctx, dn)
+}
 
-	// Disconnect from LDAP server
-	ldapDisconnect()
-
-	if len(sr.Entries) > 0 {
-		return true
+// UserAddToGroup adds the given user to the given group
+func (c *Client) UserAddToGroup(ctx context.Context, user string, group string) error {
+	dn, err := c.groupDN(ctx, group)
+	if err != nil {
+		return err
 	}
+	value, err := c.memberValue(ctx, user)
+	if err != nil {
+		return err
+	}
+	modifyRequest := ldap.NewModifyRequest(dn, nil)
+	modifyRequest.Add(c.config.Schema.MemberAttribute, []string{value})
 
-	return false
+	return c.modify(ctx, modifyRequest)
 }
 
-// LDAP server user list
-func ldapUserList() []string {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// List all users
-	searchRequest := ldap.NewSearchRequest(
-		ldapUserSearchBaseDN,
-		ldapUserSearchScopeInt,
-		ldap.NeverDerefAliases,
-		0,
-		0,
-		false,
-		ldapUserSearchFilter,
-		ldapUserSearchAttributesArray,
-		nil,
-	)
-
-	sr, err := l.Search(searchRequest)
+// UserDeleteFromGroup removes the given user from the given group. With
+// DN members, a deleted user is removed by the DN it was added with.
+func (c *Client) UserDeleteFromGroup(ctx context.Context, user string, group string) error {
+	dn, err := c.groupDN(ctx, group)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
-	// Disconnect from LDAP server
-	ldapDisconnect()
-
-	var users []string
-
-	for _, entry := range sr.Entries {
-		users = append(users, entry.GetAttributeValue("cn"))
+	value, err := c.memberValue(ctx, user)
+	if errors.Is(err, types.ErrNotFound) {
+		// The user may be deleted already, leaving its DN in the group
+		value, err = entryDN(c.userRDNAttribute(), user, c.config.UserSearchBaseDN), nil
+	}
+	if err != nil {
+		return err
 	}
+	modifyRequest := ldap.NewModifyRequest(dn, nil)
+	modifyRequest.Delete(c.config.Schema.MemberAttribute, []string{value})
 
-	return users
+	return c.modify(ctx, modifyRequest)
 }
 
-// LDAP server group list
-func ldapGroupList() []string {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// List all groups
-	searchRequest := ldap.NewSearchRequest(
-		ldapGroupSearchBaseDN,
-		ldapGroupSearchScopeInt,
-		ldap.NeverDerefAliases,
-		0,
-		0,
-		false,
-		ldapGroupSearchFilter,
-		ldapGroupSearchAttributesArray,
-		nil,
-	)
-
-	sr, err := l.Search(searchRequest)
+// GroupAddToGroup nests the given group in the given parent group. It
+// requires a schema with NestedGroups.
+func (c *Client) GroupAddToGroup(ctx context.Context, group string, parent string) error {
+	value, err := c.groupMemberValue(ctx, group)
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
-	// Disconnect from LDAP server
-	ldapDisconnect()
-
-	var groups []string
-
-	for _, entry := range sr.Entries {
-		groups = append(groups, entry.GetAttributeValue("cn"))
+	dn, err := c.groupDN(ctx, parent)
+	if err != nil {
+		return err
 	}
+	modifyRequest := ldap.NewModifyRequest(dn, nil)
+	modifyRequest.Add(c.config.Schema.MemberAttribute, []string{value})
 
-	return groups
+	return c.modify(ctx, modifyRequest)
 }
 
-// LDAP server user list from group
-func ldapUserListFromGroup(group string) []string {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// List all users from the given group
-	searchRequest := ldap.NewSearchRequest(
-		fmt.Sprintf("cn=%s,%s", group, ldapGroupSearchBaseDN),
-		ldapGroupSearchScopeInt,
-		ldap.NeverDerefAliases,
-		0,
-		0,
-		false,
-		ldapGroupSearchFilter,
-		ldapGroupSearchAttributesArray,
-		nil,
-	)
-
-	sr, err := l.Search(searchRequest)
+// GroupDeleteFromGroup removes the given group from the members of the
+// given parent group. A deleted group is removed by the DN it was added
+// with.
+func (c *Client) GroupDeleteFromGroup(ctx context.Context, group string, parent string) error {
+	value, err := c.groupMemberValue(ctx, group)
+	if errors.Is(err, types.ErrNotFound) {
+		value, err = entryDN(c.config.Schema.GroupNamingAttribute, group, c.config.GroupSearchBaseDN), nil
+	}
 	if err != nil {
-		log.Fatal(err)
+		return err
 	}
-
-	// Disconnect from LDAP server
-	ldapDisconnect()
-
-	var users []string
-
-	for _, entry := range sr.Entries {
-		users = append(users, entry.GetAttributeValue("memberUid"))
+	dn, err := c.groupDN(ctx, parent)
+	if err != nil {
+		return err
 	}
+	modifyRequest := ldap.NewModifyRequest(dn, nil)
+	modifyRequest.Delete(c.config.Schema.MemberAttribute, []string{value})
 
-	return users
+	return c.modify(ctx, modifyRequest)
 }
 
-// LDAP server group list from user
-func ldapGroupListFromUser(user string) []string {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// List all groups from the given user
-	searchRequest := ldap.NewSearchRequest(
-		ldapGroupSearchBaseDN,
-		ldapGroupSearchScopeInt,
-		ldap.NeverDerefAliases,
-		0,
-		0,
-		false,
-		fmt.Sprintf(ldapGroupSearchFilter, user),
-		ldapGroupSearchAttributesArray,
-		nil,
-	)
-
-	sr, err := l.Search(searchRequest)
+// UserCheck reports whether the given user can bind with the given
+// password. Wrong credentials and unknown users are not an error.
+func (c *Client) UserCheck(ctx context.Context, user string, password string) (bool, error) {
+	dn, err := c.userDN(ctx, user)
 	if err != nil {
-		log.Fatal(err)
+		if errors.Is(err, types.ErrNotFound) {
+			return false, nil
+		}
+		return false, err
 	}
 
-	// Disconnect from LDAP server
-	ldapDisconnect()
-
-	var groups []string
-
-	for _, entry := range sr.Entries {
-		groups = append(groups, entry.GetAttributeValue("cn"))
+	var invalid bool
+	err = c.do(ctx, "bind", dn, func(l ldap.Client) error {
+		err := l.Bind(dn, password)
+		if isConnectionError(err) {
+			return err
+		}
+		var ldapErr *ldap.Error
+		if errors.As(err, &ldapErr) && resultKind(ldapErr.ResultCode) == ErrInvalidCredentials {
+			invalid = true
+			err = nil
+		}
+		// Bind as the client again before the connection is reused
+		if rebindErr := c.bind(l); rebindErr != nil {
+			l.Close()
+		}
+		return err
+	})
+	if err != nil {
+		return false, err
 	}
 
-	return groups
+	return !invalid, nil
 }
 
-// LDAP server user password change
-func ldapUserPasswordChange(user string, password string) {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// Change the given user password
-	modifyRequest := ldap.NewModifyRequest(fmt.Sprintf("cn=%s,%s", user, ldapUserSearchBaseDN), nil)
-	modifyRequest.Replace("userPassword", []string{password})
-
-	err = l.Modify(modifyRequest)
+// GroupCheck reports whether the given user is a member of the given
+// group. A missing user or group is not an error.
+func (c *Client) GroupCheck(ctx context.Context, user string, group string) (bool, error) {
+	value, err := c.memberValue(ctx, user)
+	if errors.Is(err, types.ErrNotFound) {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	filter := "(&" + filterFor(c.config.GroupSearchFilter, group) + filterFor(c.config.GroupMemberFilter, value) + ")"
+	sr, err := c.searchGroups(ctx, c.config.GroupSearchBaseDN, filter, []string{"1.1"})
 	if err != nil {
-		log.Fatal(err)
+		return false, err
 	}
+	return len(sr.Entries) > 0, nil
+}
 
-	// Disconnect from LDAP server
-	ldapDisconnect()
+// UserList returns the names of all users
+func (c *Client) UserList(ctx context.Context) ([]string, error) {
+	return names(c.StreamUsers(ctx, nil))
 }
 
-// LDAP server user password reset
-func ldapUserPasswordReset(user string) {
-	// Connect to LDAP server
-	ldapConnect()
+// GroupList returns the names of all groups
+func (c *Client) GroupList(ctx context.Context) ([]string, error) {
+	return names(c.StreamGroups(ctx, nil))
+}
+
+// UserEntries returns the entries of all users with the given attributes,
+// keyed by user name
+func (c *Client) UserEntries(ctx context.Context, attributes []string) (map[string]*ldap.Entry, error) {
+	return entriesByName(c.StreamUsers(ctx, attributes))
+}
 
-	// Reset the given user password
-	modifyRequest := ldap.NewModifyRequest(fmt.Sprintf("cn=%s,%s", user, ldapUserSearchBaseDN), nil)
-	modifyRequest.Replace("userPassword", []string{ldapUserDefaultPassword})
+// GroupEntries returns the entries of all groups with the given
+// attributes, keyed by group name
+func (c *Client) GroupEntries(ctx context.Context, attributes []string) (map[string]*ldap.Entry, error) {
+	return entriesByName(c.StreamGroups(ctx, attributes))
+}
 
-	err = l.Modify(modifyRequest)
+// UserListFromGroup returns the names of the members of the given group
+func (c *Client) UserListFromGroup(ctx context.Context, group string) ([]string, error) {
+	filter := filterFor(c.config.GroupSearchFilter, group)
+	sr, err := c.searchGroups(ctx, c.config.GroupSearchBaseDN, filter, []string{c.config.Schema.MemberAttribute})
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	// Disconnect from LDAP server
-	ldapDisconnect()
+	if len(sr.Entries) == 0 {
+		return nil, notFoundError(c.config.GroupSearchBaseDN, filter)
+	}
+	users, _, err := c.members(ctx, attributeValues(sr, c.config.Schema.MemberAttribute))
+	return users, err
 }
 
-// LDAP server user password check
-func ldapUserPasswordCheck(user string, password string) bool {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// Check the given user password
-	err = l.Bind(fmt.Sprintf("cn=%s,%s", user, ldapUserSearchBaseDN), password)
+// GroupMembers returns the names of the users and of the nested groups
+// that are members of the given group
+func (c *Client) GroupMembers(ctx context.Context, group string) ([]string, []string, error) {
+	filter := filterFor(c.config.GroupSearchFilter, group)
+	sr, err := c.searchGroups(ctx, c.config.GroupSearchBaseDN, filter, []string{c.config.Schema.MemberAttribute})
 	if err != nil {
-		log.Fatal(err)
+		return nil, nil, err
 	}
-
-	// Disconnect from LDAP server
-	ldapDisconnect()
-
-	return true
+	if len(sr.Entries) == 0 {
+		return nil, nil, notFoundError(c.config.GroupSearchBaseDN, filter)
+	}
+	return c.members(ctx, attributeValues(sr, c.config.Schema.MemberAttribute))
 }
 
-// LDAP server group add user
-func ldapGroupAddUser(group string, user string) {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// Add the given user to the given group
-	modifyRequest := ldap.NewModifyRequest(fmt.Sprintf("cn=%s,%s", group, ldapGroupSearchBaseDN), nil)
-	modifyRequest.Add("memberUid", []string{user})
-
-	err = l.Modify(modifyRequest)
+// GroupListFromUser returns the names of the groups the given user is a member of
+func (c *Client) GroupListFromUser(ctx context.Context, user string) ([]string, error) {
+	value, err := c.memberValue(ctx, user)
+	if errors.Is(err, types.ErrNotFound) {
+		return nil, nil
+	}
 	if err != nil {
-		log.Fatal(err)
+		return nil, err
 	}
-
-	// Disconnect from LDAP server
-	ldapDisconnect()
+	naming := c.config.Schema.GroupNamingAttribute
+	return names(c.stream(ctx, c.groupSearchRequest(c.config.GroupSearchBaseDN, filterFor(c.config.GroupMemberFilter, value), []string{naming}), naming))
 }
 
-// LDAP server group delete user
-func ldapGroupDeleteUser(group string, user string) {
-	// Connect to LDAP server
-	ldapConnect()
-
-	// Delete the given user from the given group
-	modifyRequest := ldap.NewModifyRequest(fmt.Sprintf("cn=%s,%s", group, ldapGroupSearchBaseDN), nil)
-	modifyRequest.Delete("memberUid", []string{user})
+// UserPasswordCheck reports whether the given user can bind with the given password
+func (c *Client) UserPasswordCheck(ctx context.Context, user string, password string) (bool, error) {
+	return c.UserCheck(ctx, user, password)
+}
 
-	err = l.Modify(modifyRequest)
-	if err != nil {
-		log.Fatal(err)
-	}
+// GroupAddUser adds the given user to the given group
+func (c *Client) GroupAddUser(ctx context.Context, group string, user string) error {
+	return c.UserAddToGroup(ctx, user, group)
+}
 
-	// Disconnect from LDAP server
-	ldapDisconnect()
+// GroupDeleteUser removes the given user from the given group
+func (c *Client) GroupDeleteUser(ctx context.Context, group string, user string) error {
+	return c.UserDeleteFromGroup(ctx, user, group)
 }
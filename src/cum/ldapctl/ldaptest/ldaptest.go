@@ -0,0 +1,823 @@
+// Package ldaptest provides an in-memory stand-in of an LDAP server, to
+// test ldapctl and its users without a directory.
+//
+// A Server serves the requests ldapctl makes: binds, adds, modifies,
+// deletes and searches, including searches paged with the paged results
+// control of RFC 2696. Attribute names, values and DNs are compared
+// case-insensitively, and entries need no parent entry.
+package ldaptest
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+	"unicode/utf16"
+
+	ber "github.com/go-asn1-ber/asn1-ber"
+	"github.com/go-ldap/ldap/v3"
+)
+
+// errUnsupported is returned by the operations the stand-in does not serve
+var errUnsupported = ldap.NewError(ldap.LDAPResultUnwillingToPerform, errors.New("not supported by ldaptest"))
+
+// Request is a request served by a Server
+type Request struct {
+	// Conn is the number of the connection of the request, counting from
+	// 1 in the order connections are opened
+	Conn int
+	// Op is "dial", "bind", "add", "modify", "delete" or "search"
+	Op string
+	// DN is the DN of the entry of the request, or the base DN of a search
+	DN string
+	// Filter is the filter of a search
+	Filter string
+	// Paging is a copy of the paging control of a search, nil when the
+	// search is not paged
+	Paging *ldap.ControlPaging
+}
+
+// Server is an in-memory LDAP server. It is safe for concurrent use.
+type Server struct {
+	// IgnorePaging makes searches ignore the paging control, returning
+	// every entry at once like servers that do not support it. It must be
+	// set before the first request.
+	IgnorePaging bool
+
+	mu       sync.Mutex
+	entries  []*ldap.Entry
+	conns    []*Conn
+	requests []Request
+	hook     func(Request) error
+	cookies  int
+}
+
+// NewServer creates a new Server without entries
+func NewServer() *Server {
+	return &Server{}
+}
+
+// Dial opens a new connection to the server. It is an ldapctl.DialFunc.
+func (s *Server) Dial(ctx context.Context) (ldap.Client, error) {
+	s.mu.Lock()
+	r := Request{Conn: len(s.conns) + 1, Op: "dial"}
+	s.requests = append(s.requests, r)
+	hook := s.hook
+	s.mu.Unlock()
+
+	if hook != nil {
+		if err := hook(r); err != nil {
+			return nil, err
+		}
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	c := &Conn{server: s, id: len(s.conns) + 1, cookies: make(map[string][]*ldap.Entry)}
+	s.conns = append(s.conns, c)
+	return c, nil
+}
+
+// SetHook sets a function called with every request before it is served.
+// The request fails with the error it returns, if any, and an error with
+// the ldap.ErrorNetwork code also closes the connection.
+func (s *Server) SetHook(hook func(Request) error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.hook = hook
+}
+
+// Requests returns the requests served so far, in order
+func (s *Server) Requests() []Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return append([]Request(nil), s.requests...)
+}
+
+// Break breaks the open connections, like a restart of the server. The
+// connections are not known to be closing until their next request, which
+// fails with a network error.
+func (s *Server) Break() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, c := range s.conns {
+		c.broken = true
+	}
+}
+
+// OpenConns returns the number of connections neither closed nor known to
+// be broken
+func (s *Server) OpenConns() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var open int
+	for _, c := range s.conns {
+		if !c.closing {
+			open++
+		}
+	}
+	return open
+}
+
+// AddEntry adds an entry with the given attributes
+func (s *Server) AddEntry(dn string, attributes map[string][]string) error {
+	request := ldap.NewAddRequest(dn, nil)
+	for name, values := range attributes {
+		request.Attribute(name, values)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.add(request)
+}
+
+// Entry returns a copy of the entry with the given DN, or nil if there is
+// none
+func (s *Server) Entry(dn string) *ldap.Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		return nil
+	}
+	if i := s.find(parsed); i >= 0 {
+		return copyEntry(s.entries[i], nil)
+	}
+	return nil
+}
+
+// Entries returns a copy of every entry, in the order they were added
+func (s *Server) Entries() []*ldap.Entry {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := make([]*ldap.Entry, len(s.entries))
+	for i, entry := range s.entries {
+		entries[i] = copyEntry(entry, nil)
+	}
+	return entries
+}
+
+// find returns the index of the entry with the given DN, or -1
+func (s *Server) find(dn *ldap.DN) int {
+	for i, entry := range s.entries {
+		if mustParseDN(entry.DN).EqualFold(dn) {
+			return i
+		}
+	}
+	return -1
+}
+
+// add adds an entry, with the lock held
+func (s *Server) add(request *ldap.AddRequest) error {
+	dn, err := ldap.ParseDN(request.DN)
+	if err != nil {
+		return ldap.NewError(ldap.LDAPResultInvalidDNSyntax, err)
+	}
+	if s.find(dn) >= 0 {
+		return ldap.NewError(ldap.LDAPResultEntryAlreadyExists, fmt.Errorf("%s already exists", request.DN))
+	}
+
+	entry := &ldap.Entry{DN: request.DN}
+	for _, attribute := range request.Attributes {
+		for _, value := range attribute.Vals {
+			if err := addValue(entry, attribute.Type, value); err != nil {
+				return err
+			}
+		}
+	}
+	s.entries = append(s.entries, entry)
+	return nil
+}
+
+// Conn is a connection to a Server
+type Conn struct {
+	server *Server
+	id     int
+	// closing is set once the connection is closed or known to be broken
+	closing bool
+	// broken is set by Server.Break
+	broken bool
+	// cookies holds the entries left of the paged searches of the
+	// connection, by cookie
+	cookies map[string][]*ldap.Entry
+}
+
+// begin records a request and checks that it can be served, calling the
+// hook of the server
+func (c *Conn) begin(r Request) error {
+	s := c.server
+	s.mu.Lock()
+	r.Conn = c.id
+	s.requests = append(s.requests, r)
+	hook := s.hook
+	switch {
+	case c.closing:
+		s.mu.Unlock()
+		return ldap.NewError(ldap.ErrorNetwork, errors.New("ldap: connection closed"))
+	case c.broken:
+		c.closing = true
+		s.mu.Unlock()
+		return ldap.NewError(ldap.ErrorNetwork, errors.New("connection reset by peer"))
+	}
+	s.mu.Unlock()
+
+	if hook == nil {
+		return nil
+	}
+	err := hook(r)
+	if ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		s.mu.Lock()
+		c.closing = true
+		s.mu.Unlock()
+	}
+	return err
+}
+
+// Start does nothing
+func (c *Conn) Start() {}
+
+// StartTLS is not supported
+func (c *Conn) StartTLS(*tls.Config) error {
+	return errUnsupported
+}
+
+// Close closes the connection
+func (c *Conn) Close() error {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	c.closing = true
+	c.cookies = make(map[string][]*ldap.Entry)
+	return nil
+}
+
+// GetLastError returns nil
+func (c *Conn) GetLastError() error {
+	return nil
+}
+
+// IsClosing reports whether the connection is closed or known to be broken
+func (c *Conn) IsClosing() bool {
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+
+	return c.closing
+}
+
+// SetTimeout does nothing, as requests do not block
+func (c *Conn) SetTimeout(time.Duration) {}
+
+// TLSConnectionState reports that the connection does not use TLS
+func (c *Conn) TLSConnectionState() (tls.ConnectionState, bool) {
+	return tls.ConnectionState{}, false
+}
+
+// Bind binds with the userPassword of an entry, or the unicodePwd of an
+// Active Directory entry, which cannot bind while its userAccountControl
+// disables it. An empty DN and password bind anonymously.
+func (c *Conn) Bind(username, password string) error {
+	if err := c.begin(Request{Op: "bind", DN: username}); err != nil {
+		return err
+	}
+	if username == "" && password == "" {
+		return nil
+	}
+
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	invalid := ldap.NewError(ldap.LDAPResultInvalidCredentials, errors.New("invalid credentials"))
+	dn, err := ldap.ParseDN(username)
+	if err != nil || password == "" {
+		return invalid
+	}
+	i := s.find(dn)
+	if i < 0 {
+		return invalid
+	}
+	entry := s.entries[i]
+	if uac, err := strconv.ParseInt(entry.GetAttributeValue("userAccountControl"), 10, 64); err == nil && uac&uacAccountDisable != 0 {
+		return invalid
+	}
+	for _, value := range entry.GetAttributeValues("userPassword") {
+		if value == password {
+			return nil
+		}
+	}
+	for _, value := range entry.GetAttributeValues("unicodePwd") {
+		if value == unicodePwd(password) {
+			return nil
+		}
+	}
+	return invalid
+}
+
+// uacAccountDisable is the userAccountControl flag of disabled Active
+// Directory accounts
+const uacAccountDisable = 0x2
+
+// unicodePwd returns the unicodePwd value of a password: quoted, in
+// UTF-16LE
+func unicodePwd(password string) string {
+	encoded := utf16.Encode([]rune(`"` + password + `"`))
+	b := make([]byte, 2*len(encoded))
+	for i, r := range encoded {
+		binary.LittleEndian.PutUint16(b[2*i:], r)
+	}
+	return string(b)
+}
+
+// UnauthenticatedBind binds anonymously
+func (c *Conn) UnauthenticatedBind(username string) error {
+	return c.begin(Request{Op: "bind", DN: username})
+}
+
+// SimpleBind is not supported
+func (c *Conn) SimpleBind(*ldap.SimpleBindRequest) (*ldap.SimpleBindResult, error) {
+	return nil, errUnsupported
+}
+
+// ExternalBind binds as the client certificate, which always succeeds
+func (c *Conn) ExternalBind() error {
+	return c.begin(Request{Op: "bind"})
+}
+
+// NTLMUnauthenticatedBind is not supported
+func (c *Conn) NTLMUnauthenticatedBind(domain, username string) error {
+	return errUnsupported
+}
+
+// Unbind closes the connection
+func (c *Conn) Unbind() error {
+	return c.Close()
+}
+
+// Add adds an entry
+func (c *Conn) Add(request *ldap.AddRequest) error {
+	if err := c.begin(Request{Op: "add", DN: request.DN}); err != nil {
+		return err
+	}
+
+	c.server.mu.Lock()
+	defer c.server.mu.Unlock()
+	return c.server.add(request)
+}
+
+// Del deletes an entry without children
+func (c *Conn) Del(request *ldap.DelRequest) error {
+	if err := c.begin(Request{Op: "delete", DN: request.DN}); err != nil {
+		return err
+	}
+
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dn, err := ldap.ParseDN(request.DN)
+	if err != nil {
+		return ldap.NewError(ldap.LDAPResultInvalidDNSyntax, err)
+	}
+	i := s.find(dn)
+	if i < 0 {
+		return ldap.NewError(ldap.LDAPResultNoSuchObject, fmt.Errorf("no entry %s", request.DN))
+	}
+	for _, entry := range s.entries {
+		if dn.AncestorOfFold(mustParseDN(entry.DN)) {
+			return ldap.NewError(ldap.LDAPResultNotAllowedOnNonLeaf, fmt.Errorf("%s has children", request.DN))
+		}
+	}
+	s.entries = append(s.entries[:i], s.entries[i+1:]...)
+	return nil
+}
+
+// Modify applies the changes of a modify request to an entry, all of them
+// or none
+func (c *Conn) Modify(request *ldap.ModifyRequest) error {
+	if err := c.begin(Request{Op: "modify", DN: request.DN}); err != nil {
+		return err
+	}
+
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	dn, err := ldap.ParseDN(request.DN)
+	if err != nil {
+		return ldap.NewError(ldap.LDAPResultInvalidDNSyntax, err)
+	}
+	i := s.find(dn)
+	if i < 0 {
+		return ldap.NewError(ldap.LDAPResultNoSuchObject, fmt.Errorf("no entry %s", request.DN))
+	}
+
+	entry := copyEntry(s.entries[i], nil)
+	for _, change := range request.Changes {
+		if err := modify(entry, change); err != nil {
+			return err
+		}
+	}
+	s.entries[i] = entry
+	return nil
+}
+
+// ModifyDN is not supported
+func (c *Conn) ModifyDN(*ldap.ModifyDNRequest) error {
+	return errUnsupported
+}
+
+// ModifyWithResult is not supported
+func (c *Conn) ModifyWithResult(*ldap.ModifyRequest) (*ldap.ModifyResult, error) {
+	return nil, errUnsupported
+}
+
+// Compare is not supported
+func (c *Conn) Compare(dn, attribute, value string) (bool, error) {
+	return false, errUnsupported
+}
+
+// PasswordModify is not supported
+func (c *Conn) PasswordModify(*ldap.PasswordModifyRequest) (*ldap.PasswordModifyResult, error) {
+	return nil, errUnsupported
+}
+
+// Search returns the entries matching a search request. Paged searches
+// return a page at a time, with a cookie bound to the connection, and a
+// page size of zero with the cookie of a search abandons it.
+func (c *Conn) Search(request *ldap.SearchRequest) (*ldap.SearchResult, error) {
+	paging, _ := ldap.FindControl(request.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+	r := Request{Op: "search", DN: request.BaseDN, Filter: request.Filter}
+	if paging != nil {
+		r.Paging = &ldap.ControlPaging{PagingSize: paging.PagingSize, Cookie: append([]byte(nil), paging.Cookie...)}
+	}
+	if err := c.begin(r); err != nil {
+		return nil, err
+	}
+
+	s := c.server
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.IgnorePaging {
+		paging = nil
+	}
+
+	var matches []*ldap.Entry
+	if paging != nil && len(paging.Cookie) > 0 {
+		var ok bool
+		matches, ok = c.cookies[string(paging.Cookie)]
+		if !ok {
+			return nil, ldap.NewError(ldap.LDAPResultUnwillingToPerform, errors.New("invalid paged results cookie"))
+		}
+		delete(c.cookies, string(paging.Cookie))
+	} else {
+		var err error
+		if matches, err = s.search(request); err != nil {
+			return nil, err
+		}
+	}
+
+	result := &ldap.SearchResult{}
+	if paging == nil {
+		if request.SizeLimit > 0 && len(matches) > request.SizeLimit {
+			result.Entries = matches[:request.SizeLimit]
+			return result, ldap.NewError(ldap.LDAPResultSizeLimitExceeded, errors.New("size limit exceeded"))
+		}
+		result.Entries = matches
+		return result, nil
+	}
+
+	response := ldap.NewControlPaging(0)
+	result.Controls = []ldap.Control{response}
+	if len(paging.Cookie) > 0 && paging.PagingSize == 0 {
+		return result, nil
+	}
+	size := int(paging.PagingSize)
+	if size == 0 || size > len(matches) {
+		size = len(matches)
+	}
+	if size < len(matches) {
+		s.cookies++
+		cookie := strconv.Itoa(s.cookies)
+		c.cookies[cookie] = matches[size:]
+		response.SetCookie([]byte(cookie))
+	}
+	result.Entries = matches[:size]
+	return result, nil
+}
+
+// search returns copies of the entries matching a search request, with
+// the lock held
+func (s *Server) search(request *ldap.SearchRequest) ([]*ldap.Entry, error) {
+	base, err := ldap.ParseDN(request.BaseDN)
+	if err != nil {
+		return nil, ldap.NewError(ldap.LDAPResultInvalidDNSyntax, err)
+	}
+	filter, err := ldap.CompileFilter(request.Filter)
+	if err != nil {
+		return nil, err
+	}
+
+	// The root DSE
+	if len(base.RDNs) == 0 && request.Scope == ldap.ScopeBaseObject {
+		return []*ldap.Entry{{}}, nil
+	}
+
+	var matches []*ldap.Entry
+	for _, entry := range s.entries {
+		dn := mustParseDN(entry.DN)
+		var inScope bool
+		switch request.Scope {
+		case ldap.ScopeBaseObject:
+			inScope = base.EqualFold(dn)
+		case ldap.ScopeSingleLevel:
+			inScope = base.AncestorOfFold(dn) && len(dn.RDNs) == len(base.RDNs)+1
+		default:
+			inScope = base.EqualFold(dn) || base.AncestorOfFold(dn)
+		}
+		if !inScope {
+			continue
+		}
+		match, err := matchFilter(entry, filter)
+		if err != nil {
+			return nil, err
+		}
+		if match {
+			matches = append(matches, copyEntry(entry, request.Attributes))
+		}
+	}
+	return matches, nil
+}
+
+// SearchAsync is not supported
+func (c *Conn) SearchAsync(ctx context.Context, searchRequest *ldap.SearchRequest, bufferSize int) ldap.Response {
+	return nil
+}
+
+// SearchWithPaging is not supported
+func (c *Conn) SearchWithPaging(searchRequest *ldap.SearchRequest, pagingSize uint32) (*ldap.SearchResult, error) {
+	return nil, errUnsupported
+}
+
+// DirSync is not supported
+func (c *Conn) DirSync(searchRequest *ldap.SearchRequest, flags, maxAttrCount int64, cookie []byte) (*ldap.SearchResult, error) {
+	return nil, errUnsupported
+}
+
+// DirSyncAsync is not supported
+func (c *Conn) DirSyncAsync(ctx context.Context, searchRequest *ldap.SearchRequest, bufferSize int, flags, maxAttrCount int64, cookie []byte) ldap.Response {
+	return nil
+}
+
+// Syncrepl is not supported
+func (c *Conn) Syncrepl(ctx context.Context, searchRequest *ldap.SearchRequest, bufferSize int, mode ldap.ControlSyncRequestMode, cookie []byte, reloadHint bool) ldap.Response {
+	return nil
+}
+
+// mustParseDN parses the DN of a stored entry, which was checked when it
+// was added
+func mustParseDN(dn string) *ldap.DN {
+	parsed, err := ldap.ParseDN(dn)
+	if err != nil {
+		panic(err)
+	}
+	return parsed
+}
+
+// attribute returns the attribute of an entry with the given name, or nil
+func attribute(entry *ldap.Entry, name string) *ldap.EntryAttribute {
+	for _, a := range entry.Attributes {
+		if strings.EqualFold(a.Name, name) {
+			return a
+		}
+	}
+	return nil
+}
+
+// hasValue reports whether an attribute has the given value
+func hasValue(a *ldap.EntryAttribute, value string) bool {
+	if a == nil {
+		return false
+	}
+	for _, v := range a.Values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
+
+// addValue adds a value to an attribute of an entry
+func addValue(entry *ldap.Entry, name string, value string) error {
+	a := attribute(entry, name)
+	if a == nil {
+		a = &ldap.EntryAttribute{Name: name}
+		entry.Attributes = append(entry.Attributes, a)
+	}
+	if hasValue(a, value) {
+		return ldap.NewError(ldap.LDAPResultAttributeOrValueExists, fmt.Errorf("%s already has the %s value %q", entry.DN, name, value))
+	}
+	a.Values = append(a.Values, value)
+	a.ByteValues = append(a.ByteValues, []byte(value))
+	return nil
+}
+
+// removeAttribute removes an attribute from an entry
+func removeAttribute(entry *ldap.Entry, name string) {
+	var attributes []*ldap.EntryAttribute
+	for _, a := range entry.Attributes {
+		if !strings.EqualFold(a.Name, name) {
+			attributes = append(attributes, a)
+		}
+	}
+	entry.Attributes = attributes
+}
+
+// modify applies a change of a modify request to an entry
+func modify(entry *ldap.Entry, change ldap.Change) error {
+	name := change.Modification.Type
+	values := change.Modification.Vals
+	switch change.Operation {
+	case ldap.AddAttribute:
+		for _, value := range values {
+			if err := addValue(entry, name, value); err != nil {
+				return err
+			}
+		}
+	case ldap.DeleteAttribute:
+		a := attribute(entry, name)
+		if a == nil {
+			return ldap.NewError(ldap.LDAPResultNoSuchAttribute, fmt.Errorf("%s has no %s", entry.DN, name))
+		}
+		if len(values) == 0 {
+			removeAttribute(entry, name)
+			return nil
+		}
+		for _, value := range values {
+			if !hasValue(a, value) {
+				return ldap.NewError(ldap.LDAPResultNoSuchAttribute, fmt.Errorf("%s has no %s value %q", entry.DN, name, value))
+			}
+		}
+		removeAttribute(entry, name)
+		for _, v := range a.Values {
+			if !hasValue(&ldap.EntryAttribute{Values: values}, v) {
+				addValue(entry, a.Name, v)
+			}
+		}
+	case ldap.ReplaceAttribute:
+		removeAttribute(entry, name)
+		for _, value := range values {
+			if err := addValue(entry, name, value); err != nil {
+				return err
+			}
+		}
+	case ldap.IncrementAttribute:
+		a := attribute(entry, name)
+		if a == nil || len(a.Values) != 1 || len(values) != 1 {
+			return ldap.NewError(ldap.LDAPResultConstraintViolation, fmt.Errorf("cannot increment %s of %s", name, entry.DN))
+		}
+		current, err := strconv.ParseInt(a.Values[0], 10, 64)
+		if err != nil {
+			return ldap.NewError(ldap.LDAPResultConstraintViolation, err)
+		}
+		increment, err := strconv.ParseInt(values[0], 10, 64)
+		if err != nil {
+			return ldap.NewError(ldap.LDAPResultConstraintViolation, err)
+		}
+		value := strconv.FormatInt(current+increment, 10)
+		a.Values, a.ByteValues = []string{value}, [][]byte{[]byte(value)}
+	default:
+		return ldap.NewError(ldap.LDAPResultProtocolError, fmt.Errorf("unknown modify operation %d", change.Operation))
+	}
+	return nil
+}
+
+// copyEntry returns a copy of an entry with the given attributes: all of
+// them when none or "*" are given, and none for "1.1"
+func copyEntry(entry *ldap.Entry, attributes []string) *ldap.Entry {
+	all := len(attributes) == 0
+	for _, name := range attributes {
+		all = all || name == "*"
+	}
+
+	result := &ldap.Entry{DN: entry.DN}
+	for _, a := range entry.Attributes {
+		selected := all
+		for _, name := range attributes {
+			selected = selected || strings.EqualFold(a.Name, name)
+		}
+		if !selected {
+			continue
+		}
+		copied := &ldap.EntryAttribute{Name: a.Name, Values: append([]string(nil), a.Values...)}
+		for _, value := range a.ByteValues {
+			copied.ByteValues = append(copied.ByteValues, append([]byte(nil), value...))
+		}
+		result.Attributes = append(result.Attributes, copied)
+	}
+	return result
+}
+
+// matchFilter reports whether an entry matches a compiled filter. Values
+// are compared case-insensitively, and ordering matches compare integers
+// numerically.
+func matchFilter(entry *ldap.Entry, filter *ber.Packet) (bool, error) {
+	switch filter.Tag {
+	case ldap.FilterAnd:
+		for _, child := range filter.Children {
+			if match, err := matchFilter(entry, child); err != nil || !match {
+				return false, err
+			}
+		}
+		return true, nil
+	case ldap.FilterOr:
+		for _, child := range filter.Children {
+			if match, err := matchFilter(entry, child); err != nil || match {
+				return match, err
+			}
+		}
+		return false, nil
+	case ldap.FilterNot:
+		match, err := matchFilter(entry, filter.Children[0])
+		return !match, err
+	case ldap.FilterPresent:
+		a := attribute(entry, filter.Data.String())
+		return a != nil && len(a.Values) > 0, nil
+	case ldap.FilterEqualityMatch, ldap.FilterApproxMatch:
+		a := attribute(entry, filter.Children[0].Value.(string))
+		return hasValue(a, filter.Children[1].Value.(string)), nil
+	case ldap.FilterGreaterOrEqual, ldap.FilterLessOrEqual:
+		a := attribute(entry, filter.Children[0].Value.(string))
+		if a == nil {
+			return false, nil
+		}
+		for _, value := range a.Values {
+			c := compare(value, filter.Children[1].Value.(string))
+			if filter.Tag == ldap.FilterGreaterOrEqual && c >= 0 || filter.Tag == ldap.FilterLessOrEqual && c <= 0 {
+				return true, nil
+			}
+		}
+		return false, nil
+	case ldap.FilterSubstrings:
+		a := attribute(entry, filter.Children[0].Value.(string))
+		if a == nil {
+			return false, nil
+		}
+		for _, value := range a.Values {
+			if matchSubstrings(strings.ToLower(value), filter.Children[1].Children) {
+				return true, nil
+			}
+		}
+		return false, nil
+	}
+	return false, ldap.NewError(ldap.LDAPResultUnwillingToPerform, fmt.Errorf("%s filters are not supported by ldaptest", ldap.FilterMap[uint64(filter.Tag)]))
+}
+
+// compare compares two values as integers if both are, and else as
+// case-insensitive strings
+func compare(a, b string) int {
+	x, errA := strconv.ParseInt(a, 10, 64)
+	y, errB := strconv.ParseInt(b, 10, 64)
+	switch {
+	case errA != nil || errB != nil:
+		return strings.Compare(strings.ToLower(a), strings.ToLower(b))
+	case x < y:
+		return -1
+	case x > y:
+		return 1
+	}
+	return 0
+}
+
+// matchSubstrings reports whether a lower-case value matches the parts of
+// a substrings filter
+func matchSubstrings(value string, parts []*ber.Packet) bool {
+	for _, part := range parts {
+		s := strings.ToLower(part.Value.(string))
+		switch part.Tag {
+		case ldap.FilterSubstringsInitial:
+			if !strings.HasPrefix(value, s) {
+				return false
+			}
+			value = value[len(s):]
+		case ldap.FilterSubstringsAny:
+			i := strings.Index(value, s)
+			if i < 0 {
+				return false
+			}
+			value = value[i+len(s):]
+		case ldap.FilterSubstringsFinal:
+			if !strings.HasSuffix(value, s) {
+				return false
+			}
+		}
+	}
+	return true
+}
@@ -0,0 +1,203 @@
+package ldaptest
+
+import (
+	"context"
+	"reflect"
+	"testing"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+func newTestServer(t *testing.T) (*Server, ldap.Client) {
+	t.Helper()
+	s := NewServer()
+	entries := []struct {
+		dn         string
+		attributes map[string][]string
+	}{
+		{"ou=people,dc=example,dc=org", map[string][]string{"objectClass": {"organizationalUnit"}}},
+		{"uid=alice,ou=people,dc=example,dc=org", map[string][]string{"objectClass": {"inetOrgPerson"}, "uid": {"alice"}, "uidNumber": {"1000"}, "mail": {"Alice@example.org"}}},
+		{"uid=bob,ou=people,dc=example,dc=org", map[string][]string{"objectClass": {"inetOrgPerson"}, "uid": {"bob"}, "uidNumber": {"900"}}},
+		{"cn=staff,ou=groups,dc=example,dc=org", map[string][]string{"objectClass": {"groupOfNames"}, "cn": {"staff"}}},
+	}
+	for _, entry := range entries {
+		if err := s.AddEntry(entry.dn, entry.attributes); err != nil {
+			t.Fatal(err)
+		}
+	}
+	conn, err := s.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, conn
+}
+
+func searchDNs(t *testing.T, conn ldap.Client, baseDN string, scope int, filter string) []string {
+	t.Helper()
+	sr, err := conn.Search(ldap.NewSearchRequest(baseDN, scope, ldap.NeverDerefAliases, 0, 0, false, filter, []string{"1.1"}, nil))
+	if err != nil {
+		t.Fatalf("%s: %v", filter, err)
+	}
+	var dns []string
+	for _, entry := range sr.Entries {
+		dns = append(dns, entry.DN)
+	}
+	return dns
+}
+
+func TestSearchFilters(t *testing.T) {
+	_, conn := newTestServer(t)
+
+	alice, bob := "uid=alice,ou=people,dc=example,dc=org", "uid=bob,ou=people,dc=example,dc=org"
+	tests := []struct {
+		filter string
+		want   []string
+	}{
+		{"(uid=ALICE)", []string{alice}},
+		{"(&(objectClass=inetOrgPerson)(mail=*))", []string{alice}},
+		{"(|(uid=bob)(mail=alice@example.org))", []string{alice, bob}},
+		{"(&(objectClass=inetOrgPerson)(!(uid=alice)))", []string{bob}},
+		{"(uidNumber>=950)", []string{alice}},
+		{"(uidNumber<=950)", []string{bob}},
+		{"(mail=al*@*.org)", []string{alice}},
+		{"(uid=\\2a)", nil},
+	}
+	for _, tt := range tests {
+		if got := searchDNs(t, conn, "dc=example,dc=org", ldap.ScopeWholeSubtree, tt.filter); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.filter, got, tt.want)
+		}
+	}
+
+	if got := searchDNs(t, conn, "ou=people,dc=example,dc=org", ldap.ScopeSingleLevel, "(objectClass=*)"); len(got) != 2 {
+		t.Errorf("a single level search returned %v, want the 2 users", got)
+	}
+	if got := searchDNs(t, conn, "OU=People,DC=example,DC=org", ldap.ScopeBaseObject, "(objectClass=*)"); len(got) != 1 {
+		t.Errorf("a base search returned %v, want the base entry", got)
+	}
+}
+
+func TestModify(t *testing.T) {
+	s, conn := newTestServer(t)
+	dn := "uid=alice,ou=people,dc=example,dc=org"
+
+	request := ldap.NewModifyRequest(dn, nil)
+	request.Add("mail", []string{"a@example.org"})
+	request.Delete("uidNumber", nil)
+	request.Replace("uid", []string{"alice2"})
+	if err := conn.Modify(request); err != nil {
+		t.Fatal(err)
+	}
+	entry := s.Entry(dn)
+	if got := entry.GetAttributeValues("mail"); !reflect.DeepEqual(got, []string{"Alice@example.org", "a@example.org"}) {
+		t.Errorf("got mail %v", got)
+	}
+	if got := entry.GetAttributeValues("uidNumber"); len(got) != 0 {
+		t.Errorf("got uidNumber %v, want none", got)
+	}
+
+	// A failed change leaves the entry unchanged
+	request = ldap.NewModifyRequest(dn, nil)
+	request.Replace("uid", []string{"alice3"})
+	request.Delete("mail", []string{"missing@example.org"})
+	if err := conn.Modify(request); !ldap.IsErrorWithCode(err, ldap.LDAPResultNoSuchAttribute) {
+		t.Fatalf("got %v, want noSuchAttribute", err)
+	}
+	if got := s.Entry(dn).GetAttributeValue("uid"); got != "alice2" {
+		t.Errorf("got uid %q after a failed modify, want alice2", got)
+	}
+
+	if err := conn.Add(ldap.NewAddRequest(dn, nil)); !ldap.IsErrorWithCode(err, ldap.LDAPResultEntryAlreadyExists) {
+		t.Errorf("adding an existing entry returned %v, want entryAlreadyExists", err)
+	}
+	if err := conn.Del(ldap.NewDelRequest("ou=people,dc=example,dc=org", nil)); !ldap.IsErrorWithCode(err, ldap.LDAPResultNotAllowedOnNonLeaf) {
+		t.Errorf("deleting a parent entry returned %v, want notAllowedOnNonLeaf", err)
+	}
+}
+
+func TestBind(t *testing.T) {
+	s, conn := newTestServer(t)
+	dn := "cn=carol,ou=people,dc=example,dc=org"
+	if err := s.AddEntry(dn, map[string][]string{"objectClass": {"user"}, "unicodePwd": {unicodePwd("sécret")}, "userAccountControl": {"512"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.AddEntry("uid=dave,ou=people,dc=example,dc=org", map[string][]string{"userPassword": {"secret"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := conn.Bind("uid=dave,ou=people,dc=example,dc=org", "secret"); err != nil {
+		t.Errorf("binding with the userPassword returned %v", err)
+	}
+	if err := conn.Bind(dn, "sécret"); err != nil {
+		t.Errorf("binding with the unicodePwd returned %v", err)
+	}
+	if err := conn.Bind(dn, "wrong"); !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		t.Errorf("binding with a wrong password returned %v, want invalidCredentials", err)
+	}
+
+	// Disabled Active Directory accounts cannot bind
+	request := ldap.NewModifyRequest(dn, nil)
+	request.Replace("userAccountControl", []string{"514"})
+	if err := conn.Modify(request); err != nil {
+		t.Fatal(err)
+	}
+	if err := conn.Bind(dn, "sécret"); !ldap.IsErrorWithCode(err, ldap.LDAPResultInvalidCredentials) {
+		t.Errorf("binding to a disabled account returned %v, want invalidCredentials", err)
+	}
+}
+
+func TestPagedSearch(t *testing.T) {
+	s, conn := newTestServer(t)
+	request := ldap.NewSearchRequest("dc=example,dc=org", ldap.ScopeWholeSubtree, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, []ldap.Control{ldap.NewControlPaging(3)})
+
+	sr, err := conn.Search(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	control := ldap.FindControl(sr.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+	if len(sr.Entries) != 3 || len(control.Cookie) == 0 {
+		t.Fatalf("got %d entries and cookie %q, want 3 entries and a cookie", len(sr.Entries), control.Cookie)
+	}
+
+	// Cookies are bound to their connection
+	other, err := s.Dial(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	next := *request
+	next.Controls = []ldap.Control{&ldap.ControlPaging{PagingSize: 3, Cookie: control.Cookie}}
+	if _, err := other.Search(&next); !ldap.IsErrorWithCode(err, ldap.LDAPResultUnwillingToPerform) {
+		t.Fatalf("a cookie of another connection returned %v, want unwillingToPerform", err)
+	}
+
+	sr, err = conn.Search(&next)
+	if err != nil {
+		t.Fatal(err)
+	}
+	control = ldap.FindControl(sr.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging)
+	if len(sr.Entries) != 1 || len(control.Cookie) != 0 {
+		t.Fatalf("got %d entries and cookie %q on the last page, want 1 entry and no cookie", len(sr.Entries), control.Cookie)
+	}
+
+	s.IgnorePaging = true
+	sr, err = conn.Search(request)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sr.Entries) != 4 || len(sr.Controls) != 0 {
+		t.Fatalf("ignoring the control returned %d entries and controls %v, want 4 entries and no control", len(sr.Entries), sr.Controls)
+	}
+}
+
+func TestBreak(t *testing.T) {
+	s, conn := newTestServer(t)
+	s.Break()
+	if conn.IsClosing() {
+		t.Fatal("a broken connection is closing before its next request")
+	}
+	if _, err := conn.Search(ldap.NewSearchRequest("", ldap.ScopeBaseObject, ldap.NeverDerefAliases, 0, 0, false, "(objectClass=*)", nil, nil)); !ldap.IsErrorWithCode(err, ldap.ErrorNetwork) {
+		t.Fatalf("got %v, want a network error", err)
+	}
+	if !conn.IsClosing() || s.OpenConns() != 0 {
+		t.Fatal("a broken connection is not closing after a failed request")
+	}
+}
@@ -0,0 +1,103 @@
+package ldapctl
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Attributes marking reset passwords
+const (
+	// PasswordResetShadowLastChange sets the shadowLastChange of
+	// shadowAccount entries to 0 on reset, and to the day of the change
+	// otherwise
+	PasswordResetShadowLastChange = "shadowLastChange"
+	// PasswordResetPwdReset sets the pwdReset of the ppolicy overlay to TRUE
+	// on reset, and removes it otherwise
+	PasswordResetPwdReset = "pwdReset"
+	// PasswordResetNone leaves reset passwords unmarked
+	PasswordResetNone = "none"
+)
+
+// checkPasswordResetAttribute checks the configured password reset
+// attribute, which defaults to shadowLastChange
+func checkPasswordResetAttribute(attribute string) (string, error) {
+	switch attribute {
+	case "":
+		return PasswordResetShadowLastChange, nil
+	case PasswordResetShadowLastChange, PasswordResetPwdReset, PasswordResetNone:
+		return attribute, nil
+	}
+	return "", fmt.Errorf("unknown LDAP password reset attribute %q, must be shadowLastChange, pwdReset or none", attribute)
+}
+
+// UserPasswordChange replaces the password of the given user, which the
+// user no longer has to change. Active Directory passwords are cleartext,
+// and only set over TLS.
+func (c *Client) UserPasswordChange(ctx context.Context, user string, password string) error {
+	return c.setPassword(ctx, user, password, false)
+}
+
+// UserPasswordReset replaces the password of the given user with a
+// one-time password, which the user must change at the next login
+func (c *Client) UserPasswordReset(ctx context.Context, user string, password string) error {
+	return c.setPassword(ctx, user, password, true)
+}
+
+// setPassword replaces the password of the given user, marking it as reset
+// or not
+func (c *Client) setPassword(ctx context.Context, user string, password string, reset bool) error {
+	attribute, err := c.passwordAttribute(password)
+	if err != nil {
+		return err
+	}
+	entry, err := c.lookupEntry(ctx, c.config.UserSearchBaseDN, c.userScope, filterFor(c.config.UserSearchFilter, user), []string{"objectClass"})
+	if err != nil {
+		return err
+	}
+
+	modifyRequest := ldap.NewModifyRequest(entry.DN, nil)
+	modifyRequest.Replace(attribute.Type, attribute.Vals)
+
+	switch {
+	case c.activeDirectory():
+		// A pwdLastSet of 0 requires a change at the next logon, and -1
+		// sets it to the current time
+		if reset {
+			modifyRequest.Replace("pwdLastSet", []string{"0"})
+		} else {
+			modifyRequest.Replace("pwdLastSet", []string{"-1"})
+		}
+	case c.config.PasswordResetAttribute == PasswordResetPwdReset:
+		if reset {
+			modifyRequest.Replace("pwdReset", []string{"TRUE"})
+		} else {
+			modifyRequest.Replace("pwdReset", []string{})
+		}
+	case c.config.PasswordResetAttribute == PasswordResetShadowLastChange:
+		// Other entries cannot hold shadowLastChange
+		if hasObjectClass(entry, "shadowAccount") {
+			day := "0"
+			if !reset {
+				day = strconv.FormatInt(time.Now().Unix()/(24*60*60), 10)
+			}
+			modifyRequest.Replace("shadowLastChange", []string{day})
+		}
+	}
+
+	return c.modify(ctx, modifyRequest)
+}
+
+// hasObjectClass reports whether an entry has the given object class
+func hasObjectClass(entry *ldap.Entry, objectClass string) bool {
+	for _, value := range entry.GetAttributeValues("objectClass") {
+		if strings.EqualFold(value, objectClass) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,332 @@
+package ldapctl
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"time"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// ErrClosed is returned by the operations of a closed Client
+var ErrClosed = errors.New("client closed")
+
+// PoolStats describes the usage of the connection pool of a Client
+type PoolStats struct {
+	// MaxOpen is the maximum number of open connections
+	MaxOpen int `json:"max_open"`
+	// Open is the number of open connections, in use or idle
+	Open int `json:"open"`
+	// InUse is the number of connections used by an operation
+	InUse int `json:"in_use"`
+	// Idle is the number of idle connections
+	Idle int `json:"idle"`
+	// WaitCount is the number of operations that waited for a connection
+	WaitCount int64 `json:"wait_count"`
+	// WaitDuration is the total time operations waited for a connection
+	WaitDuration time.Duration `json:"wait_duration"`
+	// Dials is the number of connections opened and bound
+	Dials int64 `json:"dials"`
+	// DialErrors is the number of connections that failed to open or bind
+	DialErrors int64 `json:"dial_errors"`
+	// IdleClosed is the number of connections closed after the idle timeout
+	IdleClosed int64 `json:"idle_closed"`
+	// HealthCheckFailures is the number of idle connections found dead
+	// before their reuse
+	HealthCheckFailures int64 `json:"health_check_failures"`
+}
+
+// poolConn is a connection of the pool
+type poolConn struct {
+	conn ldap.Client
+	// usedAt is when the connection was last returned to the pool
+	usedAt time.Time
+	// reused is set when the connection was taken from the idle connections
+	reused bool
+}
+
+// pool is a bounded pool of bound connections. Idle connections are
+// closed after the idle timeout, and checked before their reuse when they
+// have been idle for longer than the health check interval, so that
+// connections broken by a server restart are replaced by new ones.
+type pool struct {
+	dial                DialFunc
+	maxOpen             int
+	maxIdle             int
+	idleTimeout         time.Duration
+	healthCheckInterval time.Duration
+
+	// slots holds a token per connection in use, bounding their number
+	slots chan struct{}
+
+	mu     sync.Mutex
+	idle   []*poolConn
+	open   int
+	closed bool
+	stats  PoolStats
+
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// newPool creates a new pool opening its connections with dial
+func newPool(dial DialFunc, maxOpen, maxIdle int, idleTimeout, healthCheckInterval time.Duration) *pool {
+	p := &pool{
+		dial:                dial,
+		maxOpen:             maxOpen,
+		maxIdle:             maxIdle,
+		idleTimeout:         idleTimeout,
+		healthCheckInterval: healthCheckInterval,
+		slots:               make(chan struct{}, maxOpen),
+		stop:                make(chan struct{}),
+		stopped:             make(chan struct{}),
+	}
+
+	if idleTimeout > 0 {
+		go p.janitor(idleTimeout / 2)
+	} else {
+		close(p.stopped)
+	}
+
+	return p
+}
+
+// janitor closes the connections idle for longer than the idle timeout
+// until the pool is closed
+func (p *pool) janitor(interval time.Duration) {
+	defer close(p.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-p.stop:
+			return
+		case now := <-ticker.C:
+			p.closeIdle(now)
+		}
+	}
+}
+
+// closeIdle closes the connections idle for longer than the idle timeout
+func (p *pool) closeIdle(now time.Time) {
+	p.mu.Lock()
+	var expired []*poolConn
+	kept := p.idle[:0]
+	for _, pc := range p.idle {
+		if now.Sub(pc.usedAt) > p.idleTimeout {
+			expired = append(expired, pc)
+		} else {
+			kept = append(kept, pc)
+		}
+	}
+	p.idle = kept
+	p.open -= len(expired)
+	p.stats.IdleClosed += int64(len(expired))
+	p.mu.Unlock()
+
+	for _, pc := range expired {
+		pc.conn.Close()
+	}
+}
+
+// get returns a connection, waiting for one to be available when the
+// maximum number of connections are in use. The connection must be given
+// back with put.
+func (p *pool) get(ctx context.Context) (*poolConn, error) {
+	select {
+	case p.slots <- struct{}{}:
+	default:
+		start := time.Now()
+		select {
+		case p.slots <- struct{}{}:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+		p.mu.Lock()
+		p.stats.WaitCount++
+		p.stats.WaitDuration += time.Since(start)
+		p.mu.Unlock()
+	}
+
+	for {
+		pc, err := p.popIdle()
+		if err != nil {
+			<-p.slots
+			return nil, err
+		}
+		if pc == nil {
+			break
+		}
+		if p.alive(ctx, pc) {
+			pc.reused = true
+			return pc, nil
+		}
+		p.discard(pc)
+		if err := ctx.Err(); err != nil {
+			<-p.slots
+			return nil, err
+		}
+	}
+
+	conn, err := p.dial(ctx)
+	p.mu.Lock()
+	if err != nil {
+		p.stats.DialErrors++
+		p.mu.Unlock()
+		<-p.slots
+		return nil, err
+	}
+	p.stats.Dials++
+	p.open++
+	p.mu.Unlock()
+
+	return &poolConn{conn: conn}, nil
+}
+
+// popIdle removes the most recently used idle connection from the pool,
+// and returns nil if there is none
+func (p *pool) popIdle() (*poolConn, error) {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	if p.closed {
+		return nil, ErrClosed
+	}
+	if len(p.idle) == 0 {
+		return nil, nil
+	}
+	pc := p.idle[len(p.idle)-1]
+	p.idle = p.idle[:len(p.idle)-1]
+	return pc, nil
+}
+
+// alive reports whether an idle connection can be reused. Connections
+// idle for longer than the health check interval are checked with a
+// search of the root DSE.
+func (p *pool) alive(ctx context.Context, pc *poolConn) bool {
+	idle := time.Since(pc.usedAt)
+	if p.idleTimeout > 0 && idle > p.idleTimeout {
+		p.mu.Lock()
+		p.stats.IdleClosed++
+		p.mu.Unlock()
+		return false
+	}
+
+	healthy := !pc.conn.IsClosing()
+	if healthy && p.healthCheckInterval > 0 && idle >= p.healthCheckInterval {
+		release := guard(ctx, pc.conn)
+		_, err := pc.conn.Search(ldap.NewSearchRequest(
+			"",
+			ldap.ScopeBaseObject,
+			ldap.NeverDerefAliases,
+			0,
+			0,
+			false,
+			"(objectClass=*)",
+			[]string{"1.1"},
+			nil,
+		))
+		release()
+		healthy = err == nil
+	}
+	if !healthy {
+		p.mu.Lock()
+		p.stats.HealthCheckFailures++
+		p.mu.Unlock()
+	}
+	return healthy
+}
+
+// put gives back a connection taken with get. It is kept for reuse unless
+// reuse is false, the connection is closing or there are enough idle
+// connections.
+func (p *pool) put(pc *poolConn, reuse bool) {
+	defer func() { <-p.slots }()
+
+	p.mu.Lock()
+	if !reuse || p.closed || pc.conn.IsClosing() || len(p.idle) >= p.maxIdle {
+		p.open--
+		p.mu.Unlock()
+		pc.conn.Close()
+		return
+	}
+	pc.usedAt = time.Now()
+	pc.reused = false
+	p.idle = append(p.idle, pc)
+	p.mu.Unlock()
+}
+
+// discard closes an idle connection removed from the pool
+func (p *pool) discard(pc *poolConn) {
+	p.mu.Lock()
+	p.open--
+	p.mu.Unlock()
+	pc.conn.Close()
+}
+
+// Stats returns the usage statistics of the pool
+func (p *pool) Stats() PoolStats {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stats := p.stats
+	stats.MaxOpen = p.maxOpen
+	stats.Open = p.open
+	stats.Idle = len(p.idle)
+	stats.InUse = p.open - len(p.idle)
+	return stats
+}
+
+// Close stops the janitor and closes the idle connections. Connections in
+// use are closed when they are given back.
+func (p *pool) Close() {
+	p.closeOnce.Do(func() {
+		close(p.stop)
+
+		p.mu.Lock()
+		idle := p.idle
+		p.idle = nil
+		p.open -= len(idle)
+		p.closed = true
+		p.mu.Unlock()
+
+		for _, pc := range idle {
+			pc.conn.Close()
+		}
+	})
+	<-p.stopped
+}
+
+// guard bounds the requests made on conn by the deadline of ctx, and
+// closes conn when ctx is cancelled, which aborts the pending request.
+// The returned function must be called once the requests are done.
+func guard(ctx context.Context, conn ldap.Client) func() {
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetTimeout(time.Until(deadline))
+	} else {
+		conn.SetTimeout(ldap.DefaultTimeout)
+	}
+
+	if ctx.Done() == nil {
+		return func() {}
+	}
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
+		}
+	}()
+	return func() { close(done) }
+}
+
+// isConnectionError reports whether err means that the connection is
+// unusable, as opposed to an LDAP result
+func isConnectionError(err error) bool {
+	return ldap.IsErrorWithCode(err, ldap.ErrorNetwork) || ldap.IsErrorWithCode(err, ldap.LDAPResultServerDown)
+}
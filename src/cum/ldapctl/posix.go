@@ -0,0 +1,81 @@
+package ldapctl
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+
+	"cum/types"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// posixAccountObjectClasses are the object classes of POSIX accounts
+var posixAccountObjectClasses = []string{"posixAccount", "shadowAccount"}
+
+// posixAccountAttributes are the attributes read into a PosixAccount
+var posixAccountAttributes = []string{"uidNumber", "gidNumber", "homeDirectory", "loginShell"}
+
+// PosixAccount holds the posixAccount attributes of a user
+type PosixAccount struct {
+	UIDNumber int64
+	// GIDNumber is the gidNumber of the primary group of the user
+	GIDNumber     int64
+	HomeDirectory string
+	// LoginShell is left out if empty
+	LoginShell string
+}
+
+// attributes returns the LDAP attributes of the account
+func (a *PosixAccount) attributes() []ldap.Attribute {
+	attributes := []ldap.Attribute{
+		{Type: "uidNumber", Vals: []string{strconv.FormatInt(a.UIDNumber, 10)}},
+		{Type: "gidNumber", Vals: []string{strconv.FormatInt(a.GIDNumber, 10)}},
+		{Type: "homeDirectory", Vals: []string{a.HomeDirectory}},
+	}
+	if a.LoginShell != "" {
+		attributes = append(attributes, ldap.Attribute{Type: "loginShell", Vals: []string{a.LoginShell}})
+	}
+	return attributes
+}
+
+// parsePosixAccount returns the POSIX attributes of an entry, or nil if it
+// has no uidNumber
+func parsePosixAccount(entry *ldap.Entry) (*PosixAccount, error) {
+	if entry.GetAttributeValue("uidNumber") == "" {
+		return nil, nil
+	}
+	account := &PosixAccount{
+		HomeDirectory: entry.GetAttributeValue("homeDirectory"),
+		LoginShell:    entry.GetAttributeValue("loginShell"),
+	}
+	var err error
+	if account.UIDNumber, err = strconv.ParseInt(entry.GetAttributeValue("uidNumber"), 10, 64); err != nil {
+		return nil, fmt.Errorf("%w: invalid uidNumber of %s: %v", types.ErrInvalidArgument, entry.DN, err)
+	}
+	if value := entry.GetAttributeValue("gidNumber"); value != "" {
+		if account.GIDNumber, err = strconv.ParseInt(value, 10, 64); err != nil {
+			return nil, fmt.Errorf("%w: invalid gidNumber of %s: %v", types.ErrInvalidArgument, entry.DN, err)
+		}
+	}
+	return account, nil
+}
+
+// missingValues returns the values of want missing from have, compared
+// case-insensitively like object classes
+func missingValues(have []string, want []string) []string {
+	var missing []string
+	for _, value := range want {
+		found := false
+		for _, other := range have {
+			if strings.EqualFold(value, other) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			missing = append(missing, value)
+		}
+	}
+	return missing
+}
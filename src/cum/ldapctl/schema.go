@@ -0,0 +1,218 @@
+package ldapctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"cum/types"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// Member formats of a schema
+const (
+	MemberFormatUID = "uid"
+	MemberFormatDN  = "dn"
+)
+
+// schemaProfiles are the predefined schemas, by profile name
+var schemaProfiles = map[string]types.LDAPSchema{
+	"rfc2307": {
+		GroupObjectClasses: []string{"top", "posixGroup"},
+		MemberAttribute:    "memberUid",
+		MemberFormat:       MemberFormatUID,
+	},
+	"rfc2307bis": {
+		GroupObjectClasses: []string{"top", "groupOfNames", "posixGroup"},
+		MemberAttribute:    "member",
+		MemberFormat:       MemberFormatDN,
+	},
+	"groupofnames": {
+		GroupObjectClasses: []string{"top", "groupOfNames"},
+		MemberAttribute:    "member",
+		MemberFormat:       MemberFormatDN,
+	},
+	"groupofuniquenames": {
+		GroupObjectClasses: []string{"top", "groupOfUniqueNames"},
+		MemberAttribute:    "uniqueMember",
+		MemberFormat:       MemberFormatDN,
+	},
+	ProfileActiveDirectory: {
+		UserObjectClasses:   []string{"top", "person", "organizationalPerson", "user"},
+		UserNamingAttribute: "sAMAccountName",
+		GroupObjectClasses:  []string{"top", "group"},
+		MemberAttribute:     "member",
+		MemberFormat:        MemberFormatDN,
+	},
+}
+
+// resolveSchema returns the schema with the settings that are not set
+// taken from its profile
+func resolveSchema(schema types.LDAPSchema) (types.LDAPSchema, error) {
+	if schema.Profile == "" {
+		schema.Profile = "rfc2307"
+	}
+	profile, ok := schemaProfiles[strings.ToLower(schema.Profile)]
+	if !ok {
+		return schema, fmt.Errorf("unknown LDAP schema profile %q, expected rfc2307, rfc2307bis, groupofnames, groupofuniquenames or activedirectory", schema.Profile)
+	}
+	if profile.UserObjectClasses == nil {
+		profile.UserObjectClasses = []string{"top", "person", "organizationalPerson", "inetOrgPerson"}
+	}
+	if profile.UserNamingAttribute == "" {
+		profile.UserNamingAttribute = "cn"
+	}
+
+	if len(schema.UserObjectClasses) == 0 {
+		schema.UserObjectClasses = profile.UserObjectClasses
+	}
+	if schema.UserNamingAttribute == "" {
+		schema.UserNamingAttribute = profile.UserNamingAttribute
+	}
+	if len(schema.GroupObjectClasses) == 0 {
+		schema.GroupObjectClasses = profile.GroupObjectClasses
+	}
+	if schema.GroupNamingAttribute == "" {
+		schema.GroupNamingAttribute = "cn"
+	}
+	if schema.MemberAttribute == "" {
+		schema.MemberAttribute = profile.MemberAttribute
+	}
+	if schema.MemberFormat == "" {
+		schema.MemberFormat = profile.MemberFormat
+	}
+
+	switch schema.MemberFormat {
+	case MemberFormatUID, MemberFormatDN:
+	default:
+		return schema, fmt.Errorf("unknown LDAP member format %q, expected uid or dn", schema.MemberFormat)
+	}
+	if schema.NestedGroups && schema.MemberFormat != MemberFormatDN {
+		return schema, fmt.Errorf("nested LDAP groups require the dn member format, not %q", schema.MemberFormat)
+	}
+	if schema.EmptyMember != "" {
+		if _, err := ldap.ParseDN(schema.EmptyMember); err != nil {
+			return schema, fmt.Errorf("invalid LDAP empty member %q: %v", schema.EmptyMember, err)
+		}
+	}
+	return schema, nil
+}
+
+// posixGroups reports whether groups are posixGroup and need a gidNumber
+func (c *Client) posixGroups() bool {
+	return len(missingValues(c.config.Schema.GroupObjectClasses, []string{"posixGroup"})) == 0
+}
+
+// isEmptyMember reports whether a member value is the placeholder of
+// empty groups
+func (c *Client) isEmptyMember(value string) bool {
+	return c.config.Schema.EmptyMember != "" && sameDN(value, c.config.Schema.EmptyMember)
+}
+
+// memberValue returns the value listing the given user in the members of
+// a group
+func (c *Client) memberValue(ctx context.Context, user string) (string, error) {
+	if c.config.Schema.MemberFormat == MemberFormatUID {
+		return user, nil
+	}
+	return c.userDN(ctx, user)
+}
+
+// groupMemberValue returns the value listing the given group in the
+// members of another group, its DN
+func (c *Client) groupMemberValue(ctx context.Context, group string) (string, error) {
+	if !c.config.Schema.NestedGroups {
+		return "", fmt.Errorf("%w: the LDAP schema does not nest groups", types.ErrInvalidArgument)
+	}
+	return c.groupDN(ctx, group)
+}
+
+// members returns the names of the users and of the nested groups listed
+// by member values, leaving out the placeholder of empty groups. DNs whose
+// RDN and parent are those of new user or group entries, and whose RDN is
+// the naming attribute, are read as is. Other DNs are looked up to tell
+// users from groups.
+func (c *Client) members(ctx context.Context, values []string) (users []string, groups []string, err error) {
+	schema := c.config.Schema
+	users = make([]string, 0, len(values))
+	for _, value := range values {
+		if c.isEmptyMember(value) {
+			continue
+		}
+		if schema.MemberFormat == MemberFormatUID {
+			users = append(users, value)
+			continue
+		}
+
+		var name string
+		var isUser bool
+		if strings.EqualFold(c.userRDNAttribute(), schema.UserNamingAttribute) {
+			name, isUser = entryName(value, schema.UserNamingAttribute, c.config.UserSearchBaseDN)
+		}
+		groupName, isGroup := entryName(value, schema.GroupNamingAttribute, c.config.GroupSearchBaseDN)
+		if isUser && !isGroup {
+			users = append(users, name)
+			continue
+		}
+		if isGroup && !isUser {
+			groups = append(groups, groupName)
+			continue
+		}
+
+		attributes := appendMissing([]string{"objectClass", schema.UserNamingAttribute}, schema.GroupNamingAttribute)
+		entry, err := c.lookupEntry(ctx, value, ldap.ScopeBaseObject, "(objectClass=*)", attributes)
+		if errors.Is(err, types.ErrNotFound) {
+			// A dangling member, such as a deleted user or group. Named
+			// like both new users and groups, it is listed as a user,
+			// which is removed by the same DN.
+			if isUser {
+				users = append(users, name)
+			}
+			continue
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+		groupClass := schema.GroupObjectClasses[len(schema.GroupObjectClasses)-1]
+		if len(missingValues(entry.GetAttributeValues("objectClass"), []string{groupClass})) == 0 {
+			if name := entry.GetAttributeValue(schema.GroupNamingAttribute); name != "" {
+				groups = append(groups, name)
+			}
+		} else if name := entry.GetAttributeValue(schema.UserNamingAttribute); name != "" {
+			users = append(users, name)
+		}
+	}
+	return users, groups, nil
+}
+
+// entryName returns the name held by the RDN of a DN, if the RDN is the
+// given naming attribute and the parent of the DN is the given base DN
+func entryName(value string, naming string, baseDN string) (string, bool) {
+	dn, err := ldap.ParseDN(value)
+	if err != nil || len(dn.RDNs) < 2 || len(dn.RDNs[0].Attributes) != 1 {
+		return "", false
+	}
+	attribute := dn.RDNs[0].Attributes[0]
+	if !strings.EqualFold(attribute.Type, naming) {
+		return "", false
+	}
+	base, err := ldap.ParseDN(baseDN)
+	if err != nil || !(&ldap.DN{RDNs: dn.RDNs[1:]}).EqualFold(base) {
+		return "", false
+	}
+	return attribute.Value, true
+}
+
+// sameDN reports whether two DNs are equal, ignoring the case and spacing
+// of their attribute types and values. DNs that cannot be parsed are
+// compared case-insensitively.
+func sameDN(a string, b string) bool {
+	dnA, errA := ldap.ParseDN(a)
+	dnB, errB := ldap.ParseDN(b)
+	if errA != nil || errB != nil {
+		return strings.EqualFold(a, b)
+	}
+	return dnA.EqualFold(dnB)
+}
@@ -0,0 +1,184 @@
+package ldapctl
+
+import (
+	"context"
+	"errors"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// defaultPageSize is the default page size of searches, the MaxPageSize of
+// Active Directory
+const defaultPageSize = 1000
+
+// EntryIterator iterates over the entries of a search. Searches paged with
+// the paged results control of RFC 2696 fetch the next page when the
+// entries of the previous one have been consumed, so that listing a large
+// directory holds a page in memory rather than the whole result.
+//
+// The iterator holds a connection of the pool from its first page to its
+// last one, since paging cookies are bound to their connection, and must
+// be closed once done with. Requests made with the client while iterating
+// use other connections of the pool.
+type EntryIterator struct {
+	client  *Client
+	ctx     context.Context
+	request *ldap.SearchRequest
+	naming  string
+	// paging is the paging control of the request, nil when the search is
+	// not paged
+	paging *ldap.ControlPaging
+
+	pc      *poolConn
+	entries []*ldap.Entry
+	entry   *ldap.Entry
+	done    bool
+	err     error
+}
+
+// stream returns an iterator over the entries matching a search request,
+// named by the given attribute. Searches without a size limit are paged
+// when a page size is set.
+func (c *Client) stream(ctx context.Context, request *ldap.SearchRequest, naming string) *EntryIterator {
+	it := &EntryIterator{client: c, ctx: ctx, request: request, naming: naming}
+	if request.SizeLimit == 0 && c.config.PageSize > 0 {
+		it.paging = ldap.NewControlPaging(uint32(c.config.PageSize))
+		paged := *request
+		paged.Controls = append(append([]ldap.Control(nil), request.Controls...), it.paging)
+		it.request = &paged
+	}
+	return it
+}
+
+// StreamUsers returns an iterator over all users, with the given attributes
+// and their naming attribute
+func (c *Client) StreamUsers(ctx context.Context, attributes []string) *EntryIterator {
+	naming := c.config.Schema.UserNamingAttribute
+	return c.stream(ctx, c.userSearchRequest(filterForAny(c.config.UserSearchFilter), appendMissing([]string{naming}, attributes...)), naming)
+}
+
+// StreamGroups returns an iterator over all groups, with the given
+// attributes and their naming attribute
+func (c *Client) StreamGroups(ctx context.Context, attributes []string) *EntryIterator {
+	naming := c.config.Schema.GroupNamingAttribute
+	return c.stream(ctx, c.groupSearchRequest(c.config.GroupSearchBaseDN, filterForAny(c.config.GroupSearchFilter), appendMissing([]string{naming}, attributes...)), naming)
+}
+
+// Next moves to the next entry, fetching the next page when needed. It
+// returns false at the end of the search or on error, which Err then
+// returns.
+func (it *EntryIterator) Next() bool {
+	for len(it.entries) == 0 {
+		if it.done || it.err != nil {
+			it.entry = nil
+			return false
+		}
+		it.err = it.fetch()
+	}
+	it.entry, it.entries = it.entries[0], it.entries[1:]
+	return true
+}
+
+// Entry returns the current entry
+func (it *EntryIterator) Entry() *ldap.Entry {
+	return it.entry
+}
+
+// Name returns the value of the naming attribute of the current entry,
+// empty when it has none
+func (it *EntryIterator) Name() string {
+	if it.entry == nil {
+		return ""
+	}
+	return it.entry.GetAttributeValue(it.naming)
+}
+
+// Err returns the error that ended the iteration, if any
+func (it *EntryIterator) Err() error {
+	return it.err
+}
+
+// Close ends the iteration and gives back its connection. A paged search
+// left before its last page is abandoned.
+func (it *EntryIterator) Close() {
+	it.done = true
+	it.entries = nil
+	it.entry = nil
+	if it.pc == nil {
+		return
+	}
+
+	// A page size of zero with the cookie of the search abandons it
+	it.paging.PagingSize = 0
+	release := guard(it.ctx, it.pc.conn)
+	_, err := it.pc.conn.Search(it.request)
+	release()
+	it.release(err == nil)
+}
+
+// fetch runs the search for the next page. When the connection of the
+// first page is a reused one that turns out to be broken, the search is
+// run again on another connection; later pages cannot be, as their cookie
+// is bound to the connection.
+func (it *EntryIterator) fetch() error {
+	first := it.pc == nil
+	for {
+		if it.pc == nil {
+			pc, err := it.client.pool.get(it.ctx)
+			if err != nil {
+				var ldapErr *Error
+				if errors.As(err, &ldapErr) {
+					return err
+				}
+				return newError(it.ctx, "search", it.request.BaseDN, err)
+			}
+			it.pc = pc
+		}
+
+		release := guard(it.ctx, it.pc.conn)
+		sr, err := it.pc.conn.Search(it.request)
+		release()
+
+		if err != nil {
+			broken := isConnectionError(err)
+			retry := broken && first && it.pc.reused && it.ctx.Err() == nil
+			it.release(!broken)
+			if retry {
+				continue
+			}
+			return newError(it.ctx, "search", it.request.BaseDN, err)
+		}
+
+		it.entries = sr.Entries
+		it.done = true
+		if it.paging != nil {
+			// Servers ignoring the control return every entry at once,
+			// without a paging control in their response
+			if control, ok := ldap.FindControl(sr.Controls, ldap.ControlTypePaging).(*ldap.ControlPaging); ok && len(control.Cookie) > 0 {
+				it.paging.SetCookie(control.Cookie)
+				it.done = false
+			}
+		}
+		if it.done {
+			it.release(true)
+		}
+		return nil
+	}
+}
+
+// release gives back the connection of the iterator
+func (it *EntryIterator) release(reuse bool) {
+	it.client.pool.put(it.pc, reuse)
+	it.pc = nil
+}
+
+// collect returns the entries of the search, with the first error met
+func (it *EntryIterator) collect() ([]*ldap.Entry, error) {
+	defer it.Close()
+
+	var entries []*ldap.Entry
+	for it.Next() {
+		entries = append(entries, it.Entry())
+	}
+	return entries, it.Err()
+}
@@ -0,0 +1,201 @@
+package ldapctl
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"testing"
+
+	"cum/ldapctl/ldaptest"
+	"cum/types"
+)
+
+// newTestStreamClient returns a client paging searches by two entries, and
+// its stand-in holding five users
+func newTestStreamClient(t *testing.T) (*Client, *ldaptest.Server) {
+	t.Helper()
+	c, server := newTestClient(t, &types.LDAPConfig{PageSize: 2})
+	for i := 1; i <= 5; i++ {
+		name := fmt.Sprintf("user%d", i)
+		err := server.AddEntry("cn="+name+",ou=people,dc=example,dc=org", map[string][]string{
+			"objectClass": {"top", "person", "organizationalPerson", "inetOrgPerson"},
+			"cn":          {name},
+			"sn":          {name},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return c, server
+}
+
+// searches returns the search requests served since the given number of
+// requests, leaving out the health checks of the root DSE
+func searches(server *ldaptest.Server, since int) []ldaptest.Request {
+	var searches []ldaptest.Request
+	for _, r := range server.Requests()[since:] {
+		if r.Op == "search" && r.DN != "" {
+			searches = append(searches, r)
+		}
+	}
+	return searches
+}
+
+// streamNames returns the names of the users of a stream
+func streamNames(t *testing.T, c *Client) []string {
+	t.Helper()
+	names, err := names(c.StreamUsers(context.Background(), nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	return names
+}
+
+var allUsers = []string{"user1", "user2", "user3", "user4", "user5"}
+
+func TestStreamPropagatesCookies(t *testing.T) {
+	c, server := newTestStreamClient(t)
+
+	if got := streamNames(t, c); !reflect.DeepEqual(got, allUsers) {
+		t.Fatalf("got %v, want %v", got, allUsers)
+	}
+
+	pages := searches(server, 0)
+	if len(pages) != 3 {
+		t.Fatalf("got %d searches, want 3 pages", len(pages))
+	}
+	seen := map[string]bool{}
+	for i, page := range pages {
+		if page.Paging == nil || page.Paging.PagingSize != 2 {
+			t.Fatalf("page %d: got paging control %v, want a page size of 2", i+1, page.Paging)
+		}
+		if page.Conn != pages[0].Conn {
+			t.Errorf("page %d was fetched on connection %d, not on the connection %d of the first page", i+1, page.Conn, pages[0].Conn)
+		}
+		cookie := string(page.Paging.Cookie)
+		if (i == 0) != (cookie == "") || seen[cookie] {
+			t.Errorf("page %d: got cookie %q, want no cookie on the first page and a new one after", i+1, cookie)
+		}
+		seen[cookie] = true
+	}
+	if stats := c.Stats(); stats.InUse != 0 || stats.Idle != 1 {
+		t.Errorf("got pool stats %+v after the last page, want the connection back in the pool", stats)
+	}
+}
+
+func TestStreamCloseAbandonsSearch(t *testing.T) {
+	c, server := newTestStreamClient(t)
+
+	it := c.StreamUsers(context.Background(), nil)
+	if !it.Next() || it.Name() != "user1" {
+		t.Fatalf("got %q, %v, want user1", it.Name(), it.Err())
+	}
+	it.Close()
+	if it.Next() {
+		t.Fatal("Next returned an entry after Close")
+	}
+
+	pages := searches(server, 0)
+	if len(pages) != 2 {
+		t.Fatalf("got %d searches, want the first page and the abandon", len(pages))
+	}
+	abandon := pages[1]
+	if abandon.Paging == nil || abandon.Paging.PagingSize != 0 || len(abandon.Paging.Cookie) == 0 || abandon.Conn != pages[0].Conn {
+		t.Fatalf("got %+v after Close, want a page size of 0 with the cookie, on the connection of the search", abandon)
+	}
+	if stats := c.Stats(); stats.InUse != 0 || stats.Idle != 1 {
+		t.Errorf("got pool stats %+v after Close, want the connection back in the pool", stats)
+	}
+
+	// Closing a finished iterator abandons nothing
+	requests := len(server.Requests())
+	it = c.StreamUsers(context.Background(), nil)
+	for it.Next() {
+	}
+	it.Close()
+	for _, page := range searches(server, requests) {
+		if page.Paging.PagingSize == 0 {
+			t.Fatal("closing a finished iterator abandoned its search")
+		}
+	}
+}
+
+func TestStreamRetriesBrokenFirstPage(t *testing.T) {
+	c, server := newTestStreamClient(t)
+
+	// An idle connection broken by a restart of the server
+	if got := streamNames(t, c); len(got) != 5 {
+		t.Fatalf("got %v", got)
+	}
+	server.Break()
+
+	requests := len(server.Requests())
+	if got := streamNames(t, c); !reflect.DeepEqual(got, allUsers) {
+		t.Fatalf("got %v after a restart, want %v", got, allUsers)
+	}
+	pages := searches(server, requests)
+	if len(pages) != 4 || pages[0].Conn == pages[1].Conn {
+		t.Fatalf("got searches %+v, want the first page retried on a new connection", pages)
+	}
+	for _, page := range pages[2:] {
+		if page.Conn != pages[1].Conn {
+			t.Errorf("a page was fetched on connection %d, not on the connection %d of the retried first page", page.Conn, pages[1].Conn)
+		}
+	}
+
+	// Later pages cannot be retried, as their cookie is bound to the
+	// broken connection
+	it := c.StreamUsers(context.Background(), nil)
+	defer it.Close()
+	for i := 0; i < 2; i++ {
+		if !it.Next() {
+			t.Fatal(it.Err())
+		}
+	}
+	server.Break()
+	if it.Next() {
+		t.Fatal("the search went on after its connection broke")
+	}
+	if !errors.Is(it.Err(), types.ErrBackendUnavailable) {
+		t.Fatalf("got %v, want ErrBackendUnavailable", it.Err())
+	}
+}
+
+func TestStreamWithoutPagingControl(t *testing.T) {
+	c, server := newTestStreamClient(t)
+	server.IgnorePaging = true
+
+	it := c.StreamUsers(context.Background(), nil)
+	defer it.Close()
+	if !it.Next() {
+		t.Fatal(it.Err())
+	}
+	// Every entry came at once, and the connection is given back
+	if stats := c.Stats(); stats.InUse != 0 {
+		t.Errorf("got pool stats %+v, want the connection back in the pool", stats)
+	}
+	got := []string{it.Name()}
+	for it.Next() {
+		got = append(got, it.Name())
+	}
+	if it.Err() != nil || !reflect.DeepEqual(got, allUsers) {
+		t.Fatalf("got %v, %v, want %v", got, it.Err(), allUsers)
+	}
+	if pages := searches(server, 0); len(pages) != 1 {
+		t.Fatalf("got %d searches, want 1", len(pages))
+	}
+}
+
+func TestStreamWithoutPaging(t *testing.T) {
+	c, server := newTestClient(t, &types.LDAPConfig{PageSize: -1})
+	if err := server.AddEntry("cn=alice,ou=people,dc=example,dc=org", map[string][]string{"objectClass": {"inetOrgPerson"}, "cn": {"alice"}}); err != nil {
+		t.Fatal(err)
+	}
+	if got := streamNames(t, c); !reflect.DeepEqual(got, []string{"alice"}) {
+		t.Fatalf("got %v, want alice", got)
+	}
+	if pages := searches(server, 0); len(pages) != 1 || pages[0].Paging != nil {
+		t.Fatalf("got searches %+v, want one without a paging control", pages)
+	}
+}
@@ -0,0 +1,72 @@
+package ldapctl
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"cum/types"
+)
+
+const (
+	// TLSModeNone sends everything in cleartext
+	TLSModeNone = "none"
+	// TLSModeLDAPS connects with TLS, to ldaps:// servers
+	TLSModeLDAPS = "ldaps"
+	// TLSModeStartTLS upgrades plain connections with the StartTLS operation
+	TLSModeStartTLS = "starttls"
+)
+
+// tlsConfig returns the TLS configuration of the connections, or nil when
+// TLS is disabled. Insecure settings are refused when RefuseInsecure is set.
+func tlsConfig(config *types.LDAPConfig) (*tls.Config, error) {
+	switch config.TLSMode {
+	case "", TLSModeNone:
+		if config.RefuseInsecure {
+			return nil, errors.New("LDAP TLS mode none is refused, use ldaps or starttls")
+		}
+		return nil, nil
+	case TLSModeLDAPS, TLSModeStartTLS:
+	default:
+		return nil, fmt.Errorf("unknown LDAP TLS mode %q, must be none, ldaps or starttls", config.TLSMode)
+	}
+
+	if config.InsecureSkipVerify && config.RefuseInsecure {
+		return nil, errors.New("skipping the verification of the LDAP server certificate is refused")
+	}
+
+	tc := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		ServerName:         config.TLSServerName,
+		InsecureSkipVerify: config.InsecureSkipVerify,
+	}
+	if tc.ServerName == "" {
+		tc.ServerName = config.Host
+	}
+
+	if config.CACertFile != "" {
+		pem, err := os.ReadFile(config.CACertFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read the LDAP CA bundle: %w", err)
+		}
+		tc.RootCAs = x509.NewCertPool()
+		if !tc.RootCAs.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificate found in the LDAP CA bundle %s", config.CACertFile)
+		}
+	}
+
+	if config.ClientCertFile != "" || config.ClientKeyFile != "" {
+		if config.ClientCertFile == "" || config.ClientKeyFile == "" {
+			return nil, errors.New("both the LDAP client certificate and key are required")
+		}
+		cert, err := tls.LoadX509KeyPair(config.ClientCertFile, config.ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the LDAP client certificate: %w", err)
+		}
+		tc.Certificates = []tls.Certificate{cert}
+	}
+
+	return tc, nil
+}
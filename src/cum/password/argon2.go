@@ -0,0 +1,102 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+
+	"golang.org/x/crypto/argon2"
+)
+
+const (
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+// Argon2id hashes passwords with argon2id
+type Argon2id struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+// NewArgon2id creates a new Argon2id algorithm with the given memory in
+// KiB, number of iterations and degree of parallelism
+func NewArgon2id(memory uint32, iterations uint32, parallelism uint8) (*Argon2id, error) {
+	if memory < 8*uint32(parallelism) || iterations < 1 || parallelism < 1 {
+		return nil, errors.New("invalid argon2id parameters")
+	}
+	return &Argon2id{
+		memory:      memory,
+		iterations:  iterations,
+		parallelism: parallelism,
+	}, nil
+}
+
+// IDs returns the PHC identifiers handled by the algorithm
+func (a *Argon2id) IDs() []string {
+	return []string{"argon2id"}
+}
+
+// Hash returns the PHC encoded hash of the password
+func (a *Argon2id) Hash(password string) (string, error) {
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	p := &phc{
+		ID:      "argon2id",
+		Version: argon2.Version,
+		Params: map[string]string{
+			"m": strconv.FormatUint(uint64(a.memory), 10),
+			"t": strconv.FormatUint(uint64(a.iterations), 10),
+			"p": strconv.FormatUint(uint64(a.parallelism), 10),
+		},
+		Order: []string{"m", "t", "p"},
+		Salt:  salt,
+		Hash:  argon2.IDKey([]byte(password), salt, a.iterations, a.memory, a.parallelism, argon2KeyLength),
+	}
+	return p.String(), nil
+}
+
+// Verify reports whether the password matches the encoded hash
+func (a *Argon2id) Verify(password string, encoded string) (bool, error) {
+	p, err := parsePHC(encoded, "argon2id")
+	if err != nil {
+		return false, err
+	}
+	if p.Version != argon2.Version {
+		return false, ErrInvalidHash
+	}
+	memory, err := p.intParam("m")
+	if err != nil {
+		return false, err
+	}
+	iterations, err := p.intParam("t")
+	if err != nil {
+		return false, err
+	}
+	parallelism, err := p.intParam("p")
+	if err != nil || parallelism > 255 {
+		return false, ErrInvalidHash
+	}
+
+	hash := argon2.IDKey([]byte(password), p.Salt, uint32(iterations), uint32(memory), uint8(parallelism), uint32(len(p.Hash)))
+	return subtle.ConstantTimeCompare(hash, p.Hash) == 1, nil
+}
+
+// NeedsRehash reports whether the encoded hash was made with parameters
+// other than the configured ones
+func (a *Argon2id) NeedsRehash(encoded string) bool {
+	p, err := parsePHC(encoded, "argon2id")
+	if err != nil {
+		return true
+	}
+	return p.Version != argon2.Version ||
+		p.Params["m"] != strconv.FormatUint(uint64(a.memory), 10) ||
+		p.Params["t"] != strconv.FormatUint(uint64(a.iterations), 10) ||
+		p.Params["p"] != strconv.FormatUint(uint64(a.parallelism), 10) ||
+		len(p.Hash) != argon2KeyLength
+}
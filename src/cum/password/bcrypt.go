@@ -0,0 +1,78 @@
+package password
+
+import (
+	"errors"
+	"fmt"
+
+	"cum/types"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+// maxBcryptPasswordLength is the length in bytes beyond which bcrypt
+// ignores the rest of a password
+const maxBcryptPasswordLength = 72
+
+// ErrPasswordTooLong is returned when hashing a password longer than
+// bcrypt can tell apart from its first 72 bytes
+var ErrPasswordTooLong = fmt.Errorf("%w: bcrypt passwords are limited to %d bytes", types.ErrInvalidArgument, maxBcryptPasswordLength)
+
+// Bcrypt hashes passwords with bcrypt. Bcrypt hashes keep their
+// traditional modular crypt format ($2a$<cost>$<salt+hash>), which PHC
+// compatible parsers accept as is.
+type Bcrypt struct {
+	cost int
+}
+
+// NewBcrypt creates a new Bcrypt algorithm with the given cost
+func NewBcrypt(cost int) (*Bcrypt, error) {
+	if cost < bcrypt.MinCost || cost > bcrypt.MaxCost {
+		return nil, errors.New("invalid bcrypt cost")
+	}
+	return &Bcrypt{cost: cost}, nil
+}
+
+// IDs returns the PHC identifiers handled by the algorithm
+func (b *Bcrypt) IDs() []string {
+	return []string{"bcrypt", "2a", "2b", "2y"}
+}
+
+// Hash returns the encoded hash of the password. Passwords longer than 72
+// bytes are refused rather than truncated.
+func (b *Bcrypt) Hash(password string) (string, error) {
+	if len(password) > maxBcryptPasswordLength {
+		return "", ErrPasswordTooLong
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), b.cost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
+}
+
+// Verify reports whether the password matches the encoded hash. Passwords
+// longer than 72 bytes never match, as bcrypt would only compare their
+// first 72 bytes.
+func (b *Bcrypt) Verify(password string, encoded string) (bool, error) {
+	if len(password) > maxBcryptPasswordLength {
+		return false, nil
+	}
+	err := bcrypt.CompareHashAndPassword([]byte(encoded), []byte(password))
+	if err != nil {
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return false, nil
+		}
+		return false, ErrInvalidHash
+	}
+	return true, nil
+}
+
+// NeedsRehash reports whether the encoded hash was made with a cost other
+// than the configured one
+func (b *Bcrypt) NeedsRehash(encoded string) bool {
+	cost, err := bcrypt.Cost([]byte(encoded))
+	if err != nil {
+		return true
+	}
+	return cost != b.cost
+}
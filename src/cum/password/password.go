@@ -0,0 +1,165 @@
+// Package password hashes and verifies user passwords. Hashes are stored
+// in the PHC string format ($<id>$<params>$<salt>$<hash>) so that the
+// algorithm and its cost travel with every hash, which allows hashes made
+// with an outdated algorithm or cost to be detected and upgraded on the
+// next successful login.
+package password
+
+import (
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"strings"
+)
+
+// ErrUnknownAlgorithm is returned when a hash uses an unsupported algorithm
+var ErrUnknownAlgorithm = errors.New("unknown password hashing algorithm")
+
+// ErrInvalidHash is returned when a hash cannot be parsed
+var ErrInvalidHash = errors.New("invalid password hash")
+
+// Algorithm is a password hashing algorithm
+type Algorithm interface {
+	// IDs returns the PHC identifiers handled by the algorithm
+	IDs() []string
+	// Hash returns the PHC encoded hash of the password
+	Hash(password string) (string, error)
+	// Verify reports whether the password matches the encoded hash
+	Verify(password string, encoded string) (bool, error)
+	// NeedsRehash reports whether the encoded hash was made with
+	// parameters other than the configured ones
+	NeedsRehash(encoded string) bool
+}
+
+// Config is the configuration for a Hasher
+type Config struct {
+	// Algorithm is the algorithm used for new hashes: argon2id, bcrypt or scrypt
+	Algorithm string
+
+	BcryptCost int
+
+	Argon2Memory      uint32
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
+
+	ScryptCost            int
+	ScryptBlockSize       int
+	ScryptParallelization int
+
+	// LegacyPlaintext verifies the stored values that are not PHC strings
+	// as legacy plain text passwords. When unset, such values never match.
+	LegacyPlaintext bool
+}
+
+// DefaultConfig returns the default hasher configuration
+func DefaultConfig() *Config {
+	return &Config{
+		Algorithm:             "argon2id",
+		BcryptCost:            12,
+		Argon2Memory:          64 * 1024,
+		Argon2Iterations:      3,
+		Argon2Parallelism:     2,
+		ScryptCost:            15,
+		ScryptBlockSize:       8,
+		ScryptParallelization: 1,
+	}
+}
+
+// Hasher hashes new passwords with the preferred algorithm and verifies
+// passwords against hashes made with any of the supported algorithms
+type Hasher struct {
+	preferred       Algorithm
+	algorithms      map[string]Algorithm
+	legacyPlaintext bool
+}
+
+// NewHasher creates a new Hasher from the given configuration
+func NewHasher(config *Config) (*Hasher, error) {
+	argon2id, err := NewArgon2id(config.Argon2Memory, config.Argon2Iterations, config.Argon2Parallelism)
+	if err != nil {
+		return nil, err
+	}
+	bcrypt, err := NewBcrypt(config.BcryptCost)
+	if err != nil {
+		return nil, err
+	}
+	scrypt, err := NewScrypt(config.ScryptCost, config.ScryptBlockSize, config.ScryptParallelization)
+	if err != nil {
+		return nil, err
+	}
+
+	h := &Hasher{
+		algorithms:      make(map[string]Algorithm),
+		legacyPlaintext: config.LegacyPlaintext,
+	}
+	for _, algorithm := range []Algorithm{argon2id, bcrypt, scrypt} {
+		h.Register(algorithm)
+	}
+
+	preferred, ok := h.algorithms[config.Algorithm]
+	if !ok {
+		return nil, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, config.Algorithm)
+	}
+	h.preferred = preferred
+
+	return h, nil
+}
+
+// Register adds an algorithm that hashes can be verified against
+func (h *Hasher) Register(algorithm Algorithm) {
+	for _, id := range algorithm.IDs() {
+		h.algorithms[id] = algorithm
+	}
+}
+
+// Hash hashes the password with the preferred algorithm
+func (h *Hasher) Hash(password string) (string, error) {
+	return h.preferred.Hash(password)
+}
+
+// Verify reports whether the password matches the encoded hash and
+// whether the hash should be replaced by a fresh one made with the
+// preferred algorithm and cost.
+//
+// Values that are not PHC strings are invalid hashes, unless legacy plain
+// text passwords are enabled, in which case they are compared with the
+// password and always need a rehash.
+func (h *Hasher) Verify(password string, encoded string) (ok bool, rehash bool, err error) {
+	if encoded == "" {
+		return false, false, nil
+	}
+
+	if !strings.HasPrefix(encoded, "$") {
+		if !h.legacyPlaintext {
+			return false, false, fmt.Errorf("%w: not a PHC string", ErrInvalidHash)
+		}
+		ok = subtle.ConstantTimeCompare([]byte(password), []byte(encoded)) == 1
+		return ok, ok, nil
+	}
+
+	id, err := identifier(encoded)
+	if err != nil {
+		return false, false, err
+	}
+	algorithm, found := h.algorithms[id]
+	if !found {
+		return false, false, fmt.Errorf("%w: %s", ErrUnknownAlgorithm, id)
+	}
+
+	ok, err = algorithm.Verify(password, encoded)
+	if err != nil || !ok {
+		return false, false, err
+	}
+
+	rehash = algorithm != h.preferred || algorithm.NeedsRehash(encoded)
+	return true, rehash, nil
+}
+
+// identifier returns the algorithm identifier of a PHC string
+func identifier(encoded string) (string, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) < 3 || parts[0] != "" || parts[1] == "" {
+		return "", ErrInvalidHash
+	}
+	return parts[1], nil
+}
@@ -0,0 +1,219 @@
+package password
+
+import (
+	"errors"
+	"strings"
+	"testing"
+
+	"cum/types"
+)
+
+// testConfig returns a configuration with the lowest costs, for fast tests
+func testConfig(algorithm string) *Config {
+	return &Config{
+		Algorithm:             algorithm,
+		BcryptCost:            4,
+		Argon2Memory:          64,
+		Argon2Iterations:      1,
+		Argon2Parallelism:     1,
+		ScryptCost:            4,
+		ScryptBlockSize:       8,
+		ScryptParallelization: 1,
+	}
+}
+
+func newTestHasher(t *testing.T, config *Config) *Hasher {
+	t.Helper()
+	h, err := NewHasher(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return h
+}
+
+var algorithms = []string{"argon2id", "bcrypt", "scrypt"}
+
+func TestHasherRoundTrip(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			h := newTestHasher(t, testConfig(algorithm))
+
+			encoded, err := h.Hash("correct horse")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			ok, rehash, err := h.Verify("correct horse", encoded)
+			if err != nil || !ok || rehash {
+				t.Fatalf("Verify(correct password) = %v, %v, %v, want true, false, nil", ok, rehash, err)
+			}
+
+			ok, rehash, err = h.Verify("wrong horse", encoded)
+			if err != nil || ok || rehash {
+				t.Fatalf("Verify(wrong password) = %v, %v, %v, want false, false, nil", ok, rehash, err)
+			}
+
+			ok, _, err = h.Verify("", encoded)
+			if err != nil || ok {
+				t.Fatalf("Verify(empty password) = %v, %v, want false, nil", ok, err)
+			}
+		})
+	}
+}
+
+func TestBcryptLongPasswords(t *testing.T) {
+	h := newTestHasher(t, testConfig("bcrypt"))
+	longest := strings.Repeat("a", 72)
+
+	if _, err := h.Hash(longest + "b"); !errors.Is(err, ErrPasswordTooLong) || !errors.Is(err, types.ErrInvalidArgument) {
+		t.Fatalf("hashing a password of 73 bytes returned %v, want ErrPasswordTooLong", err)
+	}
+	encoded, err := h.Hash(longest)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ok, _, err := h.Verify(longest, encoded); err != nil || !ok {
+		t.Fatalf("Verify of a password of 72 bytes = %v, %v, want true, nil", ok, err)
+	}
+	// bcrypt only compares the first 72 bytes
+	if ok, _, err := h.Verify(longest+"b", encoded); err != nil || ok {
+		t.Fatalf("Verify of a longer password sharing its first 72 bytes = %v, %v, want false, nil", ok, err)
+	}
+
+	// Other algorithms take passwords of any length
+	argon2 := newTestHasher(t, testConfig("argon2id"))
+	if _, err := argon2.Hash(longest + "b"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestHasherRehash(t *testing.T) {
+	for _, algorithm := range algorithms {
+		t.Run(algorithm, func(t *testing.T) {
+			old := newTestHasher(t, testConfig(algorithm))
+			encoded, err := old.Hash("secret")
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// A higher cost of the same algorithm
+			config := testConfig(algorithm)
+			config.BcryptCost++
+			config.Argon2Iterations++
+			config.ScryptCost++
+			ok, rehash, err := newTestHasher(t, config).Verify("secret", encoded)
+			if err != nil || !ok || !rehash {
+				t.Fatalf("Verify with another cost = %v, %v, %v, want true, true, nil", ok, rehash, err)
+			}
+
+			// Another preferred algorithm
+			for _, other := range algorithms {
+				if other == algorithm {
+					continue
+				}
+				ok, rehash, err := newTestHasher(t, testConfig(other)).Verify("secret", encoded)
+				if err != nil || !ok || !rehash {
+					t.Fatalf("Verify with %s preferred = %v, %v, %v, want true, true, nil", other, ok, rehash, err)
+				}
+			}
+
+			// A wrong password never asks for a rehash
+			_, rehash, _ = newTestHasher(t, config).Verify("wrong", encoded)
+			if rehash {
+				t.Fatal("Verify(wrong password) asked for a rehash")
+			}
+		})
+	}
+}
+
+func TestHasherInvalidHashes(t *testing.T) {
+	h := newTestHasher(t, testConfig("argon2id"))
+
+	tests := []struct {
+		name    string
+		encoded string
+	}{
+		{"scrypt empty hash", "$scrypt$ln=4,r=8,p=1$c2FsdHNhbHQ$"},
+		{"scrypt empty salt", "$scrypt$ln=4,r=8,p=1$$YWFhYWFhYWFhYWFhYWFhYQ"},
+		{"scrypt short hash", "$scrypt$ln=4,r=8,p=1$c2FsdHNhbHQ$YWFh"},
+		{"scrypt missing hash", "$scrypt$ln=4,r=8,p=1$c2FsdHNhbHQ"},
+		{"scrypt missing parameter", "$scrypt$ln=4,r=8$c2FsdHNhbHQ$YWFhYWFhYWFhYWFhYWFhYQ"},
+		{"scrypt invalid parameter", "$scrypt$ln=x,r=8,p=1$c2FsdHNhbHQ$YWFhYWFhYWFhYWFhYWFhYQ"},
+		{"scrypt cost too high", "$scrypt$ln=31,r=8,p=1$c2FsdHNhbHQ$YWFhYWFhYWFhYWFhYWFhYQ"},
+		{"argon2id empty hash", "$argon2id$v=19$m=65536,t=3,p=2$c2FsdHNhbHQ$"},
+		{"argon2id empty salt", "$argon2id$v=19$m=64,t=1,p=1$$YWFhYWFhYWFhYWFhYWFhYQ"},
+		{"argon2id short hash", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$YWFh"},
+		{"argon2id invalid base64", "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$!!!!"},
+		{"argon2id unsupported version", "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$YWFhYWFhYWFhYWFhYWFhYQ"},
+		{"argon2id invalid version", "$argon2id$v=x$m=64,t=1,p=1$c2FsdHNhbHQ$YWFhYWFhYWFhYWFhYWFhYQ"},
+		{"argon2id parallelism too high", "$argon2id$v=19$m=64,t=1,p=256$c2FsdHNhbHQ$YWFhYWFhYWFhYWFhYWFhYQ"},
+		{"argon2id malformed parameters", "$argon2id$v=19$m64$c2FsdHNhbHQ$YWFhYWFhYWFhYWFhYWFhYQ"},
+		{"bcrypt malformed", "$2b$04$short"},
+		{"no identifier", "$$c2FsdHNhbHQ$YWFh"},
+		{"unknown algorithm", "$md5$c2FsdHNhbHQ$YWFhYWFhYWFhYWFhYWFhYQ"},
+		{"not a PHC string", "{SSHA}c2FsdHNhbHQ"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			for _, password := range []string{"", "anything"} {
+				ok, rehash, err := h.Verify(password, tt.encoded)
+				if ok || rehash {
+					t.Fatalf("Verify(%q) = %v, %v, want false, false", password, ok, rehash)
+				}
+				if err == nil {
+					t.Fatalf("Verify(%q) returned no error", password)
+				}
+			}
+		})
+	}
+}
+
+func TestHasherInvalidHashErrors(t *testing.T) {
+	h := newTestHasher(t, testConfig("argon2id"))
+
+	_, _, err := h.Verify("secret", "$md5$c2FsdHNhbHQ$YWFhYWFhYWFhYWFhYWFhYQ")
+	if !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("got error %v, want ErrUnknownAlgorithm", err)
+	}
+	_, _, err = h.Verify("secret", "$scrypt$ln=4,r=8,p=1$c2FsdHNhbHQ$")
+	if !errors.Is(err, ErrInvalidHash) {
+		t.Fatalf("got error %v, want ErrInvalidHash", err)
+	}
+}
+
+func TestHasherNoPassword(t *testing.T) {
+	h := newTestHasher(t, testConfig("argon2id"))
+
+	ok, rehash, err := h.Verify("", "")
+	if ok || rehash || err != nil {
+		t.Fatalf("Verify of an empty value = %v, %v, %v, want false, false, nil", ok, rehash, err)
+	}
+}
+
+func TestHasherLegacyPlaintext(t *testing.T) {
+	disabled := newTestHasher(t, testConfig("argon2id"))
+	ok, _, err := disabled.Verify("secret", "secret")
+	if ok || !errors.Is(err, ErrInvalidHash) {
+		t.Fatalf("Verify of a plain text value without opt-in = %v, %v, want false, ErrInvalidHash", ok, err)
+	}
+
+	config := testConfig("argon2id")
+	config.LegacyPlaintext = true
+	enabled := newTestHasher(t, config)
+
+	ok, rehash, err := enabled.Verify("secret", "secret")
+	if err != nil || !ok || !rehash {
+		t.Fatalf("Verify of a matching plain text value = %v, %v, %v, want true, true, nil", ok, rehash, err)
+	}
+	ok, rehash, err = enabled.Verify("wrong", "secret")
+	if err != nil || ok || rehash {
+		t.Fatalf("Verify of another plain text value = %v, %v, %v, want false, false, nil", ok, rehash, err)
+	}
+}
+
+func TestNewHasherUnknownAlgorithm(t *testing.T) {
+	if _, err := NewHasher(testConfig("md5")); !errors.Is(err, ErrUnknownAlgorithm) {
+		t.Fatalf("got error %v, want ErrUnknownAlgorithm", err)
+	}
+}
@@ -0,0 +1,120 @@
+package password
+
+import (
+	"encoding/base64"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// phc is a parsed PHC string:
+//
+//	$<id>[$v=<version>][$<param>=<value>(,<param>=<value>)*][$<salt>[$<hash>]]
+type phc struct {
+	ID      string
+	Version int
+	Params  map[string]string
+	// Order is the order in which Params are encoded
+	Order []string
+	Salt  []byte
+	Hash  []byte
+}
+
+// Minimum lengths of the salt and hash of a PHC string. Deriving a key of
+// no length always matches, so shorter ones are refused before deriving.
+const (
+	minSaltLength = 8
+	minHashLength = 16
+)
+
+// b64 is the base64 encoding used by PHC strings (standard alphabet, no padding)
+var b64 = base64.RawStdEncoding
+
+// String returns the PHC string representation
+func (p *phc) String() string {
+	var sb strings.Builder
+	sb.WriteString("$")
+	sb.WriteString(p.ID)
+	if p.Version != 0 {
+		sb.WriteString(fmt.Sprintf("$v=%d", p.Version))
+	}
+	if len(p.Params) > 0 {
+		sb.WriteString("$")
+		sb.WriteString(p.encodeParams())
+	}
+	sb.WriteString("$")
+	sb.WriteString(b64.EncodeToString(p.Salt))
+	sb.WriteString("$")
+	sb.WriteString(b64.EncodeToString(p.Hash))
+	return sb.String()
+}
+
+// encodeParams encodes the parameters in order
+func (p *phc) encodeParams() string {
+	var params []string
+	for _, key := range p.Order {
+		if value, ok := p.Params[key]; ok {
+			params = append(params, key+"="+value)
+		}
+	}
+	return strings.Join(params, ",")
+}
+
+// parsePHC parses a PHC string with the given identifier. The salt and
+// hash must be at least minSaltLength and minHashLength bytes long.
+func parsePHC(encoded string, id string) (*phc, error) {
+	parts := strings.Split(encoded, "$")
+	if len(parts) < 4 || parts[0] != "" || parts[1] != id {
+		return nil, ErrInvalidHash
+	}
+
+	p := &phc{ID: id, Params: make(map[string]string)}
+	parts = parts[2:]
+
+	if strings.HasPrefix(parts[0], "v=") {
+		version, err := strconv.Atoi(strings.TrimPrefix(parts[0], "v="))
+		if err != nil {
+			return nil, ErrInvalidHash
+		}
+		p.Version = version
+		parts = parts[1:]
+	}
+
+	if len(parts) != 3 {
+		return nil, ErrInvalidHash
+	}
+
+	for _, param := range strings.Split(parts[0], ",") {
+		kv := strings.SplitN(param, "=", 2)
+		if len(kv) != 2 {
+			return nil, ErrInvalidHash
+		}
+		p.Params[kv[0]] = kv[1]
+	}
+
+	var err error
+	if p.Salt, err = b64.DecodeString(parts[1]); err != nil {
+		return nil, ErrInvalidHash
+	}
+	if p.Hash, err = b64.DecodeString(parts[2]); err != nil {
+		return nil, ErrInvalidHash
+	}
+	if len(p.Salt) < minSaltLength || len(p.Hash) < minHashLength {
+		return nil, fmt.Errorf("%w: salt or hash too short", ErrInvalidHash)
+	}
+
+	return p, nil
+}
+
+// intParam returns an integer parameter of the PHC string
+func (p *phc) intParam(key string) (int, error) {
+	value, ok := p.Params[key]
+	if !ok {
+		return 0, fmt.Errorf("%w: missing parameter %s", ErrInvalidHash, key)
+	}
+	n, err := strconv.Atoi(value)
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("%w: invalid parameter %s", ErrInvalidHash, key)
+	}
+	return n, nil
+}
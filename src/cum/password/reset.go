@@ -0,0 +1,50 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"math/big"
+)
+
+// oneTimeAlphabet are the characters of one-time passwords, leaving out
+// those easily confused with one another, such as 0 and O or 1 and l
+const oneTimeAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZabcdefghijkmnopqrstuvwxyz23456789"
+
+// OneTimePasswordLength is the length of the passwords returned by
+// GenerateOneTime, about 94 bits of entropy
+const OneTimePasswordLength = 16
+
+// GenerateOneTime returns a random one-time password, drawn uniformly from
+// letters and digits
+func GenerateOneTime() (string, error) {
+	max := big.NewInt(int64(len(oneTimeAlphabet)))
+	b := make([]byte, OneTimePasswordLength)
+	for i := range b {
+		n, err := rand.Int(rand.Reader, max)
+		if err != nil {
+			return "", err
+		}
+		b[i] = oneTimeAlphabet[n.Int64()]
+	}
+	return string(b), nil
+}
+
+// NewResetToken returns a random password reset token of 256 bits,
+// encoded in unpadded URL-safe base64
+func NewResetToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+// ResetTokenID returns the ID a reset token is stored by, the hex encoded
+// SHA-256 hash of the token, so that the stored resets cannot be redeemed
+// by whoever reads the storage
+func ResetTokenID(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
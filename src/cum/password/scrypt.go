@@ -0,0 +1,106 @@
+package password
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"strconv"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+const (
+	scryptSaltLength = 16
+	scryptKeyLength  = 32
+)
+
+// Scrypt hashes passwords with scrypt
+type Scrypt struct {
+	// cost is the base 2 logarithm of the CPU/memory cost parameter N
+	cost            int
+	blockSize       int
+	parallelization int
+}
+
+// NewScrypt creates a new Scrypt algorithm with the given log2 cost,
+// block size and parallelization
+func NewScrypt(cost int, blockSize int, parallelization int) (*Scrypt, error) {
+	if cost < 1 || cost > 30 || blockSize < 1 || parallelization < 1 {
+		return nil, errors.New("invalid scrypt parameters")
+	}
+	return &Scrypt{
+		cost:            cost,
+		blockSize:       blockSize,
+		parallelization: parallelization,
+	}, nil
+}
+
+// IDs returns the PHC identifiers handled by the algorithm
+func (s *Scrypt) IDs() []string {
+	return []string{"scrypt"}
+}
+
+// Hash returns the PHC encoded hash of the password
+func (s *Scrypt) Hash(password string) (string, error) {
+	salt := make([]byte, scryptSaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+
+	hash, err := scrypt.Key([]byte(password), salt, 1<<s.cost, s.blockSize, s.parallelization, scryptKeyLength)
+	if err != nil {
+		return "", err
+	}
+
+	p := &phc{
+		ID: "scrypt",
+		Params: map[string]string{
+			"ln": strconv.Itoa(s.cost),
+			"r":  strconv.Itoa(s.blockSize),
+			"p":  strconv.Itoa(s.parallelization),
+		},
+		Order: []string{"ln", "r", "p"},
+		Salt:  salt,
+		Hash:  hash,
+	}
+	return p.String(), nil
+}
+
+// Verify reports whether the password matches the encoded hash
+func (s *Scrypt) Verify(password string, encoded string) (bool, error) {
+	p, err := parsePHC(encoded, "scrypt")
+	if err != nil {
+		return false, err
+	}
+	cost, err := p.intParam("ln")
+	if err != nil || cost > 30 {
+		return false, ErrInvalidHash
+	}
+	blockSize, err := p.intParam("r")
+	if err != nil {
+		return false, err
+	}
+	parallelization, err := p.intParam("p")
+	if err != nil {
+		return false, err
+	}
+
+	hash, err := scrypt.Key([]byte(password), p.Salt, 1<<cost, blockSize, parallelization, len(p.Hash))
+	if err != nil {
+		return false, ErrInvalidHash
+	}
+	return subtle.ConstantTimeCompare(hash, p.Hash) == 1, nil
+}
+
+// NeedsRehash reports whether the encoded hash was made with parameters
+// other than the configured ones
+func (s *Scrypt) NeedsRehash(encoded string) bool {
+	p, err := parsePHC(encoded, "scrypt")
+	if err != nil {
+		return true
+	}
+	return p.Params["ln"] != strconv.Itoa(s.cost) ||
+		p.Params["r"] != strconv.Itoa(s.blockSize) ||
+		p.Params["p"] != strconv.Itoa(s.parallelization) ||
+		len(p.Hash) != scryptKeyLength
+}
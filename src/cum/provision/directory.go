@@ -0,0 +1,78 @@
+package provision
+
+import (
+	"context"
+	"errors"
+
+	"cum/ldapctl"
+	"cum/types"
+)
+
+// DirectoryConfig is the configuration for a Directory
+type DirectoryConfig struct {
+	// LDAP is the client of the directory the passwords are set in
+	LDAP *ldapctl.Client
+	// Posix configures the POSIX attributes of the users added with their
+	// password
+	Posix *PosixConfig
+}
+
+// Directory sets the passwords given in cleartext through the API in a
+// directory that cannot be given the stored hashes, such as Active
+// Directory, where the worker adds users without a password
+type Directory struct {
+	ldap  *ldapctl.Client
+	posix *PosixConfig
+}
+
+// NewDirectory creates a new Directory from the given configuration
+func NewDirectory(config *DirectoryConfig) *Directory {
+	return &Directory{
+		ldap:  config.LDAP,
+		posix: config.Posix.withDefaults(),
+	}
+}
+
+// AddUser adds a newly created user with its password, so that its
+// account is enabled from the start rather than disabled for lack of a
+// password. A user the worker added meanwhile is given the password and
+// enabled.
+func (d *Directory) AddUser(ctx context.Context, user *types.User, password string) error {
+	account, err := d.posix.account(ctx, user)
+	if err != nil {
+		return err
+	}
+	err = d.ldap.UserAdd(ctx, user.Username, password, account)
+	if !errors.Is(err, types.ErrAlreadyExists) {
+		return err
+	}
+	if err := d.ldap.UserPasswordChange(ctx, user.Username, password); err != nil {
+		return err
+	}
+	return d.ldap.UserSetEnabled(ctx, user.Username, true)
+}
+
+// SetPassword sets the password of a user, as a one-time password to
+// change at the next login when reset. A user the worker has not added
+// yet is added with the password, as by AddUser.
+func (d *Directory) SetPassword(ctx context.Context, user *types.User, password string, reset bool) error {
+	err := d.setPassword(ctx, user, password, reset)
+	if !errors.Is(err, types.ErrNotFound) {
+		return err
+	}
+	if err := d.AddUser(ctx, user, password); err != nil {
+		return err
+	}
+	if reset {
+		return d.setPassword(ctx, user, password, reset)
+	}
+	return nil
+}
+
+// setPassword sets the password of a user in its existing entry
+func (d *Directory) setPassword(ctx context.Context, user *types.User, password string, reset bool) error {
+	if reset {
+		return d.ldap.UserPasswordReset(ctx, user.Username, password)
+	}
+	return d.ldap.UserPasswordChange(ctx, user.Username, password)
+}
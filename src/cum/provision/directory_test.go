@@ -0,0 +1,120 @@
+package provision
+
+import (
+	"context"
+	"testing"
+
+	"cum/ldapctl"
+	"cum/ldapctl/ldaptest"
+	"cum/storage"
+	"cum/types"
+)
+
+// newTestDirectory returns a directory and a worker, not started, both
+// provisioning the changes of the returned storage to an Active Directory
+// stand-in, with a client of the stand-in
+func newTestDirectory(t *testing.T) (*Directory, *Worker, *Storage, *ldapctl.Client, *ldaptest.Server) {
+	t.Helper()
+	backend := storage.NewInMemoryStorage(&storage.InMemoryStorageConfig{})
+	t.Cleanup(func() { backend.Close() })
+	server := ldaptest.NewServer()
+	client, err := ldapctl.NewClientWithDial(&types.LDAPConfig{
+		BaseDN:            "dc=example,dc=org",
+		UserSearchBaseDN:  "ou=people,dc=example,dc=org",
+		GroupSearchBaseDN: "ou=groups,dc=example,dc=org",
+		TLSMode:           ldapctl.TLSModeLDAPS,
+		Schema:            types.LDAPSchema{Profile: ldapctl.ProfileActiveDirectory},
+	}, server.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+
+	posix := &PosixConfig{IDs: backend}
+	w := newWorker(&WorkerConfig{Storage: backend, Outbox: backend, LDAP: client, Posix: posix})
+	t.Cleanup(w.cancel)
+	d := NewDirectory(&DirectoryConfig{LDAP: client, Posix: posix})
+	return d, w, NewStorage(&StorageConfig{Storage: backend}), client, server
+}
+
+// checkCanBind checks that an Active Directory user is enabled and binds
+// with the given password
+func checkCanBind(t *testing.T, client *ldapctl.Client, user string, password string) {
+	t.Helper()
+	ctx := context.Background()
+	if enabled, err := client.UserEnabled(ctx, user); err != nil || !enabled {
+		t.Errorf("user %s is not enabled: %v", user, err)
+	}
+	if ok, err := client.UserCheck(ctx, user, password); err != nil || !ok {
+		t.Errorf("user %s cannot bind with its password: %v", user, err)
+	}
+}
+
+func TestDirectoryAddUser(t *testing.T) {
+	ctx := context.Background()
+	d, w, s, client, _ := newTestDirectory(t)
+
+	user := &types.User{ID: "u1", Username: "alice", Password: "hash"}
+	if err := s.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.AddUser(ctx, user, "sécret"); err != nil {
+		t.Fatal(err)
+	}
+	checkCanBind(t, client, "alice", "sécret")
+
+	// Applying the creation afterwards keeps the account usable
+	w.applyDue()
+	checkCanBind(t, client, "alice", "sécret")
+	if account, err := client.UserPosixAccount(ctx, "alice"); err != nil || account == nil || account.UIDNumber != 10000 {
+		t.Errorf("got POSIX account %+v (%v), want uidNumber 10000", account, err)
+	}
+}
+
+func TestDirectoryAddUserAfterWorker(t *testing.T) {
+	ctx := context.Background()
+	d, w, s, client, _ := newTestDirectory(t)
+
+	user := &types.User{ID: "u1", Username: "alice", Password: "hash"}
+	if err := s.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	// The worker adds the user first, disabled for lack of a password
+	w.applyDue()
+	if enabled, err := client.UserEnabled(ctx, "alice"); err != nil || enabled {
+		t.Fatalf("the worker added an enabled user: %v", err)
+	}
+
+	if err := d.AddUser(ctx, user, "sécret"); err != nil {
+		t.Fatal(err)
+	}
+	checkCanBind(t, client, "alice", "sécret")
+}
+
+func TestDirectorySetPasswordAddsMissingUser(t *testing.T) {
+	ctx := context.Background()
+	d, w, s, client, server := newTestDirectory(t)
+
+	for _, user := range []*types.User{{ID: "u1", Username: "alice"}, {ID: "u2", Username: "bob"}} {
+		if err := s.CreateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The worker has not added the users yet
+	if err := d.SetPassword(ctx, &types.User{ID: "u1", Username: "alice"}, "sécret", false); err != nil {
+		t.Fatal(err)
+	}
+	checkCanBind(t, client, "alice", "sécret")
+	if err := d.SetPassword(ctx, &types.User{ID: "u2", Username: "bob"}, "one-time", true); err != nil {
+		t.Fatal(err)
+	}
+	checkCanBind(t, client, "bob", "one-time")
+	if got := server.Entry("cn=bob,ou=people,dc=example,dc=org").GetAttributeValue("pwdLastSet"); got != "0" {
+		t.Errorf("got pwdLastSet %q for a one-time password, want 0", got)
+	}
+
+	w.applyDue()
+	checkCanBind(t, client, "alice", "sécret")
+	checkCanBind(t, client, "bob", "one-time")
+}
@@ -0,0 +1,397 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cum/ldapctl"
+	"cum/types"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// DefaultUserAttributes are the LDAP attributes the user fields are
+// imported from by default. The username is imported from the naming
+// attribute of the schema when it is not cn.
+var DefaultUserAttributes = map[string]string{
+	"username": "cn",
+	"email":    "mail",
+	"password": "userPassword",
+}
+
+// DefaultGroupAttributes are the LDAP attributes the group fields are
+// imported from by default. The name is imported from the naming
+// attribute of the schema when it is not cn.
+var DefaultGroupAttributes = map[string]string{
+	"name":        "cn",
+	"description": "description",
+}
+
+// ImportConfig is the configuration of an import
+type ImportConfig struct {
+	// Storage is the storage the users and groups are imported into
+	Storage types.Storage
+	// LDAP is the client of the LDAP server to import
+	LDAP *ldapctl.Client
+	// DryRun only reports the changes, without applying them
+	DryRun bool
+	// UserAttributes maps the user fields ("username", "email" and
+	// "password") to the LDAP attributes they are imported from. Missing
+	// fields are imported from their DefaultUserAttributes, and fields
+	// mapped to an empty attribute are not imported.
+	UserAttributes map[string]string
+	// GroupAttributes maps the group fields ("name" and "description") to
+	// the LDAP attributes they are imported from, like UserAttributes
+	GroupAttributes map[string]string
+	// PosixIDs, if set, stores the uidNumber and gidNumber of the LDAP
+	// users and groups, as the numbers of the users and groups they are
+	// imported as, so that they are not allocated to other ones
+	PosixIDs types.PosixIDStorage
+}
+
+// ImportReport is the result of an import
+type ImportReport struct {
+	// Changes are the changes applied to the storage, or to apply in a dry
+	// run
+	Changes []Change `json:"changes"`
+	// Skipped are the LDAP users, groups and members that are not imported
+	Skipped []Skip `json:"skipped"`
+	// PosixConflicts are the POSIX numbers of LDAP users and groups that
+	// could not be stored
+	PosixConflicts []PosixConflict `json:"posix_conflicts"`
+}
+
+// Skip is an LDAP user, group or member that is not imported
+type Skip struct {
+	// EntityType is "user", "group" or "member"
+	EntityType string `json:"entity_type"`
+	// Name is the name of the entry in LDAP
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// String returns a string representation of the skip
+func (s Skip) String() string {
+	return fmt.Sprintf("%s %s: %s", s.EntityType, s.Name, s.Reason)
+}
+
+// importer imports LDAP users and groups into the storage
+type importer struct {
+	*syncer
+	userAttributes  map[string]string
+	groupAttributes map[string]string
+	posixIDs        types.PosixIDStorage
+	skipped         []Skip
+	posixConflicts  []PosixConflict
+	// users and groups are the central users and groups, keyed by their
+	// LDAP name
+	users  map[string]*types.User
+	groups map[string]*types.Group
+	// added are the users and groups added by the import, keyed by their
+	// central username, email and name, which a dry run does not store
+	addedUsernames map[string]*types.User
+	addedEmails    map[string]*types.User
+	addedGroups    map[string]*types.Group
+}
+
+// Import creates the users and groups of LDAP that are missing from the
+// storage, and adds their members. Users and groups are matched by name,
+// and those already in the storage are left as is, so importing again only
+// adds what changed in LDAP since. It returns the changes made so far on
+// error.
+func Import(ctx context.Context, config *ImportConfig) (*ImportReport, error) {
+	schema := config.LDAP.Schema()
+	userAttributes, err := attributeMap(config.UserAttributes, DefaultUserAttributes, "username", schema.UserNamingAttribute)
+	if err != nil {
+		return nil, err
+	}
+	groupAttributes, err := attributeMap(config.GroupAttributes, DefaultGroupAttributes, "name", schema.GroupNamingAttribute)
+	if err != nil {
+		return nil, err
+	}
+
+	im := &importer{
+		syncer:          &syncer{storage: config.Storage, ldap: config.LDAP, dryRun: config.DryRun},
+		userAttributes:  userAttributes,
+		groupAttributes: groupAttributes,
+		posixIDs:        config.PosixIDs,
+		users:           map[string]*types.User{},
+		groups:          map[string]*types.Group{},
+		addedUsernames:  map[string]*types.User{},
+		addedEmails:     map[string]*types.User{},
+		addedGroups:     map[string]*types.Group{},
+	}
+	report := &ImportReport{}
+	defer func() {
+		report.Changes, report.Skipped, report.PosixConflicts = im.changes, im.skipped, im.posixConflicts
+	}()
+
+	// Entries are streamed a page at a time, and only the names of the
+	// groups are kept to import their members once every group exists
+	users := config.LDAP.StreamUsers(ctx, append(attributeList(userAttributes), posixNumberAttributes["user"]))
+	defer users.Close()
+	for users.Next() {
+		if name := users.Name(); name != "" {
+			if err := im.importUser(ctx, name, users.Entry()); err != nil {
+				return report, err
+			}
+			if err := im.reservePosixID(ctx, "user", name, users.Entry()); err != nil {
+				return report, err
+			}
+		}
+	}
+	if err := users.Err(); err != nil {
+		return report, err
+	}
+
+	var groupNames []string
+	seen := map[string]bool{}
+	groups := config.LDAP.StreamGroups(ctx, append(attributeList(groupAttributes), posixNumberAttributes["group"]))
+	defer groups.Close()
+	for groups.Next() {
+		name := groups.Name()
+		if name == "" || seen[name] {
+			continue
+		}
+		seen[name] = true
+		groupNames = append(groupNames, name)
+		if err := im.importGroup(ctx, name, groups.Entry()); err != nil {
+			return report, err
+		}
+		if err := im.reservePosixID(ctx, "group", name, groups.Entry()); err != nil {
+			return report, err
+		}
+	}
+	if err := groups.Err(); err != nil {
+		return report, err
+	}
+	for _, name := range groupNames {
+		if err := im.importMembers(ctx, name); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// importUser creates the user of an LDAP entry, unless a user with its
+// username exists
+func (im *importer) importUser(ctx context.Context, name string, entry *ldap.Entry) error {
+	username := entry.GetAttributeValue(im.userAttributes["username"])
+	if username == "" {
+		im.skip("user", name, fmt.Sprintf("no %s attribute", im.userAttributes["username"]))
+		return nil
+	}
+
+	user, err := im.storage.GetUserByUsername(ctx, username)
+	if added, ok := im.addedUsernames[username]; ok {
+		user, err = added, nil
+	}
+	if err == nil {
+		im.users[name] = user
+		return nil
+	}
+	if !errors.Is(err, types.ErrNotFound) {
+		return err
+	}
+
+	email := entry.GetAttributeValue(im.userAttributes["email"])
+	if email != "" {
+		other, err := im.storage.GetUserByEmail(ctx, email)
+		if added, ok := im.addedEmails[email]; ok {
+			other, err = added, nil
+		}
+		if err == nil {
+			im.skip("user", name, fmt.Sprintf("email %s is already taken by user %s", email, other.Username))
+			return nil
+		}
+		if !errors.Is(err, types.ErrNotFound) {
+			return err
+		}
+	}
+
+	id, err := types.NewID()
+	if err != nil {
+		return err
+	}
+	user = &types.User{
+		ID:       id,
+		Username: username,
+		Email:    email,
+		Password: importedPassword(entry.GetAttributeValue(im.userAttributes["password"])),
+	}
+	err = im.apply(Change{Action: "add", EntityType: "user", Name: username}, func() error {
+		return im.storage.CreateUser(ctx, user)
+	})
+	if err != nil {
+		return err
+	}
+	im.users[name] = user
+	im.addedUsernames[username] = user
+	if email != "" {
+		im.addedEmails[email] = user
+	}
+	return nil
+}
+
+// importGroup creates the group of an LDAP entry, unless a group with its
+// name exists
+func (im *importer) importGroup(ctx context.Context, name string, entry *ldap.Entry) error {
+	groupName := entry.GetAttributeValue(im.groupAttributes["name"])
+	if groupName == "" {
+		im.skip("group", name, fmt.Sprintf("no %s attribute", im.groupAttributes["name"]))
+		return nil
+	}
+
+	group, err := im.storage.GetGroupByName(ctx, groupName)
+	if added, ok := im.addedGroups[groupName]; ok {
+		group, err = added, nil
+	}
+	if err == nil {
+		im.groups[name] = group
+		return nil
+	}
+	if !errors.Is(err, types.ErrNotFound) {
+		return err
+	}
+
+	id, err := types.NewID()
+	if err != nil {
+		return err
+	}
+	group = &types.Group{
+		ID:          id,
+		Name:        groupName,
+		Description: entry.GetAttributeValue(im.groupAttributes["description"]),
+	}
+	err = im.apply(Change{Action: "add", EntityType: "group", Name: groupName}, func() error {
+		return im.storage.CreateGroup(ctx, group)
+	})
+	if err != nil {
+		return err
+	}
+	im.groups[name] = group
+	im.addedGroups[groupName] = group
+	return nil
+}
+
+// reservePosixID stores the POSIX number of an LDAP user or group as the
+// number of the user or group it is imported as, if any
+func (im *importer) reservePosixID(ctx context.Context, entityType string, name string, entry *ldap.Entry) error {
+	if im.posixIDs == nil || im.dryRun {
+		return nil
+	}
+	var id string
+	if user, ok := im.users[name]; ok && entityType == "user" {
+		id = user.ID
+	}
+	if group, ok := im.groups[name]; ok && entityType == "group" {
+		id = group.ID
+	}
+	conflict, err := reservePosixID(ctx, im.posixIDs, entityType, id, name, entry)
+	if conflict != nil {
+		im.posixConflicts = append(im.posixConflicts, *conflict)
+	}
+	return err
+}
+
+// importMembers adds the members of an LDAP group that are missing from
+// its central group
+func (im *importer) importMembers(ctx context.Context, name string) error {
+	group, ok := im.groups[name]
+	if !ok {
+		return nil
+	}
+	members, err := im.ldap.UserListFromGroup(ctx, name)
+	if err != nil {
+		return ignoreNotFound(err)
+	}
+	sort.Strings(members)
+
+	current := map[string]bool{}
+	for _, member := range group.Members {
+		if member != nil && *member != nil && (*member).GetType() == "user" {
+			current[(*member).GetID()] = true
+		}
+	}
+
+	for _, member := range members {
+		user, ok := im.users[member]
+		if !ok {
+			im.skip("member", member, fmt.Sprintf("member of group %s is not an imported user", group.Name))
+			continue
+		}
+		if current[user.ID] {
+			continue
+		}
+		current[user.ID] = true
+		err := im.apply(Change{Action: "add member", EntityType: "group", Name: group.Name, Member: user.Username}, func() error {
+			err := im.storage.AddMemberToGroup(ctx, user, group.ID)
+			if errors.Is(err, types.ErrAlreadyExists) {
+				return nil
+			}
+			return err
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// skip records an LDAP entry that is not imported
+func (im *importer) skip(entityType string, name string, reason string) {
+	im.skipped = append(im.skipped, Skip{EntityType: entityType, Name: name, Reason: reason})
+}
+
+// attributeMap returns the mapping of fields to LDAP attributes, with the
+// missing fields set to their defaults, the required field defaulting to
+// the naming attribute. It fails on unknown fields, and if the required
+// field is not mapped.
+func attributeMap(fields map[string]string, defaults map[string]string, required string, naming string) (map[string]string, error) {
+	mapping := make(map[string]string, len(defaults))
+	for field, attribute := range defaults {
+		mapping[field] = attribute
+	}
+	mapping[required] = naming
+	for field, attribute := range fields {
+		if _, ok := defaults[field]; !ok {
+			return nil, fmt.Errorf("%w: unknown field %q", types.ErrInvalidArgument, field)
+		}
+		mapping[field] = attribute
+	}
+	if mapping[required] == "" {
+		return nil, fmt.Errorf("%w: field %q must be mapped to an attribute", types.ErrInvalidArgument, required)
+	}
+	return mapping, nil
+}
+
+// attributeList returns the LDAP attributes of a mapping
+func attributeList(mapping map[string]string) []string {
+	var attributes []string
+	for _, attribute := range mapping {
+		if attribute != "" {
+			attributes = append(attributes, attribute)
+		}
+	}
+	sort.Strings(attributes)
+	return attributes
+}
+
+// importedPassword returns the password hash of a userPassword value, or an
+// empty string if the hash cannot be verified by the password package. It
+// is the reverse of ldapPassword.
+func importedPassword(value string) string {
+	i := strings.Index(value, "}")
+	if !strings.HasPrefix(value, "{") || i < 0 {
+		return ""
+	}
+	scheme, hash := strings.ToUpper(value[1:i]), value[i+1:]
+	if ldapPassword(hash) != "{"+scheme+"}"+hash {
+		return ""
+	}
+	return hash
+}
@@ -0,0 +1,181 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"cum/ldapctl"
+	"cum/types"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// unmanagedPosixPrefix prefixes the name of the LDAP users and groups that
+// are not in the storage to reserve their numbers under
+const unmanagedPosixPrefix = "ldap:"
+
+// posixNumberAttributes are the attributes of the POSIX numbers of LDAP
+// users and groups
+var posixNumberAttributes = map[string]string{"user": "uidNumber", "group": "gidNumber"}
+
+// PosixConflict is the uidNumber or gidNumber of an LDAP user or group
+// that could not be reserved
+type PosixConflict struct {
+	// EntityType is "user" or "group"
+	EntityType string `json:"entity_type"`
+	// Name is the name of the entry in LDAP
+	Name   string `json:"name"`
+	Reason string `json:"reason"`
+}
+
+// String returns a string representation of the conflict
+func (c PosixConflict) String() string {
+	return fmt.Sprintf("%s %s: %s", c.EntityType, c.Name, c.Reason)
+}
+
+// PosixConfig is the configuration of the POSIX attributes of the
+// provisioned users and groups
+type PosixConfig struct {
+	// IDs stores the uidNumber and gidNumber allocated to users and groups
+	IDs types.PosixIDStorage
+	// UIDMin and UIDMax bound the uidNumber of users. They default to 10000
+	// and 60000.
+	UIDMin int64
+	UIDMax int64
+	// GIDMin and GIDMax bound the gidNumber of groups. They default to 10000
+	// and 60000.
+	GIDMin int64
+	GIDMax int64
+	// UserGIDNumber is the gidNumber of the primary group of users. It
+	// defaults to 100, the users group of most distributions.
+	UserGIDNumber int64
+	// HomeDirectory is the home directory of users, %s being the username.
+	// It defaults to /home/%s.
+	HomeDirectory string
+	// LoginShell is the login shell of users. It defaults to /bin/bash.
+	LoginShell string
+}
+
+// withDefaults returns a copy of the configuration with the missing
+// settings set to their defaults
+func (c *PosixConfig) withDefaults() *PosixConfig {
+	config := *c
+	if config.UIDMin <= 0 {
+		config.UIDMin = 10000
+	}
+	if config.UIDMax < config.UIDMin {
+		config.UIDMax = 60000
+	}
+	if config.GIDMin <= 0 {
+		config.GIDMin = 10000
+	}
+	if config.GIDMax < config.GIDMin {
+		config.GIDMax = 60000
+	}
+	if config.UserGIDNumber <= 0 {
+		config.UserGIDNumber = 100
+	}
+	if config.HomeDirectory == "" {
+		config.HomeDirectory = "/home/%s"
+	}
+	if config.LoginShell == "" {
+		config.LoginShell = "/bin/bash"
+	}
+	return &config
+}
+
+// account returns the POSIX attributes of a user, allocating its
+// uidNumber if it has none
+func (c *PosixConfig) account(ctx context.Context, user *types.User) (*ldapctl.PosixAccount, error) {
+	uidNumber, err := c.IDs.AllocatePosixID(ctx, "user", user.ID, c.UIDMin, c.UIDMax)
+	if err != nil {
+		return nil, err
+	}
+	return &ldapctl.PosixAccount{
+		UIDNumber:     uidNumber,
+		GIDNumber:     c.UserGIDNumber,
+		HomeDirectory: strings.ReplaceAll(c.HomeDirectory, "%s", user.Username),
+		LoginShell:    c.LoginShell,
+	}, nil
+}
+
+// gidNumber returns the gidNumber of a group, allocating it if it has none
+func (c *PosixConfig) gidNumber(ctx context.Context, group *types.Group) (int64, error) {
+	return c.IDs.AllocatePosixID(ctx, "group", group.ID, c.GIDMin, c.GIDMax)
+}
+
+// reservePosixID reserves the POSIX number of an LDAP user or group, for
+// the user or group of the storage with the given ID, or under the name of
+// the entry when id is empty, so that it is not allocated to another one.
+// A number that cannot be reserved is returned as a conflict.
+func reservePosixID(ctx context.Context, ids types.PosixIDStorage, entityType string, id string, name string, entry *ldap.Entry) (*PosixConflict, error) {
+	attribute := posixNumberAttributes[entityType]
+	value := entry.GetAttributeValue(attribute)
+	if value == "" {
+		return nil, nil
+	}
+	number, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return &PosixConflict{EntityType: entityType, Name: name, Reason: fmt.Sprintf("invalid %s %q", attribute, value)}, nil
+	}
+
+	if id == "" {
+		id = unmanagedPosixPrefix + name
+	}
+	err = ids.ReservePosixID(ctx, entityType, id, number)
+	if errors.Is(err, types.ErrConflict) {
+		return &PosixConflict{EntityType: entityType, Name: name, Reason: err.Error()}, nil
+	}
+	return nil, err
+}
+
+// reservePosixIDs reserves the uidNumber of every LDAP user and the
+// gidNumber of every LDAP group, for the user or group of the storage
+// with the same name if any. It returns the numbers that could not be
+// reserved.
+func reservePosixIDs(ctx context.Context, storage types.Storage, ids types.PosixIDStorage, client *ldapctl.Client) ([]PosixConflict, error) {
+	var conflicts []PosixConflict
+	reserve := func(it *ldapctl.EntryIterator, entityType string, lookup func(name string) (string, error)) error {
+		defer it.Close()
+		for it.Next() {
+			name := it.Name()
+			if name == "" {
+				continue
+			}
+			id, err := lookup(name)
+			if err != nil && !errors.Is(err, types.ErrNotFound) {
+				return err
+			}
+			conflict, err := reservePosixID(ctx, ids, entityType, id, name, it.Entry())
+			if err != nil {
+				return err
+			}
+			if conflict != nil {
+				conflicts = append(conflicts, *conflict)
+			}
+		}
+		return it.Err()
+	}
+
+	err := reserve(client.StreamUsers(ctx, []string{"uidNumber"}), "user", func(name string) (string, error) {
+		user, err := storage.GetUserByUsername(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		return user.ID, nil
+	})
+	if err != nil {
+		return conflicts, err
+	}
+	err = reserve(client.StreamGroups(ctx, []string{"gidNumber"}), "group", func(name string) (string, error) {
+		group, err := storage.GetGroupByName(ctx, name)
+		if err != nil {
+			return "", err
+		}
+		return group.ID, nil
+	})
+	return conflicts, err
+}
@@ -0,0 +1,135 @@
+package provision
+
+import (
+	"context"
+	"testing"
+
+	"cum/ldapctl/ldaptest"
+	"cum/storage"
+	"cum/types"
+)
+
+// addLDAPEntries adds users and groups to an LDAP stand-in, by name and
+// POSIX number
+func addLDAPEntries(t *testing.T, server *ldaptest.Server, users map[string]string, groups map[string]string) {
+	t.Helper()
+	for name, uidNumber := range users {
+		err := server.AddEntry("cn="+name+",ou=people,dc=example,dc=org", map[string][]string{
+			"objectClass": {"top", "person", "organizationalPerson", "inetOrgPerson", "posixAccount"},
+			"cn":          {name},
+			"sn":          {name},
+			"uid":         {name},
+			"uidNumber":   {uidNumber},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	for name, gidNumber := range groups {
+		err := server.AddEntry("cn="+name+",ou=groups,dc=example,dc=org", map[string][]string{
+			"objectClass": {"top", "posixGroup"},
+			"cn":          {name},
+			"gidNumber":   {gidNumber},
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// ldapNumber returns the value of a POSIX number attribute of an LDAP entry
+func ldapNumber(t *testing.T, server *ldaptest.Server, dn string, attribute string) string {
+	t.Helper()
+	entry := server.Entry(dn)
+	if entry == nil {
+		t.Fatalf("no LDAP entry %s", dn)
+	}
+	return entry.GetAttributeValue(attribute)
+}
+
+func TestReconcileReservesLDAPNumbers(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewInMemoryStorage(&storage.InMemoryStorageConfig{})
+	t.Cleanup(func() { backend.Close() })
+	client, server := newTestLDAP(t)
+
+	// bob is in both, carol and the admins group only in LDAP
+	addLDAPEntries(t, server, map[string]string{"bob": "10000", "carol": "10003"}, map[string]string{"admins": "10001"})
+	for _, user := range []*types.User{{ID: "u1", Username: "alice"}, {ID: "u2", Username: "bob"}} {
+		if err := backend.CreateUser(ctx, user); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := backend.CreateGroup(ctx, &types.Group{ID: "g1", Name: "staff"}); err != nil {
+		t.Fatal(err)
+	}
+
+	report, err := Reconcile(ctx, &ReconcileConfig{Storage: backend, LDAP: client, Posix: &PosixConfig{IDs: backend}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.PosixConflicts) != 0 {
+		t.Fatalf("got conflicts %v", report.PosixConflicts)
+	}
+	if got := ldapNumber(t, server, "cn=alice,ou=people,dc=example,dc=org", "uidNumber"); got != "10001" {
+		t.Errorf("alice got uidNumber %s, want 10001 beside the numbers used in LDAP", got)
+	}
+	if got := ldapNumber(t, server, "cn=staff,ou=groups,dc=example,dc=org", "gidNumber"); got != "10000" {
+		t.Errorf("staff got gidNumber %s, want 10000 beside the numbers used in LDAP", got)
+	}
+	if id, err := backend.AllocatePosixID(ctx, "user", "u2", 10000, 60000); err != nil || id != 10000 {
+		t.Errorf("bob has number %d (%v), want his LDAP uidNumber 10000", id, err)
+	}
+
+	// A number of LDAP allocated to another user is reported
+	if err := backend.CreateUser(ctx, &types.User{ID: "u3", Username: "dave"}); err != nil {
+		t.Fatal(err)
+	}
+	addLDAPEntries(t, server, map[string]string{"dave": "10003"}, nil)
+	report, err = Reconcile(ctx, &ReconcileConfig{Storage: backend, LDAP: client, Posix: &PosixConfig{IDs: backend}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.PosixConflicts) != 1 || report.PosixConflicts[0].Name != "dave" {
+		t.Fatalf("got conflicts %v, want the one of dave", report.PosixConflicts)
+	}
+}
+
+func TestImportReservesLDAPNumbers(t *testing.T) {
+	ctx := context.Background()
+	backend := storage.NewInMemoryStorage(&storage.InMemoryStorageConfig{})
+	t.Cleanup(func() { backend.Close() })
+	client, server := newTestLDAP(t)
+	addLDAPEntries(t, server, map[string]string{"alice": "10005", "bob": "10001"}, map[string]string{"staff": "10002"})
+
+	// A dry run stores nothing
+	if _, err := Import(ctx, &ImportConfig{Storage: backend, LDAP: client, PosixIDs: backend, DryRun: true}); err != nil {
+		t.Fatal(err)
+	}
+	if id, err := backend.AllocatePosixID(ctx, "user", "someone", 10000, 60000); err != nil || id != 10000 {
+		t.Fatalf("got %d (%v) after a dry run, want the first number", id, err)
+	}
+
+	report, err := Import(ctx, &ImportConfig{Storage: backend, LDAP: client, PosixIDs: backend})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(report.PosixConflicts) != 0 {
+		t.Fatalf("got conflicts %v", report.PosixConflicts)
+	}
+
+	alice, err := backend.GetUserByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := backend.AllocatePosixID(ctx, "user", alice.ID, 10000, 60000); err != nil || id != 10005 {
+		t.Errorf("the imported alice has number %d (%v), want her LDAP uidNumber 10005", id, err)
+	}
+	// Following the 10000 allocated after the dry run, past the 10001 of bob
+	if id, err := backend.AllocatePosixID(ctx, "user", "new", 10000, 60000); err != nil || id != 10002 {
+		t.Errorf("a new user got number %d (%v), want 10002", id, err)
+	}
+	if id, err := backend.AllocatePosixID(ctx, "group", "new", 10000, 60000); err != nil || id != 10000 {
+		t.Errorf("a new group got number %d (%v), want 10000", id, err)
+	}
+}
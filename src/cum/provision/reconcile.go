@@ -0,0 +1,141 @@
+package provision
+
+import (
+	"context"
+
+	"cum/ldapctl"
+	"cum/types"
+)
+
+// ReconcileConfig is the configuration of a reconciliation
+type ReconcileConfig struct {
+	// Storage is the storage of the central users and groups
+	Storage types.Storage
+	// LDAP is the client of the LDAP server to repair
+	LDAP *ldapctl.Client
+	// Posix configures the POSIX attributes of users and groups
+	Posix *PosixConfig
+	// DryRun only reports the changes, without applying them
+	DryRun bool
+	// Prune deletes the LDAP users and groups that have no central
+	// counterpart, which are otherwise only reported
+	Prune bool
+}
+
+// Report is the result of a reconciliation
+type Report struct {
+	// Changes are the changes applied to LDAP, or to apply in a dry run
+	Changes []Change `json:"changes"`
+	// Unmanaged are the deletes of the LDAP users and groups that have no
+	// central counterpart, skipped unless pruning
+	Unmanaged []Change `json:"unmanaged"`
+	// PosixConflicts are the POSIX numbers of LDAP users and groups that
+	// could not be reserved
+	PosixConflicts []PosixConflict `json:"posix_conflicts"`
+}
+
+// Reconcile compares every central user and group with LDAP and repairs
+// the differences: missing users and groups are added and group members
+// are set, and existing users get POSIX attributes if they have none.
+// The uidNumber and gidNumber of the LDAP users and groups are reserved
+// first, so that they are not allocated to other ones. Passwords of existing users are left as is, as LDAP servers do not
+// return them. It returns the changes made so far on error.
+func Reconcile(ctx context.Context, config *ReconcileConfig) (*Report, error) {
+	s := &syncer{storage: config.Storage, ldap: config.LDAP, posix: config.Posix.withDefaults(), dryRun: config.DryRun}
+	report := &Report{}
+	defer func() { report.Changes = s.changes }()
+
+	if !config.DryRun {
+		conflicts, err := reservePosixIDs(ctx, config.Storage, s.posix.IDs, config.LDAP)
+		report.PosixConflicts = conflicts
+		if err != nil {
+			return report, err
+		}
+	}
+
+	usernames := map[string]bool{}
+	options := &types.UserListOptions{SortBy: "id", Limit: types.MaxListLimit}
+	for {
+		page, err := config.Storage.ListUsers(ctx, options)
+		if err != nil {
+			return report, err
+		}
+		for _, user := range page.Users {
+			usernames[user.Username] = true
+			if err := s.syncUser(ctx, user.ID, "", false); err != nil {
+				return report, err
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		options.Cursor = page.NextCursor
+	}
+
+	names := map[string]bool{}
+	groupOptions := &types.GroupListOptions{SortBy: "id", Limit: types.MaxListLimit}
+	for {
+		page, err := config.Storage.ListGroups(ctx, groupOptions)
+		if err != nil {
+			return report, err
+		}
+		for _, group := range page.Groups {
+			names[group.Name] = true
+			if err := s.syncGroup(ctx, group.ID, ""); err != nil {
+				return report, err
+			}
+		}
+		if page.NextCursor == "" {
+			break
+		}
+		groupOptions.Cursor = page.NextCursor
+	}
+
+	// LDAP entries are streamed, and pruned once their stream is done so
+	// that pruning does not wait for the connection of the stream
+	userDeletes, err := unmanaged(config.LDAP.StreamUsers(ctx, nil), "user", usernames)
+	if err != nil {
+		return report, err
+	}
+	for _, change := range userDeletes {
+		if !config.Prune {
+			report.Unmanaged = append(report.Unmanaged, change)
+			continue
+		}
+		name := change.Name
+		if err := s.apply(change, func() error { return ignoreNotFound(config.LDAP.UserDelete(ctx, name)) }); err != nil {
+			return report, err
+		}
+	}
+
+	groupDeletes, err := unmanaged(config.LDAP.StreamGroups(ctx, nil), "group", names)
+	if err != nil {
+		return report, err
+	}
+	for _, change := range groupDeletes {
+		if !config.Prune {
+			report.Unmanaged = append(report.Unmanaged, change)
+			continue
+		}
+		name := change.Name
+		if err := s.apply(change, func() error { return ignoreNotFound(config.LDAP.GroupDelete(ctx, name)) }); err != nil {
+			return report, err
+		}
+	}
+
+	return report, nil
+}
+
+// unmanaged returns the deletes of the LDAP entries of an iterator whose
+// name is not managed
+func unmanaged(it *ldapctl.EntryIterator, entityType string, managed map[string]bool) ([]Change, error) {
+	defer it.Close()
+
+	var changes []Change
+	for it.Next() {
+		if name := it.Name(); name != "" && !managed[name] {
+			changes = append(changes, Change{Action: "delete", EntityType: entityType, Name: name})
+		}
+	}
+	return changes, it.Err()
+}
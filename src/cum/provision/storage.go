@@ -0,0 +1,212 @@
+// Package provision applies the changes of the central users and groups to
+// LDAP. A Storage records every change in an outbox, from which a Worker
+// applies them with retries, and Reconcile repairs any remaining drift.
+// Import goes the other way, creating central users and groups from LDAP.
+package provision
+
+import (
+	"context"
+	"errors"
+	"time"
+
+	"cum/types"
+)
+
+// StorageConfig is the configuration for a Storage
+type StorageConfig struct {
+	// Storage is the decorated storage, which adds the outbox entries
+	// given to its changes in the same transaction, see types.OutboxEntry
+	Storage types.Storage
+	// Notify is called after changes are added to the outbox, if set
+	Notify func()
+}
+
+// Storage decorates a storage, adding an outbox entry for every change of
+// a user or group, including membership changes
+type Storage struct {
+	types.Storage
+	notify func()
+}
+
+// NewStorage creates a new Storage from the given configuration
+func NewStorage(config *StorageConfig) *Storage {
+	return &Storage{
+		Storage: config.Storage,
+		notify:  config.Notify,
+	}
+}
+
+// CreateUser creates a new user
+func (s *Storage) CreateUser(ctx context.Context, user *types.User, outbox ...*types.OutboxEntry) error {
+	return s.change(func(entries []*types.OutboxEntry) error {
+		return s.Storage.CreateUser(ctx, user, entries...)
+	}, outbox, &types.OutboxEntry{EntityType: "user", EntityID: user.ID, PasswordChanged: user.Password != ""})
+}
+
+// UpdateUser updates a user. A renamed user is provisioned again in the
+// groups it is a member of.
+func (s *Storage) UpdateUser(ctx context.Context, user *types.User, outbox ...*types.OutboxEntry) error {
+	current, err := s.Storage.GetUserByID(ctx, user.ID)
+	if err != nil {
+		return err
+	}
+	name, password := current.Username, current.Password
+
+	var groups []string
+	if user.Username != name {
+		if groups, err = s.groupsOf(ctx, user.ID); err != nil {
+			return err
+		}
+	}
+
+	entry := &types.OutboxEntry{EntityType: "user", EntityID: user.ID, Name: name, PasswordChanged: user.Password != password}
+	return s.change(func(entries []*types.OutboxEntry) error {
+		return s.Storage.UpdateUser(ctx, user, entries...)
+	}, outbox, append([]*types.OutboxEntry{entry}, groupEntries(groups)...)...)
+}
+
+// DeleteUser deletes a user, and provisions again the groups it was a
+// member of
+func (s *Storage) DeleteUser(ctx context.Context, id string, outbox ...*types.OutboxEntry) error {
+	current, err := s.Storage.GetUserByID(ctx, id)
+	if err != nil {
+		return err
+	}
+	name := current.Username
+	groups, err := s.groupsOf(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	entry := &types.OutboxEntry{EntityType: "user", EntityID: id, Name: name}
+	return s.change(func(entries []*types.OutboxEntry) error {
+		return s.Storage.DeleteUser(ctx, id, entries...)
+	}, outbox, append([]*types.OutboxEntry{entry}, groupEntries(groups)...)...)
+}
+
+// CreateGroup creates a new group
+func (s *Storage) CreateGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
+	return s.change(func(entries []*types.OutboxEntry) error {
+		return s.Storage.CreateGroup(ctx, group, entries...)
+	}, outbox, &types.OutboxEntry{EntityType: "group", EntityID: group.ID})
+}
+
+// UpdateGroup updates a group, and provisions again the groups it is
+// nested in
+func (s *Storage) UpdateGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
+	current, err := s.Storage.GetGroupByID(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+	name := current.Name
+	ancestors, err := s.ancestorsOf(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+
+	entry := &types.OutboxEntry{EntityType: "group", EntityID: group.ID, Name: name}
+	return s.change(func(entries []*types.OutboxEntry) error {
+		return s.Storage.UpdateGroup(ctx, group, entries...)
+	}, outbox, append([]*types.OutboxEntry{entry}, groupEntries(ancestors)...)...)
+}
+
+// DeleteGroup deletes a group, and provisions again the groups it was
+// nested in
+func (s *Storage) DeleteGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
+	current, err := s.Storage.GetGroupByID(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+	name := current.Name
+	ancestors, err := s.ancestorsOf(ctx, group.ID)
+	if err != nil {
+		return err
+	}
+
+	entry := &types.OutboxEntry{EntityType: "group", EntityID: group.ID, Name: name}
+	return s.change(func(entries []*types.OutboxEntry) error {
+		return s.Storage.DeleteGroup(ctx, group, entries...)
+	}, outbox, append([]*types.OutboxEntry{entry}, groupEntries(ancestors)...)...)
+}
+
+// AddMemberToGroup adds a member to a group, and provisions again the
+// group and the groups it is nested in
+func (s *Storage) AddMemberToGroup(ctx context.Context, m types.Member, parentGroupID string, outbox ...*types.OutboxEntry) error {
+	ancestors, err := s.ancestorsOf(ctx, parentGroupID)
+	if err != nil {
+		return err
+	}
+	return s.change(func(entries []*types.OutboxEntry) error {
+		return s.Storage.AddMemberToGroup(ctx, m, parentGroupID, entries...)
+	}, outbox, groupEntries(append([]string{parentGroupID}, ancestors...))...)
+}
+
+// RemoveMemberFromGroup removes a member from a group, and provisions
+// again the group and the groups it is nested in
+func (s *Storage) RemoveMemberFromGroup(ctx context.Context, m *types.Member, parentGroupID string, outbox ...*types.OutboxEntry) error {
+	ancestors, err := s.ancestorsOf(ctx, parentGroupID)
+	if err != nil {
+		return err
+	}
+	return s.change(func(entries []*types.OutboxEntry) error {
+		return s.Storage.RemoveMemberFromGroup(ctx, m, parentGroupID, entries...)
+	}, outbox, groupEntries(append([]string{parentGroupID}, ancestors...))...)
+}
+
+// groupsOf returns the IDs of the groups whose provisioned members may
+// list the given user
+func (s *Storage) groupsOf(ctx context.Context, userID string) ([]string, error) {
+	memberships, err := s.Storage.GetEffectiveGroups(ctx, userID)
+	if err != nil && !errors.Is(err, types.ErrNotFound) {
+		return nil, err
+	}
+	var ids []string
+	for _, membership := range memberships {
+		ids = append(ids, membership.GroupID)
+	}
+	return ids, nil
+}
+
+// ancestorsOf returns the IDs of the groups a group is nested in, whose
+// provisioned members may list its members when nested groups are
+// flattened
+func (s *Storage) ancestorsOf(ctx context.Context, groupID string) ([]string, error) {
+	ids, err := s.Storage.GetAncestorGroups(ctx, groupID)
+	if err != nil && !errors.Is(err, types.ErrNotFound) {
+		return nil, err
+	}
+	return ids, nil
+}
+
+// groupEntries returns an outbox entry for each of the given groups
+func groupEntries(ids []string) []*types.OutboxEntry {
+	entries := make([]*types.OutboxEntry, len(ids))
+	for i, id := range ids {
+		entries[i] = &types.OutboxEntry{EntityType: "group", EntityID: id}
+	}
+	return entries
+}
+
+// change makes a change with fn, which gives the decorated storage the
+// given entries followed by the outbox entries of the caller, and notifies
+// the worker once it is stored
+func (s *Storage) change(fn func(outbox []*types.OutboxEntry) error, outbox []*types.OutboxEntry, entries ...*types.OutboxEntry) error {
+	now := time.Now().Unix()
+	for _, entry := range entries {
+		id, err := types.NewID()
+		if err != nil {
+			return err
+		}
+		entry.ID = id
+		entry.CreatedAt = now
+		entry.NextAttemptAt = now
+	}
+
+	if err := fn(append(entries, outbox...)); err != nil {
+		return err
+	}
+	if s.notify != nil {
+		s.notify()
+	}
+	return nil
+}
@@ -0,0 +1,425 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cum/ldapctl"
+	"cum/types"
+)
+
+// Change is a change applied to LDAP, or to the storage by an import, or
+// to apply in a dry run
+type Change struct {
+	// Action is "add", "delete", "set password", "reset password", "set
+	// posix", "add member" or "remove member"
+	Action string `json:"action"`
+	// EntityType is "user" or "group"
+	EntityType string `json:"entity_type"`
+	Name       string `json:"name"`
+	// Member is the name of the added or removed member
+	Member string `json:"member,omitempty"`
+	// MemberType is "group" for a nested group, and empty for a user
+	MemberType string `json:"member_type,omitempty"`
+}
+
+// String returns a string representation of the change
+func (c Change) String() string {
+	switch c.Action {
+	case "add member":
+		return fmt.Sprintf("add member %s to %s %s", c.memberString(), c.EntityType, c.Name)
+	case "remove member":
+		return fmt.Sprintf("remove member %s from %s %s", c.memberString(), c.EntityType, c.Name)
+	case "set posix":
+		return fmt.Sprintf("set POSIX attributes of %s %s", c.EntityType, c.Name)
+	default:
+		return fmt.Sprintf("%s %s %s", c.Action, c.EntityType, c.Name)
+	}
+}
+
+// memberString returns the member of the change, prefixed by its type
+// when it is not a user
+func (c Change) memberString() string {
+	if c.MemberType != "" && c.MemberType != "user" {
+		return c.MemberType + " " + c.Member
+	}
+	return c.Member
+}
+
+// syncer applies the current state of central users and groups to LDAP
+type syncer struct {
+	storage types.Storage
+	ldap    *ldapctl.Client
+	posix   *PosixConfig
+	// dryRun only records the changes, without applying them
+	dryRun bool
+	// changes are the changes applied, or to apply in a dry run
+	changes []Change
+}
+
+// apply records a change and applies it with fn, unless in a dry run
+func (s *syncer) apply(change Change, fn func() error) error {
+	s.changes = append(s.changes, change)
+	if s.dryRun {
+		return nil
+	}
+	if err := fn(); err != nil {
+		return fmt.Errorf("failed to %s: %w", change, err)
+	}
+	return nil
+}
+
+// syncEntry applies the change of an outbox entry
+func (s *syncer) syncEntry(ctx context.Context, entry *types.OutboxEntry) error {
+	switch entry.EntityType {
+	case "user":
+		return s.syncUser(ctx, entry.EntityID, entry.Name, entry.PasswordChanged)
+	case "group":
+		return s.syncGroup(ctx, entry.EntityID, entry.Name)
+	default:
+		return fmt.Errorf("%w: unknown entity type %q", types.ErrInvalidArgument, entry.EntityType)
+	}
+}
+
+// syncUser provisions the current state of a user. Its entry under its
+// previous name, if any, is deleted, and its password is set if it
+// changed.
+func (s *syncer) syncUser(ctx context.Context, id string, previousName string, passwordChanged bool) error {
+	user, err := s.storage.GetUserByID(ctx, id)
+	if err != nil && !errors.Is(err, types.ErrNotFound) {
+		return err
+	}
+	if err != nil {
+		user = nil
+	}
+
+	if previousName != "" && (user == nil || user.Username != previousName) {
+		if err := s.deleteStaleUser(ctx, previousName); err != nil {
+			return err
+		}
+	}
+	if user == nil {
+		return nil
+	}
+
+	sr, err := s.ldap.UserSearch(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	// Directories that hash passwords themselves, such as Active
+	// Directory, cannot be given the stored hashes
+	var password string
+	if s.ldap.AcceptsPasswordHashes() {
+		password = ldapPassword(user.Password)
+	}
+	if len(sr.Entries) == 0 {
+		return s.apply(Change{Action: "add", EntityType: "user", Name: user.Username}, func() error {
+			account, err := s.posix.account(ctx, user)
+			if err != nil {
+				return err
+			}
+			if err := s.ldap.UserAdd(ctx, user.Username, password, account); err != nil {
+				return err
+			}
+			if user.MustChangePassword && password != "" {
+				return s.ldap.UserPasswordReset(ctx, user.Username, password)
+			}
+			return nil
+		})
+	}
+
+	// Users added before POSIX attributes were provisioned lack them
+	account, err := s.ldap.UserPosixAccount(ctx, user.Username)
+	if err != nil {
+		return err
+	}
+	if account == nil {
+		err := s.apply(Change{Action: "set posix", EntityType: "user", Name: user.Username}, func() error {
+			account, err := s.posix.account(ctx, user)
+			if err != nil {
+				return err
+			}
+			return s.ldap.UserSetPosixAccount(ctx, user.Username, account)
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if passwordChanged && password != "" {
+		// One-time passwords are marked for a change at the next login
+		if user.MustChangePassword {
+			return s.apply(Change{Action: "reset password", EntityType: "user", Name: user.Username}, func() error {
+				return s.ldap.UserPasswordReset(ctx, user.Username, password)
+			})
+		}
+		return s.apply(Change{Action: "set password", EntityType: "user", Name: user.Username}, func() error {
+			return s.ldap.UserPasswordChange(ctx, user.Username, password)
+		})
+	}
+	return nil
+}
+
+// deleteStaleUser deletes the LDAP entry of a user that no longer has the
+// given name, unless another user took the name since
+func (s *syncer) deleteStaleUser(ctx context.Context, name string) error {
+	_, err := s.storage.GetUserByUsername(ctx, name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, types.ErrNotFound) {
+		return err
+	}
+
+	sr, err := s.ldap.UserSearch(ctx, name)
+	if err != nil || len(sr.Entries) == 0 {
+		return err
+	}
+	return s.apply(Change{Action: "delete", EntityType: "user", Name: name}, func() error {
+		return ignoreNotFound(s.ldap.UserDelete(ctx, name))
+	})
+}
+
+// syncGroup provisions the current state of a group and its members. Its
+// entry under its previous name, if any, is deleted.
+func (s *syncer) syncGroup(ctx context.Context, id string, previousName string) error {
+	group, err := s.storage.GetGroupByID(ctx, id)
+	if err != nil && !errors.Is(err, types.ErrNotFound) {
+		return err
+	}
+	if err != nil {
+		group = nil
+	}
+
+	if previousName != "" && (group == nil || group.Name != previousName) {
+		if err := s.deleteStaleGroup(ctx, previousName); err != nil {
+			return err
+		}
+	}
+	if group == nil {
+		return nil
+	}
+
+	nested := s.ldap.Schema().NestedGroups
+	users, groups, err := s.memberNames(ctx, group, nested)
+	if err != nil {
+		return err
+	}
+
+	sr, err := s.ldap.GroupSearch(ctx, group.Name)
+	if err != nil {
+		return err
+	}
+	var currentUsers, currentGroups []string
+	if len(sr.Entries) == 0 {
+		err := s.apply(Change{Action: "add", EntityType: "group", Name: group.Name}, func() error {
+			gidNumber, err := s.posix.gidNumber(ctx, group)
+			if err != nil {
+				return err
+			}
+			return s.ldap.GroupAdd(ctx, group.Name, gidNumber)
+		})
+		if err != nil {
+			return err
+		}
+	} else if nested {
+		currentUsers, currentGroups, err = s.ldap.GroupMembers(ctx, group.Name)
+		if err != nil {
+			return err
+		}
+	} else {
+		currentUsers, err = s.ldap.UserListFromGroup(ctx, group.Name)
+		if err != nil {
+			return err
+		}
+	}
+
+	added, removed := diff(currentUsers, users)
+	for _, member := range added {
+		member := member
+		err := s.apply(Change{Action: "add member", EntityType: "group", Name: group.Name, Member: member}, func() error {
+			return ignoreConflict(s.ldap.UserAddToGroup(ctx, member, group.Name))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, member := range removed {
+		member := member
+		err := s.apply(Change{Action: "remove member", EntityType: "group", Name: group.Name, Member: member}, func() error {
+			return ignoreNotFound(s.ldap.UserDeleteFromGroup(ctx, member, group.Name))
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	added, removed = diff(currentGroups, groups)
+	for _, member := range added {
+		member := member
+		err := s.apply(Change{Action: "add member", EntityType: "group", Name: group.Name, Member: member, MemberType: "group"}, func() error {
+			return ignoreConflict(s.ldap.GroupAddToGroup(ctx, member, group.Name))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	for _, member := range removed {
+		member := member
+		err := s.apply(Change{Action: "remove member", EntityType: "group", Name: group.Name, Member: member, MemberType: "group"}, func() error {
+			return ignoreNotFound(s.ldap.GroupDeleteFromGroup(ctx, member, group.Name))
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteStaleGroup deletes the LDAP entry of a group that no longer has
+// the given name, unless another group took the name since
+func (s *syncer) deleteStaleGroup(ctx context.Context, name string) error {
+	_, err := s.storage.GetGroupByName(ctx, name)
+	if err == nil {
+		return nil
+	}
+	if !errors.Is(err, types.ErrNotFound) {
+		return err
+	}
+
+	sr, err := s.ldap.GroupSearch(ctx, name)
+	if err != nil || len(sr.Entries) == 0 {
+		return err
+	}
+	return s.apply(Change{Action: "delete", EntityType: "group", Name: name}, func() error {
+		return ignoreNotFound(s.ldap.GroupDelete(ctx, name))
+	})
+}
+
+// memberNames returns the sorted usernames and group names of the members
+// of a group. Nested groups are listed as such, or flattened into the
+// users that are members of the group through them.
+func (s *syncer) memberNames(ctx context.Context, group *types.Group, nested bool) ([]string, []string, error) {
+	usernames := make(map[string]string)
+	var users, groups []string
+	for _, member := range group.Members {
+		if member == nil || *member == nil {
+			continue
+		}
+		switch m := (*member).(type) {
+		case *types.User:
+			if m.Username != "" {
+				usernames[m.ID] = m.Username
+			}
+			if nested {
+				username, err := s.username(ctx, m.ID, usernames)
+				if err != nil {
+					return nil, nil, err
+				}
+				users = append(users, username)
+			}
+		case *types.Group:
+			if !nested {
+				continue
+			}
+			name := m.Name
+			if name == "" {
+				nestedGroup, err := s.storage.GetGroupByID(ctx, m.ID)
+				if err != nil {
+					return nil, nil, err
+				}
+				name = nestedGroup.Name
+			}
+			groups = append(groups, name)
+		}
+	}
+
+	if !nested {
+		memberships, err := s.storage.GetEffectiveMembers(ctx, group.ID)
+		if err != nil {
+			return nil, nil, err
+		}
+		for _, membership := range memberships {
+			username, err := s.username(ctx, membership.UserID, usernames)
+			if err != nil {
+				return nil, nil, err
+			}
+			users = append(users, username)
+		}
+	}
+	sort.Strings(users)
+	sort.Strings(groups)
+	return users, groups, nil
+}
+
+// username returns the username of a user, from the given usernames by ID
+// or else from the storage
+func (s *syncer) username(ctx context.Context, id string, usernames map[string]string) (string, error) {
+	if username, ok := usernames[id]; ok {
+		return username, nil
+	}
+	user, err := s.storage.GetUserByID(ctx, id)
+	if err != nil {
+		return "", err
+	}
+	usernames[id] = user.Username
+	return user.Username, nil
+}
+
+// diff returns the values of want missing from have, and the values of
+// have missing from want
+func diff(have []string, want []string) (added []string, removed []string) {
+	haveSet := make(map[string]bool, len(have))
+	for _, value := range have {
+		haveSet[value] = true
+	}
+	wantSet := make(map[string]bool, len(want))
+	for _, value := range want {
+		wantSet[value] = true
+		if !haveSet[value] {
+			added = append(added, value)
+		}
+	}
+	for _, value := range have {
+		if !wantSet[value] {
+			removed = append(removed, value)
+		}
+	}
+	return added, removed
+}
+
+// ldapPassword returns the userPassword value of a password hash, or an
+// empty string if LDAP servers cannot verify passwords against the hash.
+// Argon2 hashes are in the format of the OpenLDAP argon2 module, and
+// bcrypt hashes in the crypt(3) format.
+func ldapPassword(hash string) string {
+	switch {
+	case strings.HasPrefix(hash, "$argon2"):
+		return "{ARGON2}" + hash
+	case strings.HasPrefix(hash, "$2a$"), strings.HasPrefix(hash, "$2b$"), strings.HasPrefix(hash, "$2y$"):
+		return "{CRYPT}" + hash
+	default:
+		return ""
+	}
+}
+
+// ignoreNotFound returns nil for not found errors, which mean that a
+// delete or removal is already done
+func ignoreNotFound(err error) error {
+	if errors.Is(err, types.ErrNotFound) {
+		return nil
+	}
+	return err
+}
+
+// ignoreConflict returns nil for conflict errors, which mean that an
+// added value is already there
+func ignoreConflict(err error) error {
+	if errors.Is(err, types.ErrConflict) {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,258 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"cum/ldapctl"
+	"cum/types"
+)
+
+// WorkerConfig is the configuration for a Worker
+type WorkerConfig struct {
+	// Storage is the storage the current state of users and groups is read from
+	Storage types.Storage
+	// Outbox stores the changes to provision
+	Outbox types.OutboxStorage
+	// LDAP is the client of the LDAP server the changes are applied to
+	LDAP *ldapctl.Client
+	// Posix configures the POSIX attributes of users and groups
+	Posix *PosixConfig
+	// Interval is how often the outbox is checked for due changes, besides
+	// when notified. It defaults to 5 seconds.
+	Interval time.Duration
+	// BatchSize is the number of changes read from the outbox at once. It
+	// defaults to 100.
+	BatchSize int
+	// Timeout is how long applying a change may take. It defaults to 30
+	// seconds. Workers claim the changes of a batch for BatchSize times
+	// Timeout, so that several of them can share an outbox, and the
+	// changes claimed by a worker that stopped without being closed are
+	// applied once that claim expires.
+	Timeout time.Duration
+	// MinBackoff and MaxBackoff bound the delay before a failed change is
+	// retried, which doubles after every failure. They default to 1 second
+	// and 1 hour.
+	MinBackoff time.Duration
+	MaxBackoff time.Duration
+}
+
+// WorkerStats describes the activity of a Worker
+type WorkerStats struct {
+	// Applied is the number of changes applied
+	Applied int64 `json:"applied"`
+	// Failures is the number of failed attempts to apply a change
+	Failures int64 `json:"failures"`
+	// Pending is the number of changes in the outbox after the last run
+	Pending int `json:"pending"`
+}
+
+// Worker applies the changes of the outbox to LDAP until it is closed.
+// Failed changes stay in the outbox and are retried with an exponential
+// backoff.
+type Worker struct {
+	storage    types.Storage
+	outbox     types.OutboxStorage
+	ldap       *ldapctl.Client
+	posix      *PosixConfig
+	batchSize  int
+	timeout    time.Duration
+	minBackoff time.Duration
+	maxBackoff time.Duration
+	interval   time.Duration
+
+	mu    sync.Mutex
+	stats WorkerStats
+
+	wake      chan struct{}
+	ctx       context.Context
+	cancel    context.CancelFunc
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// NewWorker creates a new Worker from the given configuration and starts it
+func NewWorker(config *WorkerConfig) *Worker {
+	w := newWorker(config)
+	go w.run()
+	return w
+}
+
+// newWorker creates a new Worker from the given configuration, without
+// starting it
+func newWorker(config *WorkerConfig) *Worker {
+	ctx, cancel := context.WithCancel(context.Background())
+	w := &Worker{
+		storage:    config.Storage,
+		outbox:     config.Outbox,
+		ldap:       config.LDAP,
+		posix:      config.Posix.withDefaults(),
+		batchSize:  config.BatchSize,
+		timeout:    config.Timeout,
+		minBackoff: config.MinBackoff,
+		maxBackoff: config.MaxBackoff,
+		interval:   config.Interval,
+		wake:       make(chan struct{}, 1),
+		ctx:        ctx,
+		cancel:     cancel,
+		stopped:    make(chan struct{}),
+	}
+	if w.batchSize <= 0 {
+		w.batchSize = 100
+	}
+	if w.timeout <= 0 {
+		w.timeout = 30 * time.Second
+	}
+	if w.minBackoff <= 0 {
+		w.minBackoff = time.Second
+	}
+	if w.maxBackoff < w.minBackoff {
+		w.maxBackoff = time.Hour
+	}
+	if w.interval <= 0 {
+		w.interval = 5 * time.Second
+	}
+	return w
+}
+
+// Notify wakes the worker up to apply newly added changes
+func (w *Worker) Notify() {
+	select {
+	case w.wake <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns the activity statistics of the worker
+func (w *Worker) Stats() WorkerStats {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	return w.stats
+}
+
+// Close stops the worker, waiting for the change being applied
+func (w *Worker) Close() error {
+	w.closeOnce.Do(func() {
+		w.cancel()
+	})
+	<-w.stopped
+	return nil
+}
+
+// run applies the due changes every interval and when notified, until the
+// worker is closed
+func (w *Worker) run() {
+	defer close(w.stopped)
+
+	ticker := time.NewTicker(w.interval)
+	defer ticker.Stop()
+
+	for {
+		w.applyDue()
+
+		select {
+		case <-w.ctx.Done():
+			return
+		case <-w.wake:
+		case <-ticker.C:
+		}
+	}
+}
+
+// applyDue applies the due changes of the outbox, one claimed batch after
+// another
+func (w *Worker) applyDue() {
+	for w.ctx.Err() == nil {
+		now := time.Now()
+		until := now.Add(w.timeout * time.Duration(w.batchSize)).Unix()
+		entries, err := w.outbox.ClaimOutboxEntries(w.ctx, now.Unix(), until, w.batchSize)
+		if err != nil {
+			log.Printf("Failed to read the outbox: %v", err)
+			return
+		}
+		for i, entry := range entries {
+			if w.ctx.Err() != nil {
+				w.release(entries[i:])
+				return
+			}
+			w.applyEntry(entry)
+		}
+		if len(entries) < w.batchSize {
+			break
+		}
+	}
+
+	pending, err := w.outbox.CountOutboxEntries(w.ctx)
+	if err != nil {
+		return
+	}
+	w.mu.Lock()
+	w.stats.Pending = pending
+	w.mu.Unlock()
+}
+
+// applyEntry applies the change of an outbox entry, and removes it from
+// the outbox or schedules its next attempt
+func (w *Worker) applyEntry(entry *types.OutboxEntry) {
+	ctx, cancel := context.WithTimeout(w.ctx, w.timeout)
+	defer cancel()
+
+	s := &syncer{storage: w.storage, ldap: w.ldap, posix: w.posix}
+	err := s.syncEntry(ctx, entry)
+	if err == nil {
+		if err := w.outbox.DeleteOutboxEntry(w.ctx, entry.ID); err != nil && !errors.Is(err, types.ErrNotFound) {
+			log.Printf("Failed to remove %s from the outbox: %v", entry, err)
+		}
+		w.mu.Lock()
+		w.stats.Applied++
+		w.mu.Unlock()
+		return
+	}
+	if w.ctx.Err() != nil {
+		// Interrupted by Close, the entry is retried on the next start
+		w.release([]*types.OutboxEntry{entry})
+		return
+	}
+
+	entry.Attempts++
+	entry.LastError = err.Error()
+	entry.NextAttemptAt = time.Now().Add(w.backoff(entry.Attempts)).Unix()
+	log.Printf("Failed to provision %s %s (attempt %d): %v", entry.EntityType, entry.EntityID, entry.Attempts, err)
+	if err := w.outbox.UpdateOutboxEntry(w.ctx, entry); err != nil {
+		log.Printf("Failed to reschedule %s: %v", entry, err)
+	}
+	w.mu.Lock()
+	w.stats.Failures++
+	w.mu.Unlock()
+}
+
+// release makes claimed changes the worker did not apply due again, for
+// another worker or the next start not to wait for the claim to expire
+func (w *Worker) release(entries []*types.OutboxEntry) {
+	ctx, cancel := context.WithTimeout(context.Background(), w.timeout)
+	defer cancel()
+
+	now := time.Now().Unix()
+	for _, entry := range entries {
+		entry.NextAttemptAt = now
+		if err := w.outbox.UpdateOutboxEntry(ctx, entry); err != nil && !errors.Is(err, types.ErrNotFound) {
+			log.Printf("Failed to release %s: %v", entry, err)
+		}
+	}
+}
+
+// backoff returns the delay before the given attempt to apply a change
+func (w *Worker) backoff(attempts int) time.Duration {
+	delay := w.minBackoff
+	for i := 1; i < attempts && delay < w.maxBackoff; i++ {
+		delay *= 2
+	}
+	if delay > w.maxBackoff {
+		delay = w.maxBackoff
+	}
+	return delay
+}
@@ -0,0 +1,242 @@
+package provision
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"cum/ldapctl"
+	"cum/ldapctl/ldaptest"
+	"cum/storage"
+	"cum/types"
+
+	"github.com/go-ldap/ldap/v3"
+)
+
+// newTestLDAP returns a client of an LDAP stand-in with the default
+// schema, and the stand-in
+func newTestLDAP(t *testing.T) (*ldapctl.Client, *ldaptest.Server) {
+	t.Helper()
+	server := ldaptest.NewServer()
+	client, err := ldapctl.NewClientWithDial(&types.LDAPConfig{
+		BaseDN:            "dc=example,dc=org",
+		UserSearchBaseDN:  "ou=people,dc=example,dc=org",
+		GroupSearchBaseDN: "ou=groups,dc=example,dc=org",
+	}, server.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	return client, server
+}
+
+// newTestWorker returns a worker, not started, provisioning the changes of
+// the returned storage to an LDAP stand-in
+func newTestWorker(t *testing.T) (*Worker, *Storage, *storage.InMemoryStorage, *ldaptest.Server) {
+	t.Helper()
+	backend := storage.NewInMemoryStorage(&storage.InMemoryStorageConfig{})
+	t.Cleanup(func() { backend.Close() })
+	client, server := newTestLDAP(t)
+
+	w := newWorker(&WorkerConfig{
+		Storage:    backend,
+		Outbox:     backend,
+		LDAP:       client,
+		Posix:      &PosixConfig{IDs: backend},
+		MinBackoff: time.Minute,
+		MaxBackoff: 3 * time.Minute,
+	})
+	t.Cleanup(w.cancel)
+	return w, NewStorage(&StorageConfig{Storage: backend}), backend, server
+}
+
+// outboxEntries returns every outbox entry, due or not
+func outboxEntries(t *testing.T, outbox types.OutboxStorage) []*types.OutboxEntry {
+	t.Helper()
+	entries, err := outbox.GetDueOutboxEntries(context.Background(), time.Now().Add(24*time.Hour).Unix(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return entries
+}
+
+// makeDue makes an outbox entry due now
+func makeDue(t *testing.T, outbox types.OutboxStorage, entry *types.OutboxEntry) {
+	t.Helper()
+	entry.NextAttemptAt = time.Now().Unix()
+	if err := outbox.UpdateOutboxEntry(context.Background(), entry); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// countAdds returns the number of add requests served by the server
+func countAdds(server *ldaptest.Server) int {
+	var adds int
+	for _, r := range server.Requests() {
+		if r.Op == "add" {
+			adds++
+		}
+	}
+	return adds
+}
+
+func TestWorkerDeletesAppliedEntries(t *testing.T) {
+	w, s, backend, server := newTestWorker(t)
+	if err := s.CreateUser(context.Background(), &types.User{ID: "u1", Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	if entries := outboxEntries(t, backend); len(entries) != 1 {
+		t.Fatalf("got %d outbox entries after creating a user, want 1", len(entries))
+	}
+
+	w.applyDue()
+	if server.Entry("cn=alice,ou=people,dc=example,dc=org") == nil {
+		t.Fatal("the user was not added to LDAP")
+	}
+	if entries := outboxEntries(t, backend); len(entries) != 0 {
+		t.Fatalf("got %d outbox entries after applying them, want none", len(entries))
+	}
+	if stats := w.Stats(); stats.Applied != 1 || stats.Failures != 0 || stats.Pending != 0 {
+		t.Fatalf("got stats %+v, want 1 change applied and none pending", stats)
+	}
+}
+
+func TestWorkerRetriesWithBackoff(t *testing.T) {
+	w, s, backend, server := newTestWorker(t)
+	server.SetHook(func(r ldaptest.Request) error {
+		if r.Op == "add" {
+			return ldap.NewError(ldap.LDAPResultUnavailable, errors.New("unavailable"))
+		}
+		return nil
+	})
+	if err := s.CreateUser(context.Background(), &types.User{ID: "u1", Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+
+	for attempt, backoff := range []time.Duration{time.Minute, 2 * time.Minute, 3 * time.Minute, 3 * time.Minute} {
+		before := time.Now()
+		w.applyDue()
+
+		entries := outboxEntries(t, backend)
+		if len(entries) != 1 {
+			t.Fatalf("got %d outbox entries after a failure, want the failed one", len(entries))
+		}
+		entry := entries[0]
+		if entry.Attempts != attempt+1 || entry.LastError == "" {
+			t.Fatalf("got %d attempts and last error %q, want %d attempts and an error", entry.Attempts, entry.LastError, attempt+1)
+		}
+		if min, max := before.Add(backoff).Unix(), time.Now().Add(backoff).Unix(); entry.NextAttemptAt < min || entry.NextAttemptAt > max {
+			t.Fatalf("attempt %d: next attempt in %ds, want %v", entry.Attempts, entry.NextAttemptAt-before.Unix(), backoff)
+		}
+
+		// The entry is not retried before its next attempt
+		adds := countAdds(server)
+		w.applyDue()
+		if countAdds(server) != adds {
+			t.Fatal("the entry was retried before its next attempt")
+		}
+		makeDue(t, backend, entry)
+	}
+	if stats := w.Stats(); stats.Failures != 4 || stats.Applied != 0 || stats.Pending != 1 {
+		t.Fatalf("got stats %+v, want 4 failures and 1 change pending", stats)
+	}
+
+	server.SetHook(nil)
+	w.applyDue()
+	if server.Entry("cn=alice,ou=people,dc=example,dc=org") == nil {
+		t.Fatal("the user was not added to LDAP once it was available")
+	}
+	if entries := outboxEntries(t, backend); len(entries) != 0 {
+		t.Fatalf("got %d outbox entries after the retry succeeded, want none", len(entries))
+	}
+}
+
+func TestWorkersShareOutbox(t *testing.T) {
+	w1, s, backend, server := newTestWorker(t)
+	client, err := ldapctl.NewClientWithDial(&types.LDAPConfig{
+		BaseDN:            "dc=example,dc=org",
+		UserSearchBaseDN:  "ou=people,dc=example,dc=org",
+		GroupSearchBaseDN: "ou=groups,dc=example,dc=org",
+	}, server.Dial)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { client.Close() })
+	w2 := newWorker(&WorkerConfig{
+		Storage: backend,
+		Outbox:  backend,
+		LDAP:    client,
+		Posix:   &PosixConfig{IDs: backend},
+	})
+	t.Cleanup(w2.cancel)
+
+	const n = 5
+	for i := 0; i < n; i++ {
+		if err := s.CreateUser(context.Background(), &types.User{ID: fmt.Sprintf("u%d", i), Username: fmt.Sprintf("user%d", i)}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// The second worker runs while the first applies its first change
+	var started int32
+	server.SetHook(func(r ldaptest.Request) error {
+		if r.Op == "add" && atomic.CompareAndSwapInt32(&started, 0, 1) {
+			w2.applyDue()
+		}
+		return nil
+	})
+	w1.applyDue()
+
+	if adds := countAdds(server); adds != n {
+		t.Errorf("got %d adds for %d users, want each change applied once", adds, n)
+	}
+	if applied := w1.Stats().Applied + w2.Stats().Applied; applied != n {
+		t.Errorf("the workers applied %d changes, want %d", applied, n)
+	}
+	if entries := outboxEntries(t, backend); len(entries) != 0 {
+		t.Errorf("got %d outbox entries after applying them, want none", len(entries))
+	}
+}
+
+func TestWorkerReleasesClaimsOnClose(t *testing.T) {
+	w, s, backend, server := newTestWorker(t)
+	for _, id := range []string{"u1", "u2", "u3"} {
+		if err := s.CreateUser(context.Background(), &types.User{ID: id, Username: "user-" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// Closed while the first change is applied
+	server.SetHook(func(r ldaptest.Request) error {
+		if r.Op == "add" {
+			w.cancel()
+		}
+		return nil
+	})
+
+	w.applyDue()
+	entries := outboxEntries(t, backend)
+	if len(entries) < 2 {
+		t.Fatalf("got %d outbox entries after closing, want the changes not applied", len(entries))
+	}
+	for _, entry := range entries {
+		if entry.NextAttemptAt > time.Now().Unix() {
+			t.Errorf("%s is still claimed after the worker was closed", entry)
+		}
+	}
+}
+
+func TestWorkerBackoff(t *testing.T) {
+	w := &Worker{minBackoff: time.Second, maxBackoff: 10 * time.Second}
+	want := []time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 8 * time.Second, 10 * time.Second, 10 * time.Second}
+	for i, backoff := range want {
+		if got := w.backoff(i + 1); got != backoff {
+			t.Errorf("attempt %d: got %v, want %v", i+1, got, backoff)
+		}
+	}
+	if got := w.backoff(1000); got != 10*time.Second {
+		t.Errorf("attempt 1000: got %v, want the maximum", got)
+	}
+}
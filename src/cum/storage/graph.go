@@ -0,0 +1,378 @@
+package storage
+
+import (
+	"context"
+	"fmt"
+	"sort"
+	"strings"
+
+	"cum/types"
+)
+
+// DefaultMaxNestingDepth is the maximum number of levels of nested groups
+// used when a backend is configured with a zero MaxNestingDepth
+const DefaultMaxNestingDepth = 10
+
+// maxNestingDepth returns the configured maximum nesting depth, or the
+// default one if it is not set
+func maxNestingDepth(configured int) int {
+	if configured <= 0 {
+		return DefaultMaxNestingDepth
+	}
+	return configured
+}
+
+// groupGraph gives access to the nesting of groups stored by a backend
+type groupGraph interface {
+	// childGroups returns the IDs of the groups that are direct members of a group
+	childGroups(ctx context.Context, id string) ([]string, error)
+	// parentGroups returns the IDs of the groups a group is a direct member of
+	parentGroups(ctx context.Context, id string) ([]string, error)
+}
+
+// checkNesting returns an error if adding the group childID to the group
+// parentID would create a cycle or nest groups deeper than maxDepth levels.
+// The graph is walked one level at a time and at most maxDepth levels deep,
+// so that it terminates even if the stored groups already form a cycle.
+func checkNesting(ctx context.Context, graph groupGraph, parentID, childID string, maxDepth int) error {
+	if parentID == childID {
+		return fmt.Errorf("%w: group %s cannot be a member of itself", types.ErrMembershipCycle, childID)
+	}
+
+	// Count the levels of groups nested in the child, looking for the parent
+	down := 0
+	level := []string{childID}
+	for {
+		next, err := nextLevel(ctx, level, graph.childGroups)
+		if err != nil {
+			return err
+		}
+		if len(next) == 0 {
+			break
+		}
+		for _, id := range next {
+			if id == parentID {
+				return fmt.Errorf("%w: group %s is nested in group %s", types.ErrMembershipCycle, parentID, childID)
+			}
+		}
+		down++
+		if down+1 > maxDepth {
+			return maxDepthError(parentID, childID, maxDepth)
+		}
+		level = next
+	}
+
+	// Count the levels of groups the parent is nested in
+	up := 0
+	level = []string{parentID}
+	for {
+		next, err := nextLevel(ctx, level, graph.parentGroups)
+		if err != nil {
+			return err
+		}
+		if len(next) == 0 {
+			break
+		}
+		up++
+		if up+1+down > maxDepth {
+			return maxDepthError(parentID, childID, maxDepth)
+		}
+		level = next
+	}
+
+	return nil
+}
+
+// updatedGraph is the nesting of the stored groups with the nested groups
+// of one group replaced, so that a change of all the members of a group is
+// checked as a whole rather than one nested group at a time
+type updatedGraph struct {
+	groupGraph
+	groupID  string
+	children []string
+}
+
+// childGroups returns the IDs of the groups that are direct members of a
+// group once updated
+func (g *updatedGraph) childGroups(ctx context.Context, id string) ([]string, error) {
+	if id == g.groupID {
+		return g.children, nil
+	}
+	return g.groupGraph.childGroups(ctx, id)
+}
+
+// parentGroups returns the IDs of the groups a group is a direct member of
+// once updated
+func (g *updatedGraph) parentGroups(ctx context.Context, id string) ([]string, error) {
+	stored, err := g.groupGraph.parentGroups(ctx, id)
+	if err != nil {
+		return nil, err
+	}
+	var ids []string
+	for _, parentID := range stored {
+		if parentID != g.groupID {
+			ids = append(ids, parentID)
+		}
+	}
+	for _, childID := range g.children {
+		if childID == id {
+			ids = append(ids, g.groupID)
+			break
+		}
+	}
+	return ids, nil
+}
+
+// checkGroupNesting returns an error if replacing the nested groups of a
+// group with the given ones would create a cycle or nest groups deeper
+// than maxDepth levels. Every nested group is checked on the graph with
+// all of them in place. Cycles are looked for on the stored graph first,
+// as the walks of the updated graph would go round a cycle until they
+// exceed the maximum depth.
+func checkGroupNesting(ctx context.Context, graph groupGraph, groupID string, children []string, maxDepth int) error {
+	updated := &updatedGraph{groupGraph: graph, groupID: groupID, children: children}
+	for _, g := range []groupGraph{graph, updated} {
+		for _, childID := range children {
+			if err := checkNesting(ctx, g, groupID, childID, maxDepth); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// nextLevel returns the distinct groups related to any group of a level
+func nextLevel(ctx context.Context, level []string, related func(ctx context.Context, id string) ([]string, error)) ([]string, error) {
+	var next []string
+	seen := make(map[string]bool)
+	for _, id := range level {
+		ids, err := related(ctx, id)
+		if err != nil {
+			return nil, err
+		}
+		for _, id := range ids {
+			if !seen[id] {
+				seen[id] = true
+				next = append(next, id)
+			}
+		}
+	}
+	return next, nil
+}
+
+// maxDepthError is returned when nesting a group would exceed the maximum depth
+func maxDepthError(parentID, childID string, maxDepth int) error {
+	return fmt.Errorf("%w: adding group %s to group %s would nest groups more than %d levels deep", types.ErrMaxDepthExceeded, childID, parentID, maxDepth)
+}
+
+// memberRef references a group member by its type and ID
+type memberRef struct {
+	Type string
+	ID   string
+}
+
+// groupSource is implemented by the backends storing groups and their
+// members separately, to load nested groups with loadMembers
+type groupSource interface {
+	GetUserByID(ctx context.Context, id string) (*types.User, error)
+	// shallowGroup returns a group without its members
+	shallowGroup(ctx context.Context, id string) (*types.Group, error)
+	// memberRefs returns the members of a group
+	memberRefs(ctx context.Context, groupID string) ([]memberRef, error)
+}
+
+// loadMembers loads the members of a group and of all the groups nested in
+// it, one group at a time rather than recursively. Every nested group is
+// loaded once and shared by all the groups it is a member of.
+func loadMembers(ctx context.Context, source groupSource, root *types.Group) error {
+	loaded := map[string]*types.Group{root.ID: root}
+	queue := []*types.Group{root}
+
+	for len(queue) > 0 {
+		group := queue[0]
+		queue = queue[1:]
+
+		refs, err := source.memberRefs(ctx, group.ID)
+		if err != nil {
+			return err
+		}
+
+		for _, ref := range refs {
+			var member types.Member
+			switch ref.Type {
+			case "user":
+				user, err := source.GetUserByID(ctx, ref.ID)
+				if err != nil {
+					return err
+				}
+				member = user
+			case "group":
+				nested, ok := loaded[ref.ID]
+				if !ok {
+					nested, err = source.shallowGroup(ctx, ref.ID)
+					if err != nil {
+						return err
+					}
+					loaded[ref.ID] = nested
+					queue = append(queue, nested)
+				}
+				member = nested
+			default:
+				return fmt.Errorf("%w: unknown member type %s", types.ErrInvalidMember, ref.Type)
+			}
+			group.Members = append(group.Members, &member)
+		}
+	}
+
+	return nil
+}
+
+// memberLevelFunc returns the members of each of the given groups
+type memberLevelFunc func(groupIDs []string) (map[string][]memberRef, error)
+
+// parentLevelFunc returns the IDs of the groups each of the given users or
+// groups is a direct member of
+type parentLevelFunc func(members []memberRef) (map[memberRef][]string, error)
+
+// effectiveMembers returns the users that are members of a group, directly
+// or through nested groups. The groups are walked one level at a time, each
+// level being the union of the members of the previous one, so every user
+// is reached through one of its shortest paths. Ties are broken by the
+// lowest path, as compared by comparePaths.
+func effectiveMembers(groupID string, members memberLevelFunc) ([]*types.EffectiveMembership, error) {
+	paths := map[string][]string{groupID: {groupID}}
+	users := make(map[string]*types.EffectiveMembership)
+
+	level := []string{groupID}
+	for len(level) > 0 {
+		byGroup, err := members(level)
+		if err != nil {
+			return nil, err
+		}
+
+		var next []string
+		for _, id := range level {
+			refs := byGroup[id]
+			sort.Slice(refs, func(i, j int) bool {
+				return refs[i].ID < refs[j].ID
+			})
+			for _, ref := range refs {
+				switch ref.Type {
+				case "user":
+					if _, ok := users[ref.ID]; !ok {
+						users[ref.ID] = &types.EffectiveMembership{UserID: ref.ID, GroupID: groupID, Path: paths[id]}
+					}
+				case "group":
+					if _, ok := paths[ref.ID]; !ok {
+						paths[ref.ID] = appendPath(paths[id], ref.ID)
+						next = append(next, ref.ID)
+					}
+				}
+			}
+		}
+		sort.Slice(next, func(i, j int) bool {
+			return comparePaths(paths[next[i]], paths[next[j]]) < 0
+		})
+		level = next
+	}
+
+	result := make([]*types.EffectiveMembership, 0, len(users))
+	for _, membership := range users {
+		result = append(result, membership)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].UserID < result[j].UserID
+	})
+	return result, nil
+}
+
+// effectiveGroups returns the groups a user is a member of, directly or
+// through nested groups, walking up one level at a time like
+// effectiveMembers walks down
+func effectiveGroups(userID string, parents parentLevelFunc) ([]*types.EffectiveMembership, error) {
+	paths, err := parentPaths(memberRef{Type: "user", ID: userID}, parents)
+	if err != nil {
+		return nil, err
+	}
+
+	result := make([]*types.EffectiveMembership, 0, len(paths))
+	for id, path := range paths {
+		result = append(result, &types.EffectiveMembership{UserID: userID, GroupID: id, Path: path})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].GroupID < result[j].GroupID
+	})
+	return result, nil
+}
+
+// ancestorGroups returns the sorted IDs of the groups a group is nested
+// in, directly or through other groups. The group itself is left out, even
+// when it is nested in one of its members.
+func ancestorGroups(groupID string, parents parentLevelFunc) ([]string, error) {
+	paths, err := parentPaths(memberRef{Type: "group", ID: groupID}, parents)
+	if err != nil {
+		return nil, err
+	}
+
+	ids := make([]string, 0, len(paths))
+	for id := range paths {
+		if id != groupID {
+			ids = append(ids, id)
+		}
+	}
+	sort.Strings(ids)
+	return ids, nil
+}
+
+// parentPaths walks up the groups a user or group is a member of, one
+// level at a time, and returns the shortest path from every group reached
+// down to the member
+func parentPaths(member memberRef, parents parentLevelFunc) (map[string][]string, error) {
+	paths := make(map[string][]string)
+
+	level := []memberRef{member}
+	for len(level) > 0 {
+		byMember, err := parents(level)
+		if err != nil {
+			return nil, err
+		}
+
+		var next []memberRef
+		for _, ref := range level {
+			ids := byMember[ref]
+			sort.Strings(ids)
+			for _, id := range ids {
+				if _, ok := paths[id]; ok {
+					continue
+				}
+				path := []string{id}
+				if ref.Type == "group" {
+					path = append(path, paths[ref.ID]...)
+				}
+				paths[id] = path
+				next = append(next, memberRef{Type: "group", ID: id})
+			}
+		}
+		sort.Slice(next, func(i, j int) bool {
+			return comparePaths(paths[next[i].ID], paths[next[j].ID]) < 0
+		})
+		level = next
+	}
+	return paths, nil
+}
+
+// appendPath returns a copy of path with id appended
+func appendPath(path []string, id string) []string {
+	return append(append(make([]string, 0, len(path)+1), path...), id)
+}
+
+// comparePaths compares two paths element by element, like PostgreSQL
+// compares arrays
+func comparePaths(a, b []string) int {
+	for i := 0; i < len(a) && i < len(b); i++ {
+		if c := strings.Compare(a[i], b[i]); c != 0 {
+			return c
+		}
+	}
+	return len(a) - len(b)
+}
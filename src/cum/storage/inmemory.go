@@ -1,28 +1,117 @@
 package storage
 
 import (
-	"errors"
+	"context"
 	"fmt"
+	"sort"
 	"strings"
 	"sync"
+	"time"
 
 	"cum/types"
 )
 
-// InMemoryStorage implements the Storage interface with an in-memory map
+// InMemoryStorage implements the Storage interface with an in-memory map.
+// It stores copies of the users, groups and sessions it is given, and
+// returns copies of them, so that callers never share them with the
+// storage. Stored groups reference their members and owner by type and ID
+// only, and are loaded with the current members when returned.
 type InMemoryStorage struct {
 	Users    map[string]*types.User
 	Groups   map[string]*types.Group
 	Sessions map[string]*types.Session
-	mu       sync.Mutex
+	// PasswordResets are the pending password resets, by ID
+	PasswordResets map[string]*types.PasswordReset
+	Outbox         map[string]*types.OutboxEntry
+	// PosixIDs are the POSIX numbers allocated to users and groups, by
+	// entity type and ID
+	PosixIDs map[string]map[string]int64
+	// ReservedPosixIDs are the users and groups whose number was reserved
+	// rather than allocated, by entity type and ID
+	ReservedPosixIDs map[string]map[string]bool
+	mu               sync.Mutex
+
+	deletePolicy    DeletePolicy
+	maxNestingDepth int
+
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
+}
+
+// InMemoryStorageConfig is the configuration for an InMemoryStorage
+type InMemoryStorageConfig struct {
+	// JanitorInterval is how often expired sessions and password resets
+	// are removed. Zero disables the janitor; expired sessions and password
+	// resets are still never returned.
+	JanitorInterval time.Duration
+	// DeletePolicy defines what happens to the memberships and ownerships
+	// of deleted users and groups. It defaults to DeleteCascade.
+	DeletePolicy DeletePolicy
+	// MaxNestingDepth is the maximum number of levels of nested groups. It
+	// defaults to DefaultMaxNestingDepth.
+	MaxNestingDepth int
 }
 
 // NewInMemoryStorage creates a new InMemoryStorage
-func NewInMemoryStorage() *InMemoryStorage {
-	return &InMemoryStorage{
-		Users:    make(map[string]*types.User),
-		Groups:   make(map[string]*types.Group),
-		Sessions: make(map[string]*types.Session),
+func NewInMemoryStorage(config *InMemoryStorageConfig) *InMemoryStorage {
+	s := &InMemoryStorage{
+		Users:            make(map[string]*types.User),
+		Groups:           make(map[string]*types.Group),
+		Sessions:         make(map[string]*types.Session),
+		PasswordResets:   make(map[string]*types.PasswordReset),
+		Outbox:           make(map[string]*types.OutboxEntry),
+		PosixIDs:         map[string]map[string]int64{"user": {}, "group": {}},
+		ReservedPosixIDs: map[string]map[string]bool{"user": {}, "group": {}},
+		stop:             make(chan struct{}),
+		stopped:          make(chan struct{}),
+
+		deletePolicy:    config.DeletePolicy,
+		maxNestingDepth: maxNestingDepth(config.MaxNestingDepth),
+	}
+
+	if config.JanitorInterval > 0 {
+		go s.janitor(config.JanitorInterval)
+	} else {
+		close(s.stopped)
+	}
+
+	return s
+}
+
+// janitor removes expired sessions and password resets until the storage
+// is closed
+func (s *InMemoryStorage) janitor(interval time.Duration) {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case now := <-ticker.C:
+			s.deleteExpiredSessions(now)
+		}
+	}
+}
+
+// deleteExpiredSessions removes the sessions and password resets expired
+// at the given time
+func (s *InMemoryStorage) deleteExpiredSessions(now time.Time) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.Sessions {
+		if session.Expired(now) {
+			delete(s.Sessions, id)
+		}
+	}
+	for id, reset := range s.PasswordResets {
+		if reset.Expired(now) {
+			delete(s.PasswordResets, id)
+		}
 	}
 }
 
@@ -39,186 +128,881 @@ func (s *InMemoryStorage) NewSessionStorage() (types.SessionStorage, error) {
 }
 
 // CreateUser creates a new user
-func (s *InMemoryStorage) CreateUser(user *types.User) error {
+func (s *InMemoryStorage) CreateUser(ctx context.Context, user *types.User, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if _, ok := s.Users[user.ID]; ok {
-		return errors.New("user already exists")
+		return fmt.Errorf("user %s %w", user.ID, types.ErrAlreadyExists)
 	}
-	s.Users[user.ID] = user
+	if err := s.checkUserUnique(user); err != nil {
+		return err
+	}
+	s.Users[user.ID] = copyUser(user)
+	s.addOutboxEntries(outbox)
 	return nil
 }
 
 // GetUserByID returns a user by its ID
-func (s *InMemoryStorage) GetUserByID(id string) (*types.User, error) {
+func (s *InMemoryStorage) GetUserByID(ctx context.Context, id string) (*types.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if user, ok := s.Users[id]; ok {
-		return user, nil
+		return copyUser(user), nil
 	}
-	return nil, errors.New("user not found")
+	return nil, fmt.Errorf("user %s %w", id, types.ErrNotFound)
 }
 
 // GetUserByUsername returns a user by its username
-func (s *InMemoryStorage) GetUserByUsername(username string) (*types.User, error) {
+func (s *InMemoryStorage) GetUserByUsername(ctx context.Context, username string) (*types.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	for _, user := range s.Users {
 		if user.Username == username {
-			return user, nil
+			return copyUser(user), nil
 		}
 	}
-	return nil, errors.New("username not found")
+	return nil, fmt.Errorf("user with username %s %w", username, types.ErrNotFound)
 }
 
-// GetUserByEmail returns a user by its email
-func (s *InMemoryStorage) GetUserByEmail(email string) (*types.User, error) {
+// GetUserByEmail returns a user by its email. Users without an email are
+// never returned.
+func (s *InMemoryStorage) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	for _, user := range s.Users {
-		if user.Email == email {
-			return user, nil
+		if email != "" && user.Email == email {
+			return copyUser(user), nil
 		}
 	}
-	return nil, errors.New("user not found")
+	return nil, fmt.Errorf("user with email %s %w", email, types.ErrNotFound)
+}
+
+// ListUsers returns a page of users
+func (s *InMemoryStorage) ListUsers(ctx context.Context, options *types.UserListOptions) (*types.UserPage, error) {
+	params, err := userListParams(options)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	users := []*types.User{}
+	for _, user := range s.Users {
+		if !matchUser(user, options) {
+			continue
+		}
+		if params.cursor != nil && !params.cursor.after(userSortValue(user, params.sortBy), user.ID) {
+			continue
+		}
+		users = append(users, copyUser(user))
+	}
+	sort.Slice(users, func(i, j int) bool {
+		return params.less(userSortValue(users[i], params.sortBy), users[i].ID, userSortValue(users[j], params.sortBy), users[j].ID)
+	})
+	if len(users) > params.limit+1 {
+		users = users[:params.limit+1]
+	}
+	return userPage(users, params), nil
 }
 
 // UpdateUser updates a user
-func (s *InMemoryStorage) UpdateUser(user *types.User) error {
+func (s *InMemoryStorage) UpdateUser(ctx context.Context, user *types.User, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if _, ok := s.Users[user.ID]; !ok {
-		return errors.New("user not found")
+		return fmt.Errorf("user %s %w", user.ID, types.ErrNotFound)
+	}
+	if err := s.checkUserUnique(user); err != nil {
+		return err
 	}
-	s.Users[user.ID] = user
+	s.Users[user.ID] = copyUser(user)
+	s.addOutboxEntries(outbox)
 	return nil
 }
 
 // DeleteUser deletes a user
-func (s *InMemoryStorage) DeleteUser(id string) error {
+func (s *InMemoryStorage) DeleteUser(ctx context.Context, id string, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if _, ok := s.Users[id]; !ok {
-		return errors.New("user not found")
+		return fmt.Errorf("user %s %w", id, types.ErrNotFound)
+	}
+	if err := s.removeReferences(&types.User{ID: id}); err != nil {
+		return err
 	}
 	delete(s.Users, id)
+	s.addOutboxEntries(outbox)
 	return nil
 }
 
 // CreateGroup creates a new group
-func (s *InMemoryStorage) CreateGroup(group *types.Group) error {
+func (s *InMemoryStorage) CreateGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if _, ok := s.Groups[group.ID]; ok {
-		return errors.New("group already exists")
+		return fmt.Errorf("group %s %w", group.ID, types.ErrAlreadyExists)
+	}
+	if _, err := groupOwner(group); err != nil {
+		return err
+	}
+	if err := s.checkGroupUnique(group); err != nil {
+		return err
 	}
-	s.Groups[group.ID] = group
+	if err := s.checkMembers(ctx, group); err != nil {
+		return err
+	}
+	stored, err := storedGroup(group)
+	if err != nil {
+		return err
+	}
+	s.Groups[group.ID] = stored
+	s.addOutboxEntries(outbox)
 	return nil
 }
 
 // GetGroupByID returns a group by its ID
-func (s *InMemoryStorage) GetGroupByID(id string) (*types.Group, error) {
+func (s *InMemoryStorage) GetGroupByID(ctx context.Context, id string) (*types.Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	if group, ok := s.Groups[id]; ok {
-		return group, nil
+		return s.loadGroup(ctx, group)
 	}
-	return nil, errors.New("group not found")
+	return nil, fmt.Errorf("group %s %w", id, types.ErrNotFound)
 }
 
 // GetGroupByName returns a group by its name
-func (s *InMemoryStorage) GetGroupByName(name string) (*types.Group, error) {
+func (s *InMemoryStorage) GetGroupByName(ctx context.Context, name string) (*types.Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	for _, group := range s.Groups {
 		if group.Name == name {
-			return group, nil
+			return s.loadGroup(ctx, group)
+		}
+	}
+	return nil, fmt.Errorf("group with name %s %w", name, types.ErrNotFound)
+}
+
+// GetGroupsByOwner returns the groups owned by a user or group, sorted by name
+func (s *InMemoryStorage) GetGroupsByOwner(ctx context.Context, owner types.Member) ([]*types.Group, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groups := []*types.Group{}
+	for _, group := range s.Groups {
+		if group.OwnedBy(owner) {
+			loaded, err := s.loadGroup(ctx, group)
+			if err != nil {
+				return nil, err
+			}
+			groups = append(groups, loaded)
 		}
 	}
-	return nil, errors.New("group not found")
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+// ListGroups returns a page of groups, without their members
+func (s *InMemoryStorage) ListGroups(ctx context.Context, options *types.GroupListOptions) (*types.GroupPage, error) {
+	params, err := groupListParams(options)
+	if err != nil {
+		return nil, err
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	groups := []*types.Group{}
+	for _, group := range s.Groups {
+		if !matchGroup(group, options) {
+			continue
+		}
+		if params.cursor != nil && !params.cursor.after(groupSortValue(group, params.sortBy), group.ID) {
+			continue
+		}
+		groups = append(groups, shallowCopyGroup(group))
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return params.less(groupSortValue(groups[i], params.sortBy), groups[i].ID, groupSortValue(groups[j], params.sortBy), groups[j].ID)
+	})
+	if len(groups) > params.limit+1 {
+		groups = groups[:params.limit+1]
+	}
+	return groupPage(groups, params), nil
+}
+
+// GetEffectiveMembers returns the users that are members of a group,
+// directly or through nested groups
+func (s *InMemoryStorage) GetEffectiveMembers(ctx context.Context, groupID string) ([]*types.EffectiveMembership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Groups[groupID]; !ok {
+		return nil, fmt.Errorf("group %s %w", groupID, types.ErrNotFound)
+	}
+
+	return effectiveMembers(groupID, func(groupIDs []string) (map[string][]memberRef, error) {
+		members := make(map[string][]memberRef)
+		for _, id := range groupIDs {
+			for _, member := range s.Groups[id].Members {
+				members[id] = append(members[id], memberRef{Type: (*member).GetType(), ID: (*member).GetID()})
+			}
+		}
+		return members, nil
+	})
+}
+
+// GetEffectiveGroups returns the groups a user is a member of, directly or
+// through nested groups
+func (s *InMemoryStorage) GetEffectiveGroups(ctx context.Context, userID string) ([]*types.EffectiveMembership, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Users[userID]; !ok {
+		return nil, fmt.Errorf("user %s %w", userID, types.ErrNotFound)
+	}
+
+	return effectiveGroups(userID, s.parentLevel())
+}
+
+// GetAncestorGroups returns the IDs of the groups a group is nested in,
+// directly or through other groups
+func (s *InMemoryStorage) GetAncestorGroups(ctx context.Context, groupID string) ([]string, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Groups[groupID]; !ok {
+		return nil, fmt.Errorf("group %s %w", groupID, types.ErrNotFound)
+	}
+
+	return ancestorGroups(groupID, s.parentLevel())
+}
+
+// parentLevel returns a parentLevelFunc reading the groups every user and
+// group is a member of, indexed once. The caller must hold the lock.
+func (s *InMemoryStorage) parentLevel() parentLevelFunc {
+	parents := make(map[memberRef][]string)
+	for _, group := range s.Groups {
+		for _, member := range group.Members {
+			ref := memberRef{Type: (*member).GetType(), ID: (*member).GetID()}
+			parents[ref] = append(parents[ref], group.ID)
+		}
+	}
+
+	return func(refs []memberRef) (map[memberRef][]string, error) {
+		return parents, nil
+	}
 }
 
 // UpdateGroup updates a group
-func (s *InMemoryStorage) UpdateGroup(group *types.Group) error {
+func (s *InMemoryStorage) UpdateGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if _, ok := s.Groups[group.ID]; !ok {
-		return errors.New("group not found")
+		return fmt.Errorf("group %s %w", group.ID, types.ErrNotFound)
+	}
+	if _, err := groupOwner(group); err != nil {
+		return err
+	}
+	if err := s.checkGroupUnique(group); err != nil {
+		return err
+	}
+	if err := s.checkMembers(ctx, group); err != nil {
+		return err
 	}
-	s.Groups[group.ID] = group
+	stored, err := storedGroup(group)
+	if err != nil {
+		return err
+	}
+	s.Groups[group.ID] = stored
+	s.addOutboxEntries(outbox)
 	return nil
 }
 
 // DeleteGroup deletes a group
-func (s *InMemoryStorage) DeleteGroup(group *types.Group) error {
+func (s *InMemoryStorage) DeleteGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if _, ok := s.Groups[group.ID]; !ok {
-		return errors.New("group not found")
+		return fmt.Errorf("group %s %w", group.ID, types.ErrNotFound)
+	}
+	if err := s.removeReferences(&types.Group{ID: group.ID}); err != nil {
+		return err
 	}
 	delete(s.Groups, group.ID)
+	s.addOutboxEntries(outbox)
 	return nil
 }
 
 // AddMemberToGroup adds a member to a group
-func (s *InMemoryStorage) AddMemberToGroup(m types.Member, groupID string) error {
+func (s *InMemoryStorage) AddMemberToGroup(ctx context.Context, m types.Member, groupID string, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if _, ok := s.Groups[groupID]; !ok {
-		return errors.New("group not found")
+		return fmt.Errorf("group %s %w", groupID, types.ErrNotFound)
+	}
+	switch m.(type) {
+	case *types.User:
+		if _, ok := s.Users[m.GetID()]; !ok {
+			return fmt.Errorf("user %s %w", m.GetID(), types.ErrNotFound)
+		}
+	case *types.Group:
+		if _, ok := s.Groups[m.GetID()]; !ok {
+			return fmt.Errorf("group %s %w", m.GetID(), types.ErrNotFound)
+		}
+		if err := checkNesting(ctx, s, groupID, m.GetID(), s.maxNestingDepth); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("%w: unknown member type %T", types.ErrInvalidMember, m)
+	}
+	for _, member := range s.Groups[groupID].Members {
+		if (*member).GetType() == m.GetType() && (*member).GetID() == m.GetID() {
+			return fmt.Errorf("%s %s is already a member of group %s: %w", m.GetType(), m.GetID(), groupID, types.ErrAlreadyExists)
+		}
+	}
+	ref, err := memberReference(m)
+	if err != nil {
+		return err
 	}
-	s.Groups[groupID].Members = append(s.Groups[groupID].Members, &m)
+	s.Groups[groupID].Members = append(s.Groups[groupID].Members, ref)
+	s.addOutboxEntries(outbox)
 	return nil
 }
 
 // RemoveMemberFromGroup removes a member from a group
-func (s *InMemoryStorage) RemoveMemberFromGroup(m *types.Member, groupID string) error {
+func (s *InMemoryStorage) RemoveMemberFromGroup(ctx context.Context, m *types.Member, groupID string, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
 	if _, ok := s.Groups[groupID]; !ok {
-		return errors.New("group not found")
+		return fmt.Errorf("group %s %w", groupID, types.ErrNotFound)
 	}
 	for i, id := range s.Groups[groupID].Members {
-		if (*id).GetID() == (*m).GetID() {
+		if (*id).GetType() == (*m).GetType() && (*id).GetID() == (*m).GetID() {
 			s.Groups[groupID].Members = append(s.Groups[groupID].Members[:i], s.Groups[groupID].Members[i+1:]...)
+			s.addOutboxEntries(outbox)
 			return nil
 		}
 	}
-	return errors.New("member not found")
+	return fmt.Errorf("member %s of group %s %w", (*m).GetID(), groupID, types.ErrNotFound)
 }
 
 // CreateSession creates a new session
-func (s *InMemoryStorage) CreateSession(session *types.Session) error {
+func (s *InMemoryStorage) CreateSession(ctx context.Context, session *types.Session) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, ok := s.Sessions[session.ID]; ok {
-		return errors.New("session already exists")
+	if existing, ok := s.Sessions[session.ID]; ok && !existing.Expired(time.Now()) {
+		return fmt.Errorf("session %s %w", session.ID, types.ErrAlreadyExists)
 	}
-	s.Sessions[session.ID] = session
+	stored := *session
+	s.Sessions[session.ID] = &stored
 	return nil
 }
 
 // GetSessionByID returns a session by its ID
-func (s *InMemoryStorage) GetSessionByID(id string) (*types.Session, error) {
-	if session, ok := s.Sessions[id]; ok {
-		return session, nil
+func (s *InMemoryStorage) GetSessionByID(ctx context.Context, id string) (*types.Session, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if session, ok := s.Sessions[id]; ok && !session.Expired(time.Now()) {
+		found := *session
+		return &found, nil
 	}
-	return nil, errors.New("session not found")
+	return nil, fmt.Errorf("session %s %w", id, types.ErrNotFound)
 }
 
 // DeleteSession deletes a session
-func (s *InMemoryStorage) DeleteSession(id string) error {
+func (s *InMemoryStorage) DeleteSession(ctx context.Context, id string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	if _, ok := s.Sessions[id]; !ok {
-		return errors.New("session not found")
+	if session, ok := s.Sessions[id]; !ok || session.Expired(time.Now()) {
+		return fmt.Errorf("session %s %w", id, types.ErrNotFound)
 	}
 	delete(s.Sessions, id)
 	return nil
 }
 
+// DeleteUserSessions deletes every session of a user
+func (s *InMemoryStorage) DeleteUserSessions(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, session := range s.Sessions {
+		if session.UserID == userID {
+			delete(s.Sessions, id)
+		}
+	}
+	return nil
+}
+
+// CreatePasswordReset creates a new password reset
+func (s *InMemoryStorage) CreatePasswordReset(ctx context.Context, reset *types.PasswordReset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if existing, ok := s.PasswordResets[reset.ID]; ok && !existing.Expired(time.Now()) {
+		return fmt.Errorf("password reset %s %w", reset.ID, types.ErrAlreadyExists)
+	}
+	stored := *reset
+	s.PasswordResets[reset.ID] = &stored
+	return nil
+}
+
+// ConsumePasswordReset returns and deletes a password reset by its ID
+func (s *InMemoryStorage) ConsumePasswordReset(ctx context.Context, id string) (*types.PasswordReset, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reset, ok := s.PasswordResets[id]
+	delete(s.PasswordResets, id)
+	if !ok || reset.Expired(time.Now()) {
+		return nil, fmt.Errorf("password reset %s %w", id, types.ErrNotFound)
+	}
+	return reset, nil
+}
+
+// DeleteUserPasswordResets deletes every pending password reset of a user
+func (s *InMemoryStorage) DeleteUserPasswordResets(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for id, reset := range s.PasswordResets {
+		if reset.UserID == userID {
+			delete(s.PasswordResets, id)
+		}
+	}
+	return nil
+}
+
+// AddOutboxEntry adds an entry to the outbox
+func (s *InMemoryStorage) AddOutboxEntry(ctx context.Context, entry *types.OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Outbox[entry.ID]; ok {
+		return fmt.Errorf("outbox entry %s %w", entry.ID, types.ErrAlreadyExists)
+	}
+	stored := *entry
+	s.Outbox[entry.ID] = &stored
+	return nil
+}
+
+// addOutboxEntries adds the outbox entries of a change. It is called with
+// the lock held once the change is made, so that both are seen together.
+func (s *InMemoryStorage) addOutboxEntries(entries []*types.OutboxEntry) {
+	for _, entry := range entries {
+		stored := *entry
+		s.Outbox[entry.ID] = &stored
+	}
+}
+
+// GetDueOutboxEntries returns at most limit outbox entries due at the
+// given Unix time
+func (s *InMemoryStorage) GetDueOutboxEntries(ctx context.Context, now int64, limit int) ([]*types.OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.dueOutboxEntries(now, limit)
+	for i, entry := range entries {
+		due := *entry
+		entries[i] = &due
+	}
+	return entries, nil
+}
+
+// ClaimOutboxEntries returns at most limit outbox entries due at the given
+// Unix time, moving their next attempt to until
+func (s *InMemoryStorage) ClaimOutboxEntries(ctx context.Context, now int64, until int64, limit int) ([]*types.OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	entries := s.dueOutboxEntries(now, limit)
+	for i, entry := range entries {
+		entry.NextAttemptAt = until
+		claimed := *entry
+		entries[i] = &claimed
+	}
+	return entries, nil
+}
+
+// dueOutboxEntries returns the stored outbox entries due at the given Unix
+// time, in order. It is called with the lock held.
+func (s *InMemoryStorage) dueOutboxEntries(now int64, limit int) []*types.OutboxEntry {
+	var entries []*types.OutboxEntry
+	for _, entry := range s.Outbox {
+		if entry.NextAttemptAt <= now {
+			entries = append(entries, entry)
+		}
+	}
+	sort.Slice(entries, func(i, j int) bool {
+		a, b := entries[i], entries[j]
+		if a.NextAttemptAt != b.NextAttemptAt {
+			return a.NextAttemptAt < b.NextAttemptAt
+		}
+		if a.CreatedAt != b.CreatedAt {
+			return a.CreatedAt < b.CreatedAt
+		}
+		return a.ID < b.ID
+	})
+	if len(entries) > limit {
+		entries = entries[:limit]
+	}
+	return entries
+}
+
+// UpdateOutboxEntry updates an outbox entry
+func (s *InMemoryStorage) UpdateOutboxEntry(ctx context.Context, entry *types.OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Outbox[entry.ID]; !ok {
+		return fmt.Errorf("outbox entry %s %w", entry.ID, types.ErrNotFound)
+	}
+	stored := *entry
+	s.Outbox[entry.ID] = &stored
+	return nil
+}
+
+// DeleteOutboxEntry deletes an outbox entry
+func (s *InMemoryStorage) DeleteOutboxEntry(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.Outbox[id]; !ok {
+		return fmt.Errorf("outbox entry %s %w", id, types.ErrNotFound)
+	}
+	delete(s.Outbox, id)
+	return nil
+}
+
+// CountOutboxEntries returns the number of outbox entries
+func (s *InMemoryStorage) CountOutboxEntries(ctx context.Context) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return len(s.Outbox), nil
+}
+
+// AllocatePosixID returns the POSIX number of a user or group, allocating
+// one from the range [min, max] if it has none
+func (s *InMemoryStorage) AllocatePosixID(ctx context.Context, entityType string, entityID string, min int64, max int64) (int64, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids, ok := s.PosixIDs[entityType]
+	if !ok {
+		return 0, fmt.Errorf("%w: unknown entity type %q", types.ErrInvalidArgument, entityType)
+	}
+	if id, ok := ids[entityID]; ok {
+		return id, nil
+	}
+	next := min
+	taken := make(map[int64]bool, len(ids))
+	for entity, id := range ids {
+		taken[id] = true
+		if !s.ReservedPosixIDs[entityType][entity] && id >= next && id <= max {
+			next = id + 1
+		}
+	}
+	for taken[next] {
+		next++
+	}
+	if next > max {
+		return 0, fmt.Errorf("%w: no %s number left in the range %d-%d", types.ErrConflict, entityType, min, max)
+	}
+	ids[entityID] = next
+	return next, nil
+}
+
+// ReservePosixID records a number used in LDAP by a user, group or other
+// LDAP entry, so that it is never allocated to another one
+func (s *InMemoryStorage) ReservePosixID(ctx context.Context, entityType string, entityID string, number int64) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	ids, ok := s.PosixIDs[entityType]
+	if !ok {
+		return fmt.Errorf("%w: unknown entity type %q", types.ErrInvalidArgument, entityType)
+	}
+	if id, ok := ids[entityID]; ok {
+		if id == number {
+			return nil
+		}
+		return posixIDConflict(entityType, entityID, id, number)
+	}
+	for other, id := range ids {
+		if id == number {
+			return posixIDTaken(entityType, number, other)
+		}
+	}
+	ids[entityID] = number
+	s.ReservedPosixIDs[entityType][entityID] = true
+	return nil
+}
+
+// removeReferences applies the delete policy to the memberships and
+// ownerships of a user or group about to be deleted. References of a group
+// to itself are ignored. The caller must hold the lock.
+func (s *InMemoryStorage) removeReferences(ref types.Member) error {
+	isSelf := func(group *types.Group) bool {
+		return ref.GetType() == "group" && group.ID == ref.GetID()
+	}
+
+	if s.deletePolicy == DeleteRestrict {
+		for _, group := range s.Groups {
+			if isSelf(group) {
+				continue
+			}
+			for _, member := range group.Members {
+				if (*member).GetType() == ref.GetType() && (*member).GetID() == ref.GetID() {
+					return stillMemberError(ref.GetType(), ref.GetID(), group.ID)
+				}
+			}
+			if group.OwnedBy(ref) {
+				return stillOwnerError(ref.GetType(), ref.GetID(), group.ID)
+			}
+		}
+	}
+
+	for _, group := range s.Groups {
+		var members []*types.Member
+		for _, member := range group.Members {
+			if (*member).GetType() != ref.GetType() || (*member).GetID() != ref.GetID() {
+				members = append(members, member)
+			}
+		}
+		if len(members) != len(group.Members) {
+			group.Members = members
+		}
+		if group.OwnedBy(ref) {
+			group.OwnerID = nil
+		}
+	}
+	return nil
+}
+
+// checkMembers returns an error if the owner or a member of a group does
+// not exist, if a member is of an unknown type or if the nested groups
+// would together create a cycle or exceed the maximum depth. The caller
+// must hold the lock.
+func (s *InMemoryStorage) checkMembers(ctx context.Context, group *types.Group) error {
+	owner, err := groupOwner(group)
+	if err != nil {
+		return err
+	}
+	if owner != nil && !(owner.GetType() == "group" && owner.GetID() == group.ID) {
+		if err := s.checkExists(owner); err != nil {
+			return err
+		}
+	}
+
+	var children []string
+	for _, member := range group.Members {
+		switch (*member).(type) {
+		case *types.User:
+		case *types.Group:
+			children = append(children, (*member).GetID())
+		default:
+			return fmt.Errorf("%w: unknown member type %T", types.ErrInvalidMember, *member)
+		}
+		if err := s.checkExists(*member); err != nil {
+			return err
+		}
+	}
+	return checkGroupNesting(ctx, s, group.ID, children, s.maxNestingDepth)
+}
+
+// checkExists returns an error if a user or group does not exist. The
+// caller must hold the lock.
+func (s *InMemoryStorage) checkExists(m types.Member) error {
+	var ok bool
+	if m.GetType() == "group" {
+		_, ok = s.Groups[m.GetID()]
+	} else {
+		_, ok = s.Users[m.GetID()]
+	}
+	if !ok {
+		return fmt.Errorf("%s %s %w", m.GetType(), m.GetID(), types.ErrNotFound)
+	}
+	return nil
+}
+
+// loadGroup returns a copy of a stored group, with its members and the
+// groups nested in it loaded from their current state. The caller must
+// hold the lock.
+func (s *InMemoryStorage) loadGroup(ctx context.Context, stored *types.Group) (*types.Group, error) {
+	group := shallowCopyGroup(stored)
+	if err := loadMembers(ctx, inMemoryGroupSource{s}, group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// inMemoryGroupSource is the groupSource of an InMemoryStorage whose lock
+// is held by the caller
+type inMemoryGroupSource struct {
+	s *InMemoryStorage
+}
+
+// GetUserByID returns a copy of a user by its ID
+func (g inMemoryGroupSource) GetUserByID(ctx context.Context, id string) (*types.User, error) {
+	if user, ok := g.s.Users[id]; ok {
+		return copyUser(user), nil
+	}
+	return nil, fmt.Errorf("user %s %w", id, types.ErrNotFound)
+}
+
+// shallowGroup returns a copy of a group by its ID, without its members
+func (g inMemoryGroupSource) shallowGroup(ctx context.Context, id string) (*types.Group, error) {
+	if group, ok := g.s.Groups[id]; ok {
+		return shallowCopyGroup(group), nil
+	}
+	return nil, fmt.Errorf("group %s %w", id, types.ErrNotFound)
+}
+
+// memberRefs returns the members of a group
+func (g inMemoryGroupSource) memberRefs(ctx context.Context, groupID string) ([]memberRef, error) {
+	var refs []memberRef
+	for _, member := range g.s.Groups[groupID].Members {
+		refs = append(refs, memberRef{Type: (*member).GetType(), ID: (*member).GetID()})
+	}
+	return refs, nil
+}
+
+// copyUser returns a copy of a user
+func copyUser(user *types.User) *types.User {
+	c := *user
+	return &c
+}
+
+// shallowCopyGroup returns a copy of a group without its members
+func shallowCopyGroup(group *types.Group) *types.Group {
+	c := &types.Group{
+		ID:          group.ID,
+		Name:        group.Name,
+		Description: group.Description,
+	}
+	if group.OwnerID != nil && *group.OwnerID != nil {
+		// Stored owners are references, which are never modified
+		c.OwnerID, _ = memberReference(*group.OwnerID)
+	}
+	return c
+}
+
+// storedGroup returns the copy of a group to store, referencing its owner
+// and members by type and ID
+func storedGroup(group *types.Group) (*types.Group, error) {
+	stored := &types.Group{
+		ID:          group.ID,
+		Name:        group.Name,
+		Description: group.Description,
+	}
+	if group.OwnerID != nil && *group.OwnerID != nil {
+		owner, err := memberReference(*group.OwnerID)
+		if err != nil {
+			return nil, err
+		}
+		stored.OwnerID = owner
+	}
+	for _, member := range group.Members {
+		ref, err := memberReference(*member)
+		if err != nil {
+			return nil, err
+		}
+		stored.Members = append(stored.Members, ref)
+	}
+	return stored, nil
+}
+
+// memberReference returns a reference to a user or group, carrying only
+// its type and ID
+func memberReference(member types.Member) (*types.Member, error) {
+	ref, err := types.NewMemberReference(member.GetType(), member.GetID())
+	if err != nil {
+		return nil, err
+	}
+	return &ref, nil
+}
+
+// childGroups returns the IDs of the groups that are direct members of a
+// group. The caller must hold the lock.
+func (s *InMemoryStorage) childGroups(ctx context.Context, id string) ([]string, error) {
+	var ids []string
+	if group, ok := s.Groups[id]; ok {
+		for _, member := range group.Members {
+			if (*member).GetType() == "group" {
+				ids = append(ids, (*member).GetID())
+			}
+		}
+	}
+	return ids, nil
+}
+
+// parentGroups returns the IDs of the groups a group is a direct member
+// of. The caller must hold the lock.
+func (s *InMemoryStorage) parentGroups(ctx context.Context, id string) ([]string, error) {
+	var ids []string
+	for _, group := range s.Groups {
+		for _, member := range group.Members {
+			if (*member).GetType() == "group" && (*member).GetID() == id {
+				ids = append(ids, group.ID)
+				break
+			}
+		}
+	}
+	return ids, nil
+}
+
+// checkUserUnique returns an error if another user already uses the
+// username or email of the given user. The caller must hold the lock.
+func (s *InMemoryStorage) checkUserUnique(user *types.User) error {
+	for _, other := range s.Users {
+		if other.ID == user.ID {
+			continue
+		}
+		if other.Username == user.Username {
+			return fmt.Errorf("%w: username %s is already taken", types.ErrConflict, user.Username)
+		}
+		if user.Email != "" && other.Email == user.Email {
+			return fmt.Errorf("%w: email %s is already taken", types.ErrConflict, user.Email)
+		}
+	}
+	return nil
+}
+
+// checkGroupUnique returns an error if another group already uses the
+// name of the given group. The caller must hold the lock.
+func (s *InMemoryStorage) checkGroupUnique(group *types.Group) error {
+	for _, other := range s.Groups {
+		if other.ID != group.ID && other.Name == group.Name {
+			return fmt.Errorf("%w: group name %s is already taken", types.ErrConflict, group.Name)
+		}
+	}
+	return nil
+}
+
 // String returns a string representation of the InMemoryStorage instance
 func (s *InMemoryStorage) String() string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	var sb strings.Builder
 	sb.WriteString("In-memory storage:\n")
 	sb.WriteString("\tUsers:\n")
@@ -236,7 +1020,11 @@ func (s *InMemoryStorage) String() string {
 	return sb.String()
 }
 
-// Close closes the storage
+// Close stops the session janitor
 func (s *InMemoryStorage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.stopped
 	return nil
 }
@@ -0,0 +1,163 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sync"
+	"testing"
+
+	"cum/types"
+)
+
+func newTestInMemoryStorage(t *testing.T) *InMemoryStorage {
+	t.Helper()
+	s := NewInMemoryStorage(&InMemoryStorageConfig{})
+	t.Cleanup(func() { s.Close() })
+	return s
+}
+
+func TestInMemoryStorageUserCopies(t *testing.T) {
+	ctx := context.Background()
+	s := newTestInMemoryStorage(t)
+
+	user := &types.User{ID: "u1", Username: "alice", Email: "alice@example.com"}
+	if err := s.CreateUser(ctx, user); err != nil {
+		t.Fatal(err)
+	}
+	user.Username = "changed"
+
+	got, err := s.GetUserByID(ctx, "u1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got.Username != "alice" {
+		t.Fatalf("stored user changed with the created one: got username %q", got.Username)
+	}
+	got.Username = "changed"
+
+	again, err := s.GetUserByUsername(ctx, "alice")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == got {
+		t.Fatal("returned the same user twice")
+	}
+	if again.Username != "alice" {
+		t.Fatalf("stored user changed with the returned one: got username %q", again.Username)
+	}
+}
+
+func TestInMemoryStorageGroupCopies(t *testing.T) {
+	ctx := context.Background()
+	s := newTestInMemoryStorage(t)
+
+	if err := s.CreateUser(ctx, &types.User{ID: "u1", Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	var member types.Member = &types.User{ID: "u1", Username: "alice"}
+	if err := s.CreateGroup(ctx, &types.Group{ID: "g1", Name: "staff", Members: []*types.Member{&member}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateUser(ctx, &types.User{ID: "u1", Username: "alicia"}); err != nil {
+		t.Fatal(err)
+	}
+
+	group, err := s.GetGroupByID(ctx, "g1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(group.Members) != 1 {
+		t.Fatalf("got %d members, want 1", len(group.Members))
+	}
+	user, ok := (*group.Members[0]).(*types.User)
+	if !ok || user.Username != "alicia" {
+		t.Fatalf("got member %v, want the updated user alicia", *group.Members[0])
+	}
+
+	group.Name = "changed"
+	group.Members = nil
+	again, err := s.GetGroupByName(ctx, "staff")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(again.Members) != 1 {
+		t.Fatalf("stored group changed with the returned one: got %d members", len(again.Members))
+	}
+}
+
+// TestInMemoryStorageConcurrentAccess reads users and groups while they are
+// updated, for the race detector to report any shared state
+func TestInMemoryStorageConcurrentAccess(t *testing.T) {
+	ctx := context.Background()
+	s := newTestInMemoryStorage(t)
+
+	if err := s.CreateUser(ctx, &types.User{ID: "u1", Username: "alice"}); err != nil {
+		t.Fatal(err)
+	}
+	var member types.Member = &types.User{ID: "u1"}
+	if err := s.CreateGroup(ctx, &types.Group{ID: "g1", Name: "staff", Members: []*types.Member{&member}}); err != nil {
+		t.Fatal(err)
+	}
+
+	var wg sync.WaitGroup
+	for i := 0; i < 4; i++ {
+		wg.Add(2)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				username := fmt.Sprintf("alice-%d-%d", i, j)
+				if err := s.UpdateUser(ctx, &types.User{ID: "u1", Username: username}); err != nil {
+					t.Error(err)
+					return
+				}
+				if err := s.UpdateGroup(ctx, &types.Group{ID: "g1", Name: "staff", Description: username, Members: []*types.Member{&member}}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}(i)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				user, err := s.GetUserByID(ctx, "u1")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_ = user.Username
+				group, err := s.GetGroupByID(ctx, "g1")
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				for _, m := range group.Members {
+					_ = (*m).(*types.User).Username
+				}
+				_ = group.Description
+			}
+		}()
+	}
+	wg.Wait()
+}
+
+func TestInMemoryStorageOptionalEmail(t *testing.T) {
+	ctx := context.Background()
+	s := newTestInMemoryStorage(t)
+
+	for _, user := range []*types.User{{ID: "u1", Username: "alice"}, {ID: "u2", Username: "bob"}} {
+		if err := s.CreateUser(ctx, user); err != nil {
+			t.Fatalf("creating a user without an email: %v", err)
+		}
+	}
+	if _, err := s.GetUserByEmail(ctx, ""); !errors.Is(err, types.ErrNotFound) {
+		t.Fatalf("got error %v, want ErrNotFound", err)
+	}
+
+	if err := s.UpdateUser(ctx, &types.User{ID: "u1", Username: "alice", Email: "a@example.com"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateUser(ctx, &types.User{ID: "u2", Username: "bob", Email: "a@example.com"}); !errors.Is(err, types.ErrConflict) {
+		t.Fatalf("got error %v, want ErrConflict", err)
+	}
+}
@@ -0,0 +1,190 @@
+package storage
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	"cum/types"
+)
+
+// listCursor is the position after which a page of users or groups
+// starts. It is encoded as an opaque string for the callers.
+type listCursor struct {
+	SortBy     string `json:"s"`
+	Descending bool   `json:"d,omitempty"`
+	Value      string `json:"v"`
+	ID         string `json:"i"`
+}
+
+// encode returns the opaque representation of the cursor
+func (c *listCursor) encode() string {
+	data, _ := json.Marshal(c)
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// after reports whether an entity with the given sort value and ID comes
+// after the cursor
+func (c *listCursor) after(value, id string) bool {
+	cmp := compareSortKeys(value, id, c.Value, c.ID)
+	if c.Descending {
+		return cmp < 0
+	}
+	return cmp > 0
+}
+
+// listParams are the validated sort order, limit and cursor of a listing
+type listParams struct {
+	sortBy     string
+	descending bool
+	limit      int
+	cursor     *listCursor
+}
+
+// newListParams validates the sort order, limit and cursor of a listing.
+// sortFields are the allowed sort fields, the first one being the default.
+func newListParams(sortBy string, descending bool, limit int, cursor string, sortFields ...string) (*listParams, error) {
+	params := &listParams{
+		sortBy:     sortBy,
+		descending: descending,
+		limit:      limit,
+	}
+
+	if params.sortBy == "" {
+		params.sortBy = sortFields[0]
+	}
+	valid := false
+	for _, field := range sortFields {
+		if params.sortBy == field {
+			valid = true
+		}
+	}
+	if !valid {
+		return nil, fmt.Errorf("%w: cannot sort by %q", types.ErrInvalidArgument, sortBy)
+	}
+
+	switch {
+	case params.limit < 0:
+		return nil, fmt.Errorf("%w: negative limit %d", types.ErrInvalidArgument, limit)
+	case params.limit == 0:
+		params.limit = types.DefaultListLimit
+	case params.limit > types.MaxListLimit:
+		params.limit = types.MaxListLimit
+	}
+
+	if cursor != "" {
+		data, err := base64.RawURLEncoding.DecodeString(cursor)
+		if err != nil {
+			return nil, fmt.Errorf("%w: malformed cursor", types.ErrInvalidArgument)
+		}
+		params.cursor = &listCursor{}
+		if err := json.Unmarshal(data, params.cursor); err != nil {
+			return nil, fmt.Errorf("%w: malformed cursor", types.ErrInvalidArgument)
+		}
+		if params.cursor.SortBy != params.sortBy || params.cursor.Descending != params.descending {
+			return nil, fmt.Errorf("%w: cursor does not match the sort order", types.ErrInvalidArgument)
+		}
+	}
+
+	return params, nil
+}
+
+// nextCursor returns the cursor of the page following the entity with the
+// given sort value and ID
+func (p *listParams) nextCursor(value, id string) string {
+	c := &listCursor{
+		SortBy:     p.sortBy,
+		Descending: p.descending,
+		Value:      value,
+		ID:         id,
+	}
+	return c.encode()
+}
+
+// less reports whether the entity with sort value a and ID aID is listed
+// before the entity with sort value b and ID bID
+func (p *listParams) less(a, aID, b, bID string) bool {
+	cmp := compareSortKeys(a, aID, b, bID)
+	if p.descending {
+		return cmp > 0
+	}
+	return cmp < 0
+}
+
+// compareSortKeys compares two entities by sort value, then by ID. Strings
+// are compared byte by byte in every backend.
+func compareSortKeys(a, aID, b, bID string) int {
+	if cmp := strings.Compare(a, b); cmp != 0 {
+		return cmp
+	}
+	return strings.Compare(aID, bID)
+}
+
+// userListParams validates the options of a user listing
+func userListParams(options *types.UserListOptions) (*listParams, error) {
+	return newListParams(options.SortBy, options.Descending, options.Limit, options.Cursor, "username", "email", "id")
+}
+
+// groupListParams validates the options of a group listing
+func groupListParams(options *types.GroupListOptions) (*listParams, error) {
+	return newListParams(options.SortBy, options.Descending, options.Limit, options.Cursor, "name", "id")
+}
+
+// userSortValue returns the value a user is sorted by
+func userSortValue(user *types.User, sortBy string) string {
+	switch sortBy {
+	case "email":
+		return user.Email
+	case "id":
+		return user.ID
+	default:
+		return user.Username
+	}
+}
+
+// groupSortValue returns the value a group is sorted by
+func groupSortValue(group *types.Group, sortBy string) string {
+	if sortBy == "id" {
+		return group.ID
+	}
+	return group.Name
+}
+
+// matchUser reports whether a user matches the filters of a user listing
+func matchUser(user *types.User, options *types.UserListOptions) bool {
+	return strings.HasPrefix(user.Username, options.UsernamePrefix) &&
+		strings.Contains(user.Username, options.UsernameContains) &&
+		strings.HasPrefix(user.Email, options.EmailPrefix) &&
+		strings.Contains(user.Email, options.EmailContains)
+}
+
+// matchGroup reports whether a group matches the filters of a group listing
+func matchGroup(group *types.Group, options *types.GroupListOptions) bool {
+	return strings.HasPrefix(group.Name, options.NamePrefix) &&
+		strings.Contains(group.Name, options.NameContains)
+}
+
+// userPage returns the page of the first users of a sorted list, which
+// holds at most one user more than the limit
+func userPage(users []*types.User, params *listParams) *types.UserPage {
+	page := &types.UserPage{Users: users}
+	if len(users) > params.limit {
+		page.Users = users[:params.limit]
+		last := page.Users[params.limit-1]
+		page.NextCursor = params.nextCursor(userSortValue(last, params.sortBy), last.ID)
+	}
+	return page
+}
+
+// groupPage returns the page of the first groups of a sorted list, which
+// holds at most one group more than the limit
+func groupPage(groups []*types.Group, params *listParams) *types.GroupPage {
+	page := &types.GroupPage{Groups: groups}
+	if len(groups) > params.limit {
+		page.Groups = groups[:params.limit]
+		last := page.Groups[params.limit-1]
+		page.NextCursor = params.nextCursor(groupSortValue(last, params.sortBy), last.ID)
+	}
+	return page
+}
@@ -0,0 +1,300 @@
+package storage
+
+import (
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"cum/types"
+)
+
+// listAllUsers lists the users page by page, and returns their IDs in order
+func listAllUsers(t *testing.T, s types.Storage, options types.UserListOptions) []string {
+	t.Helper()
+	var ids []string
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("the listing does not end")
+		}
+		page, err := s.ListUsers(context.Background(), &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Users) > options.Limit {
+			t.Fatalf("got %d users, more than the limit %d", len(page.Users), options.Limit)
+		}
+		for _, user := range page.Users {
+			ids = append(ids, user.ID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		options.Cursor = page.NextCursor
+	}
+}
+
+// listAllGroups lists the groups page by page, and returns their IDs in order
+func listAllGroups(t *testing.T, s types.Storage, options types.GroupListOptions) []string {
+	t.Helper()
+	var ids []string
+	for pages := 0; ; pages++ {
+		if pages > 100 {
+			t.Fatal("the listing does not end")
+		}
+		page, err := s.ListGroups(context.Background(), &options)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Groups) > options.Limit {
+			t.Fatalf("got %d groups, more than the limit %d", len(page.Groups), options.Limit)
+		}
+		for _, group := range page.Groups {
+			ids = append(ids, group.ID)
+		}
+		if page.NextCursor == "" {
+			return ids
+		}
+		options.Cursor = page.NextCursor
+	}
+}
+
+func reversed(ids []string) []string {
+	r := make([]string, len(ids))
+	for i, id := range ids {
+		r[len(ids)-1-i] = id
+	}
+	return r
+}
+
+func TestListUsersPages(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		// u3, u4 and u5 have no email, so they sort equal by email
+		users := []*types.User{
+			{ID: "u1", Username: "carol", Email: "a@example.com"},
+			{ID: "u2", Username: "alice", Email: "c@example.com"},
+			{ID: "u3", Username: "bob"},
+			{ID: "u4", Username: "alicia"},
+			{ID: "u5", Username: "dave"},
+			{ID: "u6", Username: "al", Email: "b@example.com"},
+		}
+		for _, user := range users {
+			if err := s.CreateUser(ctx, user); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name    string
+			options types.UserListOptions
+			want    []string
+		}{
+			{"by username", types.UserListOptions{}, []string{"u6", "u2", "u4", "u3", "u1", "u5"}},
+			{"by email with ties", types.UserListOptions{SortBy: "email"}, []string{"u3", "u4", "u5", "u1", "u6", "u2"}},
+			{"by id", types.UserListOptions{SortBy: "id"}, []string{"u1", "u2", "u3", "u4", "u5", "u6"}},
+			{"with a prefix", types.UserListOptions{UsernamePrefix: "al"}, []string{"u6", "u2", "u4"}},
+			{"with a substring", types.UserListOptions{SortBy: "email", UsernameContains: "l"}, []string{"u4", "u1", "u6", "u2"}},
+		}
+		for _, tt := range tests {
+			for _, limit := range []int{1, 2, 4, 10} {
+				options := tt.options
+				options.Limit = limit
+				if got := listAllUsers(t, s, options); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%s, limit %d: got %v, want %v", tt.name, limit, got, tt.want)
+				}
+
+				options.Descending = true
+				if got := listAllUsers(t, s, options); !reflect.DeepEqual(got, reversed(tt.want)) {
+					t.Errorf("%s, limit %d, descending: got %v, want %v", tt.name, limit, got, reversed(tt.want))
+				}
+			}
+		}
+	})
+}
+
+func TestListGroupsPages(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		for i, name := range []string{"staff", "admins", "sales", "devs", "ops"} {
+			if err := s.CreateGroup(ctx, &types.Group{ID: fmt.Sprintf("g%d", i+1), Name: name}); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		tests := []struct {
+			name    string
+			options types.GroupListOptions
+			want    []string
+		}{
+			{"by name", types.GroupListOptions{}, []string{"g2", "g4", "g5", "g3", "g1"}},
+			{"by id", types.GroupListOptions{SortBy: "id"}, []string{"g1", "g2", "g3", "g4", "g5"}},
+			{"with a prefix", types.GroupListOptions{NamePrefix: "s"}, []string{"g3", "g1"}},
+			{"with a substring", types.GroupListOptions{SortBy: "id", NameContains: "s"}, []string{"g1", "g2", "g3", "g4", "g5"}},
+		}
+		for _, tt := range tests {
+			for _, limit := range []int{1, 2, 10} {
+				options := tt.options
+				options.Limit = limit
+				if got := listAllGroups(t, s, options); !reflect.DeepEqual(got, tt.want) {
+					t.Errorf("%s, limit %d: got %v, want %v", tt.name, limit, got, tt.want)
+				}
+
+				options.Descending = true
+				if got := listAllGroups(t, s, options); !reflect.DeepEqual(got, reversed(tt.want)) {
+					t.Errorf("%s, limit %d, descending: got %v, want %v", tt.name, limit, got, reversed(tt.want))
+				}
+			}
+		}
+	})
+}
+
+// TestListCursorSurvivesChanges checks that a cursor keeps its position
+// when the entity it was taken from is deleted
+func TestListCursorSurvivesChanges(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		mustCreateUsers(t, s, "u1", "u2", "u3", "u4")
+
+		page, err := s.ListUsers(ctx, &types.UserListOptions{Limit: 2})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteUser(ctx, "u2"); err != nil {
+			t.Fatal(err)
+		}
+		got := listAllUsers(t, s, types.UserListOptions{Limit: 2, Cursor: page.NextCursor})
+		if want := []string{"u3", "u4"}; !reflect.DeepEqual(got, want) {
+			t.Fatalf("got %v after the deleted user, want %v", got, want)
+		}
+	})
+}
+
+func TestListTamperedCursors(t *testing.T) {
+	encode := func(data string) string {
+		return base64.RawURLEncoding.EncodeToString([]byte(data))
+	}
+
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		mustCreateUsers(t, s, "u1", "u2", "u3")
+		mustCreateGroups(t, s, "g1", "g2", "g3")
+
+		page, err := s.ListUsers(ctx, &types.UserListOptions{Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		valid := page.NextCursor
+
+		tests := []struct {
+			name    string
+			options types.UserListOptions
+		}{
+			{"not base64", types.UserListOptions{Cursor: "!!!"}},
+			{"padded base64", types.UserListOptions{Cursor: valid + "=="}},
+			{"not JSON", types.UserListOptions{Cursor: encode("not json")}},
+			{"truncated", types.UserListOptions{Cursor: valid[:len(valid)/2]}},
+			{"wrong types", types.UserListOptions{Cursor: encode(`{"s":1,"v":[],"i":{}}`)}},
+			{"another sort field", types.UserListOptions{SortBy: "email", Cursor: valid}},
+			{"another direction", types.UserListOptions{Descending: true, Cursor: valid}},
+			{"forged sort field", types.UserListOptions{Cursor: encode(`{"s":"password","v":"","i":""}`)}},
+		}
+		for _, tt := range tests {
+			if _, err := s.ListUsers(ctx, &tt.options); !errors.Is(err, types.ErrInvalidArgument) {
+				t.Errorf("%s: ListUsers returned %v, want ErrInvalidArgument", tt.name, err)
+			}
+		}
+
+		groups, err := s.ListGroups(ctx, &types.GroupListOptions{Limit: 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.ListGroups(ctx, &types.GroupListOptions{Cursor: valid}); !errors.Is(err, types.ErrInvalidArgument) {
+			t.Errorf("a user cursor listing groups returned %v, want ErrInvalidArgument", err)
+		}
+		if _, err := s.ListUsers(ctx, &types.UserListOptions{Cursor: groups.NextCursor}); !errors.Is(err, types.ErrInvalidArgument) {
+			t.Errorf("a group cursor listing users returned %v, want ErrInvalidArgument", err)
+		}
+
+		// A well-formed cursor at an arbitrary position lists what follows it
+		got := listAllUsers(t, s, types.UserListOptions{Limit: 10, Cursor: encode(`{"s":"username","v":"name-u1","i":"zzz"}`)})
+		if want := []string{"u2", "u3"}; !reflect.DeepEqual(got, want) {
+			t.Errorf("got %v after a forged position, want %v", got, want)
+		}
+	})
+}
+
+func TestListLimits(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		ids := make([]string, types.DefaultListLimit+1)
+		for i := range ids {
+			ids[i] = fmt.Sprintf("u%03d", i)
+		}
+		mustCreateUsers(t, s, ids...)
+		sort.Strings(ids)
+
+		if _, err := s.ListUsers(ctx, &types.UserListOptions{Limit: -1}); !errors.Is(err, types.ErrInvalidArgument) {
+			t.Fatalf("a negative limit returned %v, want ErrInvalidArgument", err)
+		}
+		if _, err := s.ListGroups(ctx, &types.GroupListOptions{Limit: -1}); !errors.Is(err, types.ErrInvalidArgument) {
+			t.Fatalf("a negative limit returned %v, want ErrInvalidArgument", err)
+		}
+
+		page, err := s.ListUsers(ctx, &types.UserListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Users) != types.DefaultListLimit || page.NextCursor == "" {
+			t.Fatalf("the default limit listed %d users and cursor %q, want %d users and a cursor", len(page.Users), page.NextCursor, types.DefaultListLimit)
+		}
+
+		page, err = s.ListUsers(ctx, &types.UserListOptions{Limit: types.MaxListLimit + 1})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Users) != len(ids) || page.NextCursor != "" {
+			t.Fatalf("a limit above the maximum listed %d users and cursor %q, want all %d users", len(page.Users), page.NextCursor, len(ids))
+		}
+
+		// A page exactly as long as the limit is the last one
+		page, err = s.ListUsers(ctx, &types.UserListOptions{Limit: len(ids)})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Users) != len(ids) || page.NextCursor != "" {
+			t.Fatalf("a limit matching the number of users listed %d users and cursor %q, want all %d users", len(page.Users), page.NextCursor, len(ids))
+		}
+	})
+}
+
+func TestNewListParamsLimits(t *testing.T) {
+	tests := []struct {
+		limit int
+		want  int
+	}{
+		{0, types.DefaultListLimit},
+		{1, 1},
+		{types.MaxListLimit, types.MaxListLimit},
+		{types.MaxListLimit + 1, types.MaxListLimit},
+	}
+	for _, tt := range tests {
+		params, err := newListParams("", false, tt.limit, "", "name", "id")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if params.limit != tt.want {
+			t.Errorf("limit %d: got %d, want %d", tt.limit, params.limit, tt.want)
+		}
+	}
+
+	if _, err := newListParams("", false, -1, "", "name", "id"); !errors.Is(err, types.ErrInvalidArgument) {
+		t.Errorf("negative limit: got %v, want ErrInvalidArgument", err)
+	}
+	if _, err := newListParams("description", false, 0, "", "name", "id"); !errors.Is(err, types.ErrInvalidArgument) {
+		t.Errorf("unknown sort field: got %v, want ErrInvalidArgument", err)
+	}
+}
@@ -0,0 +1,437 @@
+package storage
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"testing/fstest"
+	"time"
+)
+
+func TestEmbeddedMigrations(t *testing.T) {
+	files, err := fs.Sub(migrationFiles, "migrations")
+	if err != nil {
+		t.Fatal(err)
+	}
+	migrations, err := loadMigrations(files)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(migrations) == 0 {
+		t.Fatal("no embedded migrations")
+	}
+
+	for i, migration := range migrations {
+		if migration.Version != i+1 {
+			t.Errorf("migration %d_%s has version %d, want %d: versions must follow each other from 1", migration.Version, migration.Name, migration.Version, i+1)
+		}
+		if strings.TrimSpace(migration.Up) == "" || strings.TrimSpace(migration.Down) == "" {
+			t.Errorf("migration %d_%s has an empty up or down file", migration.Version, migration.Name)
+		}
+	}
+}
+
+func TestLoadMigrations(t *testing.T) {
+	file := func(content string) *fstest.MapFile {
+		return &fstest.MapFile{Data: []byte(content)}
+	}
+
+	tests := []struct {
+		name     string
+		files    fstest.MapFS
+		versions []int
+		wantErr  string
+	}{
+		{
+			name: "sorted by version",
+			files: fstest.MapFS{
+				"10_ten.up.sql":   file("up 10"),
+				"10_ten.down.sql": file("down 10"),
+				"2_two.up.sql":    file("up 2"),
+				"2_two.down.sql":  file("down 2"),
+				"1_one.up.sql":    file("up 1"),
+				"1_one.down.sql":  file("down 1"),
+			},
+			versions: []int{1, 2, 10},
+		},
+		{
+			name: "missing down file",
+			files: fstest.MapFS{
+				"1_one.up.sql": file("up 1"),
+			},
+			wantErr: "needs both an up and a down file",
+		},
+		{
+			name: "missing up file",
+			files: fstest.MapFS{
+				"1_one.down.sql": file("down 1"),
+			},
+			wantErr: "needs both an up and a down file",
+		},
+		{
+			name: "empty down file",
+			files: fstest.MapFS{
+				"1_one.up.sql":   file("up 1"),
+				"1_one.down.sql": file(""),
+			},
+			wantErr: "needs both an up and a down file",
+		},
+		{
+			name: "conflicting names",
+			files: fstest.MapFS{
+				"1_one.up.sql":   file("up 1"),
+				"1_uno.down.sql": file("down 1"),
+			},
+			wantErr: "conflicting names",
+		},
+		{
+			name: "duplicate version",
+			files: fstest.MapFS{
+				"1_one.up.sql":    file("up 1"),
+				"01_one.up.sql":   file("up 01"),
+				"1_one.down.sql":  file("down 1"),
+				"01_one.down.sql": file("down 01"),
+			},
+			wantErr: "more than one",
+		},
+		{
+			name: "invalid file name",
+			files: fstest.MapFS{
+				"one.up.sql": file("up"),
+			},
+			wantErr: "invalid migration file name",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			migrations, err := loadMigrations(tt.files)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("got error %v, want one containing %q", err, tt.wantErr)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got := migrationVersions(migrations); !reflect.DeepEqual(got, tt.versions) {
+				t.Fatalf("got versions %v, want %v", got, tt.versions)
+			}
+			for _, migration := range migrations {
+				if migration.Up != fmt.Sprintf("up %d", migration.Version) || migration.Down != fmt.Sprintf("down %d", migration.Version) {
+					t.Fatalf("migration %d has up %q and down %q", migration.Version, migration.Up, migration.Down)
+				}
+			}
+		})
+	}
+}
+
+func TestPostgresMigrator(t *testing.T) {
+	ctx := context.Background()
+	db, state := openFakeMigrationDB(t)
+	m := &PostgresMigrator{db: db, migrations: testMigrations(1, 2, 10)}
+
+	applied, err := m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(applied); !reflect.DeepEqual(got, []int{1, 2, 10}) {
+		t.Fatalf("Up applied %v, want [1 2 10]", got)
+	}
+	state.checkLog(t, []string{
+		"lock", "create schema_migrations",
+		"begin", "up 1", "commit",
+		"begin", "up 2", "commit",
+		"begin", "up 10", "commit",
+		"unlock",
+	})
+
+	applied, err = m.Up(ctx)
+	if err != nil || len(applied) != 0 {
+		t.Fatalf("Up again applied %v, %v, want nothing", migrationVersions(applied), err)
+	}
+	state.checkLog(t, []string{"lock", "create schema_migrations", "unlock"})
+
+	reverted, err := m.Down(ctx, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(reverted); !reflect.DeepEqual(got, []int{10, 2}) {
+		t.Fatalf("Down reverted %v, want [10 2]", got)
+	}
+	state.checkLog(t, []string{
+		"lock", "create schema_migrations",
+		"begin", "down 10", "commit",
+		"begin", "down 2", "commit",
+		"unlock",
+	})
+
+	statuses, err := m.Status(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for _, status := range statuses {
+		got = append(got, fmt.Sprintf("%d:%v", status.Version, status.Applied))
+		if status.Applied == status.AppliedAt.IsZero() {
+			t.Errorf("migration %d is applied %v at %v", status.Version, status.Applied, status.AppliedAt)
+		}
+	}
+	if want := []string{"1:true", "2:false", "10:false"}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got statuses %v, want %v", got, want)
+	}
+	state.checkLog(t, []string{"lock", "create schema_migrations", "unlock"})
+}
+
+func TestPostgresMigratorFailure(t *testing.T) {
+	ctx := context.Background()
+	db, state := openFakeMigrationDB(t)
+	m := &PostgresMigrator{db: db, migrations: testMigrations(1, 2, 3)}
+	state.failOn = "up 2"
+
+	applied, err := m.Up(ctx)
+	if err == nil || !strings.Contains(err.Error(), "2_migration") {
+		t.Fatalf("got error %v, want one naming migration 2", err)
+	}
+	if got := migrationVersions(applied); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("Up applied %v, want [1]", got)
+	}
+	state.checkLog(t, []string{
+		"lock", "create schema_migrations",
+		"begin", "up 1", "commit",
+		"begin", "rollback",
+		"unlock",
+	})
+	if got := state.appliedVersions(); !reflect.DeepEqual(got, []int{1}) {
+		t.Fatalf("recorded versions %v, want [1]", got)
+	}
+
+	state.failOn = ""
+	applied, err = m.Up(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := migrationVersions(applied); !reflect.DeepEqual(got, []int{2, 3}) {
+		t.Fatalf("Up after the failure applied %v, want [2 3]", got)
+	}
+}
+
+// testMigrations returns migrations of the given versions, whose up and
+// down statements are "up <version>" and "down <version>"
+func testMigrations(versions ...int) []*Migration {
+	var migrations []*Migration
+	for _, version := range versions {
+		migrations = append(migrations, &Migration{
+			Version: version,
+			Name:    "migration",
+			Up:      fmt.Sprintf("up %d", version),
+			Down:    fmt.Sprintf("down %d", version),
+		})
+	}
+	return migrations
+}
+
+func migrationVersions(migrations []*Migration) []int {
+	var versions []int
+	for _, migration := range migrations {
+		versions = append(versions, migration.Version)
+	}
+	return versions
+}
+
+// fakeMigrationDB is the state of a fake database understanding the
+// statements of PostgresMigrator, recording the statements it runs
+type fakeMigrationDB struct {
+	mu      sync.Mutex
+	log     []string
+	applied map[int64]time.Time
+	// failOn fails the statements containing it
+	failOn string
+	locked bool
+	// snapshot is the applied versions when the transaction began
+	snapshot map[int64]time.Time
+}
+
+var (
+	fakeMigrationDBsMu sync.Mutex
+	fakeMigrationDBs   = map[string]*fakeMigrationDB{}
+	registerFakeDriver sync.Once
+)
+
+// openFakeMigrationDB opens a new fake database
+func openFakeMigrationDB(t *testing.T) (*sql.DB, *fakeMigrationDB) {
+	registerFakeDriver.Do(func() {
+		sql.Register("fakemigrations", fakeMigrationDriver{})
+	})
+
+	state := &fakeMigrationDB{applied: make(map[int64]time.Time)}
+	fakeMigrationDBsMu.Lock()
+	fakeMigrationDBs[t.Name()] = state
+	fakeMigrationDBsMu.Unlock()
+
+	db, err := sql.Open("fakemigrations", t.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Close() })
+	return db, state
+}
+
+// checkLog checks the statements run since the last check
+func (f *fakeMigrationDB) checkLog(t *testing.T, want []string) {
+	t.Helper()
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	if !reflect.DeepEqual(f.log, want) {
+		t.Fatalf("ran %q, want %q", f.log, want)
+	}
+	f.log = nil
+}
+
+func (f *fakeMigrationDB) appliedVersions() []int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	var versions []int
+	for version := range f.applied {
+		versions = append(versions, int(version))
+	}
+	sort.Ints(versions)
+	return versions
+}
+
+func (f *fakeMigrationDB) exec(query string, args []driver.NamedValue) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	switch {
+	case strings.Contains(query, "pg_advisory_lock"):
+		if f.locked {
+			return errors.New("already locked")
+		}
+		f.locked = true
+		f.log = append(f.log, "lock")
+	case strings.Contains(query, "pg_advisory_unlock"):
+		f.locked = false
+		f.log = append(f.log, "unlock")
+	case strings.HasPrefix(query, "CREATE TABLE IF NOT EXISTS schema_migrations"):
+		f.log = append(f.log, "create schema_migrations")
+	case strings.HasPrefix(query, "INSERT INTO schema_migrations"):
+		f.applied[args[0].Value.(int64)] = time.Now()
+	case strings.HasPrefix(query, "DELETE FROM schema_migrations"):
+		delete(f.applied, args[0].Value.(int64))
+	case f.failOn != "" && strings.Contains(query, f.failOn):
+		return fmt.Errorf("statement %q failed", query)
+	default:
+		f.log = append(f.log, query)
+	}
+	return nil
+}
+
+type fakeMigrationDriver struct{}
+
+func (fakeMigrationDriver) Open(name string) (driver.Conn, error) {
+	fakeMigrationDBsMu.Lock()
+	defer fakeMigrationDBsMu.Unlock()
+
+	state, ok := fakeMigrationDBs[name]
+	if !ok {
+		return nil, fmt.Errorf("unknown fake database %s", name)
+	}
+	return &fakeMigrationConn{db: state}, nil
+}
+
+type fakeMigrationConn struct {
+	db *fakeMigrationDB
+}
+
+func (c *fakeMigrationConn) Prepare(query string) (driver.Stmt, error) {
+	return nil, errors.New("prepared statements are not supported")
+}
+
+func (c *fakeMigrationConn) Close() error {
+	return nil
+}
+
+func (c *fakeMigrationConn) Begin() (driver.Tx, error) {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	c.db.snapshot = make(map[int64]time.Time)
+	for version, appliedAt := range c.db.applied {
+		c.db.snapshot[version] = appliedAt
+	}
+	c.db.log = append(c.db.log, "begin")
+	return c, nil
+}
+
+func (c *fakeMigrationConn) Commit() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	c.db.log = append(c.db.log, "commit")
+	return nil
+}
+
+func (c *fakeMigrationConn) Rollback() error {
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	c.db.applied = c.db.snapshot
+	c.db.log = append(c.db.log, "rollback")
+	return nil
+}
+
+func (c *fakeMigrationConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	if err := c.db.exec(query, args); err != nil {
+		return nil, err
+	}
+	return driver.RowsAffected(1), nil
+}
+
+func (c *fakeMigrationConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	if query != "SELECT version, applied_at FROM schema_migrations" {
+		return nil, fmt.Errorf("unexpected query %q", query)
+	}
+
+	c.db.mu.Lock()
+	defer c.db.mu.Unlock()
+
+	rows := &fakeMigrationRows{}
+	for version, appliedAt := range c.db.applied {
+		rows.values = append(rows.values, []driver.Value{version, appliedAt})
+	}
+	return rows, nil
+}
+
+type fakeMigrationRows struct {
+	values [][]driver.Value
+}
+
+func (r *fakeMigrationRows) Columns() []string {
+	return []string{"version", "applied_at"}
+}
+
+func (r *fakeMigrationRows) Close() error {
+	return nil
+}
+
+func (r *fakeMigrationRows) Next(dest []driver.Value) error {
+	if len(r.values) == 0 {
+		return io.EOF
+	}
+	copy(dest, r.values[0])
+	r.values = r.values[1:]
+	return nil
+}
@@ -0,0 +1,5 @@
+DROP TABLE IF EXISTS group_members;
+DROP TYPE IF EXISTS member_type_enum;
+DROP TABLE IF EXISTS sessions;
+DROP TABLE IF EXISTS groups;
+DROP TABLE IF EXISTS users;
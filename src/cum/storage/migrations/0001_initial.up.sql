@@ -0,0 +1,35 @@
+-- Initial schema. Every statement is idempotent so that databases created
+-- before migrations were introduced can adopt this migration as is.
+
+CREATE TABLE IF NOT EXISTS users (
+	id VARCHAR(255) PRIMARY KEY,
+	username VARCHAR(255) UNIQUE,
+	email VARCHAR(255) UNIQUE,
+	password VARCHAR(255)
+);
+
+CREATE TABLE IF NOT EXISTS groups (
+	id VARCHAR(255) PRIMARY KEY,
+	name VARCHAR(255) UNIQUE
+);
+
+CREATE TABLE IF NOT EXISTS sessions (
+	id VARCHAR(255) PRIMARY KEY,
+	user_id VARCHAR(255),
+	expires_at TIMESTAMP
+);
+
+DO $$
+	BEGIN
+		CREATE TYPE member_type_enum AS ENUM ('user', 'group');
+	EXCEPTION
+		WHEN duplicate_object THEN null;
+	END
+	$$;
+
+CREATE TABLE IF NOT EXISTS group_members (
+	group_id VARCHAR(255),
+	member_id VARCHAR(255),
+	member_type member_type_enum,
+	PRIMARY KEY (group_id, member_id, member_type)
+);
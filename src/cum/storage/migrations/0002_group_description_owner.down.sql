@@ -0,0 +1,6 @@
+DROP INDEX IF EXISTS groups_owner_idx;
+
+ALTER TABLE groups DROP CONSTRAINT IF EXISTS groups_owner_check;
+ALTER TABLE groups DROP COLUMN IF EXISTS owner_type;
+ALTER TABLE groups DROP COLUMN IF EXISTS owner_id;
+ALTER TABLE groups DROP COLUMN IF EXISTS description;
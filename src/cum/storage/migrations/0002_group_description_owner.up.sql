@@ -0,0 +1,9 @@
+-- Persist the description and the owner of groups. Like group members,
+-- owners are either users or groups.
+
+ALTER TABLE groups ADD COLUMN description TEXT NOT NULL DEFAULT '';
+ALTER TABLE groups ADD COLUMN owner_id VARCHAR(255);
+ALTER TABLE groups ADD COLUMN owner_type member_type_enum;
+ALTER TABLE groups ADD CONSTRAINT groups_owner_check CHECK ((owner_id IS NULL) = (owner_type IS NULL));
+
+CREATE INDEX groups_owner_idx ON groups (owner_type, owner_id);
@@ -0,0 +1,3 @@
+-- The removed dangling references cannot be restored.
+
+DROP INDEX IF EXISTS group_members_member_idx;
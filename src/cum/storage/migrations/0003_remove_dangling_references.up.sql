@@ -0,0 +1,13 @@
+-- Remove the memberships and ownerships left behind by users and groups
+-- deleted before deletes removed them.
+
+DELETE FROM group_members gm
+WHERE NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = gm.group_id)
+	OR (gm.member_type = 'user' AND NOT EXISTS (SELECT 1 FROM users u WHERE u.id = gm.member_id))
+	OR (gm.member_type = 'group' AND NOT EXISTS (SELECT 1 FROM groups g WHERE g.id = gm.member_id));
+
+UPDATE groups g SET owner_id = NULL, owner_type = NULL
+WHERE (g.owner_type = 'user' AND NOT EXISTS (SELECT 1 FROM users u WHERE u.id = g.owner_id))
+	OR (g.owner_type = 'group' AND NOT EXISTS (SELECT 1 FROM groups o WHERE o.id = g.owner_id));
+
+CREATE INDEX group_members_member_idx ON group_members (member_type, member_id);
@@ -0,0 +1,5 @@
+DROP INDEX IF EXISTS groups_id_list_idx;
+DROP INDEX IF EXISTS groups_name_list_idx;
+DROP INDEX IF EXISTS users_id_list_idx;
+DROP INDEX IF EXISTS users_email_list_idx;
+DROP INDEX IF EXISTS users_username_list_idx;
@@ -0,0 +1,8 @@
+-- Indexes matching the sort orders of ListUsers and ListGroups, which
+-- compare strings byte by byte.
+
+CREATE INDEX users_username_list_idx ON users ((username COLLATE "C"), (id COLLATE "C"));
+CREATE INDEX users_email_list_idx ON users ((email COLLATE "C"), (id COLLATE "C"));
+CREATE INDEX users_id_list_idx ON users ((id COLLATE "C"));
+CREATE INDEX groups_name_list_idx ON groups ((name COLLATE "C"), (id COLLATE "C"));
+CREATE INDEX groups_id_list_idx ON groups ((id COLLATE "C"));
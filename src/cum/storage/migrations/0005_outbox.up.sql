@@ -0,0 +1,16 @@
+-- Outbox of the user and group changes waiting to be applied to
+-- third-party services such as LDAP.
+
+CREATE TABLE outbox (
+	id VARCHAR(255) PRIMARY KEY,
+	entity_type member_type_enum NOT NULL,
+	entity_id VARCHAR(255) NOT NULL,
+	name VARCHAR(255) NOT NULL DEFAULT '',
+	password_changed BOOLEAN NOT NULL DEFAULT FALSE,
+	attempts INTEGER NOT NULL DEFAULT 0,
+	last_error TEXT NOT NULL DEFAULT '',
+	created_at TIMESTAMP NOT NULL,
+	next_attempt_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX outbox_due_idx ON outbox (next_attempt_at, created_at, (id COLLATE "C"));
@@ -0,0 +1 @@
+DROP TABLE IF EXISTS posix_ids;
@@ -0,0 +1,11 @@
+-- POSIX numbers of the users and groups provisioned to LDAP, their
+-- uidNumber and gidNumber. Rows are kept after the entity is deleted so
+-- that numbers are never reused.
+
+CREATE TABLE posix_ids (
+	entity_type member_type_enum NOT NULL,
+	entity_id VARCHAR(255) NOT NULL,
+	number BIGINT NOT NULL,
+	PRIMARY KEY (entity_type, entity_id),
+	UNIQUE (entity_type, number)
+);
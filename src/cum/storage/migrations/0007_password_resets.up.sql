@@ -0,0 +1,13 @@
+-- Password resets: users that must change their one-time password at
+-- their next login, and the pending reset tokens, stored by the SHA-256
+-- hash of the token.
+
+ALTER TABLE users ADD COLUMN must_change_password BOOLEAN NOT NULL DEFAULT FALSE;
+
+CREATE TABLE password_resets (
+	id VARCHAR(255) PRIMARY KEY,
+	user_id VARCHAR(255) NOT NULL REFERENCES users (id) ON DELETE CASCADE,
+	expires_at TIMESTAMP NOT NULL
+);
+
+CREATE INDEX password_resets_expires_at_idx ON password_resets (expires_at);
@@ -0,0 +1,5 @@
+-- Fails when more than one user has no email.
+
+DROP INDEX IF EXISTS users_email_unique_idx;
+
+ALTER TABLE users ADD CONSTRAINT users_email_key UNIQUE (email);
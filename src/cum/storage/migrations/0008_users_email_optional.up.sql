@@ -0,0 +1,6 @@
+-- Emails are optional: only non-empty emails must be unique, as with the
+-- in-memory and Redis storages.
+
+ALTER TABLE users DROP CONSTRAINT IF EXISTS users_email_key;
+
+CREATE UNIQUE INDEX users_email_unique_idx ON users (email) WHERE email <> '';
@@ -0,0 +1,3 @@
+DROP INDEX IF EXISTS password_resets_user_id_idx;
+
+DROP INDEX IF EXISTS sessions_user_id_idx;
@@ -0,0 +1,6 @@
+-- Sessions and password resets are revoked by user when a password reset
+-- is redeemed.
+
+CREATE INDEX sessions_user_id_idx ON sessions (user_id);
+
+CREATE INDEX password_resets_user_id_idx ON password_resets (user_id);
@@ -0,0 +1 @@
+ALTER TABLE posix_ids DROP COLUMN IF EXISTS reserved;
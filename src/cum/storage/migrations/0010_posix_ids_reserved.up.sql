@@ -0,0 +1,4 @@
+-- Numbers reserved for the entries already in LDAP are skipped by the
+-- allocation rather than moving it past them.
+
+ALTER TABLE posix_ids ADD COLUMN reserved BOOLEAN NOT NULL DEFAULT FALSE;
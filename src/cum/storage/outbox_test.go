@@ -0,0 +1,252 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strconv"
+	"sync"
+	"testing"
+
+	"cum/types"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// outboxIDs returns the IDs of every outbox entry of a storage
+func outboxIDs(t *testing.T, s types.Storage) []string {
+	t.Helper()
+	entries, err := s.(types.OutboxStorage).GetDueOutboxEntries(context.Background(), 1<<40, 1000)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, entry := range entries {
+		ids = append(ids, entry.ID)
+	}
+	sort.Strings(ids)
+	return ids
+}
+
+// TestOutboxEntriesFollowChanges checks that the outbox entries of a change
+// are added with the change, and only if it is stored
+func TestOutboxEntriesFollowChanges(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		mustCreateUsers(t, s, "u1")
+		mustCreateGroups(t, s, "g1", "g2")
+		if err := s.AddMemberToGroup(context.Background(), *owner("group", "g2"), "g1"); err != nil {
+			t.Fatal(err)
+		}
+
+		ctx := context.Background()
+		entries := 0
+		next := func() []*types.OutboxEntry {
+			entries++
+			id := fmt.Sprintf("e%02d-", entries)
+			return []*types.OutboxEntry{
+				{ID: id + "1", EntityType: "user", EntityID: "u1", CreatedAt: 1, NextAttemptAt: 1},
+				{ID: id + "2", EntityType: "group", EntityID: "g1", CreatedAt: 1, NextAttemptAt: 1},
+			}
+		}
+
+		refused := []struct {
+			name   string
+			change func(outbox []*types.OutboxEntry) error
+		}{
+			{"an existing user", func(outbox []*types.OutboxEntry) error {
+				return s.CreateUser(ctx, &types.User{ID: "u1", Username: "other"}, outbox...)
+			}},
+			{"a taken username", func(outbox []*types.OutboxEntry) error {
+				return s.CreateUser(ctx, &types.User{ID: "u2", Username: "name-u1"}, outbox...)
+			}},
+			{"a missing user update", func(outbox []*types.OutboxEntry) error {
+				return s.UpdateUser(ctx, &types.User{ID: "u9", Username: "missing"}, outbox...)
+			}},
+			{"a missing user delete", func(outbox []*types.OutboxEntry) error {
+				return s.DeleteUser(ctx, "u9", outbox...)
+			}},
+			{"an existing group", func(outbox []*types.OutboxEntry) error {
+				return s.CreateGroup(ctx, &types.Group{ID: "g1", Name: "other"}, outbox...)
+			}},
+			{"a missing group update", func(outbox []*types.OutboxEntry) error {
+				return s.UpdateGroup(ctx, &types.Group{ID: "g9", Name: "missing"}, outbox...)
+			}},
+			{"a missing group delete", func(outbox []*types.OutboxEntry) error {
+				return s.DeleteGroup(ctx, &types.Group{ID: "g9"}, outbox...)
+			}},
+			{"a missing member", func(outbox []*types.OutboxEntry) error {
+				return s.AddMemberToGroup(ctx, *owner("user", "u9"), "g1", outbox...)
+			}},
+			{"a nesting cycle", func(outbox []*types.OutboxEntry) error {
+				return s.AddMemberToGroup(ctx, *owner("group", "g1"), "g2", outbox...)
+			}},
+			{"a member of another group", func(outbox []*types.OutboxEntry) error {
+				return s.RemoveMemberFromGroup(ctx, owner("user", "u1"), "g2", outbox...)
+			}},
+		}
+		for _, tt := range refused {
+			if err := tt.change(next()); err == nil {
+				t.Fatalf("%s: the change was not refused", tt.name)
+			}
+			if ids := outboxIDs(t, s); len(ids) != 0 {
+				t.Fatalf("%s: a refused change added outbox entries %v", tt.name, ids)
+			}
+		}
+
+		stored := []struct {
+			name   string
+			change func(outbox []*types.OutboxEntry) error
+		}{
+			{"create user", func(outbox []*types.OutboxEntry) error {
+				return s.CreateUser(ctx, &types.User{ID: "u2", Username: "bob"}, outbox...)
+			}},
+			{"update user", func(outbox []*types.OutboxEntry) error {
+				return s.UpdateUser(ctx, &types.User{ID: "u2", Username: "bobby"}, outbox...)
+			}},
+			{"add member", func(outbox []*types.OutboxEntry) error {
+				return s.AddMemberToGroup(ctx, *owner("user", "u2"), "g2", outbox...)
+			}},
+			{"remove member", func(outbox []*types.OutboxEntry) error {
+				return s.RemoveMemberFromGroup(ctx, owner("user", "u2"), "g2", outbox...)
+			}},
+			{"delete user", func(outbox []*types.OutboxEntry) error {
+				return s.DeleteUser(ctx, "u2", outbox...)
+			}},
+			{"create group", func(outbox []*types.OutboxEntry) error {
+				return s.CreateGroup(ctx, &types.Group{ID: "g3", Name: "ops"}, outbox...)
+			}},
+			{"update group", func(outbox []*types.OutboxEntry) error {
+				return s.UpdateGroup(ctx, &types.Group{ID: "g3", Name: "devops"}, outbox...)
+			}},
+			{"delete group", func(outbox []*types.OutboxEntry) error {
+				return s.DeleteGroup(ctx, &types.Group{ID: "g3"}, outbox...)
+			}},
+		}
+		var want []string
+		for _, tt := range stored {
+			if err := tt.change(next()); err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			id := fmt.Sprintf("e%02d-", entries)
+			want = append(want, id+"1", id+"2")
+			sort.Strings(want)
+			if got := outboxIDs(t, s); !reflect.DeepEqual(got, want) {
+				t.Fatalf("%s: got outbox entries %v, want %v", tt.name, got, want)
+			}
+		}
+
+		// Changes made without entries add none
+		mustCreateUsers(t, s, "u3")
+		if got := outboxIDs(t, s); !reflect.DeepEqual(got, want) {
+			t.Fatalf("a change without entries changed the outbox entries to %v", got)
+		}
+	})
+}
+
+func TestClaimOutboxEntries(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		outbox := s.(types.OutboxStorage)
+		for i, due := range []int64{30, 10, 20, 10, 50} {
+			entry := &types.OutboxEntry{ID: fmt.Sprintf("e%d", i), EntityType: "user", EntityID: "u1", CreatedAt: 1, NextAttemptAt: due}
+			if err := outbox.AddOutboxEntry(ctx, entry); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		claimed, err := outbox.ClaimOutboxEntries(ctx, 40, 100, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var ids []string
+		for _, entry := range claimed {
+			ids = append(ids, entry.ID)
+			if entry.NextAttemptAt != 100 {
+				t.Errorf("claimed entry %s has its next attempt at %d, want 100", entry.ID, entry.NextAttemptAt)
+			}
+		}
+		if want := []string{"e1", "e3", "e2"}; !reflect.DeepEqual(ids, want) {
+			t.Fatalf("claimed %v, want %v", ids, want)
+		}
+
+		// Claimed entries are skipped until their claim expires
+		again, err := outbox.ClaimOutboxEntries(ctx, 40, 100, 3)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(again) != 1 || again[0].ID != "e0" {
+			t.Fatalf("claimed %v while the others were claimed, want e0 only", again)
+		}
+		due, err := outbox.GetDueOutboxEntries(ctx, 100, 10)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(due) != 5 {
+			t.Fatalf("got %d entries due once the claims expired, want 5", len(due))
+		}
+	})
+}
+
+func TestRedisStorageConcurrentClaims(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	port, err := strconv.Atoi(server.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// One storage per replica, sharing the server
+	replicas := make([]*RedisStorage, 3)
+	for i := range replicas {
+		if replicas[i], err = NewRedisStorage(&RedisStorageConfig{Host: server.Host(), Port: port}); err != nil {
+			t.Fatal(err)
+		}
+		defer replicas[i].Close()
+	}
+	const n = 50
+	for i := 0; i < n; i++ {
+		entry := &types.OutboxEntry{ID: fmt.Sprintf("e%02d", i), EntityType: "user", EntityID: "u1", CreatedAt: 1, NextAttemptAt: 1}
+		if err := replicas[0].AddOutboxEntry(ctx, entry); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	var mu sync.Mutex
+	claims := map[string]int{}
+	var wg sync.WaitGroup
+	for _, s := range replicas {
+		wg.Add(1)
+		go func(s *RedisStorage) {
+			defer wg.Done()
+			for {
+				entries, err := s.ClaimOutboxEntries(ctx, 1, 100, 4)
+				if errors.Is(err, types.ErrConflict) {
+					continue
+				}
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				if len(entries) == 0 {
+					return
+				}
+				mu.Lock()
+				for _, entry := range entries {
+					claims[entry.ID]++
+				}
+				mu.Unlock()
+			}
+		}(s)
+	}
+	wg.Wait()
+
+	if len(claims) != n {
+		t.Errorf("claimed %d entries, want %d", len(claims), n)
+	}
+	for id, count := range claims {
+		if count != 1 {
+			t.Errorf("entry %s was claimed %d times", id, count)
+		}
+	}
+}
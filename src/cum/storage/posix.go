@@ -0,0 +1,18 @@
+package storage
+
+import (
+	"fmt"
+
+	"cum/types"
+)
+
+// posixIDConflict is returned when reserving a number for an entity that
+// has another one
+func posixIDConflict(entityType string, entityID string, current int64, number int64) error {
+	return fmt.Errorf("%w: %s %s has number %d, not %d", types.ErrConflict, entityType, entityID, current, number)
+}
+
+// posixIDTaken is returned when reserving a number taken by another entity
+func posixIDTaken(entityType string, number int64, other string) error {
+	return fmt.Errorf("%w: %s number %d is taken by %s", types.ErrConflict, entityType, number, other)
+}
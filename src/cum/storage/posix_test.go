@@ -0,0 +1,87 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"testing"
+
+	"cum/types"
+)
+
+func TestPosixIDs(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		ids := s.(types.PosixIDStorage)
+		allocate := func(entityType, entityID string, want int64) {
+			t.Helper()
+			got, err := ids.AllocatePosixID(ctx, entityType, entityID, 100, 110)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got != want {
+				t.Fatalf("%s %s: allocated %d, want %d", entityType, entityID, got, want)
+			}
+		}
+
+		allocate("user", "u1", 100)
+		allocate("user", "u2", 101)
+		allocate("user", "u1", 100)
+		allocate("group", "g1", 100)
+
+		// Numbers used in LDAP are kept by their entity, and skipped by
+		// the allocation without moving it
+		if err := ids.ReservePosixID(ctx, "user", "u3", 105); err != nil {
+			t.Fatal(err)
+		}
+		if err := ids.ReservePosixID(ctx, "user", "ldap:carol", 103); err != nil {
+			t.Fatal(err)
+		}
+		if err := ids.ReservePosixID(ctx, "user", "u3", 105); err != nil {
+			t.Fatalf("reserving a number again returned %v", err)
+		}
+		allocate("user", "u3", 105)
+		allocate("user", "u4", 102)
+		allocate("user", "u5", 104)
+		allocate("user", "u6", 106)
+		allocate("group", "g2", 101)
+
+		// Numbers outside the range do not move the allocation either
+		if err := ids.ReservePosixID(ctx, "user", "ldap:nobody", 65534); err != nil {
+			t.Fatal(err)
+		}
+		allocate("user", "u7", 107)
+
+		for _, tt := range []struct {
+			name     string
+			entityID string
+			number   int64
+		}{
+			{"a taken number", "u8", 101},
+			{"a taken number by an LDAP entry", "u8", 103},
+			{"another number of an entity", "u1", 108},
+		} {
+			if err := ids.ReservePosixID(ctx, "user", tt.entityID, tt.number); !errors.Is(err, types.ErrConflict) {
+				t.Errorf("%s: got %v, want ErrConflict", tt.name, err)
+			}
+		}
+		allocate("user", "u8", 108)
+
+		if err := ids.ReservePosixID(ctx, "member", "m1", 100); !errors.Is(err, types.ErrInvalidArgument) {
+			t.Errorf("an unknown entity type returned %v, want ErrInvalidArgument", err)
+		}
+
+		// A reserved number at the top of the range leaves the numbers
+		// below it to allocate
+		if err := ids.ReservePosixID(ctx, "group", "ldap:top", 110); err != nil {
+			t.Fatal(err)
+		}
+		allocate("group", "g3", 102)
+		for i := int64(3); i <= 9; i++ {
+			allocate("group", fmt.Sprintf("g%d", i+1), 100+i)
+		}
+		if _, err := ids.AllocatePosixID(ctx, "group", "g11", 100, 110); !errors.Is(err, types.ErrConflict) {
+			t.Errorf("allocating from an exhausted range returned %v, want ErrConflict", err)
+		}
+	})
+}
@@ -1,11 +1,20 @@
 package storage
 
 import (
+	"context"
 	"cum/types"
 	"database/sql"
+	"database/sql/driver"
 	"errors"
 	"fmt"
+	"io"
+	"log"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/lib/pq"
 )
@@ -15,6 +24,10 @@ type PostgresStorage struct {
 	config *PostgresStorageConfig
 	db     *sql.DB
 	mu     sync.Mutex
+
+	stop      chan struct{}
+	stopped   chan struct{}
+	closeOnce sync.Once
 }
 
 // PostgresStorageConfig is the configuration for a PostgresStorage
@@ -27,57 +40,93 @@ type PostgresStorageConfig struct {
 	SSLMode            string
 	MaxIdleConnections int
 	MaxOpenConnections int
+	// SessionReapInterval is how often expired sessions and password
+	// resets are deleted. Zero disables the reaper; expired sessions and
+	// password resets are still never returned.
+	SessionReapInterval time.Duration
+	// SkipMigrations disables applying pending schema migrations on
+	// startup, e.g. when they are run separately with "cum migrate"
+	SkipMigrations bool
+	// DeletePolicy defines what happens to the memberships and ownerships
+	// of deleted users and groups. It defaults to DeleteCascade.
+	DeletePolicy DeletePolicy
+	// MaxNestingDepth is the maximum number of levels of nested groups. It
+	// defaults to DefaultMaxNestingDepth.
+	MaxNestingDepth int
 }
 
-// NewPostgresStorage creates a new PostgresStorage
-func NewPostgresStorage(config *PostgresStorageConfig) (*PostgresStorage, error) {
+// OpenPostgres opens the PostgreSQL database described by config
+func OpenPostgres(config *PostgresStorageConfig) (*sql.DB, error) {
 	db, err := sql.Open("postgres", "host="+config.Host+" port="+fmt.Sprint(config.Port)+" user="+config.User+" password="+config.Password+" dbname="+config.Database+" sslmode="+config.SSLMode)
 	if err != nil {
 		return nil, err
 	}
 	db.SetMaxIdleConns(config.MaxIdleConnections)
 	db.SetMaxOpenConns(config.MaxOpenConnections)
+	return db, nil
+}
 
-	// Create the users table if it doesn't exist
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS users (id VARCHAR(255) PRIMARY KEY, username VARCHAR(255) UNIQUE, email VARCHAR(255) UNIQUE, password VARCHAR(255))")
+// NewPostgresStorage creates a new PostgresStorage and, unless
+// SkipMigrations is set, applies all pending schema migrations
+func NewPostgresStorage(config *PostgresStorageConfig) (*PostgresStorage, error) {
+	db, err := OpenPostgres(config)
 	if err != nil {
-		return nil, fmt.Errorf("error creating users table: %v", err)
+		return nil, err
 	}
 
-	// Create the groups table if it doesn't exist
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS groups (id VARCHAR(255) PRIMARY KEY, name VARCHAR(255) UNIQUE)")
-	if err != nil {
-		return nil, fmt.Errorf("error creating groups table: %v", err)
+	if !config.SkipMigrations {
+		migrator, err := NewPostgresMigrator(db)
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		applied, err := migrator.Up(context.Background())
+		if err != nil {
+			db.Close()
+			return nil, err
+		}
+		for _, migration := range applied {
+			log.Printf("Applied migration %d_%s", migration.Version, migration.Name)
+		}
 	}
 
-	// Create the sessions table if it doesn't exist
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS sessions (id VARCHAR(255) PRIMARY KEY, user_id VARCHAR(255), expires_at TIMESTAMP)")
-	if err != nil {
-		return nil, fmt.Errorf("error creating sessions table: %v", err)
+	s := &PostgresStorage{
+		db:      db,
+		config:  config,
+		stop:    make(chan struct{}),
+		stopped: make(chan struct{}),
 	}
 
-	// Create member type ENUM
-	_, err = db.Exec(`DO $$
-		BEGIN
-			CREATE TYPE member_type_enum AS ENUM ('user', 'group');
-		EXCEPTION
-			WHEN duplicate_object THEN null;
-		END
-		$$;`)
-	if err != nil {
-		return nil, fmt.Errorf("error creating member_type enum: %v", err)
+	if config.SessionReapInterval > 0 {
+		go s.reaper(config.SessionReapInterval)
+	} else {
+		close(s.stopped)
 	}
 
-	// Create the group_members table if it doesn't exist
-	_, err = db.Exec("CREATE TABLE IF NOT EXISTS group_members (group_id VARCHAR(255), member_id VARCHAR(255), member_type member_type_enum, PRIMARY KEY (group_id, member_id, member_type))")
-	if err != nil {
-		return nil, fmt.Errorf("error creating group_members table: %v", err)
-	}
+	return s, nil
+}
 
-	return &PostgresStorage{
-		db:     db,
-		config: config,
-	}, nil
+// reaper deletes expired sessions and password resets until the storage is
+// closed
+func (s *PostgresStorage) reaper(interval time.Duration) {
+	defer close(s.stopped)
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-s.stop:
+			return
+		case <-ticker.C:
+			if _, err := s.DeleteExpiredSessions(context.Background()); err != nil {
+				log.Printf("Failed to delete expired sessions: %v", err)
+			}
+			if _, err := s.DeleteExpiredPasswordResets(context.Background()); err != nil {
+				log.Printf("Failed to delete expired password resets: %v", err)
+			}
+		}
+	}
 }
 
 func (s *PostgresStorage) NewUserStorage() (types.UserStorage, error) {
@@ -93,431 +142,1332 @@ func (s *PostgresStorage) NewSessionStorage() (types.SessionStorage, error) {
 }
 
 // CreateUser creates a new user
-func (s *PostgresStorage) CreateUser(user *types.User) error {
+func (s *PostgresStorage) CreateUser(ctx context.Context, user *types.User, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	stmt, err := s.db.Prepare("INSERT INTO users(id, username, email, password) VALUES($1, $2, $3, $4)")
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return postgresError(err)
 	}
-	_, err = stmt.Exec(user.ID, user.Username, user.Email, user.Password)
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO users(id, username, email, password, must_change_password) VALUES($1, $2, $3, $4, $5)",
+		user.ID, user.Username, user.Email, user.Password, user.MustChangePassword)
 	if err != nil {
-		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code.Name() == "unique_violation" {
-			return errors.New("user already exists")
+		tx.Rollback()
+		if isPrimaryKeyViolation(err) {
+			return fmt.Errorf("user %s %w", user.ID, types.ErrAlreadyExists)
 		}
+		return postgresError(err)
+	}
+
+	if err := addOutboxEntries(ctx, tx, outbox); err != nil {
+		tx.Rollback()
 		return err
 	}
-	return nil
+	return postgresError(tx.Commit())
 }
 
 // GetUserByID returns a user by its ID
-func (s *PostgresStorage) GetUserByID(id string) (*types.User, error) {
-	row := s.db.QueryRow("SELECT id, username, email, password FROM users WHERE id = $1", id)
+func (s *PostgresStorage) GetUserByID(ctx context.Context, id string) (*types.User, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT id, username, email, password, must_change_password FROM users WHERE id = $1", id)
 	user := &types.User{}
-	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.Password)
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.MustChangePassword)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("user not found")
+			return nil, fmt.Errorf("user %s %w", id, types.ErrNotFound)
 		}
-		return nil, err
+		return nil, postgresError(err)
 	}
 	return user, nil
 }
 
 // GetUserByUsername returns a user by its username
-func (s *PostgresStorage) GetUserByUsername(username string) (*types.User, error) {
-	row := s.db.QueryRow("SELECT id, username, email, password FROM users WHERE username = $1", username)
+func (s *PostgresStorage) GetUserByUsername(ctx context.Context, username string) (*types.User, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT id, username, email, password, must_change_password FROM users WHERE username = $1", username)
 	user := &types.User{}
-	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.Password)
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.MustChangePassword)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("username not found")
+			return nil, fmt.Errorf("user with username %s %w", username, types.ErrNotFound)
 		}
-		return nil, err
+		return nil, postgresError(err)
 	}
 	return user, nil
 }
 
 // GetUserByEmail returns a user by its email
-func (s *PostgresStorage) GetUserByEmail(email string) (*types.User, error) {
-	row := s.db.QueryRow("SELECT id, username, email, password FROM users WHERE email = $1", email)
+func (s *PostgresStorage) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT id, username, email, password, must_change_password FROM users WHERE email = $1 AND email <> ''", email)
 	user := &types.User{}
-	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.Password)
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.MustChangePassword)
 	if err != nil {
 		if err == sql.ErrNoRows {
-			return nil, errors.New("user email not found")
+			return nil, fmt.Errorf("user with email %s %w", email, types.ErrNotFound)
 		}
-		return nil, err
+		return nil, postgresError(err)
 	}
 	return user, nil
 }
 
+// ListUsers returns a page of users, using keyset pagination
+func (s *PostgresStorage) ListUsers(ctx context.Context, options *types.UserListOptions) (*types.UserPage, error) {
+	params, err := userListParams(options)
+	if err != nil {
+		return nil, err
+	}
+
+	query := &listQuery{}
+	query.prefix("username", options.UsernamePrefix)
+	query.contains("username", options.UsernameContains)
+	query.prefix("email", options.EmailPrefix)
+	query.contains("email", options.EmailContains)
+
+	rows, err := s.db.QueryContext(ctx, query.build("SELECT id, username, email, password, must_change_password FROM users", params), query.args...)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+
+	users := []*types.User{}
+	for rows.Next() {
+		user := &types.User{}
+		if err := rows.Scan(&user.ID, &user.Username, &user.Email, &user.Password, &user.MustChangePassword); err != nil {
+			return nil, postgresError(err)
+		}
+		users = append(users, user)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError(err)
+	}
+
+	return userPage(users, params), nil
+}
+
 // UpdateUser updates a user
-func (s *PostgresStorage) UpdateUser(user *types.User) error {
+func (s *PostgresStorage) UpdateUser(ctx context.Context, user *types.User, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	stmt, err := s.db.Prepare("UPDATE users SET username = $2, email = $3, password = $4 WHERE id = $1")
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
-		return err
+		return postgresError(err)
 	}
-	_, err = stmt.Exec(user.ID, user.Username, user.Email, user.Password)
+
+	res, err := tx.ExecContext(ctx, "UPDATE users SET username = $2, email = $3, password = $4, must_change_password = $5 WHERE id = $1",
+		user.ID, user.Username, user.Email, user.Password, user.MustChangePassword)
 	if err != nil {
+		tx.Rollback()
+		return postgresError(err)
+	}
+	if err := expectRowsAffected(res, fmt.Errorf("user %s %w", user.ID, types.ErrNotFound)); err != nil {
+		tx.Rollback()
 		return err
 	}
-	return nil
+
+	if err := addOutboxEntries(ctx, tx, outbox); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return postgresError(tx.Commit())
 }
 
-// DeleteUser deletes a user
-func (s *PostgresStorage) DeleteUser(id string) error {
+// DeleteUser deletes a user and, depending on the delete policy, removes
+// it from its groups and clears the owner of the groups it owns
+func (s *PostgresStorage) DeleteUser(ctx context.Context, id string, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	stmt, err := s.db.Prepare("DELETE FROM users WHERE id = $1")
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	// Lock the user so that it cannot be added to a group concurrently
+	var locked string
+	err = tx.QueryRowContext(ctx, "SELECT id FROM users WHERE id = $1 FOR UPDATE", id).Scan(&locked)
 	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("user %s %w", id, types.ErrNotFound)
+		}
+		return postgresError(err)
+	}
+
+	if err := s.removeReferences(ctx, tx, "user", id); err != nil {
+		tx.Rollback()
 		return err
 	}
-	_, err = stmt.Exec(id)
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM users WHERE id = $1", id)
 	if err != nil {
+		tx.Rollback()
+		return postgresError(err)
+	}
+
+	if err := addOutboxEntries(ctx, tx, outbox); err != nil {
+		tx.Rollback()
 		return err
 	}
-	return nil
+	return postgresError(tx.Commit())
 }
 
 // CreateGroup creates a new group
-func (s *PostgresStorage) CreateGroup(group *types.Group) error {
+func (s *PostgresStorage) CreateGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	ownerID, ownerType, err := postgresOwner(group)
 	if err != nil {
+		tx.Rollback()
 		return err
 	}
+	if ownerID.Valid && !(ownerType.String == "group" && ownerID.String == group.ID) {
+		if err := lockMember(ctx, tx, *group.OwnerID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 
 	// Create group
-	stmt, err := tx.Prepare("INSERT INTO groups(id, name) VALUES($1, $2)")
+	stmt, err := tx.PrepareContext(ctx, "INSERT INTO groups(id, name, description, owner_id, owner_type) VALUES($1, $2, $3, $4, $5)")
 	if err != nil {
 		tx.Rollback()
-		return err
+		return postgresError(err)
 	}
-	_, err = stmt.Exec(group.ID, group.Name)
+	_, err = stmt.ExecContext(ctx, group.ID, group.Name, group.Description, ownerID, ownerType)
 	if err != nil {
 		tx.Rollback()
-		if pgErr, ok := err.(*pq.Error); ok && pgErr.Code.Name() == "unique_violation" {
-			return errors.New("group already exists")
+		if isPrimaryKeyViolation(err) {
+			return fmt.Errorf("group %s %w", group.ID, types.ErrAlreadyExists)
 		}
-		return err
+		return postgresError(err)
 	}
 
 	// Add group members
-	stmt, err = tx.Prepare("INSERT INTO group_members(group_id, member_id, member_type) VALUES($1, $2, $3)")
+	stmt, err = tx.PrepareContext(ctx, "INSERT INTO group_members(group_id, member_id, member_type) VALUES($1, $2, $3)")
 	if err != nil {
 		tx.Rollback()
-		return err
+		return postgresError(err)
 	}
 	for _, member := range group.Members {
 		switch m := (*member).(type) {
 		case *types.User:
-			_, err = stmt.Exec(group.ID, m.ID, "user")
-			if err != nil {
-				tx.Rollback()
-				return err
-			}
 		case *types.Group:
-			_, err = stmt.Exec(group.ID, m.ID, "group")
-			if err != nil {
+			if err := s.checkNesting(ctx, tx, group.ID, m.ID); err != nil {
 				tx.Rollback()
 				return err
 			}
 		default:
 			tx.Rollback()
-			return errors.New("invalid group member type")
+			return fmt.Errorf("%w: unknown member type %T", types.ErrInvalidMember, *member)
+		}
+		// Lock the member so that it cannot be deleted concurrently,
+		// leaving a dangling membership behind
+		if err := lockMember(ctx, tx, *member); err != nil {
+			tx.Rollback()
+			return err
+		}
+		_, err = stmt.ExecContext(ctx, group.ID, (*member).GetID(), (*member).GetType())
+		if err != nil {
+			tx.Rollback()
+			return postgresError(err)
 		}
 	}
 
-	err = tx.Commit()
-	if err != nil {
+	if err := addOutboxEntries(ctx, tx, outbox); err != nil {
+		tx.Rollback()
 		return err
 	}
-
-	return nil
+	return postgresError(tx.Commit())
 }
 
 // GetGroupByID returns a group by its ID
-func (s *PostgresStorage) GetGroupByID(id string) (*types.Group, error) {
-	group := &types.Group{}
-	err := s.db.QueryRow("SELECT id, name FROM groups WHERE id = $1", id).Scan(&group.ID, &group.Name)
+func (s *PostgresStorage) GetGroupByID(ctx context.Context, id string) (*types.Group, error) {
+	group, err := s.shallowGroup(ctx, id)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("group not found")
-		}
 		return nil, err
 	}
+	if err := loadMembers(ctx, s, group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
 
-	rows, err := s.db.Query("SELECT member_id, member_type FROM group_members WHERE group_id = $1", id)
+// GetGroupByName returns a group by its name
+func (s *PostgresStorage) GetGroupByName(ctx context.Context, name string) (*types.Group, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+groupColumns+" FROM groups WHERE name = $1", name)
+	group, err := scanGroup(row, fmt.Errorf("group with name %s %w", name, types.ErrNotFound))
 	if err != nil {
 		return nil, err
 	}
+	if err := loadMembers(ctx, s, group); err != nil {
+		return nil, err
+	}
+	return group, nil
+}
+
+// GetGroupsByOwner returns the groups owned by a user or group, sorted by name
+func (s *PostgresStorage) GetGroupsByOwner(ctx context.Context, owner types.Member) ([]*types.Group, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT id FROM groups WHERE owner_type = $1 AND owner_id = $2 ORDER BY name", owner.GetType(), owner.GetID())
+	if err != nil {
+		return nil, postgresError(err)
+	}
 	defer rows.Close()
 
+	var ids []string
 	for rows.Next() {
-		var memberID string
-		var memberType string
-		err = rows.Scan(&memberID, &memberType)
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, postgresError(err)
+		}
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError(err)
+	}
+
+	groups := []*types.Group{}
+	for _, id := range ids {
+		group, err := s.GetGroupByID(ctx, id)
 		if err != nil {
 			return nil, err
 		}
-		var member types.Member
-		if memberType == "user" {
-			member, err = s.GetUserByID(memberID)
-		} else if memberType == "group" {
-			member, err = s.GetGroupByID(memberID)
-		} else {
-			return nil, errors.New("invalid member type")
-		}
+		groups = append(groups, group)
+	}
+	return groups, nil
+}
+
+// ListGroups returns a page of groups without their members, using keyset
+// pagination
+func (s *PostgresStorage) ListGroups(ctx context.Context, options *types.GroupListOptions) (*types.GroupPage, error) {
+	params, err := groupListParams(options)
+	if err != nil {
+		return nil, err
+	}
+
+	query := &listQuery{}
+	query.prefix("name", options.NamePrefix)
+	query.contains("name", options.NameContains)
+
+	rows, err := s.db.QueryContext(ctx, query.build("SELECT "+groupColumns+" FROM groups", params), query.args...)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
 
+	groups := []*types.Group{}
+	for rows.Next() {
+		group, err := scanGroup(rows, nil)
 		if err != nil {
 			return nil, err
 		}
+		groups = append(groups, group)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError(err)
+	}
+
+	return groupPage(groups, params), nil
+}
+
+// listQuery builds the conditions and arguments of a listing query
+type listQuery struct {
+	conditions []string
+	args       []interface{}
+}
 
-		group.Members = append(group.Members, &member)
+// arg adds an argument to the query and returns its placeholder
+func (q *listQuery) arg(v interface{}) string {
+	q.args = append(q.args, v)
+	return "$" + strconv.Itoa(len(q.args))
+}
+
+// prefix adds a condition matching the values of column starting with prefix
+func (q *listQuery) prefix(column, prefix string) {
+	if prefix == "" {
+		return
 	}
+	escaped := strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(prefix)
+	q.conditions = append(q.conditions, column+" LIKE "+q.arg(escaped+"%")+` ESCAPE '\'`)
+}
 
-	return group, nil
+// contains adds a condition matching the values of column containing substr
+func (q *listQuery) contains(column, substr string) {
+	if substr == "" {
+		return
+	}
+	q.conditions = append(q.conditions, "strpos("+column+", "+q.arg(substr)+") > 0")
 }
 
-// GetGroupByName returns a group by its name
-func (s *PostgresStorage) GetGroupByName(name string) (*types.Group, error) {
-	group := &types.Group{}
-	err := s.db.QueryRow("SELECT id, name FROM groups WHERE name = $1", name).Scan(&group.ID, &group.Name)
+// build returns the query selecting the page described by params. Rows are
+// sorted by the sort column, then by ID, comparing strings byte by byte, and
+// one row more than the limit is selected to detect the last page.
+func (q *listQuery) build(selectFrom string, params *listParams) string {
+	order, op := "ASC", ">"
+	if params.descending {
+		order, op = "DESC", "<"
+	}
+
+	conditions := q.conditions
+	if params.cursor != nil {
+		conditions = append(conditions, fmt.Sprintf(`(%s COLLATE "C", id COLLATE "C") %s (%s, %s)`, params.sortBy, op, q.arg(params.cursor.Value), q.arg(params.cursor.ID)))
+	}
+
+	query := selectFrom
+	if len(conditions) > 0 {
+		query += " WHERE " + strings.Join(conditions, " AND ")
+	}
+	if params.sortBy == "id" {
+		query += fmt.Sprintf(` ORDER BY id COLLATE "C" %s`, order)
+	} else {
+		query += fmt.Sprintf(` ORDER BY %s COLLATE "C" %s, id COLLATE "C" %s`, params.sortBy, order, order)
+	}
+	return query + " LIMIT " + q.arg(params.limit+1)
+}
+
+// GetEffectiveMembers returns the users that are members of a group,
+// directly or through nested groups. Every user is reported once, through
+// its shortest path.
+func (s *PostgresStorage) GetEffectiveMembers(ctx context.Context, groupID string) ([]*types.EffectiveMembership, error) {
+	if _, err := s.shallowGroup(ctx, groupID); err != nil {
+		return nil, err
+	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		WITH RECURSIVE nested(group_id, path) AS (
+			SELECT id, ARRAY[id]::VARCHAR[] FROM groups WHERE id = $1
+			UNION ALL
+			SELECT gm.member_id, array_append(n.path, gm.member_id)
+			FROM nested n JOIN group_members gm ON gm.group_id = n.group_id
+			WHERE gm.member_type = 'group' AND NOT gm.member_id = ANY(n.path)
+		)
+		SELECT DISTINCT ON (gm.member_id) gm.member_id, n.path
+		FROM nested n JOIN group_members gm ON gm.group_id = n.group_id
+		WHERE gm.member_type = 'user'
+		ORDER BY gm.member_id, array_length(n.path, 1), n.path COLLATE "C"`, groupID)
 	if err != nil {
-		if err == sql.ErrNoRows {
-			return nil, errors.New("group not found")
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+
+	memberships := []*types.EffectiveMembership{}
+	for rows.Next() {
+		membership := &types.EffectiveMembership{GroupID: groupID}
+		if err := rows.Scan(&membership.UserID, pq.Array(&membership.Path)); err != nil {
+			return nil, postgresError(err)
 		}
+		memberships = append(memberships, membership)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError(err)
+	}
+
+	sort.Slice(memberships, func(i, j int) bool {
+		return memberships[i].UserID < memberships[j].UserID
+	})
+	return memberships, nil
+}
+
+// GetEffectiveGroups returns the groups a user is a member of, directly or
+// through nested groups. Every group is reported once, through its shortest
+// path.
+func (s *PostgresStorage) GetEffectiveGroups(ctx context.Context, userID string) ([]*types.EffectiveMembership, error) {
+	if _, err := s.GetUserByID(ctx, userID); err != nil {
 		return nil, err
 	}
 
-	rows, err := s.db.Query("SELECT member_id, member_type FROM group_members WHERE group_id = $1", group.ID)
+	rows, err := s.db.QueryContext(ctx, `
+		WITH RECURSIVE parents(group_id, path) AS (
+			SELECT group_id, ARRAY[group_id]::VARCHAR[] FROM group_members WHERE member_type = 'user' AND member_id = $1
+			UNION ALL
+			SELECT gm.group_id, array_prepend(gm.group_id, p.path)
+			FROM parents p JOIN group_members gm ON gm.member_id = p.group_id
+			WHERE gm.member_type = 'group' AND NOT gm.group_id = ANY(p.path)
+		)
+		SELECT DISTINCT ON (group_id) group_id, path
+		FROM parents
+		ORDER BY group_id, array_length(path, 1), path COLLATE "C"`, userID)
 	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+
+	memberships := []*types.EffectiveMembership{}
+	for rows.Next() {
+		membership := &types.EffectiveMembership{UserID: userID}
+		if err := rows.Scan(&membership.GroupID, pq.Array(&membership.Path)); err != nil {
+			return nil, postgresError(err)
+		}
+		memberships = append(memberships, membership)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError(err)
+	}
+
+	sort.Slice(memberships, func(i, j int) bool {
+		return memberships[i].GroupID < memberships[j].GroupID
+	})
+	return memberships, nil
+}
+
+// GetAncestorGroups returns the IDs of the groups a group is nested in,
+// directly or through other groups
+func (s *PostgresStorage) GetAncestorGroups(ctx context.Context, groupID string) ([]string, error) {
+	if _, err := s.shallowGroup(ctx, groupID); err != nil {
 		return nil, err
 	}
+
+	rows, err := s.db.QueryContext(ctx, `
+		WITH RECURSIVE parents(group_id, path) AS (
+			SELECT group_id, ARRAY[group_id]::VARCHAR[] FROM group_members WHERE member_type = 'group' AND member_id = $1
+			UNION ALL
+			SELECT gm.group_id, array_prepend(gm.group_id, p.path)
+			FROM parents p JOIN group_members gm ON gm.member_id = p.group_id
+			WHERE gm.member_type = 'group' AND NOT gm.group_id = ANY(p.path)
+		)
+		SELECT DISTINCT group_id COLLATE "C"
+		FROM parents
+		WHERE group_id <> $1
+		ORDER BY 1`, groupID)
+	if err != nil {
+		return nil, postgresError(err)
+	}
 	defer rows.Close()
 
+	ids := []string{}
 	for rows.Next() {
-		var memberID string
-		var memberType string
-		err = rows.Scan(&memberID, &memberType)
-		if err != nil {
-			return nil, err
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, postgresError(err)
 		}
-		var member types.Member
-		if memberType == "user" {
-			member, err = s.GetUserByID(memberID)
-		} else if memberType == "group" {
-			member, err = s.GetGroupByID(memberID)
-		} else {
-			return nil, errors.New("invalid member type")
+		ids = append(ids, id)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError(err)
+	}
+	return ids, nil
+}
+
+// groupColumns are the columns of the groups table scanned by scanGroup
+const groupColumns = "id, name, description, owner_id, owner_type"
+
+// rowScanner is implemented by *sql.Row and *sql.Rows
+type rowScanner interface {
+	Scan(dest ...interface{}) error
+}
+
+// scanGroup scans a group row, without the members of the group. A missing
+// row is reported as notFound.
+func scanGroup(row rowScanner, notFound error) (*types.Group, error) {
+	group := &types.Group{}
+	var ownerID, ownerType sql.NullString
+	err := row.Scan(&group.ID, &group.Name, &group.Description, &ownerID, &ownerType)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, notFound
 		}
+		return nil, postgresError(err)
+	}
 
+	if ownerID.Valid {
+		owner, err := types.NewMemberReference(ownerType.String, ownerID.String)
 		if err != nil {
 			return nil, err
 		}
-
-		group.Members = append(group.Members, &member)
+		group.OwnerID = &owner
 	}
 
 	return group, nil
 }
 
+// shallowGroup returns a group by its ID, without its members
+func (s *PostgresStorage) shallowGroup(ctx context.Context, id string) (*types.Group, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT "+groupColumns+" FROM groups WHERE id = $1", id)
+	return scanGroup(row, fmt.Errorf("group %s %w", id, types.ErrNotFound))
+}
+
+// memberRefs returns the members of a group
+func (s *PostgresStorage) memberRefs(ctx context.Context, groupID string) ([]memberRef, error) {
+	rows, err := s.db.QueryContext(ctx, "SELECT member_type, member_id FROM group_members WHERE group_id = $1 ORDER BY member_type, member_id", groupID)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+
+	var refs []memberRef
+	for rows.Next() {
+		var ref memberRef
+		if err := rows.Scan(&ref.Type, &ref.ID); err != nil {
+			return nil, postgresError(err)
+		}
+		refs = append(refs, ref)
+	}
+	return refs, postgresError(rows.Err())
+}
+
+// groupNestingLockKey is the key of the PostgreSQL advisory lock held by
+// transactions nesting groups, so that concurrent changes cannot create a
+// cycle together
+const groupNestingLockKey int64 = 0x63756d01
+
+// postgresGroupGraph gives access to the nesting of groups within a transaction
+type postgresGroupGraph struct {
+	tx *sql.Tx
+}
+
+// childGroups returns the IDs of the groups that are direct members of a group
+func (g postgresGroupGraph) childGroups(ctx context.Context, id string) ([]string, error) {
+	return g.ids(ctx, "SELECT member_id FROM group_members WHERE group_id = $1 AND member_type = 'group'", id)
+}
+
+// parentGroups returns the IDs of the groups a group is a direct member of
+func (g postgresGroupGraph) parentGroups(ctx context.Context, id string) ([]string, error) {
+	return g.ids(ctx, "SELECT group_id FROM group_members WHERE member_id = $1 AND member_type = 'group'", id)
+}
+
+// ids returns the IDs selected by a query
+func (g postgresGroupGraph) ids(ctx context.Context, query string, args ...interface{}) ([]string, error) {
+	rows, err := g.tx.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			return nil, postgresError(err)
+		}
+		ids = append(ids, id)
+	}
+	return ids, postgresError(rows.Err())
+}
+
+// checkNesting locks the nesting of groups until the end of the transaction
+// and returns an error if adding the group childID to the group parentID
+// would create a cycle or exceed the maximum depth
+func (s *PostgresStorage) checkNesting(ctx context.Context, tx *sql.Tx, parentID, childID string) error {
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", groupNestingLockKey); err != nil {
+		return postgresError(err)
+	}
+	return checkNesting(ctx, postgresGroupGraph{tx: tx}, parentID, childID, maxNestingDepth(s.config.MaxNestingDepth))
+}
+
+// postgresOwner returns the owner_id and owner_type column values of a
+// group, which are both NULL when the group has no owner
+func postgresOwner(group *types.Group) (ownerID, ownerType sql.NullString, err error) {
+	owner, err := groupOwner(group)
+	if err != nil || owner == nil {
+		return ownerID, ownerType, err
+	}
+	ownerID = sql.NullString{String: owner.GetID(), Valid: true}
+	ownerType = sql.NullString{String: owner.GetType(), Valid: true}
+	return ownerID, ownerType, nil
+}
+
 // UpdateGroup updates a group
-func (s *PostgresStorage) UpdateGroup(group *types.Group) error {
+func (s *PostgresStorage) UpdateGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	tx, err := s.db.Begin()
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
+		return postgresError(err)
+	}
+
+	ownerID, ownerType, err := postgresOwner(group)
+	if err != nil {
+		tx.Rollback()
 		return err
 	}
+	if ownerID.Valid && !(ownerType.String == "group" && ownerID.String == group.ID) {
+		if err := lockMember(ctx, tx, *group.OwnerID); err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
 
 	// Update group
-	stmt, err := tx.Prepare("UPDATE groups SET name = $2 WHERE id = $1")
+	stmt, err := tx.PrepareContext(ctx, "UPDATE groups SET name = $2, description = $3, owner_id = $4, owner_type = $5 WHERE id = $1")
 	if err != nil {
 		tx.Rollback()
-		return err
+		return postgresError(err)
 	}
-	_, err = stmt.Exec(group.ID, group.Name)
+	res, err := stmt.ExecContext(ctx, group.ID, group.Name, group.Description, ownerID, ownerType)
 	if err != nil {
+		tx.Rollback()
+		return postgresError(err)
+	}
+	if err := expectRowsAffected(res, fmt.Errorf("group %s %w", group.ID, types.ErrNotFound)); err != nil {
 		tx.Rollback()
 		return err
 	}
 
 	// Delete group members
-	stmt, err = tx.Prepare("DELETE FROM group_members WHERE group_id = $1")
+	stmt, err = tx.PrepareContext(ctx, "DELETE FROM group_members WHERE group_id = $1")
 	if err != nil {
 		tx.Rollback()
-		return err
+		return postgresError(err)
 	}
-	_, err = stmt.Exec(group.ID)
+	_, err = stmt.ExecContext(ctx, group.ID)
 	if err != nil {
 		tx.Rollback()
-		return err
+		return postgresError(err)
 	}
 
 	// Add group members
-	stmt, err = tx.Prepare("INSERT INTO group_members(group_id, member_id, member_type) VALUES($1, $2, $3)")
+	stmt, err = tx.PrepareContext(ctx, "INSERT INTO group_members(group_id, member_id, member_type) VALUES($1, $2, $3)")
 	if err != nil {
 		tx.Rollback()
-		return err
+		return postgresError(err)
 	}
 	for _, member := range group.Members {
-		_, err = stmt.Exec(group.ID, (*member).GetID(), (*member).GetType())
-		if err != nil {
+		switch (*member).(type) {
+		case *types.User:
+		case *types.Group:
+			if err := s.checkNesting(ctx, tx, group.ID, (*member).GetID()); err != nil {
+				tx.Rollback()
+				return err
+			}
+		default:
+			tx.Rollback()
+			return fmt.Errorf("%w: unknown member type %T", types.ErrInvalidMember, *member)
+		}
+		if err := lockMember(ctx, tx, *member); err != nil {
 			tx.Rollback()
 			return err
 		}
+		_, err = stmt.ExecContext(ctx, group.ID, (*member).GetID(), (*member).GetType())
+		if err != nil {
+			tx.Rollback()
+			return postgresError(err)
+		}
 	}
 
-	err = tx.Commit()
-	if err != nil {
+	if err := addOutboxEntries(ctx, tx, outbox); err != nil {
+		tx.Rollback()
 		return err
 	}
-
-	return nil
+	return postgresError(tx.Commit())
 }
 
 // AddMemberToGroup adds a member to a group
-func (s *PostgresStorage) AddMemberToGroup(member types.Member, groupID string) error {
+func (s *PostgresStorage) AddMemberToGroup(ctx context.Context, member types.Member, groupID string, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	switch member := member.(type) {
+	var memberType string
+	switch member.(type) {
 	case *types.User:
-		user := member
-		_, err := s.db.Exec("INSERT INTO group_members(group_id, member_id, member_type) VALUES($1, $2, $3)", groupID, user.ID, "user")
-		if err != nil {
-			return err
-		}
+		memberType = "user"
 	case *types.Group:
-		subgroup := member
-		_, err := s.db.Exec("INSERT INTO group_members(group_id, member_id, member_type) VALUES($1, $2, $3)", groupID, subgroup.ID, "group")
-		if err != nil {
+		memberType = "group"
+	default:
+		return fmt.Errorf("%w: unknown member type %T", types.ErrInvalidMember, member)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	// Lock the group and the member so that they cannot be deleted
+	// concurrently, leaving a dangling membership behind
+	if err := lockMember(ctx, tx, &types.Group{ID: groupID}); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if err := lockMember(ctx, tx, member); err != nil {
+		tx.Rollback()
+		return err
+	}
+	if memberType == "group" {
+		if err := s.checkNesting(ctx, tx, groupID, member.GetID()); err != nil {
+			tx.Rollback()
 			return err
 		}
-	default:
-		return errors.New("unknown member type")
+	}
+
+	_, err = tx.ExecContext(ctx, "INSERT INTO group_members(group_id, member_id, member_type) VALUES($1, $2, $3)", groupID, member.GetID(), memberType)
+	if err != nil {
+		tx.Rollback()
+		if isPrimaryKeyViolation(err) {
+			return fmt.Errorf("%s %s is already a member of group %s: %w", memberType, member.GetID(), groupID, types.ErrAlreadyExists)
+		}
+		return postgresError(err)
+	}
+
+	if err := addOutboxEntries(ctx, tx, outbox); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return postgresError(tx.Commit())
+}
+
+// lockMember locks the row of a user or group until the end of the
+// transaction, preventing its deletion
+func lockMember(ctx context.Context, tx *sql.Tx, member types.Member) error {
+	query := "SELECT id FROM users WHERE id = $1 FOR SHARE"
+	if member.GetType() == "group" {
+		query = "SELECT id FROM groups WHERE id = $1 FOR SHARE"
+	}
+
+	var id string
+	err := tx.QueryRowContext(ctx, query, member.GetID()).Scan(&id)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%s %s %w", member.GetType(), member.GetID(), types.ErrNotFound)
+		}
+		return postgresError(err)
 	}
 	return nil
 }
 
 // RemoveMemberFromGroup removes a member from a group
-func (s *PostgresStorage) RemoveMemberFromGroup(member *types.Member, groupID string) error {
+func (s *PostgresStorage) RemoveMemberFromGroup(ctx context.Context, member *types.Member, groupID string, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
+	var memberType string
 	switch (*member).(type) {
 	case *types.User:
-		user := (*member).(*types.User)
-		_, err := s.db.Exec("DELETE FROM group_members WHERE group_id = $1 AND member_id = $2 AND member_type = $3", groupID, user.ID, "user")
-		if err != nil {
-			return err
-		}
+		memberType = "user"
 	case *types.Group:
-		subgroup := (*member).(*types.Group)
-		_, err := s.db.Exec("DELETE FROM group_members WHERE group_id = $1 AND member_id = $2 AND member_type = $3", groupID, subgroup.ID, "group")
-		if err != nil {
-			return err
-		}
+		memberType = "group"
 	default:
-		return errors.New("unknown member type")
+		return fmt.Errorf("%w: unknown member type %T", types.ErrInvalidMember, *member)
 	}
-	return nil
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	res, err := tx.ExecContext(ctx, "DELETE FROM group_members WHERE group_id = $1 AND member_id = $2 AND member_type = $3", groupID, (*member).GetID(), memberType)
+	if err != nil {
+		tx.Rollback()
+		return postgresError(err)
+	}
+	if err := expectRowsAffected(res, fmt.Errorf("member %s of group %s %w", (*member).GetID(), groupID, types.ErrNotFound)); err != nil {
+		tx.Rollback()
+		return err
+	}
+
+	if err := addOutboxEntries(ctx, tx, outbox); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return postgresError(tx.Commit())
 }
 
-// DeleteGroup deletes a group
-func (s *PostgresStorage) DeleteGroup(group *types.Group) error {
+// DeleteGroup deletes a group with its memberships and, depending on the
+// delete policy, removes it from its parent groups and clears the owner of
+// the groups it owns
+func (s *PostgresStorage) DeleteGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	_, err := s.db.Exec("DELETE FROM groups WHERE id = $1", group.ID)
+	tx, err := s.db.BeginTx(ctx, nil)
 	if err != nil {
+		return postgresError(err)
+	}
+
+	// Lock the group so that it cannot be added to a group concurrently
+	var locked string
+	err = tx.QueryRowContext(ctx, "SELECT id FROM groups WHERE id = $1 FOR UPDATE", group.ID).Scan(&locked)
+	if err != nil {
+		tx.Rollback()
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("group %s %w", group.ID, types.ErrNotFound)
+		}
+		return postgresError(err)
+	}
+
+	if err := s.removeReferences(ctx, tx, "group", group.ID); err != nil {
+		tx.Rollback()
 		return err
 	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM group_members WHERE group_id = $1", group.ID)
+	if err != nil {
+		tx.Rollback()
+		return postgresError(err)
+	}
+
+	_, err = tx.ExecContext(ctx, "DELETE FROM groups WHERE id = $1", group.ID)
+	if err != nil {
+		tx.Rollback()
+		return postgresError(err)
+	}
+
+	if err := addOutboxEntries(ctx, tx, outbox); err != nil {
+		tx.Rollback()
+		return err
+	}
+	return postgresError(tx.Commit())
+}
+
+// removeReferences applies the delete policy to the memberships and
+// ownerships of a user or group about to be deleted. References of a group
+// to itself are ignored.
+func (s *PostgresStorage) removeReferences(ctx context.Context, tx *sql.Tx, memberType, id string) error {
+	if s.config.DeletePolicy == DeleteRestrict {
+		var groupID string
+		err := tx.QueryRowContext(ctx, "SELECT group_id FROM group_members WHERE member_type = $1 AND member_id = $2 AND NOT (member_type = 'group' AND group_id = $2) ORDER BY group_id LIMIT 1", memberType, id).Scan(&groupID)
+		if err == nil {
+			return stillMemberError(memberType, id, groupID)
+		}
+		if err != sql.ErrNoRows {
+			return postgresError(err)
+		}
+
+		err = tx.QueryRowContext(ctx, "SELECT id FROM groups WHERE owner_type = $1 AND owner_id = $2 AND NOT (owner_type = 'group' AND id = $2) ORDER BY id LIMIT 1", memberType, id).Scan(&groupID)
+		if err == nil {
+			return stillOwnerError(memberType, id, groupID)
+		}
+		if err != sql.ErrNoRows {
+			return postgresError(err)
+		}
+	}
+
+	_, err := tx.ExecContext(ctx, "DELETE FROM group_members WHERE member_type = $1 AND member_id = $2", memberType, id)
+	if err != nil {
+		return postgresError(err)
+	}
+
+	_, err = tx.ExecContext(ctx, "UPDATE groups SET owner_id = NULL, owner_type = NULL WHERE owner_type = $1 AND owner_id = $2", memberType, id)
+	if err != nil {
+		return postgresError(err)
+	}
+
 	return nil
 }
 
 // CreateSession creates a new session
-func (s *PostgresStorage) CreateSession(session *types.Session) error {
+func (s *PostgresStorage) CreateSession(ctx context.Context, session *types.Session) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	stmt, err := s.db.Prepare("INSERT INTO sessions(id, user_id, expires_at) VALUES($1, $2, $3)")
+	stmt, err := s.db.PrepareContext(ctx, "INSERT INTO sessions(id, user_id, expires_at) VALUES($1, $2, $3)")
 	if err != nil {
-		return err
+		return postgresError(err)
 	}
-	_, err = stmt.Exec(session.ID, session.UserID, session.ExpiresAt)
+	_, err = stmt.ExecContext(ctx, session.ID, session.UserID, sessionExpiresAt(session))
 	if err != nil {
-		return err
+		if isPrimaryKeyViolation(err) {
+			return fmt.Errorf("session %s %w", session.ID, types.ErrAlreadyExists)
+		}
+		return postgresError(err)
 	}
 	return nil
 }
 
 // GetSessionByID returns a session by its ID
-func (s *PostgresStorage) GetSessionByID(id string) (*types.Session, error) {
-	row := s.db.QueryRow("SELECT id, user_id, expires_at FROM sessions WHERE id = $1", id)
-	session := &types.Session{}
-	err := row.Scan(&session.ID, &session.UserID, &session.ExpiresAt)
+func (s *PostgresStorage) GetSessionByID(ctx context.Context, id string) (*types.Session, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT id, user_id, expires_at FROM sessions WHERE id = $1 AND "+sessionNotExpired, id)
+	session, err := scanSession(row)
 	if err != nil {
-		return nil, err
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("session %s %w", id, types.ErrNotFound)
+		}
+		return nil, postgresError(err)
 	}
 	return session, nil
 }
 
 // GetSessionByUserID returns a session by its user ID
-func (s *PostgresStorage) GetSessionByUserID(userID string) (*types.Session, error) {
-	row := s.db.QueryRow("SELECT id, user_id, expires_at FROM sessions WHERE user_id = $1", userID)
-	session := &types.Session{}
-	err := row.Scan(&session.ID, &session.UserID, &session.ExpiresAt)
+func (s *PostgresStorage) GetSessionByUserID(ctx context.Context, userID string) (*types.Session, error) {
+	row := s.db.QueryRowContext(ctx, "SELECT id, user_id, expires_at FROM sessions WHERE user_id = $1 AND "+sessionNotExpired+" ORDER BY expires_at DESC NULLS FIRST LIMIT 1", userID)
+	session, err := scanSession(row)
 	if err != nil {
-		return nil, err
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("session of user %s %w", userID, types.ErrNotFound)
+		}
+		return nil, postgresError(err)
 	}
 	return session, nil
 }
 
 // UpdateSession updates a session
-func (s *PostgresStorage) UpdateSession(session *types.Session) error {
+func (s *PostgresStorage) UpdateSession(ctx context.Context, session *types.Session) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	stmt, err := s.db.Prepare("UPDATE sessions SET user_id = $2, expires_at = $3 WHERE id = $1")
+	stmt, err := s.db.PrepareContext(ctx, "UPDATE sessions SET user_id = $2, expires_at = $3 WHERE id = $1")
 	if err != nil {
-		return err
+		return postgresError(err)
 	}
-	_, err = stmt.Exec(session.ID, session.UserID, session.ExpiresAt)
+	res, err := stmt.ExecContext(ctx, session.ID, session.UserID, sessionExpiresAt(session))
 	if err != nil {
-		return err
+		return postgresError(err)
 	}
-	return nil
+	return expectRowsAffected(res, fmt.Errorf("session %s %w", session.ID, types.ErrNotFound))
 }
 
 // DeleteSession deletes a session
-func (s *PostgresStorage) DeleteSession(id string) error {
+func (s *PostgresStorage) DeleteSession(ctx context.Context, id string) error {
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
-	stmt, err := s.db.Prepare("DELETE FROM sessions WHERE id = $1")
+	stmt, err := s.db.PrepareContext(ctx, "DELETE FROM sessions WHERE id = $1")
 	if err != nil {
-		return err
+		return postgresError(err)
 	}
-	_, err = stmt.Exec(id)
+	res, err := stmt.ExecContext(ctx, id)
 	if err != nil {
+		return postgresError(err)
+	}
+	return expectRowsAffected(res, fmt.Errorf("session %s %w", id, types.ErrNotFound))
+}
+
+// DeleteUserSessions deletes every session of a user
+func (s *PostgresStorage) DeleteUserSessions(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE user_id = $1", userID)
+	return postgresError(err)
+}
+
+// DeleteExpiredSessions deletes the expired sessions and returns how many
+// were deleted
+func (s *PostgresStorage) DeleteExpiredSessions(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM sessions WHERE NOT "+sessionNotExpired)
+	if err != nil {
+		return 0, postgresError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, postgresError(err)
+	}
+	return n, nil
+}
+
+// sessionNotExpired is the condition matching sessions that are still
+// valid. Expiry times are stored in UTC.
+const sessionNotExpired = "(expires_at IS NULL OR expires_at > (now() AT TIME ZONE 'UTC'))"
+
+// sessionExpiresAt returns the expiry time of a session as stored in the
+// expires_at column
+func sessionExpiresAt(session *types.Session) sql.NullTime {
+	if session.ExpiresAt == 0 {
+		return sql.NullTime{}
+	}
+	return sql.NullTime{Time: time.Unix(session.ExpiresAt, 0).UTC(), Valid: true}
+}
+
+// scanSession scans a session row
+func scanSession(row *sql.Row) (*types.Session, error) {
+	session := &types.Session{}
+	var expiresAt sql.NullTime
+	if err := row.Scan(&session.ID, &session.UserID, &expiresAt); err != nil {
+		return nil, err
+	}
+	if expiresAt.Valid {
+		session.ExpiresAt = expiresAt.Time.Unix()
+	}
+	return session, nil
+}
+
+// CreatePasswordReset creates a new password reset
+func (s *PostgresStorage) CreatePasswordReset(ctx context.Context, reset *types.PasswordReset) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stmt, err := s.db.PrepareContext(ctx, "INSERT INTO password_resets(id, user_id, expires_at) VALUES($1, $2, $3)")
+	if err != nil {
+		return postgresError(err)
+	}
+	_, err = stmt.ExecContext(ctx, reset.ID, reset.UserID, time.Unix(reset.ExpiresAt, 0).UTC())
+	if err != nil {
+		if isPrimaryKeyViolation(err) {
+			return fmt.Errorf("password reset %s %w", reset.ID, types.ErrAlreadyExists)
+		}
+		if isForeignKeyViolation(err) {
+			return fmt.Errorf("user %s %w", reset.UserID, types.ErrNotFound)
+		}
+		return postgresError(err)
+	}
+	return nil
+}
+
+// ConsumePasswordReset returns and deletes a password reset by its ID, in
+// a single statement so that concurrent requests cannot both redeem it
+func (s *PostgresStorage) ConsumePasswordReset(ctx context.Context, id string) (*types.PasswordReset, error) {
+	reset := &types.PasswordReset{}
+	var expiresAt time.Time
+	err := s.db.QueryRowContext(ctx, "DELETE FROM password_resets WHERE id = $1 RETURNING id, user_id, expires_at", id).Scan(&reset.ID, &reset.UserID, &expiresAt)
+	if err != nil {
+		if err == sql.ErrNoRows {
+			return nil, fmt.Errorf("password reset %s %w", id, types.ErrNotFound)
+		}
+		return nil, postgresError(err)
+	}
+	reset.ExpiresAt = expiresAt.Unix()
+	if reset.Expired(time.Now()) {
+		return nil, fmt.Errorf("password reset %s %w", id, types.ErrNotFound)
+	}
+	return reset, nil
+}
+
+// DeleteUserPasswordResets deletes every pending password reset of a user
+func (s *PostgresStorage) DeleteUserPasswordResets(ctx context.Context, userID string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, "DELETE FROM password_resets WHERE user_id = $1", userID)
+	return postgresError(err)
+}
+
+// DeleteExpiredPasswordResets deletes the expired password resets and
+// returns how many were deleted
+func (s *PostgresStorage) DeleteExpiredPasswordResets(ctx context.Context) (int64, error) {
+	res, err := s.db.ExecContext(ctx, "DELETE FROM password_resets WHERE expires_at <= (now() AT TIME ZONE 'UTC')")
+	if err != nil {
+		return 0, postgresError(err)
+	}
+	n, err := res.RowsAffected()
+	if err != nil {
+		return 0, postgresError(err)
+	}
+	return n, nil
+}
+
+// outboxColumns are the columns of the outbox table, in the order scanned
+// by scanOutboxEntry
+const outboxColumns = "id, entity_type, entity_id, name, password_changed, attempts, last_error, created_at, next_attempt_at"
+
+// insertOutboxEntry is the statement inserting an outbox entry, with the
+// values returned by outboxEntryValues
+const insertOutboxEntry = "INSERT INTO outbox(" + outboxColumns + ") VALUES($1, $2, $3, $4, $5, $6, $7, $8, $9)"
+
+// outboxEntryValues returns the values of the columns of an outbox entry
+func outboxEntryValues(entry *types.OutboxEntry) []interface{} {
+	return []interface{}{entry.ID, entry.EntityType, entry.EntityID, entry.Name, entry.PasswordChanged,
+		entry.Attempts, entry.LastError, unixTime(entry.CreatedAt), unixTime(entry.NextAttemptAt)}
+}
+
+// addOutboxEntries adds the outbox entries of a change in the transaction
+// making it
+func addOutboxEntries(ctx context.Context, tx *sql.Tx, entries []*types.OutboxEntry) error {
+	for _, entry := range entries {
+		if _, err := tx.ExecContext(ctx, insertOutboxEntry, outboxEntryValues(entry)...); err != nil {
+			return postgresError(err)
+		}
+	}
+	return nil
+}
+
+// AddOutboxEntry adds an entry to the outbox
+func (s *PostgresStorage) AddOutboxEntry(ctx context.Context, entry *types.OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	_, err := s.db.ExecContext(ctx, insertOutboxEntry, outboxEntryValues(entry)...)
+	if err != nil {
+		if isPrimaryKeyViolation(err) {
+			return fmt.Errorf("outbox entry %s %w", entry.ID, types.ErrAlreadyExists)
+		}
+		return postgresError(err)
+	}
+	return nil
+}
+
+// GetDueOutboxEntries returns at most limit outbox entries due at the
+// given Unix time
+func (s *PostgresStorage) GetDueOutboxEntries(ctx context.Context, now int64, limit int) ([]*types.OutboxEntry, error) {
+	return s.queryOutboxEntries(ctx, "SELECT "+outboxColumns+" FROM outbox WHERE next_attempt_at <= $1 ORDER BY next_attempt_at, created_at, id COLLATE \"C\" LIMIT $2", unixTime(now), limit)
+}
+
+// claimOutboxEntriesQuery moves the next attempt of at most $3 entries
+// due at $1 to $2, and returns them in the order they were due. Rows
+// locked by a concurrent claim are skipped rather than waited for.
+const claimOutboxEntriesQuery = `
+WITH due AS (
+	SELECT id, next_attempt_at FROM outbox WHERE next_attempt_at <= $1
+	ORDER BY next_attempt_at, created_at, id COLLATE "C" LIMIT $3
+	FOR UPDATE SKIP LOCKED
+), claimed AS (
+	UPDATE outbox SET next_attempt_at = $2 FROM due WHERE outbox.id = due.id
+	RETURNING outbox.*, due.next_attempt_at AS due_at
+)
+SELECT ` + outboxColumns + ` FROM claimed ORDER BY due_at, created_at, id COLLATE "C"`
+
+// ClaimOutboxEntries returns at most limit outbox entries due at the given
+// Unix time, moving their next attempt to until
+func (s *PostgresStorage) ClaimOutboxEntries(ctx context.Context, now int64, until int64, limit int) ([]*types.OutboxEntry, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	return s.queryOutboxEntries(ctx, claimOutboxEntriesQuery, unixTime(now), unixTime(until), limit)
+}
+
+// queryOutboxEntries returns the outbox entries selected by a query
+func (s *PostgresStorage) queryOutboxEntries(ctx context.Context, query string, args ...interface{}) ([]*types.OutboxEntry, error) {
+	rows, err := s.db.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, postgresError(err)
+	}
+	defer rows.Close()
+
+	var entries []*types.OutboxEntry
+	for rows.Next() {
+		entry, err := scanOutboxEntry(rows)
+		if err != nil {
+			return nil, postgresError(err)
+		}
+		entries = append(entries, entry)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, postgresError(err)
+	}
+	return entries, nil
+}
+
+// UpdateOutboxEntry updates an outbox entry
+func (s *PostgresStorage) UpdateOutboxEntry(ctx context.Context, entry *types.OutboxEntry) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stmt, err := s.db.PrepareContext(ctx, "UPDATE outbox SET entity_type = $2, entity_id = $3, name = $4, password_changed = $5, attempts = $6, last_error = $7, created_at = $8, next_attempt_at = $9 WHERE id = $1")
+	if err != nil {
+		return postgresError(err)
+	}
+	res, err := stmt.ExecContext(ctx, entry.ID, entry.EntityType, entry.EntityID, entry.Name, entry.PasswordChanged,
+		entry.Attempts, entry.LastError, unixTime(entry.CreatedAt), unixTime(entry.NextAttemptAt))
+	if err != nil {
+		return postgresError(err)
+	}
+	return expectRowsAffected(res, fmt.Errorf("outbox entry %s %w", entry.ID, types.ErrNotFound))
+}
+
+// DeleteOutboxEntry deletes an outbox entry
+func (s *PostgresStorage) DeleteOutboxEntry(ctx context.Context, id string) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	stmt, err := s.db.PrepareContext(ctx, "DELETE FROM outbox WHERE id = $1")
+	if err != nil {
+		return postgresError(err)
+	}
+	res, err := stmt.ExecContext(ctx, id)
+	if err != nil {
+		return postgresError(err)
+	}
+	return expectRowsAffected(res, fmt.Errorf("outbox entry %s %w", id, types.ErrNotFound))
+}
+
+// CountOutboxEntries returns the number of outbox entries
+func (s *PostgresStorage) CountOutboxEntries(ctx context.Context) (int, error) {
+	var n int
+	if err := s.db.QueryRowContext(ctx, "SELECT count(*) FROM outbox").Scan(&n); err != nil {
+		return 0, postgresError(err)
+	}
+	return n, nil
+}
+
+// unixTime returns a Unix time in seconds as stored in TIMESTAMP columns,
+// which hold UTC times
+func unixTime(t int64) time.Time {
+	return time.Unix(t, 0).UTC()
+}
+
+// scanOutboxEntry scans an outbox row
+func scanOutboxEntry(row rowScanner) (*types.OutboxEntry, error) {
+	entry := &types.OutboxEntry{}
+	var createdAt, nextAttemptAt time.Time
+	err := row.Scan(&entry.ID, &entry.EntityType, &entry.EntityID, &entry.Name, &entry.PasswordChanged,
+		&entry.Attempts, &entry.LastError, &createdAt, &nextAttemptAt)
+	if err != nil {
+		return nil, err
+	}
+	entry.CreatedAt = createdAt.Unix()
+	entry.NextAttemptAt = nextAttemptAt.Unix()
+	return entry, nil
+}
+
+// postgresError wraps errors returned by the database driver with the
+// matching error of the types package
+func postgresError(err error) error {
+	if err == nil {
+		return nil
+	}
+
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
 		return err
 	}
+
+	var pgErr *pq.Error
+	if errors.As(err, &pgErr) {
+		if pgErr.Code.Name() == "query_canceled" {
+			// Cancelled at the deadline of the context or by statement_timeout
+			return fmt.Errorf("%w: %v", context.DeadlineExceeded, pgErr.Message)
+		}
+		switch pgErr.Code.Class() {
+		case "23":
+			// Integrity constraint violation
+			return fmt.Errorf("%w: %v", types.ErrConflict, pgErr.Message)
+		case "08", "53", "57":
+			// Connection exception, insufficient resources or operator intervention
+			return fmt.Errorf("%w: %v", types.ErrBackendUnavailable, err)
+		}
+		return err
+	}
+
+	var netErr net.Error
+	if errors.Is(err, driver.ErrBadConn) || errors.Is(err, sql.ErrConnDone) || errors.Is(err, io.EOF) || errors.As(err, &netErr) {
+		return fmt.Errorf("%w: %v", types.ErrBackendUnavailable, err)
+	}
+	if err.Error() == "sql: database is closed" {
+		return fmt.Errorf("%w: %v", types.ErrBackendUnavailable, err)
+	}
+
+	return err
+}
+
+// isPrimaryKeyViolation reports whether the error is a unique violation
+// of a primary key constraint
+func isPrimaryKeyViolation(err error) bool {
+	var pgErr *pq.Error
+	if !errors.As(err, &pgErr) {
+		return false
+	}
+	return pgErr.Code.Name() == "unique_violation" && strings.HasSuffix(pgErr.Constraint, "_pkey")
+}
+
+// isForeignKeyViolation reports whether the error is a foreign key
+// violation
+func isForeignKeyViolation(err error) bool {
+	var pgErr *pq.Error
+	return errors.As(err, &pgErr) && pgErr.Code.Name() == "foreign_key_violation"
+}
+
+// expectRowsAffected returns notFound if the statement did not affect any row
+func expectRowsAffected(res sql.Result, notFound error) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return postgresError(err)
+	}
+	if n == 0 {
+		return notFound
+	}
 	return nil
 }
 
-// Close closes the database connection
+// Close stops the session reaper and closes the database connection
 func (s *PostgresStorage) Close() error {
+	s.closeOnce.Do(func() {
+		close(s.stop)
+	})
+	<-s.stopped
+
 	s.mu.Lock()
 	defer s.mu.Unlock()
 
@@ -525,8 +1475,124 @@ func (s *PostgresStorage) Close() error {
 	if err != nil {
 		// Check if the connection is already closed
 		if err.Error() != "sql: database is closed" {
-			return err
+			return postgresError(err)
 		}
 	}
 	return nil
 }
+
+// posixIDLockKey is the key of the PostgreSQL advisory lock held by
+// transactions allocating POSIX numbers, so that concurrent allocations
+// cannot pick the same number
+const posixIDLockKey int64 = 0x63756d02
+
+// allocatePosixIDQuery returns the lowest free number of an entity type
+// from the number following the highest one allocated in the range
+// [$2, $3], reserved numbers aside. The candidates are that number and
+// the ones following the numbers taken above it. The result is above $3
+// when the range is exhausted.
+const allocatePosixIDQuery = `
+WITH start AS (
+	SELECT COALESCE(MAX(number) + 1, $2) AS number FROM posix_ids
+	WHERE entity_type = $1 AND NOT reserved AND number BETWEEN $2 AND $3
+)
+SELECT MIN(candidate) FROM (
+	SELECT number AS candidate FROM start
+	UNION ALL
+	SELECT posix_ids.number + 1 FROM posix_ids, start
+	WHERE posix_ids.entity_type = $1 AND posix_ids.number >= start.number
+) candidates
+WHERE NOT EXISTS (SELECT 1 FROM posix_ids WHERE entity_type = $1 AND number = candidate)`
+
+// AllocatePosixID returns the POSIX number of a user or group, allocating
+// one from the range [min, max] if it has none
+func (s *PostgresStorage) AllocatePosixID(ctx context.Context, entityType string, entityID string, min int64, max int64) (int64, error) {
+	if entityType != "user" && entityType != "group" {
+		return 0, fmt.Errorf("%w: unknown entity type %q", types.ErrInvalidArgument, entityType)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return 0, postgresError(err)
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", posixIDLockKey); err != nil {
+		tx.Rollback()
+		return 0, postgresError(err)
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx, "SELECT number FROM posix_ids WHERE entity_type = $1 AND entity_id = $2", entityType, entityID).Scan(&id)
+	if err == nil {
+		tx.Rollback()
+		return id, nil
+	}
+	if err != sql.ErrNoRows {
+		tx.Rollback()
+		return 0, postgresError(err)
+	}
+
+	err = tx.QueryRowContext(ctx, allocatePosixIDQuery, entityType, min, max).Scan(&id)
+	if err != nil {
+		tx.Rollback()
+		return 0, postgresError(err)
+	}
+	if id > max {
+		tx.Rollback()
+		return 0, fmt.Errorf("%w: no %s number left in the range %d-%d", types.ErrConflict, entityType, min, max)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO posix_ids(entity_type, entity_id, number) VALUES($1, $2, $3)", entityType, entityID, id); err != nil {
+		tx.Rollback()
+		return 0, postgresError(err)
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, postgresError(err)
+	}
+	return id, nil
+}
+
+// ReservePosixID records a number used in LDAP by a user, group or other
+// LDAP entry, so that it is never allocated to another one
+func (s *PostgresStorage) ReservePosixID(ctx context.Context, entityType string, entityID string, number int64) error {
+	if entityType != "user" && entityType != "group" {
+		return fmt.Errorf("%w: unknown entity type %q", types.ErrInvalidArgument, entityType)
+	}
+
+	tx, err := s.db.BeginTx(ctx, nil)
+	if err != nil {
+		return postgresError(err)
+	}
+	if _, err := tx.ExecContext(ctx, "SELECT pg_advisory_xact_lock($1)", posixIDLockKey); err != nil {
+		tx.Rollback()
+		return postgresError(err)
+	}
+
+	var id int64
+	err = tx.QueryRowContext(ctx, "SELECT number FROM posix_ids WHERE entity_type = $1 AND entity_id = $2", entityType, entityID).Scan(&id)
+	if err == nil {
+		tx.Rollback()
+		if id == number {
+			return nil
+		}
+		return posixIDConflict(entityType, entityID, id, number)
+	}
+	if err != sql.ErrNoRows {
+		tx.Rollback()
+		return postgresError(err)
+	}
+
+	var other string
+	err = tx.QueryRowContext(ctx, "SELECT entity_id FROM posix_ids WHERE entity_type = $1 AND number = $2", entityType, number).Scan(&other)
+	if err == nil {
+		tx.Rollback()
+		return posixIDTaken(entityType, number, other)
+	}
+	if err != sql.ErrNoRows {
+		tx.Rollback()
+		return postgresError(err)
+	}
+	if _, err := tx.ExecContext(ctx, "INSERT INTO posix_ids(entity_type, entity_id, number, reserved) VALUES($1, $2, $3, TRUE)", entityType, entityID, number); err != nil {
+		tx.Rollback()
+		return postgresError(err)
+	}
+	return postgresError(tx.Commit())
+}
@@ -1,17 +1,472 @@
 package storage
 
 import (
+	"context"
 	"cum/types"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"math"
+	"net"
+	"sort"
+	"strconv"
+	"strings"
 	"sync"
+	"time"
 
-	"github.com/go-redis/redis"
+	"github.com/go-redis/redis/v8"
 )
 
+// Keys used by the RedisStorage:
+//
+//	user:<id>                      JSON encoded user
+//	group:<id>                     JSON encoded group, without its members
+//	session:<id>                   JSON encoded session
+//	password_reset:<id>            JSON encoded password reset
+//	index:session:user:<user id>   sorted set of the IDs of the sessions of a user, scored by expiry time
+//	index:password_reset:user:<user id> sorted set of the IDs of the password resets of a user, scored by expiry time
+//	members:<group id>             set of the keys (user:<id> or group:<id>) of the group members
+//	memberof:<member key>          set of the IDs of the groups user:<id> or group:<id> is a member of
+//	index:user:username:<username> ID of the user with the username
+//	index:user:email:<email>       ID of the user with the email
+//	index:group:name:<name>        ID of the group with the name
+//	index:group:owner:<owner key>  set of the IDs of the groups owned by user:<id> or group:<id>
+//	sort:user:<field>              lexicographically sorted set of <field value>\x00<ID> of all users, per sort field
+//	sort:group:<field>             lexicographically sorted set of <field value>\x00<ID> of all groups, per sort field
+//	index:version                  version of the secondary indexes, see migrateIndexes
+//	outbox:<id>                    JSON encoded outbox entry
+//	outbox:due                     sorted set of <created at>:<ID> of all outbox entries, scored by next attempt time
+//	posix:user, posix:group        sorted set of the IDs of the users or groups with a POSIX number, scored by the number
+//	posix:reserved:user, posix:reserved:group set of the IDs of the users or groups whose number was reserved rather than allocated
+const (
+	redisUserPrefix            = "user:"
+	redisGroupPrefix           = "group:"
+	redisSessionPrefix         = "session:"
+	redisPasswordResetPrefix   = "password_reset:"
+	redisMembersPrefix         = "members:"
+	redisMemberOfPrefix        = "memberof:"
+	redisUsernameIndexPrefix   = "index:user:username:"
+	redisEmailIndexPrefix      = "index:user:email:"
+	redisGroupNameIndexPrefix  = "index:group:name:"
+	redisGroupOwnerIndexPrefix = "index:group:owner:"
+	redisUserSessionsPrefix    = "index:session:user:"
+	redisUserResetsPrefix      = "index:password_reset:user:"
+	redisUserSortPrefix        = "sort:user:"
+	redisGroupSortPrefix       = "sort:group:"
+	redisIndexVersionKey       = "index:version"
+	redisOutboxPrefix          = "outbox:"
+	redisOutboxDueKey          = "outbox:due"
+	redisPosixPrefix           = "posix:"
+	redisPosixReservedPrefix   = "posix:reserved:"
+)
+
+// redisIndexVersion is the current version of the secondary indexes
+const redisIndexVersion = 3
+
+// redisChangeScript returns a script changing users, groups or their
+// memberships with the given body, which returns an error reply to refuse
+// the change. The outbox entries of the change, see
+// redisOutboxArgs, are added by the script once the body succeeds, and
+// their keys and arguments are removed from KEYS and ARGV before the body
+// runs, so that it sees the layout it documents.
+//
+//	KEYS[..]    keys of the e outbox entries, then outbox:due if e > 0
+//	ARGV[..]    triples of JSON encoded outbox entry, next attempt time
+//	            and member in outbox:due, then e
+func redisChangeScript(body string) *redis.Script {
+	return redis.NewScript(`
+local outbox = {}
+local outbox_due
+local e = tonumber(table.remove(ARGV))
+if e > 0 then
+	outbox_due = table.remove(KEYS)
+	for i = e, 1, -1 do
+		local member, score, data = table.remove(ARGV), table.remove(ARGV), table.remove(ARGV)
+		outbox[i] = {key = table.remove(KEYS), data = data, score = score, member = member}
+	end
+end
+
+local function change()
+` + body + `
+end
+
+local result = change()
+if type(result) == 'table' and result.err then
+	return result
+end
+for _, entry in ipairs(outbox) do
+	redis.call('SET', entry.key, entry.data)
+	redis.call('ZADD', outbox_due, entry.score, entry.member)
+end
+return result
+`)
+}
+
+// redisOutboxArgs appends the keys and arguments of the given outbox
+// entries of a change to those of a script returned by redisChangeScript
+func redisOutboxArgs(entries []*types.OutboxEntry, keys []string, args []interface{}) ([]string, []interface{}, error) {
+	for _, entry := range entries {
+		data, err := encodeRedisOutboxEntry(entry)
+		if err != nil {
+			return nil, nil, err
+		}
+		keys = append(keys, redisOutboxPrefix+entry.ID)
+		args = append(args, data, entry.NextAttemptAt, redisOutboxMember(entry.CreatedAt, entry.ID))
+	}
+	if len(entries) > 0 {
+		keys = append(keys, redisOutboxDueKey)
+	}
+	return keys, append(args, len(entries)), nil
+}
+
+// redisSaveScript creates or updates an entity together with its secondary
+// indexes and, optionally, replaces a set owned by the entity together with
+// its reverse index. The keys referenced by the entity, such as the members
+// and owner of a group, must exist. A "unique" index maps a value to the ID of the only
+// entity having it, while a "set" index maps a value to the set of the IDs
+// of all entities having it. A "sorted" index is a single sorted set of
+// <value>\x00<ID> members with equal scores, ordering all entities by value
+// and then by ID. Every key the script touches is passed in KEYS, so the
+// caller reads the current entity and set beforehand, in a transaction
+// watching them.
+//
+//	KEYS[1]            entity key
+//	KEYS[2..n+1]       new index keys, empty when the indexed value is empty,
+//	                   or the sorted set of a "sorted" index
+//	KEYS[n+2..2n+1]    current index keys, empty when the entity or its
+//	                   indexed value is missing, or the same sorted sets
+//	KEYS[2n+2]         optional set to replace
+//	KEYS[2n+3..2n+2+c] reverse index keys of the c current members of the set
+//	KEYS[2n+3+c..]     reverse index keys of the a new members of the set,
+//	                   which map every member to the set of entity IDs
+//	KEYS[2n+3+c+a..]   keys that must exist, other than the entity key
+//	ARGV[1]            "create" or "update"
+//	ARGV[2]            entity ID
+//	ARGV[3]            JSON encoded entity
+//	ARGV[4]            n, the number of indexes
+//	ARGV[5..4+2n]      pairs of index kind ("unique", "set" or "sorted") and
+//	                   indexed JSON field
+//	ARGV[5+2n]         c, with a set to replace
+//	ARGV[6+2n]         a, with a set to replace
+//	ARGV[7+2n..]       new members of the set
+var redisSaveScript = redisChangeScript(`
+local current = redis.call('GET', KEYS[1])
+if ARGV[1] == 'create' and current then
+	return redis.error_reply('EXISTS')
+end
+if ARGV[1] == 'update' and not current then
+	return redis.error_reply('NOTFOUND')
+end
+
+local n = tonumber(ARGV[4])
+local set = 2 * n + 2
+local removed, added = 0, 0
+if #KEYS >= set then
+	removed = tonumber(ARGV[5 + 2 * n])
+	added = tonumber(ARGV[6 + 2 * n])
+end
+for i = set + removed + added + 1, #KEYS do
+	if KEYS[i] ~= KEYS[1] and redis.call('EXISTS', KEYS[i]) == 0 then
+		return redis.error_reply('NOTFOUND ' .. KEYS[i])
+	end
+end
+for i = 1, n do
+	local key = KEYS[i + 1]
+	if ARGV[3 + 2 * i] == 'unique' and key ~= '' then
+		local owner = redis.call('GET', key)
+		if owner and owner ~= ARGV[2] then
+			return redis.error_reply('CONFLICT ' .. ARGV[4 + 2 * i])
+		end
+	end
+end
+
+if current then
+	local old = cjson.decode(current)
+	for i = 1, n do
+		local key = KEYS[n + 1 + i]
+		if ARGV[3 + 2 * i] == 'sorted' then
+			redis.call('ZREM', key, (old[ARGV[4 + 2 * i]] or '') .. '\0' .. ARGV[2])
+		elseif key ~= '' and key ~= KEYS[i + 1] then
+			if ARGV[3 + 2 * i] == 'set' then
+				redis.call('SREM', key, ARGV[2])
+			elseif redis.call('GET', key) == ARGV[2] then
+				redis.call('DEL', key)
+			end
+		end
+	end
+end
+
+redis.call('SET', KEYS[1], ARGV[3])
+local new = cjson.decode(ARGV[3])
+for i = 1, n do
+	local key = KEYS[i + 1]
+	if ARGV[3 + 2 * i] == 'sorted' then
+		redis.call('ZADD', key, 0, (new[ARGV[4 + 2 * i]] or '') .. '\0' .. ARGV[2])
+	elseif key ~= '' then
+		if ARGV[3 + 2 * i] == 'set' then
+			redis.call('SADD', key, ARGV[2])
+		else
+			redis.call('SET', key, ARGV[2])
+		end
+	end
+end
+
+if #KEYS >= set then
+	for i = set + 1, set + removed do
+		redis.call('SREM', KEYS[i], ARGV[2])
+	end
+	redis.call('DEL', KEYS[set])
+	for i = 1, added do
+		redis.call('SADD', KEYS[set], ARGV[6 + 2 * n + i])
+		redis.call('SADD', KEYS[set + removed + i], ARGV[2])
+	end
+end
+
+return 'OK'
+`)
+
+// redisDeleteScript deletes a user or group together with its secondary
+// indexes and the keys it owns. With the "restrict" policy, it refuses to
+// delete an entity that is still a member or the owner of another group,
+// otherwise it removes its memberships and clears its ownerships. As with
+// redisSaveScript, the caller reads the related keys in a transaction
+// watching them.
+//
+//	KEYS[1]          entity key
+//	KEYS[2]          set of the IDs of the groups the entity is a member of
+//	KEYS[3]          set of the IDs of the groups the entity owns
+//	KEYS[4..3+p]     members sets of the p groups the entity is a member of
+//	KEYS[4+p..]      keys of the o groups the entity owns
+//	KEYS[4+p+o..]    reverse index keys of the q members of the entity
+//	KEYS[4+p+o+q..]  current keys of the n indexes, as in redisSaveScript
+//	KEYS[4+p+o+q+n]  optional members set of the entity
+//	ARGV[1]          entity ID
+//	ARGV[2]          member key of the entity
+//	ARGV[3]          "cascade" or "restrict"
+//	ARGV[4]          "user" or "group"
+//	ARGV[5..8]       p, o, q and n
+//	ARGV[9..8+2n]    pairs of index kind and indexed JSON field
+//	ARGV[9+2n..]     IDs of the p groups the entity is a member of, then of
+//	                 the o groups it owns
+var redisDeleteScript = redisChangeScript(`
+local current = redis.call('GET', KEYS[1])
+if not current then
+	return redis.error_reply('NOTFOUND')
+end
+
+local p, o, q, n = tonumber(ARGV[5]), tonumber(ARGV[6]), tonumber(ARGV[7]), tonumber(ARGV[8])
+local function is_self(id)
+	return ARGV[4] == 'group' and id == ARGV[1]
+end
+
+if ARGV[3] == 'restrict' then
+	for i = 1, p do
+		local id = ARGV[8 + 2 * n + i]
+		if not is_self(id) then
+			return redis.error_reply('MEMBER ' .. id)
+		end
+	end
+	for i = 1, o do
+		local id = ARGV[8 + 2 * n + p + i]
+		if not is_self(id) then
+			return redis.error_reply('OWNER ' .. id)
+		end
+	end
+end
+
+for i = 1, p do
+	redis.call('SREM', KEYS[3 + i], ARGV[2])
+end
+for i = 1, o do
+	local key = KEYS[3 + p + i]
+	local data = redis.call('GET', key)
+	if data then
+		local group = cjson.decode(data)
+		group['owner'] = nil
+		redis.call('SET', key, cjson.encode(group))
+	end
+end
+for i = 1, q do
+	redis.call('SREM', KEYS[3 + p + o + i], ARGV[1])
+end
+
+local old = cjson.decode(current)
+for i = 1, n do
+	local key = KEYS[3 + p + o + q + i]
+	if ARGV[7 + 2 * i] == 'sorted' then
+		redis.call('ZREM', key, (old[ARGV[8 + 2 * i]] or '') .. '\0' .. ARGV[1])
+	elseif key ~= '' then
+		if ARGV[7 + 2 * i] == 'set' then
+			redis.call('SREM', key, ARGV[1])
+		elseif redis.call('GET', key) == ARGV[1] then
+			redis.call('DEL', key)
+		end
+	end
+end
+
+redis.call('DEL', KEYS[1], KEYS[2], KEYS[3])
+if #KEYS > 3 + p + o + q + n then
+	redis.call('DEL', KEYS[#KEYS])
+end
+return 'OK'
+`)
+
+// redisAddMemberScript adds a member to a group.
+//
+//	KEYS[1]  group key
+//	KEYS[2]  members set of the group
+//	KEYS[3]  member key
+//	KEYS[4]  set of the IDs of the groups the member is a member of
+//	ARGV[1]  group ID
+var redisAddMemberScript = redisChangeScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('NOTFOUND group')
+end
+if redis.call('EXISTS', KEYS[3]) == 0 then
+	return redis.error_reply('NOTFOUND member')
+end
+if redis.call('SADD', KEYS[2], KEYS[3]) == 0 then
+	return redis.error_reply('EXISTS')
+end
+redis.call('SADD', KEYS[4], ARGV[1])
+return 'OK'
+`)
+
+// redisRemoveMemberScript removes a member from a group.
+//
+//	KEYS[1]  group key
+//	KEYS[2]  members set of the group
+//	KEYS[3]  set of the IDs of the groups the member is a member of
+//	ARGV[1]  member key
+//	ARGV[2]  group ID
+var redisRemoveMemberScript = redisChangeScript(`
+if redis.call('EXISTS', KEYS[1]) == 0 then
+	return redis.error_reply('NOTFOUND group')
+end
+if redis.call('SREM', KEYS[2], ARGV[1]) == 0 then
+	return redis.error_reply('NOTFOUND member')
+end
+redis.call('SREM', KEYS[3], ARGV[2])
+return 'OK'
+`)
+
+// redisSetSessionScript stores a session or a password reset that expires
+// at the given time, and indexes it by user. Sessions expiring in the past
+// are removed by Redis right away, and the expired ones are dropped from
+// the index of the user.
+//
+//	KEYS[1]  session key
+//	KEYS[2]  index of the sessions of its user
+//	KEYS[3]  index of the sessions of its previous user, when it changes
+//	ARGV[1]  JSON encoded session
+//	ARGV[2]  "NX" to create or "XX" to update the session
+//	ARGV[3]  expiry time in Unix milliseconds, 0 if the session never expires
+//	ARGV[4]  session ID
+//	ARGV[5]  current time in Unix milliseconds
+var redisSetSessionScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], ARGV[1], ARGV[2]) then
+	return 0
+end
+local score = '+inf'
+if ARGV[3] ~= '0' then
+	redis.call('PEXPIREAT', KEYS[1], ARGV[3])
+	score = ARGV[3]
+end
+if KEYS[3] then
+	redis.call('ZREM', KEYS[3], ARGV[4])
+end
+redis.call('ZREMRANGEBYSCORE', KEYS[2], '-inf', '(' .. ARGV[5])
+redis.call('ZADD', KEYS[2], score, ARGV[4])
+return 1
+`)
+
+// redisSetOutboxScript stores an outbox entry and schedules it at its next
+// attempt time
+//
+//	KEYS[1]  outbox entry key
+//	KEYS[2]  outbox:due
+//	ARGV[1]  JSON encoded outbox entry
+//	ARGV[2]  "NX" to create or "XX" to update the entry
+//	ARGV[3]  next attempt time in Unix seconds
+//	ARGV[4]  member of the entry in outbox:due
+var redisSetOutboxScript = redis.NewScript(`
+if not redis.call('SET', KEYS[1], ARGV[1], ARGV[2]) then
+	return 0
+end
+redis.call('ZADD', KEYS[2], ARGV[3], ARGV[4])
+return 1
+`)
+
+// redisAllocatePosixIDScript returns the POSIX number of an entity,
+// allocating the lowest free number above the highest one allocated in the
+// range if it has none. Reserved numbers are skipped but do not move the
+// allocation. It returns -1 when the range is exhausted.
+//
+//	KEYS[1]  posix:user or posix:group
+//	KEYS[2]  posix:reserved:user or posix:reserved:group
+//	ARGV[1]  entity ID
+//	ARGV[2]  lowest number of the range
+//	ARGV[3]  highest number of the range
+var redisAllocatePosixIDScript = redis.NewScript(`
+local current = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if current then
+	return tonumber(current)
+end
+local next = tonumber(ARGV[2])
+local offset = 0
+repeat
+	local highest = redis.call('ZREVRANGEBYSCORE', KEYS[1], ARGV[3], ARGV[2], 'WITHSCORES', 'LIMIT', offset, 100)
+	for i = 1, #highest, 2 do
+		if redis.call('SISMEMBER', KEYS[2], highest[i]) == 0 then
+			next = tonumber(highest[i + 1]) + 1
+			highest = {}
+			break
+		end
+	end
+	offset = offset + 100
+until #highest == 0
+while next <= tonumber(ARGV[3]) and redis.call('ZCOUNT', KEYS[1], next, next) > 0 do
+	next = next + 1
+end
+if next > tonumber(ARGV[3]) then
+	return -1
+end
+redis.call('ZADD', KEYS[1], next, ARGV[1])
+return next
+`)
+
+// redisReservePosixIDScript records a number used by an entity. It returns
+// {"ok"}, {"has", current number} when the entity has another number, or
+// {"taken", entity ID} when the number is taken by another entity.
+//
+//	KEYS[1]  posix:user or posix:group
+//	KEYS[2]  posix:reserved:user or posix:reserved:group
+//	ARGV[1]  entity ID
+//	ARGV[2]  number
+var redisReservePosixIDScript = redis.NewScript(`
+local current = redis.call('ZSCORE', KEYS[1], ARGV[1])
+if current then
+	if tonumber(current) == tonumber(ARGV[2]) then
+		return {'ok'}
+	end
+	return {'has', current}
+end
+local other = redis.call('ZRANGEBYSCORE', KEYS[1], ARGV[2], ARGV[2], 'LIMIT', 0, 1)
+if #other > 0 then
+	return {'taken', other[1]}
+end
+redis.call('ZADD', KEYS[1], ARGV[2], ARGV[1])
+redis.call('SADD', KEYS[2], ARGV[1])
+return {'ok'}
+`)
+
 // RedisStorage is a storage backend that uses Redis as a backend
 type RedisStorage struct {
-	client *redis.Client
-	mu     sync.Mutex
+	client          *redis.Client
+	deletePolicy    DeletePolicy
+	maxNestingDepth int
+	mu              sync.Mutex
 }
 
 // RedisStorageConfig is the configuration for the RedisStorage
@@ -20,19 +475,229 @@ type RedisStorageConfig struct {
 	Port     int
 	Password string
 	DB       int
+	// DeletePolicy defines what happens to the memberships and ownerships
+	// of deleted users and groups. It defaults to DeleteCascade.
+	DeletePolicy DeletePolicy
+	// MaxNestingDepth is the maximum number of levels of nested groups. It
+	// defaults to DefaultMaxNestingDepth.
+	MaxNestingDepth int
+}
+
+// redisUser is the representation of a user stored in Redis
+type redisUser struct {
+	ID       string `json:"id"`
+	Username string `json:"username"`
+	Email    string `json:"email"`
+	Password string `json:"password"`
+	// MustChangePassword is omitted when false, as in users stored before
+	// it existed
+	MustChangePassword bool `json:"must_change_password,omitempty"`
+}
+
+// redisGroup is the representation of a group stored in Redis. Members
+// are stored in a separate set.
+type redisGroup struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// Owner is the key (user:<id> or group:<id>) of the owner of the group
+	Owner string `json:"owner,omitempty"`
+}
+
+// redisSession is the representation of a session stored in Redis
+type redisSession struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// redisPasswordReset is the representation of a password reset stored in
+// Redis
+type redisPasswordReset struct {
+	ID        string `json:"id"`
+	UserID    string `json:"user_id"`
+	ExpiresAt int64  `json:"expires_at"`
+}
+
+// redisOutboxEntry is the representation of an outbox entry stored in Redis
+type redisOutboxEntry struct {
+	ID              string `json:"id"`
+	EntityType      string `json:"entity_type"`
+	EntityID        string `json:"entity_id"`
+	Name            string `json:"name"`
+	PasswordChanged bool   `json:"password_changed"`
+	Attempts        int    `json:"attempts"`
+	LastError       string `json:"last_error"`
+	CreatedAt       int64  `json:"created_at"`
+	NextAttemptAt   int64  `json:"next_attempt_at"`
 }
 
 // NewRedisStorage creates a new RedisStorage
-func NewRedisStorage(config *RedisStorageConfig) *RedisStorage {
+func NewRedisStorage(config *RedisStorageConfig) (*RedisStorage, error) {
 	client := redis.NewClient(&redis.Options{
 		Addr:     config.Host + ":" + fmt.Sprint(config.Port),
 		Password: config.Password,
 		DB:       config.DB,
 	})
 
-	return &RedisStorage{
-		client: client,
+	ctx := context.Background()
+	if err := client.Ping(ctx).Err(); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error connecting to redis: %w", redisError(err, nil))
+	}
+
+	r := &RedisStorage{
+		client:          client,
+		deletePolicy:    config.DeletePolicy,
+		maxNestingDepth: maxNestingDepth(config.MaxNestingDepth),
+	}
+	if r.deletePolicy == "" {
+		r.deletePolicy = DeleteCascade
+	}
+
+	if err := r.migrateIndexes(ctx); err != nil {
+		client.Close()
+		return nil, fmt.Errorf("error migrating redis indexes: %w", err)
+	}
+
+	return r, nil
+}
+
+// migrateIndexes builds the secondary indexes missing from data stored by
+// older versions and records the current index version
+func (r *RedisStorage) migrateIndexes(ctx context.Context) error {
+	version, err := r.client.Get(ctx, redisIndexVersionKey).Int()
+	if err != nil && err != redis.Nil {
+		return redisError(err, nil)
+	}
+	if version >= redisIndexVersion {
+		return nil
+	}
+	if version < 1 {
+		if err := r.migrateMemberOf(ctx); err != nil {
+			return err
+		}
+	}
+	if version < 2 {
+		if err := r.migrateSortIndexes(ctx); err != nil {
+			return err
+		}
+	}
+	if err := r.migrateUserSessionIndexes(ctx); err != nil {
+		return err
+	}
+
+	return redisError(r.client.Set(ctx, redisIndexVersionKey, redisIndexVersion, 0).Err(), nil)
+}
+
+// migrateMemberOf builds the memberof sets, added by index version 1
+func (r *RedisStorage) migrateMemberOf(ctx context.Context) error {
+	// Memberships of deleted users and groups are dropped on the way.
+	iter := r.client.Scan(ctx, 0, redisMembersPrefix+"*", 100).Iterator()
+	for iter.Next(ctx) {
+		groupID := strings.TrimPrefix(iter.Val(), redisMembersPrefix)
+		members, err := r.client.SMembers(ctx, iter.Val()).Result()
+		if err != nil {
+			return redisError(err, nil)
+		}
+		for _, member := range members {
+			exists, err := r.client.Exists(ctx, member).Result()
+			if err != nil {
+				return redisError(err, nil)
+			}
+			if exists == 0 {
+				err = r.client.SRem(ctx, iter.Val(), member).Err()
+			} else {
+				err = r.client.SAdd(ctx, redisMemberOfPrefix+member, groupID).Err()
+			}
+			if err != nil {
+				return redisError(err, nil)
+			}
+		}
+	}
+	return redisError(iter.Err(), nil)
+}
+
+// migrateSortIndexes builds the sorted indexes of the users and groups,
+// added by index version 2
+func (r *RedisStorage) migrateSortIndexes(ctx context.Context) error {
+	for _, entity := range []struct {
+		prefix     string
+		sortPrefix string
+		fields     []string
+	}{
+		{redisUserPrefix, redisUserSortPrefix, redisUserSortFields},
+		{redisGroupPrefix, redisGroupSortPrefix, redisGroupSortFields},
+	} {
+		iter := r.client.Scan(ctx, 0, entity.prefix+"*", 100).Iterator()
+		for iter.Next(ctx) {
+			data, err := r.client.Get(ctx, iter.Val()).Bytes()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return redisError(err, nil)
+			}
+
+			var stored map[string]interface{}
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return fmt.Errorf("error decoding %s: %v", iter.Val(), err)
+			}
+			id := strings.TrimPrefix(iter.Val(), entity.prefix)
+			for _, field := range entity.fields {
+				value, _ := stored[field].(string)
+				member := &redis.Z{Member: redisSortMember(value, id)}
+				if err := r.client.ZAdd(ctx, entity.sortPrefix+field, member).Err(); err != nil {
+					return redisError(err, nil)
+				}
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return redisError(err, nil)
+		}
+	}
+	return nil
+}
+
+// migrateUserSessionIndexes builds the indexes of the sessions and the
+// password resets of each user, added by index version 3
+func (r *RedisStorage) migrateUserSessionIndexes(ctx context.Context) error {
+	for _, entity := range []struct {
+		prefix      string
+		indexPrefix string
+	}{
+		{redisSessionPrefix, redisUserSessionsPrefix},
+		{redisPasswordResetPrefix, redisUserResetsPrefix},
+	} {
+		iter := r.client.Scan(ctx, 0, entity.prefix+"*", 100).Iterator()
+		for iter.Next(ctx) {
+			data, err := r.client.Get(ctx, iter.Val()).Bytes()
+			if err == redis.Nil {
+				continue
+			}
+			if err != nil {
+				return redisError(err, nil)
+			}
+
+			// Sessions and password resets are stored alike
+			var stored redisSession
+			if err := json.Unmarshal(data, &stored); err != nil {
+				return fmt.Errorf("error decoding %s: %v", iter.Val(), err)
+			}
+			score := math.Inf(1)
+			if stored.ExpiresAt != 0 {
+				score = float64(stored.ExpiresAt * 1000)
+			}
+			member := &redis.Z{Score: score, Member: stored.ID}
+			if err := r.client.ZAdd(ctx, entity.indexPrefix+stored.UserID, member).Err(); err != nil {
+				return redisError(err, nil)
+			}
+		}
+		if err := iter.Err(); err != nil {
+			return redisError(err, nil)
+		}
 	}
+	return nil
 }
 
 // NewUserStorage creates a new user storage
@@ -51,147 +716,1452 @@ func (r *RedisStorage) NewSessionStorage() (types.SessionStorage, error) {
 }
 
 // Get returns the value for a given key
-func (r *RedisStorage) Get(key string) (string, error) {
-	return r.client.Get(key).Result()
+func (r *RedisStorage) Get(ctx context.Context, key string) (string, error) {
+	return r.client.Get(ctx, key).Result()
+}
+
+// redisUserSortFields and redisGroupSortFields are the fields users and
+// groups can be listed by, each one having a sorted index
+var (
+	redisUserSortFields  = []string{"username", "email", "id"}
+	redisGroupSortFields = []string{"name", "id"}
+)
+
+// redisIndex is a secondary index of the users or groups, as maintained by
+// redisSaveScript and redisDeleteScript
+type redisIndex struct {
+	// kind is "unique", "set" or "sorted"
+	kind string
+	// field is the indexed JSON field
+	field string
+	// key is the key prefix of the index, or the sorted set of a "sorted"
+	// index
+	key string
+}
+
+// keyFor returns the index key of a value, empty when an empty value is
+// not indexed
+func (index redisIndex) keyFor(value string) string {
+	if index.kind == "sorted" {
+		return index.key
+	}
+	if value == "" {
+		return ""
+	}
+	return index.key + value
+}
+
+// redisSortIndexes returns the sorted indexes of the given fields
+func redisSortIndexes(prefix string, fields []string) []redisIndex {
+	indexes := make([]redisIndex, len(fields))
+	for i, field := range fields {
+		indexes[i] = redisIndex{kind: "sorted", field: field, key: prefix + field}
+	}
+	return indexes
+}
+
+// redisUserIndexes and redisGroupIndexes are the secondary indexes of the
+// users and groups
+var (
+	redisUserIndexes = append([]redisIndex{
+		{kind: "unique", field: "username", key: redisUsernameIndexPrefix},
+		{kind: "unique", field: "email", key: redisEmailIndexPrefix},
+	}, redisSortIndexes(redisUserSortPrefix, redisUserSortFields)...)
+	redisGroupIndexes = append([]redisIndex{
+		{kind: "unique", field: "name", key: redisGroupNameIndexPrefix},
+		{kind: "set", field: "owner", key: redisGroupOwnerIndexPrefix},
+	}, redisSortIndexes(redisGroupSortPrefix, redisGroupSortFields)...)
+)
+
+// redisIndexKeys returns the index keys of a JSON encoded entity, which
+// are all empty but the sorted sets when data is nil
+func redisIndexKeys(indexes []redisIndex, data []byte) ([]string, error) {
+	fields := make(map[string]interface{})
+	if data != nil {
+		if err := json.Unmarshal(data, &fields); err != nil {
+			return nil, fmt.Errorf("error decoding indexed entity: %v", err)
+		}
+	}
+
+	keys := make([]string, len(indexes))
+	for i, index := range indexes {
+		value, _ := fields[index.field].(string)
+		keys[i] = index.keyFor(value)
+	}
+	return keys, nil
+}
+
+// redisIndexArgs returns the index arguments of the save and delete scripts
+func redisIndexArgs(indexes []redisIndex) []interface{} {
+	args := make([]interface{}, 0, 2*len(indexes))
+	for _, index := range indexes {
+		args = append(args, index.kind, index.field)
+	}
+	return args
+}
+
+// redisMaxTxAttempts is the number of times a transaction is attempted
+// while other clients keep changing the keys it watches
+const redisMaxTxAttempts = 10
+
+// transaction runs fn in a transaction watching the given keys, and any key
+// fn watches itself, until no other client changed them before it completed
+func (r *RedisStorage) transaction(ctx context.Context, fn func(tx *redis.Tx) error, keys ...string) error {
+	for i := 0; i < redisMaxTxAttempts; i++ {
+		err := r.client.Watch(ctx, fn, keys...)
+		if err != redis.TxFailedErr {
+			return err
+		}
+	}
+	return fmt.Errorf("%w: the stored data kept changing, try again", types.ErrConflict)
+}
+
+// evalInTx runs a script returned by redisChangeScript, with the given
+// outbox entries of the change, in the MULTI/EXEC block of a transaction.
+// It returns redis.TxFailedErr, for transaction to retry, when a watched
+// key changed.
+func evalInTx(ctx context.Context, tx *redis.Tx, script *redis.Script, outbox []*types.OutboxEntry, keys []string, args ...interface{}) error {
+	keys, args, err := redisOutboxArgs(outbox, keys, args)
+	if err != nil {
+		return err
+	}
+	_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		script.Eval(ctx, pipe, keys, args...)
+		return nil
+	})
+	return err
+}
+
+// getInTx returns the value of a key read in a transaction, nil if it does
+// not exist
+func getInTx(ctx context.Context, tx *redis.Tx, key string) ([]byte, error) {
+	data, err := tx.Get(ctx, key).Bytes()
+	if err == redis.Nil {
+		return nil, nil
+	}
+	return data, redisError(err, nil)
+}
+
+// saveUser creates or updates a user
+func (r *RedisStorage) saveUser(ctx context.Context, mode string, user *types.User, outbox []*types.OutboxEntry) error {
+	data, err := json.Marshal(&redisUser{
+		ID:       user.ID,
+		Username: user.Username,
+		Email:    user.Email,
+		Password: user.Password,
+
+		MustChangePassword: user.MustChangePassword,
+	})
+	if err != nil {
+		return err
+	}
+	newKeys, err := redisIndexKeys(redisUserIndexes, data)
+	if err != nil {
+		return err
+	}
+
+	key := redisUserPrefix + user.ID
+	return r.transaction(ctx, func(tx *redis.Tx) error {
+		current, err := getInTx(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		currentKeys, err := redisIndexKeys(redisUserIndexes, current)
+		if err != nil {
+			return err
+		}
+
+		keys := append(append([]string{key}, newKeys...), currentKeys...)
+		args := append([]interface{}{mode, user.ID, data, len(redisUserIndexes)}, redisIndexArgs(redisUserIndexes)...)
+		err = evalInTx(ctx, tx, redisSaveScript, outbox, keys, args...)
+		return redisScriptError(err, "user "+user.ID)
+	}, key)
 }
 
 // CreateUser creates a new user
-func (r *RedisStorage) CreateUser(user *types.User) error {
+func (r *RedisStorage) CreateUser(ctx context.Context, user *types.User, outbox ...*types.OutboxEntry) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	return r.client.Set(user.ID, user, 0).Err()
+	return r.saveUser(ctx, "create", user, outbox)
 }
 
 // GetUserByEmail returns a user by its email
-func (r *RedisStorage) GetUserByEmail(email string) (*types.User, error) {
-	return nil, nil
+func (r *RedisStorage) GetUserByEmail(ctx context.Context, email string) (*types.User, error) {
+	id, err := r.client.Get(ctx, redisEmailIndexPrefix+email).Result()
+	if err != nil {
+		return nil, redisError(err, fmt.Errorf("user with email %s %w", email, types.ErrNotFound))
+	}
+	return r.GetUserByID(ctx, id)
 }
 
 // GetUserByID returns a user by its ID
-func (r *RedisStorage) GetUserByID(id string) (*types.User, error) {
-	user := &types.User{}
-	err := r.client.Get(id).Scan(user)
+func (r *RedisStorage) GetUserByID(ctx context.Context, id string) (*types.User, error) {
+	data, err := r.client.Get(ctx, redisUserPrefix+id).Bytes()
+	if err != nil {
+		return nil, redisError(err, fmt.Errorf("user %s %w", id, types.ErrNotFound))
+	}
+	return decodeRedisUser(id, data)
+}
+
+// decodeRedisUser decodes a user stored in Redis
+func decodeRedisUser(id string, data []byte) (*types.User, error) {
+	var stored redisUser
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("error decoding user %s: %v", id, err)
+	}
+
+	return &types.User{
+		ID:       stored.ID,
+		Username: stored.Username,
+		Email:    stored.Email,
+		Password: stored.Password,
+
+		MustChangePassword: stored.MustChangePassword,
+	}, nil
+}
+
+// ListUsers returns a page of users, read from the sorted index of the
+// sort field
+func (r *RedisStorage) ListUsers(ctx context.Context, options *types.UserListOptions) (*types.UserPage, error) {
+	params, err := userListParams(options)
+	if err != nil {
+		return nil, err
+	}
+
+	var prefix string
+	switch params.sortBy {
+	case "username":
+		prefix = options.UsernamePrefix
+	case "email":
+		prefix = options.EmailPrefix
+	}
+
+	users := []*types.User{}
+	err = r.scanSortIndex(ctx, redisUserSortPrefix+params.sortBy, params, prefix, func(ids []string) (bool, error) {
+		values, err := r.mget(ctx, redisUserPrefix, ids)
+		if err != nil {
+			return false, err
+		}
+		for i, data := range values {
+			if data == nil {
+				continue
+			}
+			user, err := decodeRedisUser(ids[i], data)
+			if err != nil {
+				return false, err
+			}
+			if matchUser(user, options) {
+				users = append(users, user)
+			}
+			if len(users) > params.limit {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
 	if err != nil {
 		return nil, err
 	}
 
-	return user, nil
+	return userPage(users, params), nil
 }
 
 // UpdateUser updates a user
-func (r *RedisStorage) UpdateUser(user *types.User) error {
+func (r *RedisStorage) UpdateUser(ctx context.Context, user *types.User, outbox ...*types.OutboxEntry) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	return r.client.Set(user.ID, user, 0).Err()
+	return r.saveUser(ctx, "update", user, outbox)
 }
 
 // GetUserByUsername returns a user by its username
-func (r *RedisStorage) GetUserByUsername(username string) (*types.User, error) {
-	return nil, nil
+func (r *RedisStorage) GetUserByUsername(ctx context.Context, username string) (*types.User, error) {
+	id, err := r.client.Get(ctx, redisUsernameIndexPrefix+username).Result()
+	if err != nil {
+		return nil, redisError(err, fmt.Errorf("user with username %s %w", username, types.ErrNotFound))
+	}
+	return r.GetUserByID(ctx, id)
 }
 
 // DeleteUser deletes a user
-func (r *RedisStorage) DeleteUser(user string) error {
+func (r *RedisStorage) DeleteUser(ctx context.Context, id string, outbox ...*types.OutboxEntry) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	return r.client.Del(user).Err()
+	err := r.deleteMember(ctx, &types.User{ID: id}, redisUserIndexes, outbox)
+	return redisScriptError(err, "user "+id)
+}
+
+// saveGroup creates or updates a group and replaces its members. The
+// nesting of its member groups is checked in the same transaction, which
+// watches every membership set the check reads, so that concurrent changes
+// cannot create a cycle together.
+func (r *RedisStorage) saveGroup(ctx context.Context, mode string, group *types.Group, outbox []*types.OutboxEntry) error {
+	var ownerKey string
+	owner, err := groupOwner(group)
+	if err != nil {
+		return err
+	}
+	if owner != nil {
+		if ownerKey, err = redisMemberKey(owner); err != nil {
+			return err
+		}
+	}
+
+	data, err := json.Marshal(&redisGroup{
+		ID:          group.ID,
+		Name:        group.Name,
+		Description: group.Description,
+		Owner:       ownerKey,
+	})
+	if err != nil {
+		return err
+	}
+	newKeys, err := redisIndexKeys(redisGroupIndexes, data)
+	if err != nil {
+		return err
+	}
+
+	memberKeys := make([]string, 0, len(group.Members))
+	for _, member := range group.Members {
+		key, err := redisMemberKey(*member)
+		if err != nil {
+			return err
+		}
+		memberKeys = append(memberKeys, key)
+	}
+
+	key := redisGroupPrefix + group.ID
+	membersKey := redisMembersPrefix + group.ID
+	err = r.transaction(ctx, func(tx *redis.Tx) error {
+		var children []string
+		for _, member := range group.Members {
+			if (*member).GetType() == "group" {
+				children = append(children, (*member).GetID())
+			}
+		}
+		if err := checkGroupNesting(ctx, redisGroupGraph{tx}, group.ID, children, r.maxNestingDepth); err != nil {
+			return err
+		}
+
+		current, err := getInTx(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		currentKeys, err := redisIndexKeys(redisGroupIndexes, current)
+		if err != nil {
+			return err
+		}
+		currentMembers, err := tx.SMembers(ctx, membersKey).Result()
+		if err != nil {
+			return redisError(err, nil)
+		}
+
+		keys := append(append([]string{key}, newKeys...), currentKeys...)
+		keys = append(keys, membersKey)
+		for _, member := range currentMembers {
+			keys = append(keys, redisMemberOfPrefix+member)
+		}
+		for _, member := range memberKeys {
+			keys = append(keys, redisMemberOfPrefix+member)
+		}
+		keys = append(keys, memberKeys...)
+		if ownerKey != "" {
+			keys = append(keys, ownerKey)
+		}
+
+		args := append([]interface{}{mode, group.ID, data, len(redisGroupIndexes)}, redisIndexArgs(redisGroupIndexes)...)
+		args = append(args, len(currentMembers), len(memberKeys))
+		for _, member := range memberKeys {
+			args = append(args, member)
+		}
+		return evalInTx(ctx, tx, redisSaveScript, outbox, keys, args...)
+	}, key, membersKey)
+	if msg := scriptErrorReply(err); strings.HasPrefix(msg, "NOTFOUND ") {
+		member, refErr := redisMemberReference(strings.TrimPrefix(msg, "NOTFOUND "))
+		if refErr != nil {
+			return refErr
+		}
+		return fmt.Errorf("%s %s %w", member.GetType(), member.GetID(), types.ErrNotFound)
+	}
+	return redisScriptError(err, "group "+group.ID)
 }
 
 // CreateGroup creates a new group
-func (r *RedisStorage) CreateGroup(group *types.Group) error {
+func (r *RedisStorage) CreateGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
 
-	return r.client.Set(group.ID, group, 0).Err()
+	return r.saveGroup(ctx, "create", group, outbox)
 }
 
 // GetGroupByID returns a group by its ID
-func (r *RedisStorage) GetGroupByID(id string) (*types.Group, error) {
-	group := &types.Group{}
-	err := r.client.Get(id).Scan(group)
+func (r *RedisStorage) GetGroupByID(ctx context.Context, id string) (*types.Group, error) {
+	group, err := r.shallowGroup(ctx, id)
 	if err != nil {
 		return nil, err
 	}
-
+	if err := loadMembers(ctx, r, group); err != nil {
+		return nil, err
+	}
 	return group, nil
 }
 
-// GetGroupByName returns a group by its name
-func (r *RedisStorage) GetGroupByName(name string) (*types.Group, error) {
-	return nil, nil
+// shallowGroup returns a group by its ID, without its members
+func (r *RedisStorage) shallowGroup(ctx context.Context, id string) (*types.Group, error) {
+	data, err := r.client.Get(ctx, redisGroupPrefix+id).Bytes()
+	if err != nil {
+		return nil, redisError(err, fmt.Errorf("group %s %w", id, types.ErrNotFound))
+	}
+	return decodeRedisGroup(id, data)
 }
 
-// UpdateGroup updates a group
-func (r *RedisStorage) UpdateGroup(group *types.Group) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// decodeRedisGroup decodes a group stored in Redis, without its members
+func decodeRedisGroup(id string, data []byte) (*types.Group, error) {
+	var stored redisGroup
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("error decoding group %s: %v", id, err)
+	}
 
-	return r.client.Set(group.ID, group, 0).Err()
+	group := &types.Group{
+		ID:          stored.ID,
+		Name:        stored.Name,
+		Description: stored.Description,
+	}
+	if stored.Owner != "" {
+		owner, err := redisMemberReference(stored.Owner)
+		if err != nil {
+			return nil, err
+		}
+		group.OwnerID = &owner
+	}
+	return group, nil
 }
 
-// AddMemberToGroup adds a member to a group
-func (r *RedisStorage) AddMemberToGroup(m types.Member, parentGroupId string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// ListGroups returns a page of groups without their members, read from the
+// sorted index of the sort field
+func (r *RedisStorage) ListGroups(ctx context.Context, options *types.GroupListOptions) (*types.GroupPage, error) {
+	params, err := groupListParams(options)
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
-}
+	var prefix string
+	if params.sortBy == "name" {
+		prefix = options.NamePrefix
+	}
 
-// RemoveMemberFromGroup removes a member from a group
-func (r *RedisStorage) RemoveMemberFromGroup(m *types.Member, parentGroupId string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+	groups := []*types.Group{}
+	err = r.scanSortIndex(ctx, redisGroupSortPrefix+params.sortBy, params, prefix, func(ids []string) (bool, error) {
+		values, err := r.mget(ctx, redisGroupPrefix, ids)
+		if err != nil {
+			return false, err
+		}
+		for i, data := range values {
+			if data == nil {
+				continue
+			}
+			group, err := decodeRedisGroup(ids[i], data)
+			if err != nil {
+				return false, err
+			}
+			if matchGroup(group, options) {
+				groups = append(groups, group)
+			}
+			if len(groups) > params.limit {
+				return false, nil
+			}
+		}
+		return true, nil
+	})
+	if err != nil {
+		return nil, err
+	}
 
-	return nil
+	return groupPage(groups, params), nil
 }
 
-// DeleteGroup deletes a group
-func (r *RedisStorage) DeleteGroup(group *types.Group) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// scanSortIndex calls fn with batches of entity IDs read from a sorted
+// index, in the order and starting after the cursor of params, until fn
+// returns false or the index is exhausted. When prefix is not empty, only
+// the entities whose sort value starts with it are read.
+func (r *RedisStorage) scanSortIndex(ctx context.Context, key string, params *listParams, prefix string, fn func(ids []string) (bool, error)) error {
+	min, max := "-", "+"
+	if prefix != "" {
+		min = "[" + prefix
+		if end := prefixEnd(prefix); end != "" {
+			max = "(" + end
+		}
+	}
+	if params.cursor != nil {
+		member := redisSortMember(params.cursor.Value, params.cursor.ID)
+		if params.descending {
+			if max == "+" || member < max[1:] {
+				max = "(" + member
+			}
+		} else if member >= prefix {
+			min = "(" + member
+		}
+	}
 
-	return r.client.Del(group.ID).Err()
-}
+	batch := int64(params.limit + 1)
+	for {
+		var members []string
+		var err error
+		if params.descending {
+			members, err = r.client.ZRevRangeByLex(ctx, key, &redis.ZRangeBy{Min: min, Max: max, Count: batch}).Result()
+		} else {
+			members, err = r.client.ZRangeByLex(ctx, key, &redis.ZRangeBy{Min: min, Max: max, Count: batch}).Result()
+		}
+		if err != nil {
+			return redisError(err, nil)
+		}
 
-// CreateSession creates a new session
-func (r *RedisStorage) CreateSession(session *types.Session) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+		ids := make([]string, len(members))
+		for i, member := range members {
+			ids[i] = redisSortMemberID(member)
+		}
+		more, err := fn(ids)
+		if err != nil || !more || int64(len(members)) < batch {
+			return err
+		}
 
-	return r.client.Set(session.ID, session, 0).Err()
+		if params.descending {
+			max = "(" + members[len(members)-1]
+		} else {
+			min = "(" + members[len(members)-1]
+		}
+	}
 }
 
-// GetSessionByID returns a session by its ID
-func (r *RedisStorage) GetSessionByID(id string) (*types.Session, error) {
-	session := &types.Session{}
-	err := r.client.Get(id).Scan(session)
-	if err != nil {
-		return nil, err
+// mget returns the values of the keys made of prefix and each ID, nil for
+// the missing ones
+func (r *RedisStorage) mget(ctx context.Context, prefix string, ids []string) ([][]byte, error) {
+	if len(ids) == 0 {
+		return nil, nil
+	}
+	keys := make([]string, len(ids))
+	for i, id := range ids {
+		keys[i] = prefix + id
 	}
 
-	return session, nil
+	values, err := r.client.MGet(ctx, keys...).Result()
+	if err != nil {
+		return nil, redisError(err, nil)
+	}
+	result := make([][]byte, len(values))
+	for i, value := range values {
+		if s, ok := value.(string); ok {
+			result[i] = []byte(s)
+		}
+	}
+	return result, nil
 }
 
-// UpdateSession updates a session
-func (r *RedisStorage) UpdateSession(session *types.Session) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
-
-	return r.client.Set(session.ID, session, 0).Err()
+// redisSortMember returns the member of a sorted index for the entity with
+// the given sort value and ID
+func redisSortMember(value, id string) string {
+	return value + "\x00" + id
 }
 
-// DeleteSession deletes a session
-func (r *RedisStorage) DeleteSession(session string) error {
-	r.mu.Lock()
-	defer r.mu.Unlock()
+// redisSortMemberID returns the entity ID of a member of a sorted index
+func redisSortMemberID(member string) string {
+	return member[strings.LastIndexByte(member, 0)+1:]
+}
 
-	return r.client.Del(session).Err()
+// prefixEnd returns the smallest string greater than all strings starting
+// with prefix, or an empty string if there is none
+func prefixEnd(prefix string) string {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1])
+		}
+	}
+	return ""
 }
 
-// Close closes the storage
+// memberRefs returns the members of a group
+func (r *RedisStorage) memberRefs(ctx context.Context, groupID string) ([]memberRef, error) {
+	keys, err := r.client.SMembers(ctx, redisMembersPrefix+groupID).Result()
+	if err != nil {
+		return nil, redisError(err, nil)
+	}
+	sort.Strings(keys)
+
+	refs := make([]memberRef, 0, len(keys))
+	for _, key := range keys {
+		member, err := redisMemberReference(key)
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, memberRef{Type: member.GetType(), ID: member.GetID()})
+	}
+	return refs, nil
+}
+
+// redisGroupGraph gives access to the nesting of groups within a
+// transaction. It watches every membership set it reads, so that the
+// transaction fails if another client changes them before it completes.
+type redisGroupGraph struct {
+	tx *redis.Tx
+}
+
+// childGroups returns the IDs of the groups that are direct members of a group
+func (g redisGroupGraph) childGroups(ctx context.Context, id string) ([]string, error) {
+	keys, err := g.members(ctx, redisMembersPrefix+id)
+	if err != nil {
+		return nil, err
+	}
+
+	var ids []string
+	for _, key := range keys {
+		if strings.HasPrefix(key, redisGroupPrefix) {
+			ids = append(ids, strings.TrimPrefix(key, redisGroupPrefix))
+		}
+	}
+	return ids, nil
+}
+
+// parentGroups returns the IDs of the groups a group is a direct member of
+func (g redisGroupGraph) parentGroups(ctx context.Context, id string) ([]string, error) {
+	return g.members(ctx, redisMemberOfPrefix+redisGroupPrefix+id)
+}
+
+// members watches a set and returns its members
+func (g redisGroupGraph) members(ctx context.Context, key string) ([]string, error) {
+	if err := g.tx.Watch(ctx, key).Err(); err != nil {
+		return nil, redisError(err, nil)
+	}
+	members, err := g.tx.SMembers(ctx, key).Result()
+	if err != nil {
+		return nil, redisError(err, nil)
+	}
+	return members, nil
+}
+
+// GetGroupByName returns a group by its name
+func (r *RedisStorage) GetGroupByName(ctx context.Context, name string) (*types.Group, error) {
+	id, err := r.client.Get(ctx, redisGroupNameIndexPrefix+name).Result()
+	if err != nil {
+		return nil, redisError(err, fmt.Errorf("group with name %s %w", name, types.ErrNotFound))
+	}
+	return r.GetGroupByID(ctx, id)
+}
+
+// GetGroupsByOwner returns the groups owned by a user or group, sorted by name
+func (r *RedisStorage) GetGroupsByOwner(ctx context.Context, owner types.Member) ([]*types.Group, error) {
+	key, err := redisMemberKey(owner)
+	if err != nil {
+		return nil, err
+	}
+
+	ids, err := r.client.SMembers(ctx, redisGroupOwnerIndexPrefix+key).Result()
+	if err != nil {
+		return nil, redisError(err, nil)
+	}
+
+	groups := []*types.Group{}
+	for _, id := range ids {
+		group, err := r.GetGroupByID(ctx, id)
+		if err != nil {
+			// The group may have been deleted since the index was read
+			if errors.Is(err, types.ErrNotFound) {
+				continue
+			}
+			return nil, err
+		}
+		groups = append(groups, group)
+	}
+	sort.Slice(groups, func(i, j int) bool {
+		return groups[i].Name < groups[j].Name
+	})
+	return groups, nil
+}
+
+// GetEffectiveMembers returns the users that are members of a group,
+// directly or through nested groups. The members sets of every level of
+// nested groups are read in a single round trip.
+func (r *RedisStorage) GetEffectiveMembers(ctx context.Context, groupID string) ([]*types.EffectiveMembership, error) {
+	exists, err := r.client.Exists(ctx, redisGroupPrefix+groupID).Result()
+	if err != nil {
+		return nil, redisError(err, nil)
+	}
+	if exists == 0 {
+		return nil, fmt.Errorf("group %s %w", groupID, types.ErrNotFound)
+	}
+
+	return effectiveMembers(groupID, func(groupIDs []string) (map[string][]memberRef, error) {
+		keys := make([]string, len(groupIDs))
+		for i, id := range groupIDs {
+			keys[i] = redisMembersPrefix + id
+		}
+		sets, err := r.smembersAll(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		members := make(map[string][]memberRef)
+		for i, id := range groupIDs {
+			for _, key := range sets[i] {
+				member, err := redisMemberReference(key)
+				if err != nil {
+					return nil, err
+				}
+				members[id] = append(members[id], memberRef{Type: member.GetType(), ID: member.GetID()})
+			}
+		}
+		return members, nil
+	})
+}
+
+// GetEffectiveGroups returns the groups a user is a member of, directly or
+// through nested groups. The memberof sets of every level of nested groups
+// are read in a single round trip.
+func (r *RedisStorage) GetEffectiveGroups(ctx context.Context, userID string) ([]*types.EffectiveMembership, error) {
+	exists, err := r.client.Exists(ctx, redisUserPrefix+userID).Result()
+	if err != nil {
+		return nil, redisError(err, nil)
+	}
+	if exists == 0 {
+		return nil, fmt.Errorf("user %s %w", userID, types.ErrNotFound)
+	}
+
+	return effectiveGroups(userID, r.parentLevel(ctx))
+}
+
+// GetAncestorGroups returns the IDs of the groups a group is nested in,
+// directly or through other groups. The memberof sets of every level are
+// read in a single round trip.
+func (r *RedisStorage) GetAncestorGroups(ctx context.Context, groupID string) ([]string, error) {
+	exists, err := r.client.Exists(ctx, redisGroupPrefix+groupID).Result()
+	if err != nil {
+		return nil, redisError(err, nil)
+	}
+	if exists == 0 {
+		return nil, fmt.Errorf("group %s %w", groupID, types.ErrNotFound)
+	}
+
+	return ancestorGroups(groupID, r.parentLevel(ctx))
+}
+
+// parentLevel returns a parentLevelFunc reading the memberof sets of the
+// members of a level in a single round trip
+func (r *RedisStorage) parentLevel(ctx context.Context) parentLevelFunc {
+	return func(refs []memberRef) (map[memberRef][]string, error) {
+		keys := make([]string, len(refs))
+		for i, ref := range refs {
+			member, err := types.NewMemberReference(ref.Type, ref.ID)
+			if err != nil {
+				return nil, err
+			}
+			key, err := redisMemberKey(member)
+			if err != nil {
+				return nil, err
+			}
+			keys[i] = redisMemberOfPrefix + key
+		}
+		sets, err := r.smembersAll(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+
+		parents := make(map[memberRef][]string)
+		for i, ref := range refs {
+			parents[ref] = sets[i]
+		}
+		return parents, nil
+	}
+}
+
+// smembersAll returns the members of every given set in a single round trip
+func (r *RedisStorage) smembersAll(ctx context.Context, keys []string) ([][]string, error) {
+	pipe := r.client.Pipeline()
+	cmds := make([]*redis.StringSliceCmd, len(keys))
+	for i, key := range keys {
+		cmds[i] = pipe.SMembers(ctx, key)
+	}
+	if _, err := pipe.Exec(ctx); err != nil {
+		return nil, redisError(err, nil)
+	}
+
+	sets := make([][]string, len(keys))
+	for i, cmd := range cmds {
+		sets[i] = cmd.Val()
+	}
+	return sets, nil
+}
+
+// UpdateGroup updates a group
+func (r *RedisStorage) UpdateGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.saveGroup(ctx, "update", group, outbox)
+}
+
+// AddMemberToGroup adds a member to a group
+func (r *RedisStorage) AddMemberToGroup(ctx context.Context, m types.Member, parentGroupId string, outbox ...*types.OutboxEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, err := redisMemberKey(m)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{redisGroupPrefix + parentGroupId, redisMembersPrefix + parentGroupId, key, redisMemberOfPrefix + key}
+	err = r.transaction(ctx, func(tx *redis.Tx) error {
+		if m.GetType() == "group" {
+			if err := checkNesting(ctx, redisGroupGraph{tx}, parentGroupId, m.GetID(), r.maxNestingDepth); err != nil {
+				return err
+			}
+		}
+		return evalInTx(ctx, tx, redisAddMemberScript, outbox, keys, parentGroupId)
+	})
+	switch scriptErrorReply(err) {
+	case "EXISTS":
+		return fmt.Errorf("%s %s is already a member of group %s: %w", m.GetType(), m.GetID(), parentGroupId, types.ErrAlreadyExists)
+	case "NOTFOUND member":
+		return fmt.Errorf("%s %s %w", m.GetType(), m.GetID(), types.ErrNotFound)
+	}
+	return redisScriptError(err, "group "+parentGroupId)
+}
+
+// RemoveMemberFromGroup removes a member from a group
+func (r *RedisStorage) RemoveMemberFromGroup(ctx context.Context, m *types.Member, parentGroupId string, outbox ...*types.OutboxEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	key, err := redisMemberKey(*m)
+	if err != nil {
+		return err
+	}
+
+	keys := []string{redisGroupPrefix + parentGroupId, redisMembersPrefix + parentGroupId, redisMemberOfPrefix + key}
+	keys, args, err := redisOutboxArgs(outbox, keys, []interface{}{key, parentGroupId})
+	if err != nil {
+		return err
+	}
+	err = redisRemoveMemberScript.Run(ctx, r.client, keys, args...).Err()
+	if scriptErrorReply(err) == "NOTFOUND member" {
+		return fmt.Errorf("member %s of group %s %w", (*m).GetID(), parentGroupId, types.ErrNotFound)
+	}
+	return redisScriptError(err, "group "+parentGroupId)
+}
+
+// DeleteGroup deletes a group
+func (r *RedisStorage) DeleteGroup(ctx context.Context, group *types.Group, outbox ...*types.OutboxEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	err := r.deleteMember(ctx, &types.Group{ID: group.ID}, redisGroupIndexes, outbox)
+	return redisScriptError(err, "group "+group.ID)
+}
+
+// deleteMember deletes a user or group and applies the delete policy to its
+// memberships and ownerships
+func (r *RedisStorage) deleteMember(ctx context.Context, m types.Member, indexes []redisIndex, outbox []*types.OutboxEntry) error {
+	key, err := redisMemberKey(m)
+	if err != nil {
+		return err
+	}
+
+	memberOfKey := redisMemberOfPrefix + key
+	ownedKey := redisGroupOwnerIndexPrefix + key
+	watched := []string{key, memberOfKey, ownedKey}
+	var membersKey string
+	if m.GetType() == "group" {
+		membersKey = redisMembersPrefix + m.GetID()
+		watched = append(watched, membersKey)
+	}
+
+	err = r.transaction(ctx, func(tx *redis.Tx) error {
+		current, err := getInTx(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		indexKeys, err := redisIndexKeys(indexes, current)
+		if err != nil {
+			return err
+		}
+		sets := make([][]string, 3)
+		for i, key := range watched[1:] {
+			if sets[i], err = tx.SMembers(ctx, key).Result(); err != nil {
+				return redisError(err, nil)
+			}
+		}
+		parents, owned, members := sets[0], sets[1], sets[2]
+		sort.Strings(parents)
+		sort.Strings(owned)
+
+		keys := []string{key, memberOfKey, ownedKey}
+		for _, id := range parents {
+			keys = append(keys, redisMembersPrefix+id)
+		}
+		for _, id := range owned {
+			keys = append(keys, redisGroupPrefix+id)
+		}
+		for _, member := range members {
+			keys = append(keys, redisMemberOfPrefix+member)
+		}
+		keys = append(keys, indexKeys...)
+		if membersKey != "" {
+			keys = append(keys, membersKey)
+		}
+
+		args := []interface{}{m.GetID(), key, string(r.deletePolicy), m.GetType(), len(parents), len(owned), len(members), len(indexes)}
+		args = append(args, redisIndexArgs(indexes)...)
+		for _, id := range append(parents, owned...) {
+			args = append(args, id)
+		}
+		return evalInTx(ctx, tx, redisDeleteScript, outbox, keys, args...)
+	}, watched...)
+	msg := scriptErrorReply(err)
+	switch {
+	case strings.HasPrefix(msg, "MEMBER "):
+		return stillMemberError(m.GetType(), m.GetID(), strings.TrimPrefix(msg, "MEMBER "))
+	case strings.HasPrefix(msg, "OWNER "):
+		return stillOwnerError(m.GetType(), m.GetID(), strings.TrimPrefix(msg, "OWNER "))
+	}
+	return err
+}
+
+// setSession stores a session with a native key expiry matching its
+// ExpiresAt. It reports whether the session was stored, which depends on
+// the NX or XX mode.
+func (r *RedisStorage) setSession(ctx context.Context, session *types.Session, mode string) (bool, error) {
+	data, err := json.Marshal(&redisSession{
+		ID:        session.ID,
+		UserID:    session.UserID,
+		ExpiresAt: session.ExpiresAt,
+	})
+	if err != nil {
+		return false, err
+	}
+	return r.storeSession(ctx, redisSessionPrefix+session.ID, redisUserSessionsPrefix, session.ID, session.UserID, data, mode, session.ExpiresAt*1000)
+}
+
+// storeSession stores a session or a password reset, and indexes it by
+// user. The user it belonged to is read in a transaction, so that the
+// script declares the index it is removed from when its user changes.
+func (r *RedisStorage) storeSession(ctx context.Context, key string, indexPrefix string, id string, userID string, data []byte, mode string, expiresAt int64) (bool, error) {
+	var stored bool
+	err := r.transaction(ctx, func(tx *redis.Tx) error {
+		current, err := getInTx(ctx, tx, key)
+		if err != nil {
+			return err
+		}
+		keys := []string{key, indexPrefix + userID}
+		if current != nil {
+			var previous redisSession
+			if err := json.Unmarshal(current, &previous); err != nil {
+				return fmt.Errorf("error decoding %s: %v", key, err)
+			}
+			if previous.UserID != userID {
+				keys = append(keys, indexPrefix+previous.UserID)
+			}
+		}
+
+		var cmd *redis.Cmd
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			cmd = redisSetSessionScript.Eval(ctx, pipe, keys, data, mode, expiresAt, id, time.Now().UnixMilli())
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		result, err := cmd.Int64()
+		stored = result == 1
+		return err
+	}, key)
+	return stored, redisError(err, nil)
+}
+
+// takeSession returns a session or a password reset, stored alike, and
+// deletes it along with its entry in the index of its user. It returns nil
+// if there is none. The value is read in a transaction, so that concurrent
+// calls cannot both take it.
+func (r *RedisStorage) takeSession(ctx context.Context, key string, indexPrefix string) ([]byte, error) {
+	var taken []byte
+	err := r.transaction(ctx, func(tx *redis.Tx) error {
+		taken = nil
+		current, err := getInTx(ctx, tx, key)
+		if err != nil || current == nil {
+			return err
+		}
+		var stored redisSession
+		if err := json.Unmarshal(current, &stored); err != nil {
+			return fmt.Errorf("error decoding %s: %v", key, err)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			pipe.Del(ctx, key)
+			pipe.ZRem(ctx, indexPrefix+stored.UserID, stored.ID)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		taken = current
+		return nil
+	}, key)
+	return taken, redisError(err, nil)
+}
+
+// deleteUserSessions deletes the sessions or password resets of a user,
+// listed by its index. The index is watched, so that one created
+// meanwhile is deleted as well.
+func (r *RedisStorage) deleteUserSessions(ctx context.Context, indexKey string, prefix string) error {
+	err := r.transaction(ctx, func(tx *redis.Tx) error {
+		ids, err := tx.ZRange(ctx, indexKey, 0, -1).Result()
+		if err != nil {
+			return redisError(err, nil)
+		}
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for _, id := range ids {
+				pipe.Del(ctx, prefix+id)
+			}
+			pipe.Del(ctx, indexKey)
+			return nil
+		})
+		return err
+	}, indexKey)
+	return redisError(err, nil)
+}
+
+// CreateSession creates a new session
+func (r *RedisStorage) CreateSession(ctx context.Context, session *types.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	created, err := r.setSession(ctx, session, "NX")
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("session %s %w", session.ID, types.ErrAlreadyExists)
+	}
+	return nil
+}
+
+// GetSessionByID returns a session by its ID
+func (r *RedisStorage) GetSessionByID(ctx context.Context, id string) (*types.Session, error) {
+	data, err := r.client.Get(ctx, redisSessionPrefix+id).Bytes()
+	if err != nil {
+		return nil, redisError(err, fmt.Errorf("session %s %w", id, types.ErrNotFound))
+	}
+
+	var stored redisSession
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("error decoding session %s: %v", id, err)
+	}
+
+	session := &types.Session{
+		ID:        stored.ID,
+		UserID:    stored.UserID,
+		ExpiresAt: stored.ExpiresAt,
+	}
+	// Redis expires keys lazily and with millisecond precision, so the
+	// expiry is checked again here
+	if session.Expired(time.Now()) {
+		return nil, fmt.Errorf("session %s %w", id, types.ErrNotFound)
+	}
+	return session, nil
+}
+
+// UpdateSession updates a session
+func (r *RedisStorage) UpdateSession(ctx context.Context, session *types.Session) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	updated, err := r.setSession(ctx, session, "XX")
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return fmt.Errorf("session %s %w", session.ID, types.ErrNotFound)
+	}
+	return nil
+}
+
+// DeleteSession deletes a session
+func (r *RedisStorage) DeleteSession(ctx context.Context, session string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	taken, err := r.takeSession(ctx, redisSessionPrefix+session, redisUserSessionsPrefix)
+	if err != nil {
+		return err
+	}
+	if taken == nil {
+		return fmt.Errorf("session %s %w", session, types.ErrNotFound)
+	}
+	return nil
+}
+
+// DeleteUserSessions deletes every session of a user
+func (r *RedisStorage) DeleteUserSessions(ctx context.Context, userID string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return r.deleteUserSessions(ctx, redisUserSessionsPrefix+userID, redisSessionPrefix)
+}
+
+// CreatePasswordReset creates a new password reset, with a native key
+// expiry matching its ExpiresAt
+func (r *RedisStorage) CreatePasswordReset(ctx context.Context, reset *types.PasswordReset) error {
+	data, err := json.Marshal(&redisPasswordReset{
+		ID:        reset.ID,
+		UserID:    reset.UserID,
+		ExpiresAt: reset.ExpiresAt,
+	})
+	if err != nil {
+		return err
+	}
+
+	// Resets are stored like sessions, except that they always expire
+	created, err := r.storeSession(ctx, redisPasswordResetPrefix+reset.ID, redisUserResetsPrefix, reset.ID, reset.UserID, data, "NX", reset.ExpiresAt*1000)
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("password reset %s %w", reset.ID, types.ErrAlreadyExists)
+	}
+	return nil
+}
+
+// ConsumePasswordReset returns and deletes a password reset by its ID, in
+// a single step so that concurrent requests cannot both redeem it
+func (r *RedisStorage) ConsumePasswordReset(ctx context.Context, id string) (*types.PasswordReset, error) {
+	data, err := r.takeSession(ctx, redisPasswordResetPrefix+id, redisUserResetsPrefix)
+	if err != nil {
+		return nil, err
+	}
+	if data == nil {
+		return nil, fmt.Errorf("password reset %s %w", id, types.ErrNotFound)
+	}
+
+	var stored redisPasswordReset
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, fmt.Errorf("error decoding password reset %s: %v", id, err)
+	}
+
+	reset := &types.PasswordReset{
+		ID:        stored.ID,
+		UserID:    stored.UserID,
+		ExpiresAt: stored.ExpiresAt,
+	}
+	if reset.Expired(time.Now()) {
+		return nil, fmt.Errorf("password reset %s %w", id, types.ErrNotFound)
+	}
+	return reset, nil
+}
+
+// DeleteUserPasswordResets deletes every pending password reset of a user
+func (r *RedisStorage) DeleteUserPasswordResets(ctx context.Context, userID string) error {
+	return r.deleteUserSessions(ctx, redisUserResetsPrefix+userID, redisPasswordResetPrefix)
+}
+
+// redisOutboxMember returns the member of an outbox entry in outbox:due,
+// which orders entries due at the same time by creation time and ID
+func redisOutboxMember(createdAt int64, id string) string {
+	return fmt.Sprintf("%020d:%s", createdAt, id)
+}
+
+// setOutboxEntry stores an outbox entry. It reports whether the entry was
+// stored, which depends on the NX or XX mode.
+func (r *RedisStorage) setOutboxEntry(ctx context.Context, entry *types.OutboxEntry, mode string) (bool, error) {
+	data, err := encodeRedisOutboxEntry(entry)
+	if err != nil {
+		return false, err
+	}
+
+	keys := []string{redisOutboxPrefix + entry.ID, redisOutboxDueKey}
+	stored, err := redisSetOutboxScript.Run(ctx, r.client, keys, data, mode, entry.NextAttemptAt, redisOutboxMember(entry.CreatedAt, entry.ID)).Int64()
+	if err != nil {
+		return false, redisError(err, nil)
+	}
+	return stored == 1, nil
+}
+
+// encodeRedisOutboxEntry encodes an outbox entry to store in Redis
+func encodeRedisOutboxEntry(entry *types.OutboxEntry) ([]byte, error) {
+	return json.Marshal(&redisOutboxEntry{
+		ID:              entry.ID,
+		EntityType:      entry.EntityType,
+		EntityID:        entry.EntityID,
+		Name:            entry.Name,
+		PasswordChanged: entry.PasswordChanged,
+		Attempts:        entry.Attempts,
+		LastError:       entry.LastError,
+		CreatedAt:       entry.CreatedAt,
+		NextAttemptAt:   entry.NextAttemptAt,
+	})
+}
+
+// decodeRedisOutboxEntry decodes an outbox entry stored in Redis
+func decodeRedisOutboxEntry(data []byte) (*types.OutboxEntry, error) {
+	var stored redisOutboxEntry
+	if err := json.Unmarshal(data, &stored); err != nil {
+		return nil, err
+	}
+	return &types.OutboxEntry{
+		ID:              stored.ID,
+		EntityType:      stored.EntityType,
+		EntityID:        stored.EntityID,
+		Name:            stored.Name,
+		PasswordChanged: stored.PasswordChanged,
+		Attempts:        stored.Attempts,
+		LastError:       stored.LastError,
+		CreatedAt:       stored.CreatedAt,
+		NextAttemptAt:   stored.NextAttemptAt,
+	}, nil
+}
+
+// AddOutboxEntry adds an entry to the outbox
+func (r *RedisStorage) AddOutboxEntry(ctx context.Context, entry *types.OutboxEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	created, err := r.setOutboxEntry(ctx, entry, "NX")
+	if err != nil {
+		return err
+	}
+	if !created {
+		return fmt.Errorf("outbox entry %s %w", entry.ID, types.ErrAlreadyExists)
+	}
+	return nil
+}
+
+// GetDueOutboxEntries returns at most limit outbox entries due at the
+// given Unix time
+func (r *RedisStorage) GetDueOutboxEntries(ctx context.Context, now int64, limit int) ([]*types.OutboxEntry, error) {
+	members, err := r.client.ZRangeByScore(ctx, redisOutboxDueKey, &redis.ZRangeBy{
+		Min:   "-inf",
+		Max:   strconv.FormatInt(now, 10),
+		Count: int64(limit),
+	}).Result()
+	if err != nil {
+		return nil, redisError(err, nil)
+	}
+
+	ids := make([]string, len(members))
+	for i, member := range members {
+		ids[i] = member[strings.IndexByte(member, ':')+1:]
+	}
+	values, err := r.mget(ctx, redisOutboxPrefix, ids)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]*types.OutboxEntry, 0, len(values))
+	for i, data := range values {
+		if data == nil {
+			// Deleted since the range was read
+			continue
+		}
+		entry, err := decodeRedisOutboxEntry(data)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding outbox entry %s: %v", ids[i], err)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+// ClaimOutboxEntries returns at most limit outbox entries due at the given
+// Unix time, moving their next attempt to until. The due entries are read
+// under WATCH, so that a concurrent claim or change makes the transaction
+// retry.
+func (r *RedisStorage) ClaimOutboxEntries(ctx context.Context, now int64, until int64, limit int) ([]*types.OutboxEntry, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	var entries []*types.OutboxEntry
+	err := r.transaction(ctx, func(tx *redis.Tx) error {
+		entries = nil
+		members, err := tx.ZRangeByScore(ctx, redisOutboxDueKey, &redis.ZRangeBy{
+			Min:   "-inf",
+			Max:   strconv.FormatInt(now, 10),
+			Count: int64(limit),
+		}).Result()
+		if err != nil || len(members) == 0 {
+			return redisError(err, nil)
+		}
+
+		keys := make([]string, len(members))
+		for i, member := range members {
+			keys[i] = redisOutboxPrefix + member[strings.IndexByte(member, ':')+1:]
+		}
+		if err := tx.Watch(ctx, keys...).Err(); err != nil {
+			return redisError(err, nil)
+		}
+		values, err := tx.MGet(ctx, keys...).Result()
+		if err != nil {
+			return redisError(err, nil)
+		}
+
+		data := make([][]byte, 0, len(values))
+		for i, value := range values {
+			stored, ok := value.(string)
+			if !ok {
+				// Deleted since the range was read
+				continue
+			}
+			entry, err := decodeRedisOutboxEntry([]byte(stored))
+			if err != nil {
+				return fmt.Errorf("error decoding outbox entry %s: %v", keys[i], err)
+			}
+			entry.NextAttemptAt = until
+			encoded, err := encodeRedisOutboxEntry(entry)
+			if err != nil {
+				return err
+			}
+			entries = append(entries, entry)
+			data = append(data, encoded)
+		}
+
+		_, err = tx.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+			for i, entry := range entries {
+				pipe.Set(ctx, redisOutboxPrefix+entry.ID, data[i], 0)
+				pipe.ZAdd(ctx, redisOutboxDueKey, &redis.Z{Score: float64(until), Member: redisOutboxMember(entry.CreatedAt, entry.ID)})
+			}
+			return nil
+		})
+		return err
+	}, redisOutboxDueKey)
+	if err != nil {
+		return nil, redisError(err, nil)
+	}
+	return entries, nil
+}
+
+// UpdateOutboxEntry updates an outbox entry
+func (r *RedisStorage) UpdateOutboxEntry(ctx context.Context, entry *types.OutboxEntry) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	updated, err := r.setOutboxEntry(ctx, entry, "XX")
+	if err != nil {
+		return err
+	}
+	if !updated {
+		return fmt.Errorf("outbox entry %s %w", entry.ID, types.ErrNotFound)
+	}
+	return nil
+}
+
+// DeleteOutboxEntry deletes an outbox entry
+func (r *RedisStorage) DeleteOutboxEntry(ctx context.Context, id string) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	notFound := fmt.Errorf("outbox entry %s %w", id, types.ErrNotFound)
+	data, err := r.client.Get(ctx, redisOutboxPrefix+id).Bytes()
+	if err != nil {
+		return redisError(err, notFound)
+	}
+	entry, err := decodeRedisOutboxEntry(data)
+	if err != nil {
+		return fmt.Errorf("error decoding outbox entry %s: %v", id, err)
+	}
+
+	_, err = r.client.TxPipelined(ctx, func(pipe redis.Pipeliner) error {
+		pipe.Del(ctx, redisOutboxPrefix+id)
+		pipe.ZRem(ctx, redisOutboxDueKey, redisOutboxMember(entry.CreatedAt, id))
+		return nil
+	})
+	return redisError(err, nil)
+}
+
+// CountOutboxEntries returns the number of outbox entries
+func (r *RedisStorage) CountOutboxEntries(ctx context.Context) (int, error) {
+	n, err := r.client.ZCard(ctx, redisOutboxDueKey).Result()
+	if err != nil {
+		return 0, redisError(err, nil)
+	}
+	return int(n), nil
+}
+
+// redisMemberKey returns the key of a group member, which is also the
+// value stored in the members set of its groups
+func redisMemberKey(m types.Member) (string, error) {
+	switch m.(type) {
+	case *types.User:
+		return redisUserPrefix + m.GetID(), nil
+	case *types.Group:
+		return redisGroupPrefix + m.GetID(), nil
+	default:
+		return "", fmt.Errorf("%w: unknown member type %T", types.ErrInvalidMember, m)
+	}
+}
+
+// redisMemberReference returns a reference to the user or group with the
+// given member key
+func redisMemberReference(key string) (types.Member, error) {
+	switch {
+	case strings.HasPrefix(key, redisUserPrefix):
+		return types.NewMemberReference("user", strings.TrimPrefix(key, redisUserPrefix))
+	case strings.HasPrefix(key, redisGroupPrefix):
+		return types.NewMemberReference("group", strings.TrimPrefix(key, redisGroupPrefix))
+	default:
+		return nil, fmt.Errorf("%w: unknown member %s", types.ErrInvalidMember, key)
+	}
+}
+
+// redisScriptError converts the error replies of the Lua scripts to the
+// errors of the types package
+func redisScriptError(err error, entity string) error {
+	if err == nil {
+		return nil
+	}
+
+	msg := scriptErrorReply(err)
+	switch {
+	case strings.HasPrefix(msg, "EXISTS"):
+		return fmt.Errorf("%s %w", entity, types.ErrAlreadyExists)
+	case strings.HasPrefix(msg, "NOTFOUND"):
+		return fmt.Errorf("%s %w", entity, types.ErrNotFound)
+	case strings.HasPrefix(msg, "CONFLICT"):
+		return fmt.Errorf("%w: %s of %s is already taken", types.ErrConflict, strings.TrimPrefix(msg, "CONFLICT "), entity)
+	}
+	return redisError(err, nil)
+}
+
+// scriptErrorReply returns the error reply of a Lua script, without the
+// generic ERR prefix some servers add to it
+func scriptErrorReply(err error) string {
+	if err == nil {
+		return ""
+	}
+	return strings.TrimPrefix(err.Error(), "ERR ")
+}
+
+// redisError wraps errors returned by the Redis client with the matching
+// error of the types package. A missing key is reported as notFound.
+func redisError(err error, notFound error) error {
+	if err == nil {
+		return nil
+	}
+	if err == redis.Nil && notFound != nil {
+		return notFound
+	}
+	if errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded) {
+		return err
+	}
+
+	var netErr net.Error
+	if errors.As(err, &netErr) || errors.Is(err, io.EOF) || err.Error() == "redis: client is closed" {
+		return fmt.Errorf("%w: %v", types.ErrBackendUnavailable, err)
+	}
+
+	return err
+}
+
+// Close closes the storage
 func (r *RedisStorage) Close() error {
 	r.mu.Lock()
 	defer r.mu.Unlock()
@@ -206,3 +2176,46 @@ func (r *RedisStorage) Close() error {
 
 	return nil
 }
+
+// AllocatePosixID returns the POSIX number of a user or group, allocating
+// one from the range [min, max] if it has none
+func (r *RedisStorage) AllocatePosixID(ctx context.Context, entityType string, entityID string, min int64, max int64) (int64, error) {
+	if entityType != "user" && entityType != "group" {
+		return 0, fmt.Errorf("%w: unknown entity type %q", types.ErrInvalidArgument, entityType)
+	}
+
+	keys := []string{redisPosixPrefix + entityType, redisPosixReservedPrefix + entityType}
+	id, err := redisAllocatePosixIDScript.Run(ctx, r.client, keys, entityID, min, max).Int64()
+	if err != nil {
+		return 0, redisError(err, nil)
+	}
+	if id < 0 {
+		return 0, fmt.Errorf("%w: no %s number left in the range %d-%d", types.ErrConflict, entityType, min, max)
+	}
+	return id, nil
+}
+
+// ReservePosixID records a number used in LDAP by a user, group or other
+// LDAP entry, so that it is never allocated to another one
+func (r *RedisStorage) ReservePosixID(ctx context.Context, entityType string, entityID string, number int64) error {
+	if entityType != "user" && entityType != "group" {
+		return fmt.Errorf("%w: unknown entity type %q", types.ErrInvalidArgument, entityType)
+	}
+
+	keys := []string{redisPosixPrefix + entityType, redisPosixReservedPrefix + entityType}
+	result, err := redisReservePosixIDScript.Run(ctx, r.client, keys, entityID, number).StringSlice()
+	if err != nil {
+		return redisError(err, nil)
+	}
+	switch result[0] {
+	case "has":
+		current, err := strconv.ParseInt(result[1], 10, 64)
+		if err != nil {
+			return err
+		}
+		return posixIDConflict(entityType, entityID, current, number)
+	case "taken":
+		return posixIDTaken(entityType, number, result[1])
+	}
+	return nil
+}
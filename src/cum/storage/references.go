@@ -0,0 +1,60 @@
+package storage
+
+import (
+	"fmt"
+
+	"cum/types"
+)
+
+// DeletePolicy defines what happens to the memberships and ownerships of a
+// user or group when it is deleted
+type DeletePolicy string
+
+const (
+	// DeleteCascade removes the deleted user or group from the groups it is
+	// a member of and clears the owner of the groups it owns
+	DeleteCascade DeletePolicy = "cascade"
+
+	// DeleteRestrict refuses to delete a user or group that is still a
+	// member or the owner of a group
+	DeleteRestrict DeletePolicy = "restrict"
+)
+
+// ParseDeletePolicy parses a delete policy. An empty string is DeleteCascade.
+func ParseDeletePolicy(s string) (DeletePolicy, error) {
+	switch DeletePolicy(s) {
+	case "", DeleteCascade:
+		return DeleteCascade, nil
+	case DeleteRestrict:
+		return DeleteRestrict, nil
+	default:
+		return "", fmt.Errorf("unknown delete policy %q", s)
+	}
+}
+
+// groupOwner returns the owner of a group, or nil if the group has no
+// owner. Owners must be users or groups.
+func groupOwner(group *types.Group) (types.Member, error) {
+	if group.OwnerID == nil || *group.OwnerID == nil {
+		return nil, nil
+	}
+	owner := *group.OwnerID
+	switch owner.(type) {
+	case *types.User, *types.Group:
+		return owner, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown owner type %T", types.ErrInvalidMember, owner)
+	}
+}
+
+// stillMemberError is returned by the restrict policy when deleting a user
+// or group that is still a member of a group
+func stillMemberError(memberType, memberID, groupID string) error {
+	return fmt.Errorf("%w: %s %s is still a member of group %s", types.ErrConflict, memberType, memberID, groupID)
+}
+
+// stillOwnerError is returned by the restrict policy when deleting a user
+// or group that still owns a group
+func stillOwnerError(ownerType, ownerID, groupID string) error {
+	return fmt.Errorf("%w: %s %s still owns group %s", types.ErrConflict, ownerType, ownerID, groupID)
+}
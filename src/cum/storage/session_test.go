@@ -0,0 +1,154 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"testing"
+	"time"
+
+	"cum/types"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+func TestDeleteUserSessions(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		mustCreateUsers(t, s, "u1", "u2")
+		expiresAt := time.Now().Add(time.Hour).Unix()
+		for _, session := range []*types.Session{
+			{ID: "s1", UserID: "u1", ExpiresAt: expiresAt},
+			{ID: "s2", UserID: "u1"},
+			{ID: "s3", UserID: "u2", ExpiresAt: expiresAt},
+		} {
+			if err := s.CreateSession(ctx, session); err != nil {
+				t.Fatal(err)
+			}
+		}
+		for _, reset := range []*types.PasswordReset{
+			{ID: "r1", UserID: "u1", ExpiresAt: expiresAt},
+			{ID: "r2", UserID: "u1", ExpiresAt: expiresAt},
+			{ID: "r3", UserID: "u2", ExpiresAt: expiresAt},
+		} {
+			if err := s.CreatePasswordReset(ctx, reset); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		// A consumed reset and a deleted session can be stored again
+		reset, err := s.ConsumePasswordReset(ctx, "r1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := s.CreatePasswordReset(ctx, reset); err != nil {
+			t.Fatalf("restoring a consumed reset returned %v", err)
+		}
+		if err := s.DeleteSession(ctx, "s1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteSession(ctx, "s1"); !errors.Is(err, types.ErrNotFound) {
+			t.Errorf("deleting a session twice returned %v, want ErrNotFound", err)
+		}
+		if err := s.CreateSession(ctx, &types.Session{ID: "s1", UserID: "u1", ExpiresAt: expiresAt}); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.DeleteUserSessions(ctx, "u1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.DeleteUserPasswordResets(ctx, "u1"); err != nil {
+			t.Fatal(err)
+		}
+		for _, id := range []string{"s1", "s2"} {
+			if _, err := s.GetSessionByID(ctx, id); !errors.Is(err, types.ErrNotFound) {
+				t.Errorf("session %s of u1: got %v, want ErrNotFound", id, err)
+			}
+		}
+		for _, id := range []string{"r1", "r2"} {
+			if _, err := s.ConsumePasswordReset(ctx, id); !errors.Is(err, types.ErrNotFound) {
+				t.Errorf("reset %s of u1: got %v, want ErrNotFound", id, err)
+			}
+		}
+
+		// Other users keep theirs, and users without any are fine
+		if _, err := s.GetSessionByID(ctx, "s3"); err != nil {
+			t.Errorf("session of u2: %v", err)
+		}
+		if _, err := s.ConsumePasswordReset(ctx, "r3"); err != nil {
+			t.Errorf("reset of u2: %v", err)
+		}
+		if err := s.DeleteUserSessions(ctx, "nobody"); err != nil {
+			t.Error(err)
+		}
+		if err := s.DeleteUserPasswordResets(ctx, "nobody"); err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestRedisStorageMigratesUserSessionIndexes(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	// Stored by index version 2, without the indexes by user
+	server.Set(redisIndexVersionKey, "2")
+	server.Set(redisSessionPrefix+"s1", `{"id":"s1","user_id":"u1","expires_at":0}`)
+	server.Set(redisPasswordResetPrefix+"r1", `{"id":"r1","user_id":"u1","expires_at":`+strconv.FormatInt(time.Now().Add(time.Hour).Unix(), 10)+`}`)
+
+	port, err := strconv.Atoi(server.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewRedisStorage(&RedisStorageConfig{Host: server.Host(), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if err := s.DeleteUserSessions(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.DeleteUserPasswordResets(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if server.Exists(redisSessionPrefix+"s1") || server.Exists(redisPasswordResetPrefix+"r1") {
+		t.Error("the session or the reset stored before the indexes was not deleted")
+	}
+}
+
+func TestRedisStorageSessionChangesUser(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	port, err := strconv.Atoi(server.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := NewRedisStorage(&RedisStorageConfig{Host: server.Host(), Port: port})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { s.Close() })
+
+	if err := s.CreateSession(ctx, &types.Session{ID: "s1", UserID: "u1"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.UpdateSession(ctx, &types.Session{ID: "s1", UserID: "u2"}); err != nil {
+		t.Fatal(err)
+	}
+	if members, _ := server.ZMembers(redisUserSessionsPrefix + "u1"); len(members) != 0 {
+		t.Errorf("the session is still indexed under its previous user: %v", members)
+	}
+
+	if err := s.DeleteUserSessions(ctx, "u1"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetSessionByID(ctx, "s1"); err != nil {
+		t.Fatalf("deleting the sessions of the previous user deleted the session: %v", err)
+	}
+	if err := s.DeleteUserSessions(ctx, "u2"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.GetSessionByID(ctx, "s1"); !errors.Is(err, types.ErrNotFound) {
+		t.Fatalf("got %v after deleting the sessions of its user, want ErrNotFound", err)
+	}
+}
@@ -0,0 +1,379 @@
+package storage
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strconv"
+	"testing"
+
+	"cum/types"
+
+	"github.com/alicebob/miniredis/v2"
+)
+
+// forEachStorage runs a test against every storage that runs in-process:
+// the in-memory storage, and the Redis storage backed by miniredis
+func forEachStorage(t *testing.T, maxNestingDepth int, fn func(t *testing.T, s types.Storage)) {
+	t.Run("in-memory", func(t *testing.T) {
+		s := NewInMemoryStorage(&InMemoryStorageConfig{MaxNestingDepth: maxNestingDepth})
+		t.Cleanup(func() { s.Close() })
+		fn(t, s)
+	})
+
+	t.Run("redis", func(t *testing.T) {
+		server := miniredis.RunT(t)
+		port, err := strconv.Atoi(server.Port())
+		if err != nil {
+			t.Fatal(err)
+		}
+		s, err := NewRedisStorage(&RedisStorageConfig{
+			Host:            server.Host(),
+			Port:            port,
+			MaxNestingDepth: maxNestingDepth,
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { s.Close() })
+		fn(t, s)
+	})
+}
+
+// members returns the members of a group, as referenced by their type and
+// ID
+func members(refs ...string) []*types.Member {
+	var members []*types.Member
+	for i := 0; i < len(refs); i += 2 {
+		member, err := types.NewMemberReference(refs[i], refs[i+1])
+		if err != nil {
+			panic(err)
+		}
+		members = append(members, &member)
+	}
+	return members
+}
+
+// owner returns a reference to the owner of a group
+func owner(memberType, id string) *types.Member {
+	return members(memberType, id)[0]
+}
+
+func mustCreateUsers(t *testing.T, s types.Storage, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := s.CreateUser(context.Background(), &types.User{ID: id, Username: "name-" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func mustCreateGroups(t *testing.T, s types.Storage, ids ...string) {
+	t.Helper()
+	for _, id := range ids {
+		if err := s.CreateGroup(context.Background(), &types.Group{ID: id, Name: "name-" + id}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestGroupReferencesMustExist(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		mustCreateUsers(t, s, "u1")
+		mustCreateGroups(t, s, "g1", "g3")
+
+		tests := []struct {
+			name  string
+			group *types.Group
+		}{
+			{"missing user member", &types.Group{ID: "g2", Name: "two", Members: members("user", "u1", "user", "missing")}},
+			{"missing group member", &types.Group{ID: "g2", Name: "two", Members: members("group", "g1", "group", "missing")}},
+			{"missing user owner", &types.Group{ID: "g2", Name: "two", OwnerID: owner("user", "missing")}},
+			{"missing group owner", &types.Group{ID: "g2", Name: "two", OwnerID: owner("group", "missing")}},
+		}
+		for _, tt := range tests {
+			if err := s.CreateGroup(ctx, tt.group); !errors.Is(err, types.ErrNotFound) {
+				t.Fatalf("%s: CreateGroup returned %v, want ErrNotFound", tt.name, err)
+			}
+			if _, err := s.GetGroupByID(ctx, "g2"); !errors.Is(err, types.ErrNotFound) {
+				t.Fatalf("%s: the refused group was created: %v", tt.name, err)
+			}
+
+			update := *tt.group
+			update.ID = "g3"
+			if err := s.UpdateGroup(ctx, &update); !errors.Is(err, types.ErrNotFound) {
+				t.Fatalf("%s: UpdateGroup returned %v, want ErrNotFound", tt.name, err)
+			}
+			group, err := s.GetGroupByID(ctx, "g3")
+			if err != nil {
+				t.Fatalf("%s: %v", tt.name, err)
+			}
+			if group.Name != "name-g3" || len(group.Members) != 0 || group.OwnerID != nil {
+				t.Fatalf("%s: the refused update changed the group to %v", tt.name, group)
+			}
+		}
+
+		// A group may own itself, and existing references are accepted
+		group := &types.Group{ID: "g2", Name: "two", OwnerID: owner("group", "g2"), Members: members("user", "u1", "group", "g1")}
+		if err := s.CreateGroup(ctx, group); err != nil {
+			t.Fatal(err)
+		}
+		got, err := s.GetGroupByID(ctx, "g2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(got.Members) != 2 {
+			t.Fatalf("got %d members, want 2", len(got.Members))
+		}
+	})
+}
+
+func TestGroupNestingCycles(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		mustCreateGroups(t, s, "g1", "g2", "g3")
+		if err := s.AddMemberToGroup(ctx, &types.Group{ID: "g2"}, "g1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddMemberToGroup(ctx, &types.Group{ID: "g3"}, "g2"); err != nil {
+			t.Fatal(err)
+		}
+
+		tests := []struct {
+			name          string
+			child, parent string
+		}{
+			{"self", "g1", "g1"},
+			{"direct", "g1", "g2"},
+			{"indirect", "g1", "g3"},
+		}
+		for _, tt := range tests {
+			if err := s.AddMemberToGroup(ctx, &types.Group{ID: tt.child}, tt.parent); !errors.Is(err, types.ErrMembershipCycle) {
+				t.Fatalf("%s: AddMemberToGroup returned %v, want ErrMembershipCycle", tt.name, err)
+			}
+			update := &types.Group{ID: tt.parent, Name: "name-" + tt.parent, Members: members("group", tt.child)}
+			if err := s.UpdateGroup(ctx, update); !errors.Is(err, types.ErrMembershipCycle) {
+				t.Fatalf("%s: UpdateGroup returned %v, want ErrMembershipCycle", tt.name, err)
+			}
+		}
+
+		group, err := s.GetGroupByID(ctx, "g3")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(group.Members) != 0 {
+			t.Fatalf("a refused change added %d members to g3", len(group.Members))
+		}
+	})
+}
+
+func TestGroupNestingDepth(t *testing.T) {
+	forEachStorage(t, 2, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		mustCreateGroups(t, s, "g1", "g2", "g3", "g4", "other")
+
+		// g1 > g2 > g3 nests groups two levels deep
+		if err := s.AddMemberToGroup(ctx, &types.Group{ID: "g2"}, "g1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddMemberToGroup(ctx, &types.Group{ID: "g3"}, "g2"); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.AddMemberToGroup(ctx, &types.Group{ID: "g4"}, "g3"); !errors.Is(err, types.ErrMaxDepthExceeded) {
+			t.Fatalf("nesting below the deepest group returned %v, want ErrMaxDepthExceeded", err)
+		}
+		if err := s.AddMemberToGroup(ctx, &types.Group{ID: "g1"}, "g4"); !errors.Is(err, types.ErrMaxDepthExceeded) {
+			t.Fatalf("nesting above the top group returned %v, want ErrMaxDepthExceeded", err)
+		}
+		update := &types.Group{ID: "g4", Name: "name-g4", Members: members("group", "g1")}
+		if err := s.UpdateGroup(ctx, update); !errors.Is(err, types.ErrMaxDepthExceeded) {
+			t.Fatalf("UpdateGroup returned %v, want ErrMaxDepthExceeded", err)
+		}
+		create := &types.Group{ID: "g5", Name: "name-g5", Members: members("group", "g1")}
+		if err := s.CreateGroup(ctx, create); !errors.Is(err, types.ErrMaxDepthExceeded) {
+			t.Fatalf("CreateGroup returned %v, want ErrMaxDepthExceeded", err)
+		}
+
+		// Groups beside the deepest branch are still accepted
+		if err := s.AddMemberToGroup(ctx, &types.Group{ID: "other"}, "g2"); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestGroupNestingUpdates(t *testing.T) {
+	forEachStorage(t, 2, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		mustCreateGroups(t, s, "g1", "g2", "g3", "g4", "g5")
+		// g1 > g2, and g3 > g4
+		if err := s.AddMemberToGroup(ctx, &types.Group{ID: "g2"}, "g1"); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.AddMemberToGroup(ctx, &types.Group{ID: "g4"}, "g3"); err != nil {
+			t.Fatal(err)
+		}
+
+		// The nested groups of an update are checked together
+		for _, tt := range []struct {
+			name    string
+			members []*types.Member
+			want    error
+		}{
+			{"a cycle after a valid group", members("group", "g5", "group", "g1"), types.ErrMembershipCycle},
+			{"a deep group after a valid one", members("group", "g5", "group", "g3"), types.ErrMaxDepthExceeded},
+		} {
+			update := &types.Group{ID: "g2", Name: "name-g2", Members: tt.members}
+			if err := s.UpdateGroup(ctx, update); !errors.Is(err, tt.want) {
+				t.Errorf("%s: UpdateGroup returned %v, want %v", tt.name, err, tt.want)
+			}
+		}
+		group, err := s.GetGroupByID(ctx, "g2")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(group.Members) != 0 {
+			t.Fatalf("a refused update added %d members to g2", len(group.Members))
+		}
+
+		// g1 > g3 > g4 replaces g1 > g2, after which g2 > g1 is no longer a
+		// cycle, but too deep
+		update := &types.Group{ID: "g1", Name: "name-g1", Members: members("group", "g3", "group", "g5")}
+		if err := s.UpdateGroup(ctx, update); err != nil {
+			t.Fatal(err)
+		}
+		update = &types.Group{ID: "g2", Name: "name-g2", Members: members("group", "g1")}
+		if err := s.UpdateGroup(ctx, update); !errors.Is(err, types.ErrMaxDepthExceeded) {
+			t.Fatalf("nesting g1 > g3 > g4 in g2 returned %v, want ErrMaxDepthExceeded", err)
+		}
+	})
+}
+
+// TestRedisStorageConcurrentNesting nests two groups into each other from
+// two storages sharing a server, as two replicas would, and checks that at
+// most one of them succeeds
+func TestRedisStorageConcurrentNesting(t *testing.T) {
+	ctx := context.Background()
+	server := miniredis.RunT(t)
+	port, err := strconv.Atoi(server.Port())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var replicas [2]*RedisStorage
+	for i := range replicas {
+		replicas[i], err = NewRedisStorage(&RedisStorageConfig{Host: server.Host(), Port: port})
+		if err != nil {
+			t.Fatal(err)
+		}
+		t.Cleanup(func() { replicas[i].Close() })
+	}
+
+	for i := 0; i < 50; i++ {
+		a, b := fmt.Sprintf("a%d", i), fmt.Sprintf("b%d", i)
+		mustCreateGroups(t, replicas[0], a, b)
+
+		errs := make(chan error, 2)
+		go func() { errs <- replicas[0].AddMemberToGroup(ctx, &types.Group{ID: b}, a) }()
+		go func() { errs <- replicas[1].AddMemberToGroup(ctx, &types.Group{ID: a}, b) }()
+		succeeded := 0
+		for j := 0; j < 2; j++ {
+			err := <-errs
+			switch {
+			case err == nil:
+				succeeded++
+			case !errors.Is(err, types.ErrMembershipCycle) && !errors.Is(err, types.ErrConflict):
+				t.Fatal(err)
+			}
+		}
+		if succeeded != 1 {
+			t.Fatalf("%d of the two opposite nestings of %s and %s succeeded, want 1", succeeded, a, b)
+		}
+	}
+}
+
+func TestDeleteCascade(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		mustCreateUsers(t, s, "u1")
+		if err := s.CreateGroup(ctx, &types.Group{ID: "g2", Name: "two", Members: members("user", "u1")}); err != nil {
+			t.Fatal(err)
+		}
+		g1 := &types.Group{ID: "g1", Name: "one", OwnerID: owner("user", "u1"), Members: members("user", "u1", "group", "g2")}
+		if err := s.CreateGroup(ctx, g1); err != nil {
+			t.Fatal(err)
+		}
+
+		if err := s.DeleteUser(ctx, "u1"); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetUserByUsername(ctx, "name-u1"); !errors.Is(err, types.ErrNotFound) {
+			t.Fatalf("got error %v for the username of the deleted user, want ErrNotFound", err)
+		}
+		group, err := s.GetGroupByID(ctx, "g1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if group.OwnerID != nil || len(group.Members) != 1 {
+			t.Fatalf("got owner %v and %d members, want no owner and 1 member", group.OwnerID, len(group.Members))
+		}
+		if groups, err := s.GetGroupsByOwner(ctx, &types.User{ID: "u1"}); err != nil || len(groups) != 0 {
+			t.Fatalf("got %d groups owned by the deleted user, error %v", len(groups), err)
+		}
+
+		if err := s.DeleteGroup(ctx, &types.Group{ID: "g2"}); err != nil {
+			t.Fatal(err)
+		}
+		if group, err = s.GetGroupByID(ctx, "g1"); err != nil {
+			t.Fatal(err)
+		}
+		if len(group.Members) != 0 {
+			t.Fatalf("got %d members after deleting the last one", len(group.Members))
+		}
+
+		// The names of the deleted entities are free again
+		mustCreateUsers(t, s, "u1")
+		if err := s.CreateGroup(ctx, &types.Group{ID: "g3", Name: "two"}); err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+func TestIndexesFollowUpdates(t *testing.T) {
+	forEachStorage(t, 0, func(t *testing.T, s types.Storage) {
+		ctx := context.Background()
+		if err := s.CreateUser(ctx, &types.User{ID: "u1", Username: "alice", Email: "alice@example.com"}); err != nil {
+			t.Fatal(err)
+		}
+		if err := s.UpdateUser(ctx, &types.User{ID: "u1", Username: "alicia"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetUserByUsername(ctx, "alice"); !errors.Is(err, types.ErrNotFound) {
+			t.Fatalf("got error %v for the old username, want ErrNotFound", err)
+		}
+		if _, err := s.GetUserByEmail(ctx, "alice@example.com"); !errors.Is(err, types.ErrNotFound) {
+			t.Fatalf("got error %v for the removed email, want ErrNotFound", err)
+		}
+		if user, err := s.GetUserByUsername(ctx, "alicia"); err != nil || user.ID != "u1" {
+			t.Fatalf("got %v, %v for the new username", user, err)
+		}
+		if err := s.CreateUser(ctx, &types.User{ID: "u2", Username: "alicia"}); !errors.Is(err, types.ErrConflict) {
+			t.Fatalf("got error %v for a taken username, want ErrConflict", err)
+		}
+
+		mustCreateGroups(t, s, "g1")
+		if err := s.UpdateGroup(ctx, &types.Group{ID: "g1", Name: "renamed"}); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := s.GetGroupByName(ctx, "name-g1"); !errors.Is(err, types.ErrNotFound) {
+			t.Fatalf("got error %v for the old group name, want ErrNotFound", err)
+		}
+		page, err := s.ListUsers(ctx, &types.UserListOptions{})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(page.Users) != 1 || page.Users[0].Username != "alicia" {
+			t.Fatalf("listed %v, want the renamed user only", page.Users)
+		}
+	})
+}
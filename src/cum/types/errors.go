@@ -0,0 +1,36 @@
+package types
+
+import "errors"
+
+// Errors returned by every storage backend. Backends wrap them with
+// details about the affected entity, so callers should compare them with
+// errors.Is rather than ==.
+var (
+	// ErrNotFound is returned when a user, group, member or session does not exist
+	ErrNotFound = errors.New("not found")
+
+	// ErrAlreadyExists is returned when an entity with the same ID already exists
+	ErrAlreadyExists = errors.New("already exists")
+
+	// ErrConflict is returned when a change violates a uniqueness or
+	// consistency constraint, e.g. a username that is already taken
+	ErrConflict = errors.New("conflict")
+
+	// ErrInvalidMember is returned when a group member is neither a user nor a group
+	ErrInvalidMember = errors.New("invalid member")
+
+	// ErrInvalidArgument is returned when listing options such as the sort
+	// order or the cursor are invalid
+	ErrInvalidArgument = errors.New("invalid argument")
+
+	// ErrMembershipCycle is returned when adding a group to a group would
+	// make a group a member of itself, directly or through nested groups
+	ErrMembershipCycle = errors.New("membership cycle")
+
+	// ErrMaxDepthExceeded is returned when adding a group to a group would
+	// nest groups deeper than the configured maximum depth
+	ErrMaxDepthExceeded = errors.New("maximum nesting depth exceeded")
+
+	// ErrBackendUnavailable is returned when the storage backend cannot be reached
+	ErrBackendUnavailable = errors.New("backend unavailable")
+)
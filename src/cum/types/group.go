@@ -1,6 +1,7 @@
 package types
 
 import (
+	"context"
 	"fmt"
 	"strings"
 )
@@ -10,20 +11,40 @@ type Group struct {
 	ID          string
 	Name        string
 	Description string
-	OwnerID     *Member
-	Members     []*Member
+	// OwnerID is the user or group owning the group, referenced by its
+	// type and ID only, or nil if the group has no owner
+	OwnerID *Member
+	Members []*Member
 }
 
-// GroupStorage represents a storage for groups
+// EffectiveMembership is the membership of a user in a group, either
+// direct or inherited through nested groups
+type EffectiveMembership struct {
+	UserID  string
+	GroupID string
+	// Path holds the IDs of the groups through which the membership is
+	// inherited, from GroupID down to the group the user is a direct member
+	// of. The path of a direct membership only holds GroupID.
+	Path []string
+}
+
+// GroupStorage represents a storage for groups. Its changes, including
+// membership changes, add the given outbox entries in the same
+// transaction, see OutboxEntry.
 type GroupStorage interface {
-	AddMemberToGroup(m Member, parentGroupID string) error
+	AddMemberToGroup(ctx context.Context, m Member, parentGroupID string, outbox ...*OutboxEntry) error
 	Close() error
-	CreateGroup(group *Group) error
-	DeleteGroup(group *Group) error
-	GetGroupByID(id string) (*Group, error)
-	GetGroupByName(name string) (*Group, error)
-	UpdateGroup(group *Group) error
-	RemoveMemberFromGroup(m *Member, parentGroupID string) error
+	CreateGroup(ctx context.Context, group *Group, outbox ...*OutboxEntry) error
+	DeleteGroup(ctx context.Context, group *Group, outbox ...*OutboxEntry) error
+	GetGroupByID(ctx context.Context, id string) (*Group, error)
+	GetGroupByName(ctx context.Context, name string) (*Group, error)
+	GetGroupsByOwner(ctx context.Context, owner Member) ([]*Group, error)
+	ListGroups(ctx context.Context, options *GroupListOptions) (*GroupPage, error)
+	GetEffectiveMembers(ctx context.Context, groupID string) ([]*EffectiveMembership, error)
+	GetEffectiveGroups(ctx context.Context, userID string) ([]*EffectiveMembership, error)
+	GetAncestorGroups(ctx context.Context, groupID string) ([]string, error)
+	UpdateGroup(ctx context.Context, group *Group, outbox ...*OutboxEntry) error
+	RemoveMemberFromGroup(ctx context.Context, m *Member, parentGroupID string, outbox ...*OutboxEntry) error
 }
 
 // GroupStorageFactory represents a factory for group storages
@@ -55,6 +76,14 @@ func (g *Group) GetOwnerID() *Member {
 	return g.OwnerID
 }
 
+// OwnedBy reports whether the group is owned by the given user or group
+func (g *Group) OwnedBy(owner Member) bool {
+	if g.OwnerID == nil || *g.OwnerID == nil {
+		return false
+	}
+	return (*g.OwnerID).GetType() == owner.GetType() && (*g.OwnerID).GetID() == owner.GetID()
+}
+
 func (g *Group) GetMembers() []*Member {
 	return g.Members
 }
@@ -0,0 +1,15 @@
+package types
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+)
+
+// NewID returns a new random identifier for users, groups and sessions
+func NewID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
@@ -3,6 +3,143 @@ package types
 // Defines the LDAP types to manage the LDAP configuration
 // of the openldap server.
 
+import "time"
+
 // LDAPConfig defines the LDAP configuration
 type LDAPConfig struct {
+	// Host and Port are the address of the LDAP server. Port defaults to
+	// 636 with the ldaps TLS mode, and to 389 otherwise.
+	Host string
+	Port int
+
+	// TLSMode is "none" (default), "ldaps" or "starttls"
+	TLSMode string
+	// CACertFile is a PEM bundle of the CAs trusted to verify the server
+	// certificate, instead of the system ones
+	CACertFile string
+	// ClientCertFile and ClientKeyFile are the PEM certificate and key
+	// presented to the server. Without a bind DN, the client then binds
+	// with SASL EXTERNAL.
+	ClientCertFile string
+	ClientKeyFile  string
+	// TLSServerName is the name the server certificate is verified
+	// against. It defaults to Host.
+	TLSServerName string
+	// InsecureSkipVerify disables the verification of the server
+	// certificate
+	InsecureSkipVerify bool
+	// RefuseInsecure refuses the none TLS mode and InsecureSkipVerify
+	RefuseInsecure bool
+
+	// BindDN and BindPassword are the credentials the client binds with
+	BindDN       string
+	BindPassword string
+
+	// BaseDN is the base DN of the directory. It is the default search
+	// base of users and groups.
+	BaseDN string
+
+	// UserSearchBaseDN is the DN under which users are searched and added
+	UserSearchBaseDN string
+	// UserSearchFilter is the filter matching a user, with a %s verb for
+	// the user name. It defaults to the user object class and naming
+	// attribute of the schema, (&(objectClass=inetOrgPerson)(cn=%s)).
+	UserSearchFilter string
+	// UserSearchScope is "base", "one" or "sub" (default)
+	UserSearchScope string
+	// UserSearchAttributes are the attributes returned by user searches.
+	// They default to the naming attribute, cn, sn and mail.
+	UserSearchAttributes []string
+
+	// GroupSearchBaseDN is the DN under which groups are searched and added
+	GroupSearchBaseDN string
+	// GroupSearchFilter is the filter matching a group, with a %s verb for
+	// the group name. It defaults to the group object class and naming
+	// attribute of the schema, (&(objectClass=posixGroup)(cn=%s)).
+	GroupSearchFilter string
+	// GroupMemberFilter is the filter matching the groups a user is a
+	// member of, with a %s verb for the member value of the user, its name
+	// or DN. It defaults to the group object class and member attribute of
+	// the schema, (&(objectClass=posixGroup)(memberUid=%s)).
+	GroupMemberFilter string
+	// GroupSearchScope is "base", "one" or "sub" (default)
+	GroupSearchScope string
+	// GroupSearchAttributes are the attributes returned by group searches.
+	// They default to the naming attribute, gidNumber for posixGroup
+	// groups, and the member attribute.
+	GroupSearchAttributes []string
+	// PageSize is the number of entries per page of the searches listing
+	// users and groups, made with the paged results control of RFC 2696.
+	// It defaults to 1000, the largest page of Active Directory. Servers
+	// that do not support paging return every entry at once. A negative
+	// size disables paging.
+	PageSize int
+	// PasswordResetAttribute is the attribute marking the passwords reset
+	// to one-time passwords, which users must change at their next login:
+	// "shadowLastChange" (default), set to 0 on shadowAccount entries,
+	// "pwdReset", set to TRUE for the ppolicy overlay, or "none". Active
+	// Directory users get a pwdLastSet of 0 instead.
+	PasswordResetAttribute string
+
+	// Schema selects how users, groups and memberships are represented in
+	// the directory
+	Schema LDAPSchema
+
+	// MaxOpenConnections is the maximum number of connections to the
+	// server. It defaults to 10.
+	MaxOpenConnections int
+	// MaxIdleConnections is the maximum number of idle connections kept
+	// for reuse. It defaults to MaxOpenConnections.
+	MaxIdleConnections int
+	// ConnectionIdleTimeout is how long a connection may stay idle before
+	// it is closed. Zero keeps idle connections open.
+	ConnectionIdleTimeout time.Duration
+	// HealthCheckInterval is how long a connection may stay idle before it
+	// is checked before its reuse. Zero only checks that the connection
+	// was not closed.
+	HealthCheckInterval time.Duration
+}
+
+// LDAPSchema defines how users, groups and memberships are represented in
+// the directory. The settings that are not set are taken from the profile.
+type LDAPSchema struct {
+	// Profile is "rfc2307" (default) for posixGroup groups listing the
+	// names of their members in memberUid, "rfc2307bis" for groupOfNames
+	// and posixGroup groups listing the DNs of their members in member,
+	// "groupofnames" for groupOfNames groups, "groupofuniquenames" for
+	// groupOfUniqueNames groups listing the DNs of their members in
+	// uniqueMember, or "activedirectory" for the user and group entries of
+	// Active Directory, named by sAMAccountName and with cleartext
+	// unicodePwd passwords
+	Profile string
+	// UserObjectClasses are the object classes of added users. The last
+	// one is the object class of the default user filter.
+	UserObjectClasses []string
+	// UserNamingAttribute is the attribute holding the user name, which
+	// names user entries: "cn" (default) or "uid"
+	UserNamingAttribute string
+	// GroupObjectClasses are the object classes of added groups. The last
+	// one is the object class of the default group filters. Groups get a
+	// gidNumber when one of them is posixGroup.
+	GroupObjectClasses []string
+	// GroupNamingAttribute is the attribute holding the group name, which
+	// names group entries. It defaults to "cn".
+	GroupNamingAttribute string
+	// MemberAttribute is the attribute of groups listing their members
+	MemberAttribute string
+	// MemberFormat is the format of the values of MemberAttribute: "uid"
+	// for the user names, or "dn" for the DNs of the users
+	MemberFormat string
+	// EmptyMember is a DN kept as the first member of every group, for
+	// object classes such as groupOfNames that require a member. It is
+	// never listed as a member.
+	EmptyMember string
+	// NestedGroups lists the groups nested in a group by their DNs, next
+	// to its users, rather than flattening their users into the group. It
+	// requires the "dn" member format.
+	NestedGroups bool
+	// UserPrincipalNameSuffix is the domain of the userPrincipalName of
+	// users added to Active Directory. It defaults to the domain of the dc
+	// components of the base DN.
+	UserPrincipalNameSuffix string
 }
@@ -0,0 +1,61 @@
+package types
+
+const (
+	// DefaultListLimit is the number of users or groups listed per page
+	// when no limit is given
+	DefaultListLimit = 50
+
+	// MaxListLimit is the maximum number of users or groups listed per page
+	MaxListLimit = 1000
+)
+
+// UserListOptions defines which users are listed and in which order.
+// Filters are case-sensitive and combined with AND.
+type UserListOptions struct {
+	UsernamePrefix   string
+	UsernameContains string
+	EmailPrefix      string
+	EmailContains    string
+	// SortBy is "username" (default), "email" or "id". Users sorting equal
+	// are sorted by ID, so the order is stable.
+	SortBy     string
+	Descending bool
+	// Limit is the maximum number of users per page. It defaults to
+	// DefaultListLimit and is capped at MaxListLimit.
+	Limit int
+	// Cursor is the NextCursor of the previous page, or empty for the
+	// first page. It is only valid with the same sort order.
+	Cursor string
+}
+
+// UserPage is a page of listed users
+type UserPage struct {
+	Users []*User
+	// NextCursor is the cursor of the next page, or empty on the last page
+	NextCursor string
+}
+
+// GroupListOptions defines which groups are listed and in which order.
+// Filters are case-sensitive and combined with AND.
+type GroupListOptions struct {
+	NamePrefix   string
+	NameContains string
+	// SortBy is "name" (default) or "id". Groups sorting equal are sorted
+	// by ID, so the order is stable.
+	SortBy     string
+	Descending bool
+	// Limit is the maximum number of groups per page. It defaults to
+	// DefaultListLimit and is capped at MaxListLimit.
+	Limit int
+	// Cursor is the NextCursor of the previous page, or empty for the
+	// first page. It is only valid with the same sort order.
+	Cursor string
+}
+
+// GroupPage is a page of listed groups. Listed groups are returned
+// without their members.
+type GroupPage struct {
+	Groups []*Group
+	// NextCursor is the cursor of the next page, or empty on the last page
+	NextCursor string
+}
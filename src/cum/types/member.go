@@ -1,8 +1,23 @@
 package types
 
+import "fmt"
+
 // Member represents a member of a group
 type Member interface {
 	GetID() string
 	GetType() string
 	String() string
 }
+
+// NewMemberReference returns a user or a group that only carries the given
+// ID, to reference a member by its type and ID without loading it
+func NewMemberReference(memberType, id string) (Member, error) {
+	switch memberType {
+	case "user":
+		return &User{ID: id}, nil
+	case "group":
+		return &Group{ID: id}, nil
+	default:
+		return nil, fmt.Errorf("%w: unknown member type %q", ErrInvalidMember, memberType)
+	}
+}
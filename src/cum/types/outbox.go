@@ -0,0 +1,54 @@
+package types
+
+import (
+	"context"
+	"fmt"
+)
+
+// OutboxEntry is a change of a user or group waiting to be applied to a
+// third-party service such as LDAP. Entries only reference the changed
+// entity, whose current state is applied when the entry is processed.
+//
+// Entries are given to the change methods of the user and group storages,
+// which add them in the same transaction as the change, so that they are
+// added if and only if the change is stored.
+type OutboxEntry struct {
+	ID string
+	// EntityType is "user" or "group"
+	EntityType string
+	EntityID   string
+	// Name is the username or group name of the entity before the change,
+	// to find its copy in the service after a rename or a delete
+	Name string
+	// PasswordChanged is set when the password of a user changed
+	PasswordChanged bool
+	// Attempts is the number of failed attempts to apply the change
+	Attempts int
+	// LastError is the error of the last failed attempt
+	LastError string
+	// CreatedAt is the Unix time in seconds the entry was added at
+	CreatedAt int64
+	// NextAttemptAt is the Unix time in seconds from which the change can
+	// be applied
+	NextAttemptAt int64
+}
+
+// OutboxStorage represents a storage for outbox entries
+type OutboxStorage interface {
+	AddOutboxEntry(ctx context.Context, entry *OutboxEntry) error
+	// GetDueOutboxEntries returns at most limit entries due at the given
+	// Unix time, by NextAttemptAt, then CreatedAt and ID
+	GetDueOutboxEntries(ctx context.Context, now int64, limit int) ([]*OutboxEntry, error)
+	// ClaimOutboxEntries returns the entries GetDueOutboxEntries would,
+	// moving their NextAttemptAt to the Unix time until in the same atomic
+	// operation, so that concurrent workers never claim the same entry.
+	// An entry neither updated nor deleted by then is due again.
+	ClaimOutboxEntries(ctx context.Context, now int64, until int64, limit int) ([]*OutboxEntry, error)
+	UpdateOutboxEntry(ctx context.Context, entry *OutboxEntry) error
+	DeleteOutboxEntry(ctx context.Context, id string) error
+	CountOutboxEntries(ctx context.Context) (int, error)
+}
+
+func (e *OutboxEntry) String() string {
+	return fmt.Sprintf("Outbox entry ID: %s, %s: %s (%s), Attempts: %d", e.ID, e.EntityType, e.EntityID, e.Name, e.Attempts)
+}
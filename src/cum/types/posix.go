@@ -0,0 +1,23 @@
+package types
+
+import "context"
+
+// PosixIDStorage represents a storage for the POSIX numbers of users and
+// groups, their uidNumber and gidNumber
+type PosixIDStorage interface {
+	// AllocatePosixID returns the number of the user or group with the
+	// given type ("user" or "group") and ID. An entity without a number is
+	// allocated the lowest free number above the highest one allocated in
+	// the range [min, max], so that numbers are never reused, even after a
+	// delete. Reserved numbers are skipped but do not move the allocation,
+	// so that a reserved number near the top of the range does not exhaust
+	// it. It fails with ErrConflict when no number is left.
+	AllocatePosixID(ctx context.Context, entityType string, entityID string, min int64, max int64) (int64, error)
+	// ReservePosixID records a number already used in LDAP by the user or
+	// group with the given type and ID, or by an LDAP entry that is neither,
+	// keyed by any other unique ID, so that it is never allocated to
+	// another one. It does nothing if the entity already has this number,
+	// and fails with ErrConflict if it has another one or the number is
+	// taken.
+	ReservePosixID(ctx context.Context, entityType string, entityID string, number int64) error
+}
@@ -1,20 +1,45 @@
 package types
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+	"time"
+)
 
 // Session represents a session entity
 type Session struct {
-	ID        string
-	UserID    string
+	ID     string
+	UserID string
+	// ExpiresAt is the Unix time in seconds after which the session is no
+	// longer valid. Sessions with a zero ExpiresAt never expire.
 	ExpiresAt int64
 }
 
 // SessionStorage represents a storage for sessions
 type SessionStorage interface {
 	Close() error
-	CreateSession(session *Session) error
-	GetSessionByID(id string) (*Session, error)
-	DeleteSession(id string) error
+	CreateSession(ctx context.Context, session *Session) error
+	GetSessionByID(ctx context.Context, id string) (*Session, error)
+	DeleteSession(ctx context.Context, id string) error
+	// DeleteUserSessions deletes every session of a user
+	DeleteUserSessions(ctx context.Context, userID string) error
+	CreatePasswordReset(ctx context.Context, reset *PasswordReset) error
+	// ConsumePasswordReset returns a password reset that has not expired
+	// and deletes it, so that it is redeemed at most once
+	ConsumePasswordReset(ctx context.Context, id string) (*PasswordReset, error)
+	// DeleteUserPasswordResets deletes every pending password reset of a
+	// user
+	DeleteUserPasswordResets(ctx context.Context, userID string) error
+}
+
+// PasswordReset is a pending password reset, redeemed with a token given
+// to the user. Only a hash of the token is stored, as the ID of the reset.
+type PasswordReset struct {
+	ID     string
+	UserID string
+	// ExpiresAt is the Unix time in seconds after which the reset can no
+	// longer be redeemed
+	ExpiresAt int64
 }
 
 // SessionStorageFactory represents a factory for session storages
@@ -34,6 +59,16 @@ func (s *Session) GetID() string {
 	return s.ID
 }
 
+// Expired reports whether the session is expired at the given time
+func (s *Session) Expired(now time.Time) bool {
+	return s.ExpiresAt > 0 && now.Unix() >= s.ExpiresAt
+}
+
 func (s *Session) String() string {
 	return fmt.Sprintf("Session ID: %s, User: %s, Expires at: %d", s.ID, s.UserID, s.ExpiresAt)
 }
+
+// Expired reports whether the password reset is expired at the given time
+func (r *PasswordReset) Expired(now time.Time) bool {
+	return now.Unix() >= r.ExpiresAt
+}
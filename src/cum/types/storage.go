@@ -1,5 +1,7 @@
 package types
 
+import "context"
+
 // Storage represents a storage for users, groups and sessions
 type Storage interface {
 	UserStorage
@@ -52,82 +54,132 @@ type storage struct {
 }
 
 // CreateUser creates a new user
-func (s *storage) CreateUser(user *User) error {
-	return s.userStorage.CreateUser(user)
+func (s *storage) CreateUser(ctx context.Context, user *User, outbox ...*OutboxEntry) error {
+	return s.userStorage.CreateUser(ctx, user, outbox...)
 }
 
 // GetUserByID returns a user by ID
-func (s *storage) GetUserByID(id string) (*User, error) {
-	return s.userStorage.GetUserByID(id)
+func (s *storage) GetUserByID(ctx context.Context, id string) (*User, error) {
+	return s.userStorage.GetUserByID(ctx, id)
 }
 
 // GetUserByEmail returns a user by email
-func (s *storage) GetUserByEmail(email string) (*User, error) {
-	return s.userStorage.GetUserByEmail(email)
+func (s *storage) GetUserByEmail(ctx context.Context, email string) (*User, error) {
+	return s.userStorage.GetUserByEmail(ctx, email)
+}
+
+func (s *storage) GetUserByUsername(ctx context.Context, username string) (*User, error) {
+	return s.userStorage.GetUserByUsername(ctx, username)
 }
 
-func (s *storage) GetUserByUsername(username string) (*User, error) {
-	return s.userStorage.GetUserByUsername(username)
+// ListUsers returns a page of users
+func (s *storage) ListUsers(ctx context.Context, options *UserListOptions) (*UserPage, error) {
+	return s.userStorage.ListUsers(ctx, options)
 }
 
 // UpdateUser updates a user
-func (s *storage) UpdateUser(user *User) error {
-	return s.userStorage.UpdateUser(user)
+func (s *storage) UpdateUser(ctx context.Context, user *User, outbox ...*OutboxEntry) error {
+	return s.userStorage.UpdateUser(ctx, user, outbox...)
 }
 
 // DeleteUser deletes a user
-func (s *storage) DeleteUser(id string) error {
-	return s.userStorage.DeleteUser(id)
+func (s *storage) DeleteUser(ctx context.Context, id string, outbox ...*OutboxEntry) error {
+	return s.userStorage.DeleteUser(ctx, id, outbox...)
 }
 
 // CreateGroup creates a new group
-func (s *storage) CreateGroup(group *Group) error {
-	return s.groupStorage.CreateGroup(group)
+func (s *storage) CreateGroup(ctx context.Context, group *Group, outbox ...*OutboxEntry) error {
+	return s.groupStorage.CreateGroup(ctx, group, outbox...)
 }
 
 // GetGroupByID returns a group by ID
-func (s *storage) GetGroupByID(id string) (*Group, error) {
-	return s.groupStorage.GetGroupByID(id)
+func (s *storage) GetGroupByID(ctx context.Context, id string) (*Group, error) {
+	return s.groupStorage.GetGroupByID(ctx, id)
 }
 
 // GetGroupByName returns a group by name
-func (s *storage) GetGroupByName(name string) (*Group, error) {
-	return s.groupStorage.GetGroupByName(name)
+func (s *storage) GetGroupByName(ctx context.Context, name string) (*Group, error) {
+	return s.groupStorage.GetGroupByName(ctx, name)
+}
+
+// GetGroupsByOwner returns the groups owned by a user or group
+func (s *storage) GetGroupsByOwner(ctx context.Context, owner Member) ([]*Group, error) {
+	return s.groupStorage.GetGroupsByOwner(ctx, owner)
+}
+
+// ListGroups returns a page of groups
+func (s *storage) ListGroups(ctx context.Context, options *GroupListOptions) (*GroupPage, error) {
+	return s.groupStorage.ListGroups(ctx, options)
+}
+
+// GetEffectiveMembers returns the users that are members of a group, directly or through nested groups
+func (s *storage) GetEffectiveMembers(ctx context.Context, groupID string) ([]*EffectiveMembership, error) {
+	return s.groupStorage.GetEffectiveMembers(ctx, groupID)
+}
+
+// GetEffectiveGroups returns the groups a user is a member of, directly or through nested groups
+func (s *storage) GetEffectiveGroups(ctx context.Context, userID string) ([]*EffectiveMembership, error) {
+	return s.groupStorage.GetEffectiveGroups(ctx, userID)
+}
+
+// GetAncestorGroups returns the IDs of the groups a group is nested in, directly or through other groups
+func (s *storage) GetAncestorGroups(ctx context.Context, groupID string) ([]string, error) {
+	return s.groupStorage.GetAncestorGroups(ctx, groupID)
 }
 
 // UpdateGroup updates a group
-func (s *storage) UpdateGroup(group *Group) error {
-	return s.groupStorage.UpdateGroup(group)
+func (s *storage) UpdateGroup(ctx context.Context, group *Group, outbox ...*OutboxEntry) error {
+	return s.groupStorage.UpdateGroup(ctx, group, outbox...)
 }
 
 // DeleteGroup deletes a group
-func (s *storage) DeleteGroup(group *Group) error {
-	return s.groupStorage.DeleteGroup(group)
+func (s *storage) DeleteGroup(ctx context.Context, group *Group, outbox ...*OutboxEntry) error {
+	return s.groupStorage.DeleteGroup(ctx, group, outbox...)
 }
 
 // AddMemberToGroup adds a member to a group
-func (s *storage) AddMemberToGroup(m Member, parentGroupID string) error {
-	return s.groupStorage.AddMemberToGroup(m, parentGroupID)
+func (s *storage) AddMemberToGroup(ctx context.Context, m Member, parentGroupID string, outbox ...*OutboxEntry) error {
+	return s.groupStorage.AddMemberToGroup(ctx, m, parentGroupID, outbox...)
 }
 
 // RemoveMemberFromGroup removes a member from a group
-func (s *storage) RemoveMemberFromGroup(m *Member, parentGroupID string) error {
-	return s.groupStorage.RemoveMemberFromGroup(m, parentGroupID)
+func (s *storage) RemoveMemberFromGroup(ctx context.Context, m *Member, parentGroupID string, outbox ...*OutboxEntry) error {
+	return s.groupStorage.RemoveMemberFromGroup(ctx, m, parentGroupID, outbox...)
 }
 
 // AddGroupToGroup adds a group to a group
-func (s *storage) CreateSession(session *Session) error {
-	return s.sessionStorage.CreateSession(session)
+func (s *storage) CreateSession(ctx context.Context, session *Session) error {
+	return s.sessionStorage.CreateSession(ctx, session)
 }
 
 // GetSessionByID returns a session by ID
-func (s *storage) GetSessionByID(id string) (*Session, error) {
-	return s.sessionStorage.GetSessionByID(id)
+func (s *storage) GetSessionByID(ctx context.Context, id string) (*Session, error) {
+	return s.sessionStorage.GetSessionByID(ctx, id)
 }
 
 // DeleteSession deletes a session
-func (s *storage) DeleteSession(id string) error {
-	return s.sessionStorage.DeleteSession(id)
+func (s *storage) DeleteSession(ctx context.Context, id string) error {
+	return s.sessionStorage.DeleteSession(ctx, id)
+}
+
+// DeleteUserSessions deletes every session of a user
+func (s *storage) DeleteUserSessions(ctx context.Context, userID string) error {
+	return s.sessionStorage.DeleteUserSessions(ctx, userID)
+}
+
+// CreatePasswordReset creates a new password reset
+func (s *storage) CreatePasswordReset(ctx context.Context, reset *PasswordReset) error {
+	return s.sessionStorage.CreatePasswordReset(ctx, reset)
+}
+
+// ConsumePasswordReset returns and deletes a password reset by ID
+func (s *storage) ConsumePasswordReset(ctx context.Context, id string) (*PasswordReset, error) {
+	return s.sessionStorage.ConsumePasswordReset(ctx, id)
+}
+
+// DeleteUserPasswordResets deletes every pending password reset of a user
+func (s *storage) DeleteUserPasswordResets(ctx context.Context, userID string) error {
+	return s.sessionStorage.DeleteUserPasswordResets(ctx, userID)
 }
 
 // Close closes the storage
@@ -1,6 +1,9 @@
 package types
 
-import "fmt"
+import (
+	"context"
+	"fmt"
+)
 
 // User represents a user entity
 type User struct {
@@ -8,17 +11,22 @@ type User struct {
 	Username string
 	Email    string
 	Password string
+	// MustChangePassword is set when the password was reset to a one-time
+	// password, which the user must change at the next login
+	MustChangePassword bool
 }
 
-// UserStorage represents a storage for users
+// UserStorage represents a storage for users. Its changes add the given
+// outbox entries in the same transaction, see OutboxEntry.
 type UserStorage interface {
 	Close() error
-	CreateUser(user *User) error
-	GetUserByID(id string) (*User, error)
-	GetUserByEmail(email string) (*User, error)
-	GetUserByUsername(username string) (*User, error)
-	UpdateUser(user *User) error
-	DeleteUser(id string) error
+	CreateUser(ctx context.Context, user *User, outbox ...*OutboxEntry) error
+	GetUserByID(ctx context.Context, id string) (*User, error)
+	GetUserByEmail(ctx context.Context, email string) (*User, error)
+	GetUserByUsername(ctx context.Context, username string) (*User, error)
+	ListUsers(ctx context.Context, options *UserListOptions) (*UserPage, error)
+	UpdateUser(ctx context.Context, user *User, outbox ...*OutboxEntry) error
+	DeleteUser(ctx context.Context, id string, outbox ...*OutboxEntry) error
 }
 
 // UserStorageFactory represents a factory for user storages